@@ -0,0 +1,207 @@
+package etcd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/zhuguangfeng/study/cache"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"math"
+	"time"
+)
+
+var _ cache.Locker = &Locker{}
+
+// Locker 基于 etcd 的分布式锁
+// 每次加锁都会创建一个租约，锁的过期时间就是租约的 TTL
+// 同一把锁的所有竞争者都在 key/ 下面写一个自己的 key，create revision 最小的那个持有锁
+// 其余的人按照 revision 排队，只 watch 排在自己前面的那个 key
+type Locker struct {
+	c *clientv3.Client
+}
+
+func NewLocker(c *clientv3.Client) *Locker {
+	return &Locker{
+		c: c,
+	}
+}
+
+// TryLock 加锁，前面有人就直接返回 cache.ErrFailedToPreemptLock
+func (l *Locker) TryLock(ctx context.Context, key string, expiration time.Duration) (cache.Mutex, error) {
+	m, err := l.acquire(ctx, key, expiration)
+	if err != nil {
+		return nil, err
+	}
+	if m.isOwner {
+		return m, nil
+	}
+	// 别人抢到了锁，把自己的 key 删掉
+	m.release(ctx)
+	return nil, cache.ErrFailedToPreemptLock
+}
+
+// Lock 加锁，前面有人就排队，每次最多等 retry 给出的间隔，然后重新检查一次
+func (l *Locker) Lock(ctx context.Context, key string, expiration time.Duration, timeout time.Duration, retry cache.RetryStrategy) (cache.Mutex, error) {
+	actx, cancel := context.WithTimeout(ctx, timeout)
+	m, err := l.acquire(actx, key, expiration)
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	for !m.isOwner {
+		// 排队的时候也要续约，不然还没轮到自己，自己的 key 就过期了
+		err = m.waitPredecessor(ctx, timeout, retry)
+		if err != nil {
+			m.release(ctx)
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// 创建租约，然后写入自己的 key
+func (l *Locker) acquire(ctx context.Context, key string, expiration time.Duration) (*Mutex, error) {
+	ttl := int64(math.Ceil(expiration.Seconds()))
+	if ttl < 1 {
+		ttl = 1
+	}
+	lease, err := l.c.Grant(ctx, ttl)
+	if err != nil {
+		return nil, err
+	}
+	m := &Mutex{
+		c:          l.c,
+		pfx:        key + "/",
+		myKey:      fmt.Sprintf("%s/%x", key, lease.ID),
+		leaseID:    lease.ID,
+		ttl:        time.Duration(ttl) * time.Second,
+		unlockChan: make(chan struct{}, 1),
+	}
+	getOwner := clientv3.OpGet(m.pfx, clientv3.WithFirstCreate()...)
+	resp, err := l.c.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(m.myKey), "=", 0)).
+		Then(clientv3.OpPut(m.myKey, "", clientv3.WithLease(lease.ID)), getOwner).
+		Else(clientv3.OpGet(m.myKey), getOwner).
+		Commit()
+	if err != nil {
+		m.release(ctx)
+		return nil, err
+	}
+	m.myRev = resp.Header.Revision
+	if !resp.Succeeded {
+		m.myRev = resp.Responses[0].GetResponseRange().Kvs[0].CreateRevision
+	}
+	ownerKey := resp.Responses[1].GetResponseRange().Kvs
+	m.isOwner = len(ownerKey) == 0 || ownerKey[0].CreateRevision == m.myRev
+	return m, nil
+}
+
+type Mutex struct {
+	c       *clientv3.Client
+	pfx     string
+	myKey   string
+	myRev   int64
+	leaseID clientv3.LeaseID
+	// 租约的 TTL，续约一直超时超过了这么久，租约就已经过期了
+	ttl        time.Duration
+	isOwner    bool
+	unlockChan chan struct{}
+}
+
+// 等待排在自己前面的那个 key 被删除，每次最多等 retry 给出的间隔
+// 前面没有人了就说明轮到自己了
+func (m *Mutex) waitPredecessor(ctx context.Context, timeout time.Duration, retry cache.RetryStrategy) error {
+	rctx, cancel := context.WithTimeout(ctx, timeout)
+	pred, rev, err := m.predecessor(rctx)
+	cancel()
+	if err != nil && !errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	if err == nil && pred == "" {
+		m.isOwner = true
+		return nil
+	}
+
+	//在这里重试
+	interval, ok := retry.Next()
+	if !ok {
+		return fmt.Errorf("etcd-lock: 超出重试限制, %w", cache.ErrFailedToPreemptLock)
+	}
+	wctx, cancel := context.WithTimeout(ctx, interval)
+	defer cancel()
+	if pred == "" {
+		// 上一次请求超时了，等一会再试
+		<-wctx.Done()
+		return ctx.Err()
+	}
+	for resp := range m.c.Watch(wctx, pred, clientv3.WithRev(rev+1)) {
+		for _, ev := range resp.Events {
+			if ev.Type == clientv3.EventTypeDelete {
+				return nil
+			}
+		}
+	}
+	return ctx.Err()
+}
+
+// 续约，顺便找到排在自己前面的那个 key
+func (m *Mutex) predecessor(ctx context.Context) (string, int64, error) {
+	err := m.Refresh(ctx)
+	if err != nil {
+		return "", 0, err
+	}
+	opts := append(clientv3.WithLastCreate(), clientv3.WithMaxCreateRev(m.myRev-1))
+	resp, err := m.c.Get(ctx, m.pfx, opts...)
+	if err != nil {
+		return "", 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return "", resp.Header.Revision, nil
+	}
+	return string(resp.Kvs[0].Key), resp.Header.Revision, nil
+}
+
+// 手动续约
+func (m *Mutex) Refresh(ctx context.Context) error {
+	_, err := m.c.KeepAliveOnce(ctx, m.leaseID)
+	if errors.Is(err, rpctypes.ErrLeaseNotFound) {
+		return cache.ErrLockNotHold
+	}
+	return err
+}
+
+// 自动续约，续约一直超时超过了租约的 TTL 返回 cache.ErrLockNotHold
+func (m *Mutex) AutoRefresh(interval time.Duration, timeout time.Duration) error {
+	return cache.RefreshLoop(m.Refresh, m.unlockChan, interval, timeout, m.ttl, cache.ErrLockNotHold)
+}
+
+// 解锁，删除自己的 key 并且撤销租约
+func (m *Mutex) Unlock(ctx context.Context) error {
+	resp, err := m.c.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(m.myKey), "=", m.myRev)).
+		Then(clientv3.OpDelete(m.myKey)).
+		Commit()
+	defer func() {
+		select {
+		case m.unlockChan <- struct{}{}:
+		default:
+			//说明没有人调用 AutoRefresh
+		}
+	}()
+	if err != nil {
+		return err
+	}
+	m.release(ctx)
+	if !resp.Succeeded {
+		return cache.ErrLockNotHold
+	}
+	return nil
+}
+
+// 撤销租约，租约上的 key 会被一起删掉
+func (m *Mutex) release(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Second)
+	defer cancel()
+	_, _ = m.c.Revoke(ctx, m.leaseID)
+}
@@ -0,0 +1,21 @@
+//go:build e2e
+
+package etcd
+
+import (
+	"github.com/stretchr/testify/require"
+	"github.com/zhuguangfeng/study/cache/locktest"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"testing"
+	"time"
+)
+
+func TestLocker_e2e(t *testing.T) {
+	etcdClient, err := clientv3.New(clientv3.Config{
+		Endpoints: []string{"localhost:2379"},
+	})
+	require.NoError(t, err)
+	defer etcdClient.Close()
+	// etcd 租约的最小 TTL 是秒级的
+	locktest.Run(t, NewLocker(etcdClient), time.Second*2)
+}
@@ -0,0 +1,36 @@
+package etcd
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zhuguangfeng/study/cache"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"testing"
+	"time"
+)
+
+func TestMutex_AutoRefreshTimeout(t *testing.T) {
+	// 连不上 etcd，每次续约都超时
+	c, err := clientv3.New(clientv3.Config{
+		Endpoints: []string{"127.0.0.1:1"},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	m := &Mutex{
+		c:          c,
+		leaseID:    1,
+		ttl:        time.Millisecond * 300,
+		unlockChan: make(chan struct{}, 1),
+	}
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- m.AutoRefresh(time.Millisecond*50, time.Millisecond*20)
+	}()
+	// 超过 TTL 之后租约已经过期了，不能再认为自己还持有锁
+	select {
+	case err = <-errChan:
+		assert.Equal(t, cache.ErrLockNotHold, err)
+	case <-time.After(time.Second * 3):
+		t.Fatal("AutoRefresh 没有返回")
+	}
+}
@@ -0,0 +1,122 @@
+package cache
+
+import (
+	"context"
+	_ "embed"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"time"
+)
+
+const (
+	// 等待者多久不来续就认为它已经放弃了，会被清理出队列
+	fairLockWaiterTTL = time.Second * 5
+	// 每次阻塞等待唤醒的最长时间，超时之后会再抢一次锁，顺便续一下等待者的截止时间
+	// 持有者崩溃导致锁自然过期的时候不会有人唤醒，靠的也是这个兜底
+	fairLockWaitInterval = time.Second
+)
+
+var (
+	//go:embed lua/fair_lock.lua
+	luaFairLock string
+	//go:embed lua/fair_unlock.lua
+	luaFairUnlock string
+	//go:embed lua/fair_cancel.lua
+	luaFairCancel string
+	//go:embed lua/fair_wake.lua
+	luaFairWake string
+)
+
+// FairLock 公平锁，等待者按照排队的先后顺序拿到锁
+// 释放锁的时候会通过 redis list 唤醒队头的等待者，等待者用 BLPOP 阻塞等待，不需要轮询
+// 排队用到的 key 都用锁的 key 作为 hash tag，集群模式下也能用
+type FairLock struct {
+	*Lock
+	// 排队用的 id
+	id         string
+	queueKey   string
+	timeoutKey string
+	wakePrefix string
+}
+
+// FairLock 加公平锁，拿不到锁就排队，直到拿到锁或者 ctx 结束
+// timeout 是单次请求 redis 的超时时间
+// 放弃等待的时候会把自己移出队列，不会堵住后面的人
+func (c *Client) FairLock(ctx context.Context, key string, expiration time.Duration, timeout time.Duration) (*FairLock, error) {
+	val := c.lockValue(c.owner.Label)
+	// 锁的 value 比较长，排队和唤醒用单独的 id
+	id := uuid.New().String()
+	l := &FairLock{
+		Lock: &Lock{
+			client:     c.client,
+			key:        key,
+			val:        val,
+			expiration: expiration,
+			unlockChan: make(chan struct{}, 1),
+		},
+		id:         id,
+		queueKey:   hashTagKey(key, ":fair:queue"),
+		timeoutKey: hashTagKey(key, ":fair:timeout"),
+		wakePrefix: hashTagKey(key, ":fair:wake:"),
+	}
+	wakeKey := l.wakePrefix + id
+	for {
+		lctx, cancel := context.WithTimeout(ctx, timeout)
+		res, err := c.client.Eval(lctx, luaFairLock, []string{key, l.queueKey, l.timeoutKey, wakeKey},
+			val, expiration.Seconds(), fairLockWaiterTTL.Milliseconds(), id).Result()
+		cancel()
+		if err != nil && !errors.Is(err, context.DeadlineExceeded) {
+			return nil, l.cancelWait(err, timeout)
+		}
+		if res == "OK" {
+			return l, nil
+		}
+
+		// 排上队了，等前面的人释放锁的时候唤醒自己
+		err = c.client.BLPop(ctx, fairLockWaitInterval, wakeKey).Err()
+		if ctx.Err() != nil {
+			return nil, l.cancelWait(ctx.Err(), timeout)
+		}
+		if err != nil && !errors.Is(err, redis.Nil) {
+			return nil, l.cancelWait(err, timeout)
+		}
+	}
+}
+
+// 退出队列，返回原本的 error 和退出队列的 error
+func (l *FairLock) cancelWait(cause error, timeout time.Duration) error {
+	// 调用方的 ctx 可能已经结束了，这里要用新的 ctx
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	next, err := l.client.Eval(ctx, luaFairCancel, []string{l.key, l.queueKey, l.timeoutKey, l.wakePrefix + l.id},
+		l.id).Text()
+	if err != nil {
+		return errors.Join(cause, err)
+	}
+	l.wake(ctx, next)
+	return cause
+}
+
+// Unlock 解锁，并且唤醒队头的等待者
+func (l *FairLock) Unlock(ctx context.Context) error {
+	head, err := l.client.Eval(ctx, luaFairUnlock, []string{l.key, l.queueKey}, l.val).Text()
+	defer stopAutoRefresh(l.unlockChan)
+	if errors.Is(err, redis.Nil) {
+		return ErrLockNotHold
+	}
+	if err != nil {
+		return err
+	}
+	l.wake(ctx, head)
+	return nil
+}
+
+// 唤醒等待者 id，它的唤醒 key 要作为 KEYS 传给 lua，所以不能和解锁放在同一个脚本里面
+// 唤醒失败也没关系，等待者最多等 fairLockWaitInterval 就会自己再抢一次锁
+func (l *FairLock) wake(ctx context.Context, id string) {
+	if id == "" {
+		return
+	}
+	_ = l.client.Eval(ctx, luaFairWake, []string{l.wakePrefix + id}, fairLockWaiterTTL.Milliseconds()).Err()
+}
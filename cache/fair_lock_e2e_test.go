@@ -0,0 +1,61 @@
+//go:build e2e
+
+package cache
+
+import (
+	"context"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClient_e2e_FairLock(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+	})
+	client := NewClient(rdb)
+	key := "fair_lock_key1"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	first, err := client.FairLock(ctx, key, time.Minute, time.Second)
+	require.NoError(t, err)
+
+	// 按顺序排队
+	var (
+		mutex sync.Mutex
+		order []int
+		wg    sync.WaitGroup
+	)
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			l, er := client.FairLock(ctx, key, time.Minute, time.Second)
+			require.NoError(t, er)
+			mutex.Lock()
+			order = append(order, i)
+			mutex.Unlock()
+			require.NoError(t, l.Unlock(ctx))
+		}(i)
+		// 保证排队的先后顺序
+		time.Sleep(time.Millisecond * 100)
+	}
+
+	// 中途放弃的等待者不会堵住队列
+	abandonCtx, abandonCancel := context.WithTimeout(ctx, time.Millisecond*200)
+	defer abandonCancel()
+	_, err = client.FairLock(abandonCtx, key, time.Minute, time.Second)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	require.NoError(t, first.Unlock(ctx))
+	wg.Wait()
+	assert.Equal(t, []int{0, 1, 2}, order)
+
+	n, err := rdb.Exists(ctx, key, hashTagKey(key, ":fair:queue"), hashTagKey(key, ":fair:timeout")).Result()
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), n)
+}
@@ -0,0 +1,214 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"github.com/golang/mock/gomock"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/zhuguangfeng/study/cache/mocks"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClient_FairLock(t *testing.T) {
+	fairKeys := fairKeysMatcher{}
+	testCases := []struct {
+		name string
+		mock func(ctrl *gomock.Controller) redis.Cmdable
+		ctx  func() (context.Context, context.CancelFunc)
+
+		wantErr error
+	}{
+		{
+			name: "locked",
+			mock: func(ctrl *gomock.Controller) redis.Cmdable {
+				cmd := mocks.NewMockCmdable(ctrl)
+				res := redis.NewCmd(context.Background())
+				res.SetVal("OK")
+				cmd.EXPECT().Eval(gomock.Any(), luaFairLock, fairKeys, gomock.Any()).Return(res)
+				return cmd
+			},
+			ctx: func() (context.Context, context.CancelFunc) {
+				return context.WithCancel(context.Background())
+			},
+		},
+		{
+			name: "woken up and locked",
+			mock: func(ctrl *gomock.Controller) redis.Cmdable {
+				cmd := mocks.NewMockCmdable(ctrl)
+				queued := redis.NewCmd(context.Background())
+				queued.SetVal("")
+				locked := redis.NewCmd(context.Background())
+				locked.SetVal("OK")
+				gomock.InOrder(
+					cmd.EXPECT().Eval(gomock.Any(), luaFairLock, fairKeys, gomock.Any()).Return(queued),
+					// 第一次等待超时，没人唤醒
+					cmd.EXPECT().BLPop(gomock.Any(), fairLockWaitInterval, gomock.Any()).
+						Return(redis.NewStringSliceResult(nil, redis.Nil)),
+					cmd.EXPECT().Eval(gomock.Any(), luaFairLock, fairKeys, gomock.Any()).Return(queued),
+					cmd.EXPECT().BLPop(gomock.Any(), fairLockWaitInterval, gomock.Any()).
+						Return(redis.NewStringSliceResult([]string{"wake", "1"}, nil)),
+					cmd.EXPECT().Eval(gomock.Any(), luaFairLock, fairKeys, gomock.Any()).Return(locked),
+				)
+				return cmd
+			},
+			ctx: func() (context.Context, context.CancelFunc) {
+				return context.WithCancel(context.Background())
+			},
+		},
+		{
+			name: "timeout and leave queue",
+			mock: func(ctrl *gomock.Controller) redis.Cmdable {
+				cmd := mocks.NewMockCmdable(ctrl)
+				queued := redis.NewCmd(context.Background())
+				queued.SetVal("")
+				cancelRes := redis.NewCmd(context.Background())
+				cancelRes.SetVal(int64(1))
+				gomock.InOrder(
+					cmd.EXPECT().Eval(gomock.Any(), luaFairLock, fairKeys, gomock.Any()).Return(queued),
+					cmd.EXPECT().BLPop(gomock.Any(), fairLockWaitInterval, gomock.Any()).
+						DoAndReturn(func(ctx context.Context, timeout time.Duration, keys ...string) *redis.StringSliceCmd {
+							<-ctx.Done()
+							return redis.NewStringSliceResult(nil, ctx.Err())
+						}),
+					cmd.EXPECT().Eval(gomock.Any(), luaFairCancel, fairKeys, gomock.Any()).Return(cancelRes),
+				)
+				return cmd
+			},
+			ctx: func() (context.Context, context.CancelFunc) {
+				return context.WithTimeout(context.Background(), time.Millisecond*10)
+			},
+			wantErr: context.DeadlineExceeded,
+		},
+		{
+			name: "eval error and leave queue",
+			mock: func(ctrl *gomock.Controller) redis.Cmdable {
+				cmd := mocks.NewMockCmdable(ctrl)
+				res := redis.NewCmd(context.Background())
+				res.SetErr(errors.New("network error"))
+				cancelRes := redis.NewCmd(context.Background())
+				cancelRes.SetVal(int64(1))
+				gomock.InOrder(
+					cmd.EXPECT().Eval(gomock.Any(), luaFairLock, fairKeys, gomock.Any()).Return(res),
+					cmd.EXPECT().Eval(gomock.Any(), luaFairCancel, fairKeys, gomock.Any()).Return(cancelRes),
+				)
+				return cmd
+			},
+			ctx: func() (context.Context, context.CancelFunc) {
+				return context.WithCancel(context.Background())
+			},
+			wantErr: errors.New("network error"),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			client := NewClient(tc.mock(ctrl))
+			ctx, cancel := tc.ctx()
+			defer cancel()
+
+			l, err := client.FairLock(ctx, "key1", time.Minute, time.Second)
+			if tc.wantErr != nil {
+				assert.ErrorContains(t, err, tc.wantErr.Error())
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, "key1", l.key)
+			assert.NotEmpty(t, l.val)
+		})
+	}
+}
+
+// 唤醒 key 里面有随机的 id，只比较前缀
+type fairKeysMatcher struct{}
+
+func (fairKeysMatcher) Matches(x any) bool {
+	keys, ok := x.([]string)
+	return ok && len(keys) == 4 && keys[0] == "key1" && keys[1] == "{key1}:fair:queue" &&
+		keys[2] == "{key1}:fair:timeout" && strings.HasPrefix(keys[3], "{key1}:fair:wake:")
+}
+
+func (fairKeysMatcher) String() string {
+	return "fair lock keys of key1"
+}
+
+func TestFairLock_Unlock(t *testing.T) {
+	testCases := []struct {
+		name string
+		mock func(ctrl *gomock.Controller) redis.Cmdable
+
+		wantErr error
+	}{
+		{
+			name: "not hold",
+			mock: func(ctrl *gomock.Controller) redis.Cmdable {
+				cmd := mocks.NewMockCmdable(ctrl)
+				res := redis.NewCmd(context.Background())
+				res.SetErr(redis.Nil)
+				cmd.EXPECT().Eval(gomock.Any(), luaFairUnlock, []string{"key1", "{key1}:fair:queue"},
+					"val1").Return(res)
+				return cmd
+			},
+			wantErr: ErrLockNotHold,
+		},
+		{
+			name: "no waiter",
+			mock: func(ctrl *gomock.Controller) redis.Cmdable {
+				cmd := mocks.NewMockCmdable(ctrl)
+				res := redis.NewCmd(context.Background())
+				res.SetVal("")
+				cmd.EXPECT().Eval(gomock.Any(), luaFairUnlock, []string{"key1", "{key1}:fair:queue"},
+					"val1").Return(res)
+				return cmd
+			},
+		},
+		{
+			name: "wake head",
+			mock: func(ctrl *gomock.Controller) redis.Cmdable {
+				cmd := mocks.NewMockCmdable(ctrl)
+				res := redis.NewCmd(context.Background())
+				res.SetVal("waiter1")
+				wakeRes := redis.NewCmd(context.Background())
+				wakeRes.SetVal(int64(1))
+				gomock.InOrder(
+					cmd.EXPECT().Eval(gomock.Any(), luaFairUnlock, []string{"key1", "{key1}:fair:queue"},
+						"val1").Return(res),
+					cmd.EXPECT().Eval(gomock.Any(), luaFairWake, []string{"{key1}:fair:wake:waiter1"},
+						fairLockWaiterTTL.Milliseconds()).Return(wakeRes),
+				)
+				return cmd
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			l := &FairLock{
+				Lock: &Lock{
+					client:     tc.mock(ctrl),
+					key:        "key1",
+					val:        "val1",
+					unlockChan: make(chan struct{}, 1),
+				},
+				queueKey:   "{key1}:fair:queue",
+				timeoutKey: "{key1}:fair:timeout",
+				wakePrefix: "{key1}:fair:wake:",
+			}
+			err := l.Unlock(context.Background())
+			assert.Equal(t, tc.wantErr, err)
+		})
+	}
+}
+
+func TestHashTagKey(t *testing.T) {
+	assert.Equal(t, "{key1}:fair:queue", hashTagKey("key1", ":fair:queue"))
+	// 已经有 hash tag 的不再加
+	assert.Equal(t, "lock:{user}:1:fair:queue", hashTagKey("lock:{user}:1", ":fair:queue"))
+	// {} 不算 hash tag
+	assert.Equal(t, "{a{}b}:fair:queue", hashTagKey("a{}b", ":fair:queue"))
+}
@@ -0,0 +1,158 @@
+package cache
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	ErrLockNotFound = errors.New("redis-lock: 没有找到锁")
+
+	//go:embed lua/inspect.lua
+	luaInspect string
+)
+
+// LockInfo 锁的持有者信息
+// 加锁的时候编码成 JSON 作为锁的 value，解锁和续约仍然是比较整个 value，所以每次加锁的 value 都不一样
+type LockInfo struct {
+	// 每次加锁都不一样
+	ID         string    `json:"id"`
+	Host       string    `json:"host,omitempty"`
+	PID        int       `json:"pid,omitempty"`
+	AcquiredAt time.Time `json:"acquired_at"`
+	// 调用方自己设置的标签，例如任务的名字
+	Label string `json:"label,omitempty"`
+
+	// 下面的字段是 Inspect 的时候填充的，不会写进 redis
+	Key string        `json:"-"`
+	TTL time.Duration `json:"-"`
+	// redis 里面原始的 value，ForceUnlock 要用它来比较
+	val string
+}
+
+func newOwner() LockInfo {
+	host, _ := os.Hostname()
+	return LockInfo{
+		Host: host,
+		PID:  os.Getpid(),
+	}
+}
+
+func (c *Client) lockValue(label string) string {
+	info := c.owner
+	info.ID = uuid.New().String()
+	info.AcquiredAt = time.Now()
+	info.Label = label
+	val, err := json.Marshal(info)
+	if err != nil {
+		// 不会发生
+		return info.ID
+	}
+	return string(val)
+}
+
+// Inspect 查看锁的持有者，锁不存在返回 ErrLockNotFound
+// value 和过期时间在同一个脚本里面读，不会拿到旧的持有者配上新的过期时间
+func (c *Client) Inspect(ctx context.Context, key string) (*LockInfo, error) {
+	res, err := c.client.Eval(ctx, luaInspect, []string{key}).Slice()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrLockNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(res) != 2 {
+		return nil, fmt.Errorf("redis-lock: Inspect 返回了非法的结果 %v", res)
+	}
+	val, ok1 := res[0].(string)
+	pttl, ok2 := res[1].(int64)
+	if !ok1 || !ok2 {
+		return nil, fmt.Errorf("redis-lock: Inspect 返回了非法的结果 %v", res)
+	}
+	// 没有设置过期时间的时候 PTTL 是 -1
+	ttl := time.Duration(pttl)
+	if pttl > 0 {
+		ttl = time.Duration(pttl) * time.Millisecond
+	}
+	var info LockInfo
+	if json.Unmarshal([]byte(val), &info) != nil || info.ID == "" {
+		// 老版本的锁 value 只有一个 uuid
+		info = LockInfo{ID: val}
+	}
+	info.Key = key
+	info.TTL = ttl
+	info.val = val
+	return &info, nil
+}
+
+// ListLocks 列出 key 以 prefix 开头的锁
+// 用的是 SCAN，不会阻塞 redis，但是返回的结果不是某一个时刻的快照
+func (c *Client) ListLocks(ctx context.Context, prefix string) ([]*LockInfo, error) {
+	var (
+		res    []*LockInfo
+		cursor uint64
+	)
+	for {
+		keys, next, err := c.client.Scan(ctx, cursor, escapePattern(prefix)+"*", 100).Result()
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			info, err := c.Inspect(ctx, key)
+			// 扫描之后锁过期了，或者不是锁，例如公平锁的等待队列
+			if errors.Is(err, ErrLockNotFound) || isWrongType(err) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, info)
+		}
+		cursor = next
+		if cursor == 0 {
+			return res, nil
+		}
+	}
+}
+
+// ForceUnlock 运维强制释放锁，info 必须是 Inspect 或者 ListLocks 拿到的
+// 只有锁还是 info 对应的那一次加锁的时候才会删除，避免误删别人后来加的锁
+func (c *Client) ForceUnlock(ctx context.Context, info *LockInfo) error {
+	if info == nil || info.val == "" {
+		return errors.New("redis-lock: 只能强制释放 Inspect 或者 ListLocks 返回的锁")
+	}
+	res, err := c.client.Eval(ctx, luaUnlock, []string{info.Key}, info.val).Int64()
+	if err != nil {
+		return err
+	}
+	if res != 1 {
+		return ErrLockNotHold
+	}
+	return nil
+}
+
+// 脚本里面的错误老版本的 redis 会加上 ERR Error running script 的前缀
+func isWrongType(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "WRONGTYPE")
+}
+
+// 转义 SCAN MATCH 里面的特殊字符
+func escapePattern(s string) string {
+	var sb strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			sb.WriteRune('\\')
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
@@ -0,0 +1,207 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/golang/mock/gomock"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zhuguangfeng/study/cache/mocks"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestClient_LockValue(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	cmd := mocks.NewMockCmdable(ctrl)
+	var val string
+	cmd.EXPECT().SetNX(context.Background(), "key1", gomock.Any(), time.Minute).
+		DoAndReturn(func(ctx context.Context, key string, value any, expiration time.Duration) *redis.BoolCmd {
+			val = value.(string)
+			return redis.NewBoolResult(true, nil)
+		})
+
+	client := NewClient(cmd, ClientWithLabel("order-job"))
+	l, err := client.TryLock(context.Background(), "key1", time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, val, l.val)
+
+	var info LockInfo
+	require.NoError(t, json.Unmarshal([]byte(val), &info))
+	assert.NotEmpty(t, info.ID)
+	assert.Equal(t, os.Getpid(), info.PID)
+	assert.Equal(t, "order-job", info.Label)
+	assert.False(t, info.AcquiredAt.IsZero())
+}
+
+func inspectResult(val any, err error) *redis.Cmd {
+	res := redis.NewCmd(context.Background())
+	res.SetVal(val)
+	res.SetErr(err)
+	return res
+}
+
+func TestClient_Inspect(t *testing.T) {
+	acquiredAt := time.UnixMilli(1700000000000)
+	testCases := []struct {
+		name string
+		mock func(ctrl *gomock.Controller) redis.Cmdable
+
+		wantInfo *LockInfo
+		wantErr  error
+	}{
+		{
+			name: "lock not exist",
+			mock: func(ctrl *gomock.Controller) redis.Cmdable {
+				cmd := mocks.NewMockCmdable(ctrl)
+				cmd.EXPECT().Eval(context.Background(), luaInspect, []string{"key1"}).Return(inspectResult(nil, redis.Nil))
+				return cmd
+			},
+			wantErr: ErrLockNotFound,
+		},
+		{
+			name: "eval error",
+			mock: func(ctrl *gomock.Controller) redis.Cmdable {
+				cmd := mocks.NewMockCmdable(ctrl)
+				cmd.EXPECT().Eval(context.Background(), luaInspect, []string{"key1"}).
+					Return(inspectResult(nil, context.DeadlineExceeded))
+				return cmd
+			},
+			wantErr: context.DeadlineExceeded,
+		},
+		{
+			name: "legacy value",
+			mock: func(ctrl *gomock.Controller) redis.Cmdable {
+				cmd := mocks.NewMockCmdable(ctrl)
+				cmd.EXPECT().Eval(context.Background(), luaInspect, []string{"key1"}).
+					Return(inspectResult([]any{"uuid1", int64(1000)}, nil))
+				return cmd
+			},
+			wantInfo: &LockInfo{ID: "uuid1", Key: "key1", TTL: time.Second, val: "uuid1"},
+		},
+		{
+			name: "no expiration",
+			mock: func(ctrl *gomock.Controller) redis.Cmdable {
+				cmd := mocks.NewMockCmdable(ctrl)
+				cmd.EXPECT().Eval(context.Background(), luaInspect, []string{"key1"}).
+					Return(inspectResult([]any{"uuid1", int64(-1)}, nil))
+				return cmd
+			},
+			wantInfo: &LockInfo{ID: "uuid1", Key: "key1", TTL: -1, val: "uuid1"},
+		},
+		{
+			name: "owner info",
+			mock: func(ctrl *gomock.Controller) redis.Cmdable {
+				cmd := mocks.NewMockCmdable(ctrl)
+				val := `{"id":"uuid1","host":"host1","pid":123,"acquired_at":"2023-11-14T22:13:20Z","label":"job1"}`
+				cmd.EXPECT().Eval(context.Background(), luaInspect, []string{"key1"}).
+					Return(inspectResult([]any{val, int64(1000)}, nil))
+				return cmd
+			},
+			wantInfo: &LockInfo{
+				ID:         "uuid1",
+				Host:       "host1",
+				PID:        123,
+				AcquiredAt: acquiredAt.UTC(),
+				Label:      "job1",
+				Key:        "key1",
+				TTL:        time.Second,
+				val:        `{"id":"uuid1","host":"host1","pid":123,"acquired_at":"2023-11-14T22:13:20Z","label":"job1"}`,
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			client := NewClient(tc.mock(ctrl))
+
+			info, err := client.Inspect(context.Background(), "key1")
+			assert.Equal(t, tc.wantErr, err)
+			if err != nil {
+				return
+			}
+			assert.Equal(t, tc.wantInfo, info)
+		})
+	}
+}
+
+func TestClient_ListLocks(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	cmd := mocks.NewMockCmdable(ctrl)
+	ctx := context.Background()
+	scan1 := redis.NewScanCmd(ctx, nil)
+	scan1.SetVal([]string{"job:1", "job:1:fair:queue"}, 10)
+	scan2 := redis.NewScanCmd(ctx, nil)
+	scan2.SetVal([]string{"job:2"}, 0)
+	gomock.InOrder(
+		cmd.EXPECT().Scan(ctx, uint64(0), `job\*:*`, int64(100)).Return(scan1),
+		cmd.EXPECT().Scan(ctx, uint64(10), `job\*:*`, int64(100)).Return(scan2),
+	)
+	cmd.EXPECT().Eval(ctx, luaInspect, []string{"job:1"}).Return(inspectResult([]any{"uuid1", int64(1000)}, nil))
+	cmd.EXPECT().Eval(ctx, luaInspect, []string{"job:1:fair:queue"}).
+		Return(inspectResult(nil, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value script: 1234, on @user_script:3.")))
+	// 扫描之后过期了
+	cmd.EXPECT().Eval(ctx, luaInspect, []string{"job:2"}).Return(inspectResult(nil, redis.Nil))
+
+	infos, err := NewClient(cmd).ListLocks(ctx, "job*:")
+	require.NoError(t, err)
+	assert.Equal(t, []*LockInfo{{ID: "uuid1", Key: "job:1", TTL: time.Second, val: "uuid1"}}, infos)
+}
+
+func TestClient_ForceUnlock(t *testing.T) {
+	testCases := []struct {
+		name string
+		mock func(ctrl *gomock.Controller) redis.Cmdable
+		info *LockInfo
+
+		wantErr error
+	}{
+		{
+			name: "not inspected",
+			mock: func(ctrl *gomock.Controller) redis.Cmdable {
+				return mocks.NewMockCmdable(ctrl)
+			},
+			info:    &LockInfo{ID: "uuid1", Key: "key1"},
+			wantErr: errors.New("redis-lock: 只能强制释放 Inspect 或者 ListLocks 返回的锁"),
+		},
+		{
+			name: "lock changed",
+			mock: func(ctrl *gomock.Controller) redis.Cmdable {
+				cmd := mocks.NewMockCmdable(ctrl)
+				res := redis.NewCmd(context.Background())
+				res.SetVal(int64(0))
+				cmd.EXPECT().Eval(context.Background(), luaUnlock, []string{"key1"}, "val1").Return(res)
+				return cmd
+			},
+			info:    &LockInfo{ID: "uuid1", Key: "key1", val: "val1"},
+			wantErr: ErrLockNotHold,
+		},
+		{
+			name: "unlocked",
+			mock: func(ctrl *gomock.Controller) redis.Cmdable {
+				cmd := mocks.NewMockCmdable(ctrl)
+				res := redis.NewCmd(context.Background())
+				res.SetVal(int64(1))
+				cmd.EXPECT().Eval(context.Background(), luaUnlock, []string{"key1"}, "val1").Return(res)
+				return cmd
+			},
+			info: &LockInfo{ID: "uuid1", Key: "key1", val: "val1"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			err := NewClient(tc.mock(ctrl)).ForceUnlock(context.Background(), tc.info)
+			assert.Equal(t, tc.wantErr, err)
+		})
+	}
+}
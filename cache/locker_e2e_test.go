@@ -0,0 +1,18 @@
+//go:build e2e
+
+package cache_test
+
+import (
+	"github.com/redis/go-redis/v9"
+	"github.com/zhuguangfeng/study/cache"
+	"github.com/zhuguangfeng/study/cache/locktest"
+	"testing"
+	"time"
+)
+
+func TestClient_e2e_Locker(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+	})
+	locktest.Run(t, cache.NewClient(rdb).Locker(), time.Second*2)
+}
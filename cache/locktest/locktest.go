@@ -0,0 +1,163 @@
+// Package locktest 是 cache.Locker 的一致性测试，每个实现都应该跑一遍
+package locktest
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zhuguangfeng/study/cache"
+	"testing"
+	"time"
+)
+
+// fixedRetry 固定间隔重试，最多重试 max 次
+type fixedRetry struct {
+	interval time.Duration
+	max      int
+	cnt      int
+}
+
+func (f *fixedRetry) Next() (time.Duration, bool) {
+	f.cnt++
+	return f.interval, f.cnt <= f.max
+}
+
+// Run 跑一遍所有的用例，expiration 是用例里面锁的过期时间
+// 有些实现有最小过期时间，例如 etcd 的租约，所以交给调用方决定
+func Run(t *testing.T, locker cache.Locker, expiration time.Duration) {
+	// 每次跑用的 key 都不一样，避免上一次残留的数据影响结果
+	prefix := fmt.Sprintf("locktest_%d", time.Now().UnixNano())
+	newKey := func(t *testing.T) string {
+		return fmt.Sprintf("%s_%s", prefix, t.Name())
+	}
+	newCtx := func() (context.Context, context.CancelFunc) {
+		return context.WithTimeout(context.Background(), expiration*5)
+	}
+
+	t.Run("try lock", func(t *testing.T) {
+		ctx, cancel := newCtx()
+		defer cancel()
+		key := newKey(t)
+
+		m, err := locker.TryLock(ctx, key, expiration)
+		require.NoError(t, err)
+		// 别人持有锁
+		_, err = locker.TryLock(ctx, key, expiration)
+		assert.ErrorIs(t, err, cache.ErrFailedToPreemptLock)
+
+		require.NoError(t, m.Unlock(ctx))
+		// 释放之后可以再加锁
+		m, err = locker.TryLock(ctx, key, expiration)
+		require.NoError(t, err)
+		require.NoError(t, m.Unlock(ctx))
+	})
+
+	t.Run("unlock twice", func(t *testing.T) {
+		ctx, cancel := newCtx()
+		defer cancel()
+
+		m, err := locker.TryLock(ctx, newKey(t), expiration)
+		require.NoError(t, err)
+		require.NoError(t, m.Unlock(ctx))
+		assert.ErrorIs(t, m.Unlock(ctx), cache.ErrLockNotHold)
+	})
+
+	t.Run("refresh", func(t *testing.T) {
+		ctx, cancel := newCtx()
+		defer cancel()
+		key := newKey(t)
+
+		m, err := locker.TryLock(ctx, key, expiration)
+		require.NoError(t, err)
+		// 续约之后过了原本的过期时间也还是自己的
+		time.Sleep(expiration * 2 / 3)
+		require.NoError(t, m.Refresh(ctx))
+		time.Sleep(expiration * 2 / 3)
+		_, err = locker.TryLock(ctx, key, expiration)
+		assert.ErrorIs(t, err, cache.ErrFailedToPreemptLock)
+		require.NoError(t, m.Unlock(ctx))
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		ctx, cancel := newCtx()
+		defer cancel()
+		key := newKey(t)
+
+		m, err := locker.TryLock(ctx, key, expiration)
+		require.NoError(t, err)
+		time.Sleep(expiration * 3 / 2)
+		assert.ErrorIs(t, m.Refresh(ctx), cache.ErrLockNotHold)
+		// 过期之后别人可以拿到锁
+		other, err := locker.TryLock(ctx, key, expiration)
+		require.NoError(t, err)
+		assert.ErrorIs(t, m.Unlock(ctx), cache.ErrLockNotHold)
+		require.NoError(t, other.Unlock(ctx))
+	})
+
+	t.Run("lock wait for release", func(t *testing.T) {
+		ctx, cancel := newCtx()
+		defer cancel()
+		key := newKey(t)
+
+		m, err := locker.TryLock(ctx, key, expiration)
+		require.NoError(t, err)
+		go func() {
+			time.Sleep(expiration / 4)
+			_ = m.Unlock(context.Background())
+		}()
+		other, err := locker.Lock(ctx, key, expiration, time.Second,
+			&fixedRetry{interval: expiration / 10, max: 100})
+		require.NoError(t, err)
+		require.NoError(t, other.Unlock(ctx))
+	})
+
+	t.Run("lock retry exhausted", func(t *testing.T) {
+		ctx, cancel := newCtx()
+		defer cancel()
+		key := newKey(t)
+
+		m, err := locker.TryLock(ctx, key, expiration)
+		require.NoError(t, err)
+		_, err = locker.Lock(ctx, key, expiration, time.Second,
+			&fixedRetry{interval: time.Millisecond * 10, max: 3})
+		assert.ErrorIs(t, err, cache.ErrFailedToPreemptLock)
+		// 放弃加锁不能影响持有者
+		require.NoError(t, m.Refresh(ctx))
+		require.NoError(t, m.Unlock(ctx))
+	})
+
+	t.Run("lock context canceled", func(t *testing.T) {
+		ctx, cancel := newCtx()
+		defer cancel()
+		key := newKey(t)
+
+		m, err := locker.TryLock(ctx, key, expiration)
+		require.NoError(t, err)
+		lctx, lcancel := context.WithTimeout(ctx, expiration/4)
+		defer lcancel()
+		_, err = locker.Lock(lctx, key, expiration, time.Second,
+			&fixedRetry{interval: time.Millisecond * 10, max: 1000})
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		require.NoError(t, m.Unlock(ctx))
+	})
+
+	t.Run("auto refresh", func(t *testing.T) {
+		ctx, cancel := newCtx()
+		defer cancel()
+		key := newKey(t)
+
+		m, err := locker.TryLock(ctx, key, expiration)
+		require.NoError(t, err)
+		errChan := make(chan error, 1)
+		go func() {
+			errChan <- m.AutoRefresh(expiration/3, time.Second)
+		}()
+		time.Sleep(expiration * 2)
+		_, err = locker.TryLock(ctx, key, expiration)
+		assert.ErrorIs(t, err, cache.ErrFailedToPreemptLock)
+		require.NoError(t, m.Unlock(ctx))
+		// 解锁之后 AutoRefresh 要退出
+		assert.NoError(t, <-errChan)
+	})
+}
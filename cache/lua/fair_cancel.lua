@@ -0,0 +1,18 @@
+-- 等待者放弃排队，返回需要唤醒的下一个等待者，不需要唤醒返回空字符串
+-- KEYS[1] 锁的 key
+-- KEYS[2] 等待队列
+-- KEYS[3] 等待者的截止时间
+-- KEYS[4] 自己的唤醒 key
+-- ARGV[1] 等待者的标识
+local head = redis.call('zrange', KEYS[2], 0, 0)[1]
+redis.call('zrem', KEYS[2], ARGV[1])
+redis.call('zrem', KEYS[3], ARGV[1])
+redis.call('del', KEYS[4])
+-- 你是队头并且锁是空闲的，说明你可能已经被唤醒了，要把机会让给下一个
+if head == ARGV[1] and redis.call('exists', KEYS[1]) == 0 then
+    local next = redis.call('zrange', KEYS[2], 0, 0)[1]
+    if next ~= nil then
+        return next
+    end
+end
+return ''
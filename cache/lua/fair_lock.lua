@@ -0,0 +1,54 @@
+-- 公平锁加锁
+-- KEYS[1] 锁的 key
+-- KEYS[2] 等待队列，zset，score 是排队的时间
+-- KEYS[3] 等待者的截止时间，zset，超过截止时间还没来续的等待者会被清理掉
+-- KEYS[4] 自己的唤醒 key
+-- ARGV[1] 锁的 value
+-- ARGV[2] 锁的过期时间，秒
+-- ARGV[3] 等待者的存活时间，毫秒
+-- ARGV[4] 等待者的标识
+local t = redis.call('time')
+local nowMs = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+
+-- 清理队头已经放弃或者崩溃的等待者
+while true do
+    local head = redis.call('zrange', KEYS[2], 0, 0)[1]
+    if head == nil then
+        break
+    end
+    local deadline = redis.call('zscore', KEYS[3], head)
+    if deadline ~= false and tonumber(deadline) > nowMs then
+        break
+    end
+    redis.call('zrem', KEYS[2], head)
+    redis.call('zrem', KEYS[3], head)
+end
+
+local val = redis.call('get', KEYS[1])
+if val == ARGV[1] then
+    --    你上次加锁成功了
+    redis.call('expire', KEYS[1], ARGV[2])
+    return 'OK'
+end
+
+if val == false then
+    local head = redis.call('zrange', KEYS[2], 0, 0)[1]
+    --    没人排队，或者轮到你了
+    if head == nil or head == ARGV[4] then
+        redis.call('set', KEYS[1], ARGV[1], 'EX', ARGV[2])
+        redis.call('zrem', KEYS[2], ARGV[4])
+        redis.call('zrem', KEYS[3], ARGV[4])
+        redis.call('del', KEYS[4])
+        return 'OK'
+    end
+end
+
+-- 排队，已经在队列里的只更新截止时间，保持原来的位置
+if redis.call('zscore', KEYS[2], ARGV[4]) == false then
+    redis.call('zadd', KEYS[2], tonumber(t[1]) * 1000000 + tonumber(t[2]), ARGV[4])
+end
+redis.call('zadd', KEYS[3], nowMs + tonumber(ARGV[3]), ARGV[4])
+-- 没人排队的时候队列自己会过期
+redis.call('pexpire', KEYS[2], tonumber(ARGV[3]) * 2)
+redis.call('pexpire', KEYS[3], tonumber(ARGV[3]) * 2)
+return ''
@@ -0,0 +1,15 @@
+-- 公平锁解锁，返回需要唤醒的队头，没人排队返回空字符串
+-- 队头的唤醒 key 事先不知道，不能在这里唤醒，由调用方执行 fair_wake.lua
+-- KEYS[1] 锁的 key
+-- KEYS[2] 等待队列
+-- ARGV[1] 锁的 value
+if redis.call('get', KEYS[1]) ~= ARGV[1] then
+    --     不是你的锁
+    return false
+end
+redis.call('del', KEYS[1])
+local head = redis.call('zrange', KEYS[2], 0, 0)[1]
+if head == nil then
+    return ''
+end
+return head
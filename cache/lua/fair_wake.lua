@@ -0,0 +1,6 @@
+-- 唤醒等待者
+-- KEYS[1] 等待者的唤醒 key
+-- ARGV[1] 唤醒 key 的过期时间，毫秒
+redis.call('rpush', KEYS[1], 1)
+redis.call('pexpire', KEYS[1], ARGV[1])
+return 1
@@ -0,0 +1,7 @@
+-- 一次拿到锁的 value 和剩余的过期时间，避免两次调用之间锁过期或者换了持有者
+-- KEYS[1] 锁的 key
+local val = redis.call('get', KEYS[1])
+if not val then
+    return false
+end
+return {val, redis.call('pttl', KEYS[1])}
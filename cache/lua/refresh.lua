@@ -1,4 +1,4 @@
-if redis.call('get',KYES[1])==ARGV[1] then
+if redis.call('get',KEYS[1])==ARGV[1] then
     return redis.call('expire',KEYS[1],ARGV[2])
 else
     return 0
@@ -0,0 +1,38 @@
+-- 信号量申请许可
+-- KEYS[1] 租约，zset，member 是租约 id，score 是过期时间
+-- KEYS[2] 每个租约占用的许可数量，hash
+-- ARGV[1] 租约 id
+-- ARGV[2] 申请的许可数量
+-- ARGV[3] 许可总数
+-- ARGV[4] 租约的过期时间，毫秒
+local t = redis.call('time')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local expireAt = now + tonumber(ARGV[4])
+
+-- 回收过期的租约，持有者可能已经崩溃了
+local expired = redis.call('zrangebyscore', KEYS[1], '-inf', now)
+for _, id in ipairs(expired) do
+    redis.call('hdel', KEYS[2], id)
+end
+redis.call('zremrangebyscore', KEYS[1], '-inf', now)
+
+if redis.call('zscore', KEYS[1], ARGV[1]) == false then
+    local used = 0
+    for _, n in ipairs(redis.call('hvals', KEYS[2])) do
+        used = used + tonumber(n)
+    end
+    if used + tonumber(ARGV[2]) > tonumber(ARGV[3]) then
+        --    许可不够
+        return 0
+    end
+    redis.call('hset', KEYS[2], ARGV[1], ARGV[2])
+end
+--    你上次申请成功了，或者这次申请成功了
+redis.call('zadd', KEYS[1], expireAt, ARGV[1])
+
+-- 整个信号量的过期时间不能比任何一个租约短
+if redis.call('pttl', KEYS[1]) < tonumber(ARGV[4]) then
+    redis.call('pexpire', KEYS[1], ARGV[4])
+    redis.call('pexpire', KEYS[2], ARGV[4])
+end
+return 1
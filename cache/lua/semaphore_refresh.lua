@@ -0,0 +1,19 @@
+-- 信号量续约
+-- KEYS[1] 租约
+-- KEYS[2] 每个租约占用的许可数量
+-- ARGV[1] 租约 id
+-- ARGV[2] 租约的过期时间，毫秒
+local t = redis.call('time')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+
+local score = redis.call('zscore', KEYS[1], ARGV[1])
+if score == false or tonumber(score) <= now then
+    --    租约已经过期了，许可可能已经被别人拿走了
+    return 0
+end
+redis.call('zadd', KEYS[1], 'XX', now + tonumber(ARGV[2]), ARGV[1])
+if redis.call('pttl', KEYS[1]) < tonumber(ARGV[2]) then
+    redis.call('pexpire', KEYS[1], ARGV[2])
+    redis.call('pexpire', KEYS[2], ARGV[2])
+end
+return 1
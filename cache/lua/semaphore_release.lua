@@ -0,0 +1,6 @@
+-- 信号量释放许可
+-- KEYS[1] 租约
+-- KEYS[2] 每个租约占用的许可数量
+-- ARGV[1] 租约 id
+redis.call('hdel', KEYS[2], ARGV[1])
+return redis.call('zrem', KEYS[1], ARGV[1])
@@ -5,8 +5,8 @@ import (
 	_ "embed"
 	"errors"
 	"fmt"
-	"github.com/google/uuid"
 	"github.com/redis/go-redis/v9"
+	"strings"
 	"time"
 )
 
@@ -22,20 +22,40 @@ var (
 	luaLock string
 )
 
+type ClientOption func(c *Client)
+
 // Client就是对redis.Cmdable的二次封装
 type Client struct {
 	client redis.Cmdable
+	// 写进锁里面的持有者信息
+	owner LockInfo
 }
 
-func NewClient(client redis.Cmdable) *Client {
-	return &Client{
+func NewClient(client redis.Cmdable, opts ...ClientOption) *Client {
+	res := &Client{
 		client: client,
+		owner:  newOwner(),
+	}
+	for _, opt := range opts {
+		opt(res)
+	}
+	return res
+}
+
+// ClientWithLabel 这个 Client 加的锁默认带上的标签，方便排查问题的时候知道锁是谁加的
+func ClientWithLabel(label string) ClientOption {
+	return func(c *Client) {
+		c.owner.Label = label
 	}
 }
 
 func (c *Client) Lock(ctx context.Context, key string, expiration time.Duration, timeout time.Duration, retry RetryStrategy) (*Lock, error) {
+	return c.lock(ctx, key, c.owner.Label, expiration, timeout, retry)
+}
+
+func (c *Client) lock(ctx context.Context, key string, label string, expiration time.Duration, timeout time.Duration, retry RetryStrategy) (*Lock, error) {
 	var timer *time.Timer
-	val := uuid.New().String()
+	val := c.lockValue(label)
 	for {
 
 		lctx, cancel := context.WithTimeout(ctx, timeout)
@@ -74,7 +94,7 @@ func (c *Client) Lock(ctx context.Context, key string, expiration time.Duration,
 }
 
 func (c *Client) TryLock(ctx context.Context, key string, expiration time.Duration) (*Lock, error) {
-	val := uuid.New().String()
+	val := c.lockValue(c.owner.Label)
 
 	ok, err := c.client.SetNX(ctx, key, val, expiration).Result()
 	if err != nil {
@@ -94,6 +114,89 @@ func (c *Client) TryLock(ctx context.Context, key string, expiration time.Durati
 	}, nil
 }
 
+// LockOptions Do 加锁和续约用到的参数
+type LockOptions struct {
+	// 锁的过期时间，不设置就是 30s
+	Expiration time.Duration
+	// 单次加锁和解锁请求的超时时间，不设置就是 1s
+	Timeout time.Duration
+	// 加锁失败的重试策略，不设置就是每 100ms 重试一次，最多 10 次
+	Retry RetryStrategy
+	// 续约间隔，不设置就是 Expiration 的三分之一
+	RefreshInterval time.Duration
+	// 单次续约的超时时间，不设置就是 Timeout
+	RefreshTimeout time.Duration
+	// 锁的标签，不设置就用 ClientWithLabel 设置的
+	Label string
+}
+
+// Do 加锁，自动续约，然后执行 fn，最后释放锁
+// 续约失败，或者续约一直超时超过了 Expiration，都意味着锁已经丢了，
+// 这时候传给 fn 的 ctx 会被取消，原因是 ErrLockNotHold，fn 应该尽快退出
+// fn 发生 panic 也会释放锁，然后继续 panic
+// 返回的 error 是 fn、续约、解锁三者 error 的组合
+func (c *Client) Do(ctx context.Context, key string, opts LockOptions, fn func(ctx context.Context) error) (err error) {
+	opts = opts.withDefault()
+	label := opts.Label
+	if label == "" {
+		label = c.owner.Label
+	}
+	l, err := c.lock(ctx, key, label, opts.Expiration, opts.Timeout, opts.Retry)
+	if err != nil {
+		return err
+	}
+
+	bizCtx, cancel := context.WithCancelCause(ctx)
+	refreshErrChan := make(chan error, 1)
+	go func() {
+		er := l.AutoRefresh(opts.RefreshInterval, opts.RefreshTimeout)
+		if er != nil {
+			// 锁丢了，通知业务中断
+			cancel(er)
+		}
+		refreshErrChan <- er
+	}()
+
+	defer func() {
+		// panic 了也要释放锁
+		r := recover()
+		cancel(nil)
+		uctx, ucancel := context.WithTimeout(context.Background(), opts.Timeout)
+		unlockErr := l.Unlock(uctx)
+		ucancel()
+		// Unlock 会让 AutoRefresh 退出，这里等它退出，避免 goroutine 泄露
+		refreshErr := <-refreshErrChan
+		if r != nil {
+			panic(r)
+		}
+		err = errors.Join(err, refreshErr, unlockErr)
+	}()
+
+	return fn(bizCtx)
+}
+
+func (o LockOptions) withDefault() LockOptions {
+	if o.Expiration <= 0 {
+		o.Expiration = time.Second * 30
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = time.Second
+	}
+	if o.Retry == nil {
+		o.Retry = &fixedIntervalRetryStrategy{
+			Interval: time.Millisecond * 100,
+			MaxCnt:   10,
+		}
+	}
+	if o.RefreshInterval <= 0 {
+		o.RefreshInterval = o.Expiration / 3
+	}
+	if o.RefreshTimeout <= 0 {
+		o.RefreshTimeout = o.Timeout
+	}
+	return o
+}
+
 //func (c *Client) Unlock(ctx context.Context, lock *Lock) error {
 //
 //}
@@ -108,30 +211,48 @@ type Lock struct {
 
 // 自动续约
 func (l *Lock) AutoRefresh(interval time.Duration, timeout time.Duration) error {
+	return RefreshLoop(l.Refresh, l.unlockChan, interval, timeout, l.expiration, ErrLockNotHold)
+}
+
+// RefreshLoop 自动续约的通用实现，每隔 interval 调用一次 refresh，直到 stop 收到信号或者 refresh 返回超时以外的 error
+// 超时会立刻重试，但是距离上一次续约成功已经超过了 expiration 的话，锁在服务端已经过期了，返回 notHold
+func RefreshLoop(refresh func(ctx context.Context) error, stop <-chan struct{},
+	interval time.Duration, timeout time.Duration, expiration time.Duration, notHold error) error {
 	timeoutChan := make(chan struct{}, 1)
 	//续约
 
 	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	// 加锁之后马上就会开始续约，从这里开始算
+	refreshedAt := time.Now()
 
 	for {
 		select {
 		case <-ticker.C:
-			ctx, cancel := context.WithTimeout(context.Background(), timeout)
-			err := l.Refresh(ctx)
-			cancel()
-			if errors.Is(err, context.DeadlineExceeded) {
-				timeoutChan <- struct{}{}
-				continue
+		case <-timeoutChan:
+			// 超时了立刻再试一次，不用等下一个 ticker
+		case <-stop:
+			return nil
+		}
+		start := time.Now()
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		err := refresh(ctx)
+		cancel()
+		switch {
+		case err == nil:
+			refreshedAt = start
+		case errors.Is(err, context.DeadlineExceeded):
+			if time.Since(refreshedAt) >= expiration {
+				return notHold
 			}
-			if err != nil {
-				return err
+			select {
+			case timeoutChan <- struct{}{}:
+			default:
 			}
-
-		case <-l.unlockChan:
-			return nil
+		default:
+			return err
 		}
 	}
-
 }
 
 // 手动续约
@@ -151,14 +272,7 @@ func (l *Lock) Refresh(ctx context.Context) error {
 // 解锁
 func (l *Lock) Unlock(ctx context.Context) error {
 	res, err := l.client.Eval(ctx, luaUnlock, []string{l.key}, l.val).Int64()
-	defer func() {
-		select {
-		case l.unlockChan <- struct{}{}:
-		default:
-			//说明没有人调用 AutoRefresh
-		}
-
-	}()
+	defer stopAutoRefresh(l.unlockChan)
 	if err != nil {
 		return err
 	}
@@ -170,6 +284,15 @@ func (l *Lock) Unlock(ctx context.Context) error {
 	return nil
 }
 
+// 通知 AutoRefresh 退出
+func stopAutoRefresh(stop chan<- struct{}) {
+	select {
+	case stop <- struct{}{}:
+	default:
+		//说明没有人调用 AutoRefresh
+	}
+}
+
 // 错误写法 因为 get和del中间有间隔 可能会被其它实例插入
 //func (l *Lock) Unlock(ctx context.Context) error {
 //	//先要判断一下这把锁是不是自己的锁
@@ -191,3 +314,14 @@ func (l *Lock) Unlock(ctx context.Context) error {
 //
 //	return nil
 //}
+
+// 和 key 放在同一个 slot 的辅助 key，集群模式下一个 lua 脚本用到的 key 必须在同一个 slot
+// key 本身已经带了 hash tag 的话直接加后缀，不然把 key 整个作为 hash tag
+func hashTagKey(key string, suffix string) string {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			return key + suffix
+		}
+	}
+	return "{" + key + "}" + suffix
+}
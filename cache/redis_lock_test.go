@@ -2,6 +2,7 @@ package cache
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/golang/mock/gomock"
 	_ "github.com/golang/mock/mockgen/model"
@@ -149,6 +150,159 @@ func TestLock_Unlock(t *testing.T) {
 	}
 }
 
+func TestClient_Do(t *testing.T) {
+	testCases := []struct {
+		name string
+		mock func(ctrl *gomock.Controller) redis.Cmdable
+		fn   func(ctx context.Context) error
+		opts LockOptions
+
+		wantErrs  []error
+		wantPanic bool
+	}{
+		{
+			name: "lock error",
+			mock: func(ctrl *gomock.Controller) redis.Cmdable {
+				cmd := mocks.NewMockCmdable(ctrl)
+				res := redis.NewCmd(context.Background())
+				res.SetErr(errors.New("network error"))
+				cmd.EXPECT().Eval(gomock.Any(), luaLock, []string{"key1"}, gomock.Any()).Return(res)
+				return cmd
+			},
+			fn: func(ctx context.Context) error {
+				panic("不应该执行")
+			},
+			wantErrs: []error{errors.New("network error")},
+		},
+		{
+			name: "success",
+			mock: func(ctrl *gomock.Controller) redis.Cmdable {
+				cmd := mocks.NewMockCmdable(ctrl)
+				lockRes := redis.NewCmd(context.Background())
+				lockRes.SetVal("OK")
+				cmd.EXPECT().Eval(gomock.Any(), luaLock, []string{"key1"}, gomock.Any()).Return(lockRes)
+				unlockRes := redis.NewCmd(context.Background())
+				unlockRes.SetVal(int64(1))
+				cmd.EXPECT().Eval(gomock.Any(), luaUnlock, []string{"key1"}, gomock.Any()).Return(unlockRes)
+				return cmd
+			},
+			fn: func(ctx context.Context) error {
+				return nil
+			},
+		},
+		{
+			name: "biz error and lock not hold",
+			mock: func(ctrl *gomock.Controller) redis.Cmdable {
+				cmd := mocks.NewMockCmdable(ctrl)
+				lockRes := redis.NewCmd(context.Background())
+				lockRes.SetVal("OK")
+				cmd.EXPECT().Eval(gomock.Any(), luaLock, []string{"key1"}, gomock.Any()).Return(lockRes)
+				unlockRes := redis.NewCmd(context.Background())
+				unlockRes.SetVal(int64(0))
+				cmd.EXPECT().Eval(gomock.Any(), luaUnlock, []string{"key1"}, gomock.Any()).Return(unlockRes)
+				return cmd
+			},
+			fn: func(ctx context.Context) error {
+				return errors.New("biz error")
+			},
+			wantErrs: []error{errors.New("biz error"), ErrLockNotHold},
+		},
+		{
+			name: "refresh failed",
+			mock: func(ctrl *gomock.Controller) redis.Cmdable {
+				cmd := mocks.NewMockCmdable(ctrl)
+				lockRes := redis.NewCmd(context.Background())
+				lockRes.SetVal("OK")
+				cmd.EXPECT().Eval(gomock.Any(), luaLock, []string{"key1"}, gomock.Any()).Return(lockRes)
+				refreshRes := redis.NewCmd(context.Background())
+				refreshRes.SetVal(int64(0))
+				cmd.EXPECT().Eval(gomock.Any(), luaRefresh, []string{"key1"}, gomock.Any()).Return(refreshRes)
+				unlockRes := redis.NewCmd(context.Background())
+				unlockRes.SetVal(int64(0))
+				cmd.EXPECT().Eval(gomock.Any(), luaUnlock, []string{"key1"}, gomock.Any()).Return(unlockRes)
+				return cmd
+			},
+			opts: LockOptions{
+				Expiration:      time.Minute,
+				RefreshInterval: time.Millisecond * 10,
+			},
+			fn: func(ctx context.Context) error {
+				// 等到续约失败
+				<-ctx.Done()
+				return context.Cause(ctx)
+			},
+			wantErrs: []error{ErrLockNotHold},
+		},
+		{
+			name: "refresh timeout until expired",
+			mock: func(ctrl *gomock.Controller) redis.Cmdable {
+				cmd := mocks.NewMockCmdable(ctrl)
+				lockRes := redis.NewCmd(context.Background())
+				lockRes.SetVal("OK")
+				cmd.EXPECT().Eval(gomock.Any(), luaLock, []string{"key1"}, gomock.Any()).Return(lockRes)
+				refreshRes := redis.NewCmd(context.Background())
+				refreshRes.SetErr(context.DeadlineExceeded)
+				cmd.EXPECT().Eval(gomock.Any(), luaRefresh, []string{"key1"}, gomock.Any()).
+					Return(refreshRes).MinTimes(1)
+				unlockRes := redis.NewCmd(context.Background())
+				unlockRes.SetErr(context.DeadlineExceeded)
+				cmd.EXPECT().Eval(gomock.Any(), luaUnlock, []string{"key1"}, gomock.Any()).Return(unlockRes)
+				return cmd
+			},
+			opts: LockOptions{
+				Expiration:      time.Millisecond * 100,
+				RefreshInterval: time.Millisecond * 10,
+			},
+			fn: func(ctx context.Context) error {
+				// redis 一直超时，过期之后就不能再认为自己持有锁
+				<-ctx.Done()
+				return context.Cause(ctx)
+			},
+			wantErrs: []error{ErrLockNotHold, context.DeadlineExceeded},
+		},
+		{
+			name: "panic",
+			mock: func(ctrl *gomock.Controller) redis.Cmdable {
+				cmd := mocks.NewMockCmdable(ctrl)
+				lockRes := redis.NewCmd(context.Background())
+				lockRes.SetVal("OK")
+				cmd.EXPECT().Eval(gomock.Any(), luaLock, []string{"key1"}, gomock.Any()).Return(lockRes)
+				unlockRes := redis.NewCmd(context.Background())
+				unlockRes.SetVal(int64(1))
+				cmd.EXPECT().Eval(gomock.Any(), luaUnlock, []string{"key1"}, gomock.Any()).Return(unlockRes)
+				return cmd
+			},
+			fn: func(ctx context.Context) error {
+				panic("biz panic")
+			},
+			wantPanic: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			client := NewClient(tc.mock(ctrl))
+
+			if tc.wantPanic {
+				assert.Panics(t, func() {
+					_ = client.Do(context.Background(), "key1", tc.opts, tc.fn)
+				})
+				return
+			}
+			err := client.Do(context.Background(), "key1", tc.opts, tc.fn)
+			if len(tc.wantErrs) == 0 {
+				assert.NoError(t, err)
+				return
+			}
+			for _, wantErr := range tc.wantErrs {
+				assert.ErrorContains(t, err, wantErr.Error())
+			}
+		})
+	}
+}
+
 // 刷新锁的示例
 func ExampleLock_Refresh() {
 	var l *Lock
@@ -203,13 +357,8 @@ func ExampleLock_Refresh() {
 
 	//业务结束要退出续约的循环
 	stopChan <- struct{}{}
+	// l 需要真实的 redis 才能拿到，所以这个示例只编译不运行（没有 Output 注释）
 	l.Unlock(context.Background())
-
-	//下面内容删掉就不可以运行这个方法了
-	fmt.Println("Hello")
-	// Output:
-	// Hello
-
 }
 
 func ExampleLock_AutoRefresh() {
@@ -220,7 +369,25 @@ func ExampleLock_AutoRefresh() {
 		l.AutoRefresh(time.Second*30, time.Second)
 	}()
 
-	fmt.Println("Hello")
-	// Output:
-	// Hello
+	//业务结束解锁，AutoRefresh 会跟着退出
+	l.Unlock(context.Background())
+}
+
+// 用 Do 就不需要自己写加锁、续约、解锁了
+func ExampleClient_Do() {
+	var c *Client
+	err := c.Do(context.Background(), "key1", LockOptions{
+		Expiration: time.Minute,
+		Timeout:    time.Second,
+	}, func(ctx context.Context) error {
+		select {
+		case <-ctx.Done():
+			//续约失败，锁丢了，要中断业务
+			return context.Cause(ctx)
+		default:
+			//正常业务逻辑
+			return nil
+		}
+	})
+	fmt.Println(err)
 }
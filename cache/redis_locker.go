@@ -0,0 +1,32 @@
+package cache
+
+import (
+	"context"
+	"time"
+)
+
+// Locker 把 Client 当成 Locker 使用
+func (c *Client) Locker() Locker {
+	return redisLocker{c: c}
+}
+
+// Client 的 Lock 和 TryLock 返回的是 *Lock，所以这里需要适配一下
+type redisLocker struct {
+	c *Client
+}
+
+func (r redisLocker) Lock(ctx context.Context, key string, expiration time.Duration, timeout time.Duration, retry RetryStrategy) (Mutex, error) {
+	l, err := r.c.Lock(ctx, key, expiration, timeout, retry)
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (r redisLocker) TryLock(ctx context.Context, key string, expiration time.Duration) (Mutex, error) {
+	l, err := r.c.TryLock(ctx, key, expiration)
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
@@ -8,6 +8,14 @@ type RetryStrategy interface {
 	Next() (time.Duration, bool)
 }
 
+// NewFixedIntervalRetryStrategy 固定间隔重试，最多重试 maxCnt 次
+func NewFixedIntervalRetryStrategy(interval time.Duration, maxCnt int) RetryStrategy {
+	return &fixedIntervalRetryStrategy{
+		Interval: interval,
+		MaxCnt:   maxCnt,
+	}
+}
+
 type fixedIntervalRetryStrategy struct {
 	Interval time.Duration
 	MaxCnt   int
@@ -15,8 +23,37 @@ type fixedIntervalRetryStrategy struct {
 }
 
 func (f *fixedIntervalRetryStrategy) Next() (time.Duration, bool) {
+	f.cnt++
 	if f.cnt > f.MaxCnt {
 		return 0, false
 	}
 	return f.Interval, true
 }
+
+// NewExponentialBackoffRetryStrategy 指数退避重试，间隔从 initial 开始翻倍，最大不超过 max，最多重试 maxCnt 次
+func NewExponentialBackoffRetryStrategy(initial time.Duration, max time.Duration, maxCnt int) RetryStrategy {
+	return &exponentialBackoffRetryStrategy{
+		initial: initial,
+		max:     max,
+		maxCnt:  maxCnt,
+	}
+}
+
+type exponentialBackoffRetryStrategy struct {
+	initial time.Duration
+	max     time.Duration
+	maxCnt  int
+	cnt     int
+}
+
+func (e *exponentialBackoffRetryStrategy) Next() (time.Duration, bool) {
+	e.cnt++
+	if e.cnt > e.maxCnt {
+		return 0, false
+	}
+	interval := e.initial
+	for i := 1; i < e.cnt && interval < e.max; i++ {
+		interval *= 2
+	}
+	return min(interval, e.max), true
+}
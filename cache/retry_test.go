@@ -0,0 +1,47 @@
+package cache
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestRetryStrategy_Next(t *testing.T) {
+	testCases := []struct {
+		name     string
+		strategy RetryStrategy
+
+		wantIntervals []time.Duration
+	}{
+		{
+			name:          "fixed interval",
+			strategy:      NewFixedIntervalRetryStrategy(time.Second, 3),
+			wantIntervals: []time.Duration{time.Second, time.Second, time.Second},
+		},
+		{
+			name:     "exponential backoff",
+			strategy: NewExponentialBackoffRetryStrategy(time.Millisecond*100, time.Second, 6),
+			wantIntervals: []time.Duration{
+				time.Millisecond * 100, time.Millisecond * 200, time.Millisecond * 400,
+				time.Millisecond * 800, time.Second, time.Second,
+			},
+		},
+		{
+			name:     "no retry",
+			strategy: NewExponentialBackoffRetryStrategy(time.Millisecond*100, time.Second, 0),
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var intervals []time.Duration
+			for {
+				interval, ok := tc.strategy.Next()
+				if !ok {
+					break
+				}
+				intervals = append(intervals, interval)
+			}
+			assert.Equal(t, tc.wantIntervals, intervals)
+		})
+	}
+}
@@ -0,0 +1,189 @@
+package cache
+
+import (
+	"context"
+	_ "embed"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"time"
+)
+
+var (
+	ErrFailedToAcquirePermit = errors.New("redis-semaphore: 许可不足")
+	ErrPermitNotHold         = errors.New("redis-semaphore: 租约不存在")
+
+	//go:embed lua/semaphore_acquire.lua
+	luaSemaphoreAcquire string
+	//go:embed lua/semaphore_refresh.lua
+	luaSemaphoreRefresh string
+	//go:embed lua/semaphore_release.lua
+	luaSemaphoreRelease string
+)
+
+type SemaphoreOption func(s *Semaphore)
+
+// Semaphore 分布式信号量，整个集群最多同时发出 permits 个许可
+// 每一次申请都是一个带过期时间的租约，持有者崩溃之后租约过期，许可会被回收
+type Semaphore struct {
+	client     redis.Cmdable
+	key        string
+	permitsKey string
+	permits    int64
+	expiration time.Duration
+	// Acquire 许可不足时的重试间隔
+	interval time.Duration
+	// 单次请求 redis 的超时时间
+	timeout time.Duration
+}
+
+// Semaphore 创建一个信号量，同一个 key 的信号量许可总数应该保持一致
+// 租约记在 key 上，每个租约占用的许可数记在 {key}:permits 上，两个 key 在同一个 slot，集群模式下也能用
+func (c *Client) Semaphore(key string, permits int64, expiration time.Duration, opts ...SemaphoreOption) *Semaphore {
+	res := &Semaphore{
+		client:     c.client,
+		key:        key,
+		permitsKey: hashTagKey(key, ":permits"),
+		permits:    permits,
+		expiration: expiration,
+		interval:   time.Millisecond * 100,
+		timeout:    time.Second,
+	}
+	for _, opt := range opts {
+		opt(res)
+	}
+	return res
+}
+
+func SemaphoreWithRetryInterval(interval time.Duration) SemaphoreOption {
+	return func(s *Semaphore) {
+		s.interval = interval
+	}
+}
+
+func SemaphoreWithTimeout(timeout time.Duration) SemaphoreOption {
+	return func(s *Semaphore) {
+		s.timeout = timeout
+	}
+}
+
+// TryAcquire 申请 n 个许可，许可不足直接返回 ErrFailedToAcquirePermit
+func (s *Semaphore) TryAcquire(ctx context.Context, n int64) (*Permit, error) {
+	if n <= 0 || n > s.permits {
+		return nil, fmt.Errorf("redis-semaphore: 申请的许可数量 %d 不合法，许可总数 %d", n, s.permits)
+	}
+	id := uuid.New().String()
+	res, err := s.acquire(ctx, id, n)
+	if err != nil {
+		return nil, err
+	}
+	if !res {
+		return nil, ErrFailedToAcquirePermit
+	}
+	return s.newPermit(id, n), nil
+}
+
+// Acquire 申请 n 个许可，许可不足就每隔一段时间重试，直到成功或者 ctx 结束
+func (s *Semaphore) Acquire(ctx context.Context, n int64) (*Permit, error) {
+	if n <= 0 || n > s.permits {
+		return nil, fmt.Errorf("redis-semaphore: 申请的许可数量 %d 不合法，许可总数 %d", n, s.permits)
+	}
+	var timer *time.Timer
+	id := uuid.New().String()
+	for {
+		actx, cancel := context.WithTimeout(ctx, s.timeout)
+		res, err := s.acquire(actx, id, n)
+		cancel()
+		if err != nil && !errors.Is(err, context.DeadlineExceeded) {
+			return nil, err
+		}
+		if res {
+			return s.newPermit(id, n), nil
+		}
+
+		if timer == nil {
+			timer = time.NewTimer(s.interval)
+		} else {
+			timer.Reset(s.interval)
+		}
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			// 超时的那次请求可能已经申请成功了，这里把它还回去
+			s.release(id)
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (s *Semaphore) acquire(ctx context.Context, id string, n int64) (bool, error) {
+	res, err := s.client.Eval(ctx, luaSemaphoreAcquire, []string{s.key, s.permitsKey},
+		id, n, s.permits, s.expiration.Milliseconds()).Int64()
+	return res == 1, err
+}
+
+func (s *Semaphore) release(id string) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	_ = s.client.Eval(ctx, luaSemaphoreRelease, []string{s.key, s.permitsKey}, id).Err()
+}
+
+func (s *Semaphore) newPermit(id string, n int64) *Permit {
+	return &Permit{
+		client:      s.client,
+		key:         s.key,
+		permitsKey:  s.permitsKey,
+		id:          id,
+		n:           n,
+		expiration:  s.expiration,
+		releaseChan: make(chan struct{}, 1),
+	}
+}
+
+// Permit 一次申请拿到的许可
+type Permit struct {
+	client      redis.Cmdable
+	key         string
+	permitsKey  string
+	id          string
+	n           int64
+	expiration  time.Duration
+	releaseChan chan struct{}
+}
+
+// N 这个租约占用的许可数量
+func (p *Permit) N() int64 {
+	return p.n
+}
+
+// 自动续约
+func (p *Permit) AutoRefresh(interval time.Duration, timeout time.Duration) error {
+	return RefreshLoop(p.Refresh, p.releaseChan, interval, timeout, p.expiration, ErrPermitNotHold)
+}
+
+// 手动续约
+func (p *Permit) Refresh(ctx context.Context) error {
+	res, err := p.client.Eval(ctx, luaSemaphoreRefresh, []string{p.key, p.permitsKey},
+		p.id, p.expiration.Milliseconds()).Int64()
+	if err != nil {
+		return err
+	}
+	if res != 1 {
+		return ErrPermitNotHold
+	}
+	return nil
+}
+
+// Release 归还许可
+func (p *Permit) Release(ctx context.Context) error {
+	res, err := p.client.Eval(ctx, luaSemaphoreRelease, []string{p.key, p.permitsKey}, p.id).Int64()
+	defer stopAutoRefresh(p.releaseChan)
+	if err != nil {
+		return err
+	}
+	if res != 1 {
+		return ErrPermitNotHold
+	}
+	return nil
+}
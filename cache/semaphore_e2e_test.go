@@ -0,0 +1,51 @@
+//go:build e2e
+
+package cache
+
+import (
+	"context"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestSemaphore_e2e(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+	})
+	client := NewClient(rdb)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	sem := client.Semaphore("sem_key1", 3, time.Second)
+
+	p1, err := sem.TryAcquire(ctx, 2)
+	require.NoError(t, err)
+	p2, err := sem.TryAcquire(ctx, 1)
+	require.NoError(t, err)
+
+	// 许可已经用完了
+	_, err = sem.TryAcquire(ctx, 1)
+	assert.Equal(t, ErrFailedToAcquirePermit, err)
+
+	// 归还之后可以再申请
+	require.NoError(t, p2.Release(ctx))
+	p3, err := sem.TryAcquire(ctx, 1)
+	require.NoError(t, err)
+
+	// p1 续约，p3 不续约，p3 过期之后许可会被回收
+	require.NoError(t, p1.Refresh(ctx))
+	time.Sleep(time.Millisecond * 600)
+	require.NoError(t, p1.Refresh(ctx))
+	time.Sleep(time.Millisecond * 600)
+	p4, err := sem.Acquire(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, ErrPermitNotHold, p3.Refresh(ctx))
+
+	require.NoError(t, p1.Release(ctx))
+	require.NoError(t, p4.Release(ctx))
+	n, err := rdb.Exists(ctx, "sem_key1", "{sem_key1}:permits").Result()
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), n)
+}
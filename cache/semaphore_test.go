@@ -0,0 +1,191 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"github.com/golang/mock/gomock"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/zhuguangfeng/study/cache/mocks"
+	"testing"
+	"time"
+)
+
+func TestSemaphore_TryAcquire(t *testing.T) {
+	semKeys := []string{"sem1", "{sem1}:permits"}
+	testCases := []struct {
+		name string
+		mock func(ctrl *gomock.Controller) redis.Cmdable
+		n    int64
+
+		wantErr error
+	}{
+		{
+			name: "invalid n",
+			mock: func(ctrl *gomock.Controller) redis.Cmdable {
+				return mocks.NewMockCmdable(ctrl)
+			},
+			n:       6,
+			wantErr: errors.New("redis-semaphore: 申请的许可数量 6 不合法，许可总数 5"),
+		},
+		{
+			name: "eval error",
+			mock: func(ctrl *gomock.Controller) redis.Cmdable {
+				cmd := mocks.NewMockCmdable(ctrl)
+				res := redis.NewCmd(context.Background())
+				res.SetErr(context.DeadlineExceeded)
+				cmd.EXPECT().Eval(gomock.Any(), luaSemaphoreAcquire, semKeys, gomock.Any()).Return(res)
+				return cmd
+			},
+			n:       1,
+			wantErr: context.DeadlineExceeded,
+		},
+		{
+			name: "not enough permits",
+			mock: func(ctrl *gomock.Controller) redis.Cmdable {
+				cmd := mocks.NewMockCmdable(ctrl)
+				res := redis.NewCmd(context.Background())
+				res.SetVal(int64(0))
+				cmd.EXPECT().Eval(gomock.Any(), luaSemaphoreAcquire, semKeys, gomock.Any()).Return(res)
+				return cmd
+			},
+			n:       2,
+			wantErr: ErrFailedToAcquirePermit,
+		},
+		{
+			name: "acquired",
+			mock: func(ctrl *gomock.Controller) redis.Cmdable {
+				cmd := mocks.NewMockCmdable(ctrl)
+				res := redis.NewCmd(context.Background())
+				res.SetVal(int64(1))
+				cmd.EXPECT().Eval(gomock.Any(), luaSemaphoreAcquire, semKeys,
+					gomock.Any(), int64(2), int64(5), int64(60000)).Return(res)
+				return cmd
+			},
+			n: 2,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			sem := NewClient(tc.mock(ctrl)).Semaphore("sem1", 5, time.Minute)
+
+			p, err := sem.TryAcquire(context.Background(), tc.n)
+			assert.Equal(t, tc.wantErr, err)
+			if err != nil {
+				return
+			}
+			assert.Equal(t, tc.n, p.N())
+			assert.NotEmpty(t, p.id)
+		})
+	}
+}
+
+func TestSemaphore_Acquire(t *testing.T) {
+	semKeys := []string{"sem1", "{sem1}:permits"}
+	testCases := []struct {
+		name string
+		mock func(ctrl *gomock.Controller) redis.Cmdable
+		ctx  func() (context.Context, context.CancelFunc)
+
+		wantErr error
+	}{
+		{
+			name: "retry and acquired",
+			mock: func(ctrl *gomock.Controller) redis.Cmdable {
+				cmd := mocks.NewMockCmdable(ctrl)
+				notEnough := redis.NewCmd(context.Background())
+				notEnough.SetVal(int64(0))
+				ok := redis.NewCmd(context.Background())
+				ok.SetVal(int64(1))
+				gomock.InOrder(
+					cmd.EXPECT().Eval(gomock.Any(), luaSemaphoreAcquire, semKeys, gomock.Any()).Return(notEnough),
+					cmd.EXPECT().Eval(gomock.Any(), luaSemaphoreAcquire, semKeys, gomock.Any()).Return(ok),
+				)
+				return cmd
+			},
+			ctx: func() (context.Context, context.CancelFunc) {
+				return context.WithTimeout(context.Background(), time.Second)
+			},
+		},
+		{
+			name: "timeout and release",
+			mock: func(ctrl *gomock.Controller) redis.Cmdable {
+				cmd := mocks.NewMockCmdable(ctrl)
+				notEnough := redis.NewCmd(context.Background())
+				notEnough.SetVal(int64(0))
+				released := redis.NewCmd(context.Background())
+				released.SetVal(int64(0))
+				cmd.EXPECT().Eval(gomock.Any(), luaSemaphoreAcquire, semKeys, gomock.Any()).
+					Return(notEnough).MinTimes(1)
+				cmd.EXPECT().Eval(gomock.Any(), luaSemaphoreRelease, semKeys, gomock.Any()).Return(released)
+				return cmd
+			},
+			ctx: func() (context.Context, context.CancelFunc) {
+				return context.WithTimeout(context.Background(), time.Millisecond*50)
+			},
+			wantErr: context.DeadlineExceeded,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			sem := NewClient(tc.mock(ctrl)).Semaphore("sem1", 5, time.Minute,
+				SemaphoreWithRetryInterval(time.Millisecond*10))
+			ctx, cancel := tc.ctx()
+			defer cancel()
+
+			p, err := sem.Acquire(ctx, 1)
+			assert.Equal(t, tc.wantErr, err)
+			if err != nil {
+				return
+			}
+			assert.Equal(t, int64(1), p.N())
+		})
+	}
+}
+
+func TestPermit_Refresh(t *testing.T) {
+	testCases := []struct {
+		name    string
+		val     int64
+		wantErr error
+	}{
+		{
+			name:    "permit not hold",
+			val:     0,
+			wantErr: ErrPermitNotHold,
+		},
+		{
+			name: "refreshed",
+			val:  1,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			cmd := mocks.NewMockCmdable(ctrl)
+			res := redis.NewCmd(context.Background())
+			res.SetVal(tc.val)
+			cmd.EXPECT().Eval(context.Background(), luaSemaphoreRefresh, []string{"sem1", "{sem1}:permits"},
+				"id1", int64(60000)).Return(res)
+
+			p := &Permit{
+				client:     cmd,
+				key:        "sem1",
+				permitsKey: "{sem1}:permits",
+				id:         "id1",
+				n:          1,
+				expiration: time.Minute,
+			}
+			err := p.Refresh(context.Background())
+			assert.Equal(t, tc.wantErr, err)
+		})
+	}
+}
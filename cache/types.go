@@ -12,3 +12,21 @@ type Cache interface {
 
 	Delete(ctx context.Context, key string) error
 }
+
+// Locker 分布式锁，redis 和 etcd 各有一个实现
+type Locker interface {
+	// Lock 加锁，拿不到锁就按照 retry 重试，timeout 是单次请求的超时时间
+	Lock(ctx context.Context, key string, expiration time.Duration, timeout time.Duration, retry RetryStrategy) (Mutex, error)
+	// TryLock 加锁，拿不到锁直接返回 ErrFailedToPreemptLock
+	TryLock(ctx context.Context, key string, expiration time.Duration) (Mutex, error)
+}
+
+// Mutex 加锁成功之后拿到的锁
+type Mutex interface {
+	// Refresh 续约，锁已经不是自己的了返回 ErrLockNotHold
+	Refresh(ctx context.Context) error
+	// AutoRefresh 每隔 interval 续约一次，直到 Unlock 或者续约失败
+	AutoRefresh(interval time.Duration, timeout time.Duration) error
+	// Unlock 解锁，锁已经不是自己的了返回 ErrLockNotHold
+	Unlock(ctx context.Context) error
+}
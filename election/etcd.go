@@ -0,0 +1,151 @@
+package election
+
+import (
+	"context"
+	"errors"
+	"go.etcd.io/etcd/client/v3/concurrency"
+	"sync"
+	"time"
+)
+
+var _ Election = &EtcdElection{}
+
+// 竞选结束之后清理 key 的超时时间
+const resignTimeout = time.Second
+
+// EtcdElection 基于 etcd concurrency.Election 的选举
+// 可以直接复用 etcd.Registry 的 session，这样实例下线的时候领导权会跟着一起释放
+type EtcdElection struct {
+	state
+	session func() *concurrency.Session
+	prefix  string
+	val     string
+	// 每次竞选创建一个 campaigner，返回的 channel 关闭表示 session 没了
+	newCampaigner func() (campaigner, <-chan struct{})
+
+	campaignMutex sync.Mutex
+	// 当选的时候用的 campaigner，Resign 要用同一个
+	leader campaigner
+	// 当选的时候的 session
+	leaderDone <-chan struct{}
+	resigned   chan struct{}
+	// 正在进行的竞选共用的 ctx，当选或者 Resign 的时候取消
+	campaignCtx    context.Context
+	campaignCancel context.CancelCauseFunc
+}
+
+// campaigner 就是 concurrency.Election，测试的时候替换
+type campaigner interface {
+	Campaign(ctx context.Context, val string) error
+	Resign(ctx context.Context) error
+}
+
+// NewEtcdElection prefix 相同的实例参与同一个选举，val 是当选之后写入的值，一般是自己的地址
+// session 每次竞选的时候调用，例如传 etcd.Registry 的 Session 方法，租约丢失换了 session 之后还能重新竞选
+func NewEtcdElection(session func() *concurrency.Session, prefix string, val string) *EtcdElection {
+	res := &EtcdElection{
+		session: session,
+		prefix:  prefix,
+		val:     val,
+	}
+	res.newCampaigner = func() (campaigner, <-chan struct{}) {
+		sess := res.session()
+		return concurrency.NewElection(sess, res.prefix), sess.Done()
+	}
+	return res
+}
+
+// Campaign 竞选的时候不持有 campaignMutex，Resign 可以打断正在进行的竞选
+// 同时有多个 Campaign 的时候，一个当选之后其它的也会返回
+func (e *EtcdElection) Campaign(ctx context.Context) error {
+	e.campaignMutex.Lock()
+	if e.leader != nil {
+		e.campaignMutex.Unlock()
+		return nil
+	}
+	if e.campaignCancel == nil {
+		e.campaignCtx, e.campaignCancel = context.WithCancelCause(context.Background())
+	}
+	campaignCtx := e.campaignCtx
+	e.campaignMutex.Unlock()
+
+	cctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(campaignCtx, cancel)
+	defer stop()
+	c, done := e.newCampaigner()
+	err := c.Campaign(cctx, e.val)
+
+	e.campaignMutex.Lock()
+	defer e.campaignMutex.Unlock()
+	if err != nil {
+		if e.leader != nil {
+			// 别的 Campaign 已经当选了
+			return nil
+		}
+		if errors.Is(context.Cause(campaignCtx), ErrResigned) && ctx.Err() == nil {
+			return ErrResigned
+		}
+		return err
+	}
+	if e.leader != nil {
+		// 别的 Campaign 已经当选了，同一个 session 的 key 是同一个，不能删
+		if done != e.leaderDone {
+			e.resignQuietly(c)
+		}
+		return nil
+	}
+	if errors.Is(context.Cause(campaignCtx), ErrResigned) {
+		// 当选之前已经 Resign 了，把 key 删掉
+		e.resignQuietly(c)
+		return ErrResigned
+	}
+	resigned := make(chan struct{})
+	e.leader = c
+	e.leaderDone = done
+	e.resigned = resigned
+	if e.campaignCancel != nil {
+		e.campaignCancel(errElected)
+		e.campaignCtx, e.campaignCancel = nil, nil
+	}
+	e.setLeader(true)
+	go func() {
+		select {
+		case <-done:
+			// session 的租约过期了，key 会被 etcd 删掉，别人可以当选
+			e.campaignMutex.Lock()
+			if e.resigned == resigned {
+				e.leader, e.leaderDone, e.resigned = nil, nil, nil
+				e.setLeader(false)
+			}
+			e.campaignMutex.Unlock()
+		case <-resigned:
+		}
+	}()
+	return nil
+}
+
+// 删掉没有用上的 key，失败了也没关系，租约过期之后 etcd 会删掉
+func (e *EtcdElection) resignQuietly(c campaigner) {
+	ctx, cancel := context.WithTimeout(context.Background(), resignTimeout)
+	defer cancel()
+	_ = c.Resign(ctx)
+}
+
+// Resign 放弃领导权，正在进行的 Campaign 会返回 ErrResigned
+func (e *EtcdElection) Resign(ctx context.Context) error {
+	e.campaignMutex.Lock()
+	defer e.campaignMutex.Unlock()
+	if e.campaignCancel != nil {
+		e.campaignCancel(ErrResigned)
+		e.campaignCtx, e.campaignCancel = nil, nil
+	}
+	if e.resigned == nil {
+		return nil
+	}
+	err := e.leader.Resign(ctx)
+	close(e.resigned)
+	e.leader, e.leaderDone, e.resigned = nil, nil, nil
+	e.setLeader(false)
+	return err
+}
@@ -0,0 +1,63 @@
+//go:build e2e
+
+package election
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
+	"testing"
+	"time"
+)
+
+func TestEtcdElection_e2e(t *testing.T) {
+	etcdClient, err := clientv3.New(clientv3.Config{
+		Endpoints: []string{"localhost:2379"},
+	})
+	require.NoError(t, err)
+	defer etcdClient.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	sess1, err := concurrency.NewSession(etcdClient, concurrency.WithTTL(1))
+	require.NoError(t, err)
+	sess2, err := concurrency.NewSession(etcdClient, concurrency.WithTTL(1))
+	require.NoError(t, err)
+	defer sess2.Close()
+
+	e1 := NewEtcdElection(func() *concurrency.Session { return sess1 }, "/election/e2e", "instance1")
+	e2 := NewEtcdElection(func() *concurrency.Session { return sess2 }, "/election/e2e", "instance2")
+	ch1 := e1.Observe(ctx)
+	ch2 := e2.Observe(ctx)
+	assert.False(t, <-ch1)
+	assert.False(t, <-ch2)
+
+	require.NoError(t, e1.Campaign(ctx))
+	assert.True(t, <-ch1)
+
+	// e1 还是 leader，e2 竞选会一直阻塞
+	campaignCtx, campaignCancel := context.WithTimeout(ctx, time.Millisecond*500)
+	defer campaignCancel()
+	assert.Error(t, e2.Campaign(campaignCtx))
+	assert.False(t, e2.IsLeader())
+
+	// e1 的 session 没了，e2 可以当选
+	require.NoError(t, sess1.Close())
+	assert.False(t, <-ch1)
+	require.NoError(t, e2.Campaign(ctx))
+	assert.True(t, <-ch2)
+
+	require.NoError(t, e2.Resign(ctx))
+	assert.False(t, <-ch2)
+
+	// 换了新的 session 之后 e1 可以重新竞选
+	sess1, err = concurrency.NewSession(etcdClient, concurrency.WithTTL(1))
+	require.NoError(t, err)
+	defer sess1.Close()
+	require.NoError(t, e1.Campaign(ctx))
+	assert.True(t, <-ch1)
+	require.NoError(t, e1.Resign(ctx))
+	assert.False(t, <-ch1)
+}
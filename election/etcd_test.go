@@ -0,0 +1,111 @@
+package election
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeCampaigner 在 win 关闭之前一直竞选不上
+type fakeCampaigner struct {
+	win     <-chan struct{}
+	resigns *atomic.Int32
+}
+
+func (f *fakeCampaigner) Campaign(ctx context.Context, val string) error {
+	select {
+	case <-f.win:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (f *fakeCampaigner) Resign(ctx context.Context) error {
+	f.resigns.Add(1)
+	return nil
+}
+
+func newFakeEtcdElection(win <-chan struct{}, done <-chan struct{}) (*EtcdElection, *atomic.Int32) {
+	resigns := &atomic.Int32{}
+	e := &EtcdElection{val: "instance1"}
+	e.newCampaigner = func() (campaigner, <-chan struct{}) {
+		return &fakeCampaigner{win: win, resigns: resigns}, done
+	}
+	return e, resigns
+}
+
+func TestEtcdElection_ResignDuringCampaign(t *testing.T) {
+	e, resigns := newFakeEtcdElection(make(chan struct{}), make(chan struct{}))
+	errChan := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			errChan <- e.Campaign(context.Background())
+		}()
+	}
+	time.Sleep(time.Millisecond * 50)
+	// 竞选的时候也可以 Resign，不会被阻塞
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, e.Resign(ctx))
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errChan:
+			assert.Equal(t, ErrResigned, err)
+		case <-time.After(time.Second):
+			t.Fatal("Campaign 没有返回")
+		}
+	}
+	assert.False(t, e.IsLeader())
+	assert.Equal(t, int32(0), resigns.Load())
+
+	// Resign 之后还可以重新竞选
+	campaignCtx, campaignCancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer campaignCancel()
+	assert.Equal(t, context.DeadlineExceeded, e.Campaign(campaignCtx))
+}
+
+func TestEtcdElection_Campaign(t *testing.T) {
+	win := make(chan struct{})
+	done := make(chan struct{})
+	e, resigns := newFakeEtcdElection(win, done)
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, e.Campaign(context.Background()))
+		}()
+	}
+	time.Sleep(time.Millisecond * 50)
+	close(win)
+	wg.Wait()
+	assert.True(t, e.IsLeader())
+	// 同一个 session 的 key 是同一个，没当选的那个不能删
+	assert.Equal(t, int32(0), resigns.Load())
+
+	// session 没了就失去领导权
+	close(done)
+	assert.Eventually(t, func() bool {
+		return !e.IsLeader()
+	}, time.Second, time.Millisecond*10)
+	assert.Nil(t, e.leader)
+}
+
+func TestEtcdElection_Resign(t *testing.T) {
+	win := make(chan struct{})
+	close(win)
+	e, resigns := newFakeEtcdElection(win, make(chan struct{}))
+	require.NoError(t, e.Campaign(context.Background()))
+	assert.True(t, e.IsLeader())
+	require.NoError(t, e.Resign(context.Background()))
+	assert.False(t, e.IsLeader())
+	assert.Equal(t, int32(1), resigns.Load())
+	// 没有当选的时候 Resign 什么都不做
+	require.NoError(t, e.Resign(context.Background()))
+	assert.Equal(t, int32(1), resigns.Load())
+}
@@ -0,0 +1,151 @@
+package election
+
+import (
+	"context"
+	"errors"
+	"github.com/zhuguangfeng/study/cache"
+	"sync"
+	"time"
+)
+
+var _ Election = &RedisElection{}
+
+type RedisOption func(e *RedisElection)
+
+// RedisElection 基于 cache.Client 分布式锁的选举，拿到锁的就是 leader
+// 当选之后会自动续约，续约失败，或者续约一直超时超过了 expiration，就认为失去了领导权
+type RedisElection struct {
+	state
+	client     *cache.Client
+	key        string
+	expiration time.Duration
+	// 单次请求 redis 的超时时间
+	timeout time.Duration
+	// 竞选失败之后的重试间隔
+	retryInterval time.Duration
+
+	campaignMutex sync.Mutex
+	lock          *cache.Lock
+	// 正在进行的竞选共用的 ctx，当选或者 Resign 的时候取消
+	campaignCtx    context.Context
+	campaignCancel context.CancelCauseFunc
+}
+
+func NewRedisElection(client *cache.Client, key string, expiration time.Duration, opts ...RedisOption) *RedisElection {
+	res := &RedisElection{
+		client:        client,
+		key:           key,
+		expiration:    expiration,
+		timeout:       time.Second,
+		retryInterval: expiration / 3,
+	}
+	for _, opt := range opts {
+		opt(res)
+	}
+	return res
+}
+
+func RedisWithTimeout(timeout time.Duration) RedisOption {
+	return func(e *RedisElection) {
+		e.timeout = timeout
+	}
+}
+
+func RedisWithRetryInterval(interval time.Duration) RedisOption {
+	return func(e *RedisElection) {
+		e.retryInterval = interval
+	}
+}
+
+// Campaign 抢锁的时候不持有 campaignMutex，Resign 可以打断正在进行的竞选
+// 同时有多个 Campaign 的时候，一个当选之后其它的也会返回
+func (e *RedisElection) Campaign(ctx context.Context) error {
+	e.campaignMutex.Lock()
+	if e.lock != nil {
+		e.campaignMutex.Unlock()
+		return nil
+	}
+	if e.campaignCancel == nil {
+		e.campaignCtx, e.campaignCancel = context.WithCancelCause(context.Background())
+	}
+	campaignCtx := e.campaignCtx
+	e.campaignMutex.Unlock()
+
+	lctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(campaignCtx, cancel)
+	defer stop()
+	l, err := e.client.Lock(lctx, e.key, e.expiration, e.timeout, &foreverRetry{interval: e.retryInterval})
+
+	e.campaignMutex.Lock()
+	defer e.campaignMutex.Unlock()
+	if err != nil {
+		if e.lock != nil {
+			// 别的 Campaign 已经当选了
+			return nil
+		}
+		if errors.Is(context.Cause(campaignCtx), ErrResigned) && ctx.Err() == nil {
+			return ErrResigned
+		}
+		return err
+	}
+	if e.lock != nil || errors.Is(context.Cause(campaignCtx), ErrResigned) {
+		// 别的 Campaign 已经当选了，或者抢到锁之前已经 Resign 了，把锁还回去
+		uctx, ucancel := context.WithTimeout(context.Background(), e.timeout)
+		_ = l.Unlock(uctx)
+		ucancel()
+		if e.lock != nil {
+			return nil
+		}
+		return ErrResigned
+	}
+	e.lock = l
+	if e.campaignCancel != nil {
+		e.campaignCancel(errElected)
+		e.campaignCtx, e.campaignCancel = nil, nil
+	}
+	e.setLeader(true)
+	go func() {
+		// 续约一直超时超过了过期时间也会返回 error，这个时候锁在 redis 里面已经过期了，
+		// 别人可能已经当选，不能再认为自己是 leader
+		err := l.AutoRefresh(e.expiration/3, e.timeout)
+		if err == nil {
+			// 主动放弃的，Resign 会处理
+			return
+		}
+		// 续约失败，锁可能已经被别人拿走了
+		e.campaignMutex.Lock()
+		if e.lock == l {
+			e.lock = nil
+			e.setLeader(false)
+		}
+		e.campaignMutex.Unlock()
+	}()
+	return nil
+}
+
+// Resign 放弃领导权，正在进行的 Campaign 会返回 ErrResigned
+func (e *RedisElection) Resign(ctx context.Context) error {
+	e.campaignMutex.Lock()
+	defer e.campaignMutex.Unlock()
+	if e.campaignCancel != nil {
+		e.campaignCancel(ErrResigned)
+		e.campaignCtx, e.campaignCancel = nil, nil
+	}
+	if e.lock == nil {
+		return nil
+	}
+	err := e.lock.Unlock(ctx)
+	e.lock = nil
+	e.setLeader(false)
+	return err
+}
+
+// foreverRetry 一直按照固定间隔重试，直到 ctx 结束
+type foreverRetry struct {
+	interval time.Duration
+}
+
+func (f *foreverRetry) Next() (time.Duration, bool) {
+	return f.interval, true
+}
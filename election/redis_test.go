@@ -0,0 +1,127 @@
+package election
+
+import (
+	"context"
+	"github.com/golang/mock/gomock"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zhuguangfeng/study/cache"
+	"github.com/zhuguangfeng/study/cache/mocks"
+	"testing"
+	"time"
+)
+
+func TestRedisElection(t *testing.T) {
+	testCases := []struct {
+		name       string
+		mock       func(ctrl *gomock.Controller) redis.Cmdable
+		expiration time.Duration
+		// 当选之后怎么失去领导权
+		after func(t *testing.T, e *RedisElection)
+	}{
+		{
+			name: "campaign and resign",
+			mock: func(ctrl *gomock.Controller) redis.Cmdable {
+				cmd := mocks.NewMockCmdable(ctrl)
+				lockRes := redis.NewCmd(context.Background())
+				lockRes.SetVal("OK")
+				cmd.EXPECT().Eval(gomock.Any(), gomock.Any(), []string{"leader"}, gomock.Any()).Return(lockRes)
+				unlockRes := redis.NewCmd(context.Background())
+				unlockRes.SetVal(int64(1))
+				cmd.EXPECT().Eval(gomock.Any(), gomock.Any(), []string{"leader"}, gomock.Any()).Return(unlockRes)
+				return cmd
+			},
+			expiration: time.Minute,
+			after: func(t *testing.T, e *RedisElection) {
+				require.NoError(t, e.Resign(context.Background()))
+			},
+		},
+		{
+			name: "lost leadership",
+			mock: func(ctrl *gomock.Controller) redis.Cmdable {
+				cmd := mocks.NewMockCmdable(ctrl)
+				lockRes := redis.NewCmd(context.Background())
+				lockRes.SetVal("OK")
+				cmd.EXPECT().Eval(gomock.Any(), gomock.Any(), []string{"leader"}, gomock.Any()).Return(lockRes)
+				// 续约的时候发现锁已经不是自己的了
+				refreshRes := redis.NewCmd(context.Background())
+				refreshRes.SetVal(int64(0))
+				cmd.EXPECT().Eval(gomock.Any(), gomock.Any(), []string{"leader"}, gomock.Any()).Return(refreshRes)
+				return cmd
+			},
+			expiration: time.Millisecond * 30,
+			after:      func(t *testing.T, e *RedisElection) {},
+		},
+		{
+			name: "refresh timeout",
+			mock: func(ctrl *gomock.Controller) redis.Cmdable {
+				cmd := mocks.NewMockCmdable(ctrl)
+				lockRes := redis.NewCmd(context.Background())
+				lockRes.SetVal("OK")
+				cmd.EXPECT().Eval(gomock.Any(), gomock.Any(), []string{"leader"}, gomock.Any()).Return(lockRes)
+				// redis 一直超时，锁过期之后就不再是 leader
+				refreshRes := redis.NewCmd(context.Background())
+				refreshRes.SetErr(context.DeadlineExceeded)
+				cmd.EXPECT().Eval(gomock.Any(), gomock.Any(), []string{"leader"}, gomock.Any()).
+					Return(refreshRes).MinTimes(1)
+				return cmd
+			},
+			expiration: time.Millisecond * 60,
+			after:      func(t *testing.T, e *RedisElection) {},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			e := NewRedisElection(cache.NewClient(tc.mock(ctrl)), "leader", tc.expiration)
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			ch := e.Observe(ctx)
+			assert.False(t, <-ch)
+
+			require.NoError(t, e.Campaign(ctx))
+			assert.True(t, e.IsLeader())
+			// 已经是 leader 了，再竞选直接返回
+			require.NoError(t, e.Campaign(ctx))
+			assert.True(t, <-ch)
+
+			tc.after(t, e)
+			assert.False(t, <-ch)
+			assert.False(t, e.IsLeader())
+		})
+	}
+}
+
+func TestRedisElection_ResignDuringCampaign(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	cmd := mocks.NewMockCmdable(ctrl)
+	// 锁一直在别人手上
+	lockRes := redis.NewCmd(context.Background())
+	lockRes.SetVal("")
+	cmd.EXPECT().Eval(gomock.Any(), gomock.Any(), []string{"leader"}, gomock.Any()).Return(lockRes).AnyTimes()
+	e := NewRedisElection(cache.NewClient(cmd), "leader", time.Minute,
+		RedisWithRetryInterval(time.Millisecond*10))
+
+	errChan := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			errChan <- e.Campaign(context.Background())
+		}()
+	}
+	time.Sleep(time.Millisecond * 50)
+	// 竞选的时候也可以 Resign，不会被阻塞
+	require.NoError(t, e.Resign(context.Background()))
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errChan:
+			assert.Equal(t, ErrResigned, err)
+		case <-time.After(time.Second):
+			t.Fatal("Campaign 没有返回")
+		}
+	}
+	assert.False(t, e.IsLeader())
+}
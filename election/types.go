@@ -0,0 +1,88 @@
+package election
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrResigned 竞选还没有结果的时候调用了 Resign
+var ErrResigned = errors.New("election: 已经放弃竞选")
+
+// 当选之后取消其它的竞选用的
+var errElected = errors.New("election: 已经当选")
+
+// Election 领导者选举，同一时刻最多只有一个实例是 leader
+// 典型的用法是定时任务只在 leader 上执行
+type Election interface {
+	// Campaign 参与竞选，阻塞到当选或者 ctx 结束，已经是 leader 的话直接返回
+	Campaign(ctx context.Context) error
+	// Resign 主动放弃领导权
+	Resign(ctx context.Context) error
+	// Observe 领导权的变化，true 表示当选，false 表示失去领导权
+	// 订阅的时候会先收到当前的状态，ctx 结束之后 channel 会被关闭
+	Observe(ctx context.Context) <-chan bool
+	// IsLeader 当前是不是 leader
+	IsLeader() bool
+}
+
+// state 维护领导权的状态，并且通知所有的订阅者
+type state struct {
+	mutex     sync.RWMutex
+	leader    bool
+	observers map[chan bool]struct{}
+}
+
+func (s *state) IsLeader() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.leader
+}
+
+func (s *state) Observe(ctx context.Context) <-chan bool {
+	// 订阅者处理得慢，channel 满了的时候丢掉最旧的变化
+	ch := make(chan bool, 8)
+	s.mutex.Lock()
+	if s.observers == nil {
+		s.observers = make(map[chan bool]struct{})
+	}
+	s.observers[ch] = struct{}{}
+	ch <- s.leader
+	s.mutex.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		s.mutex.Lock()
+		delete(s.observers, ch)
+		close(ch)
+		s.mutex.Unlock()
+	}()
+	return ch
+}
+
+func (s *state) setLeader(leader bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.leader == leader {
+		return
+	}
+	s.leader = leader
+	for ch := range s.observers {
+		send(ch, leader)
+	}
+}
+
+// 发送变化，channel 满了就丢掉最旧的，直到发送成功
+func send(ch chan bool, leader bool) {
+	for {
+		select {
+		case ch <- leader:
+			return
+		default:
+		}
+		select {
+		case <-ch:
+		default:
+		}
+	}
+}
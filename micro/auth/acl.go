@@ -0,0 +1,50 @@
+package auth
+
+import "strings"
+
+// Rule 一个方法允许哪些调用方访问，Subjects 和 Roles 满足一个就可以
+type Rule struct {
+	// 完整的方法名，例如 /user.UserService/GetById
+	// /user.UserService/* 表示整个服务，* 表示所有方法
+	Method   string
+	Subjects []string
+	Roles    []string
+}
+
+// ACL 方法级别的访问控制
+// 按照 完整方法名、服务、* 的顺序找到最具体的规则，一条规则都没有匹配上的方法不允许访问
+type ACL []Rule
+
+// Allow p 能不能调用 fullMethod
+func (a ACL) Allow(fullMethod string, p Principal) bool {
+	rule, ok := a.match(fullMethod)
+	if !ok {
+		return false
+	}
+	for _, s := range rule.Subjects {
+		if s == p.Subject || s == "*" {
+			return true
+		}
+	}
+	for _, r := range rule.Roles {
+		if p.HasRole(r) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a ACL) match(fullMethod string) (Rule, bool) {
+	service := fullMethod
+	if idx := strings.LastIndex(fullMethod, "/"); idx > 0 {
+		service = fullMethod[:idx]
+	}
+	for _, pattern := range []string{fullMethod, service + "/*", "*"} {
+		for _, rule := range a {
+			if rule.Method == pattern {
+				return rule, true
+			}
+		}
+	}
+	return Rule{}, false
+}
@@ -0,0 +1,67 @@
+package auth
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestACL_Allow(t *testing.T) {
+	acl := ACL{
+		{Method: "/user.UserService/*", Subjects: []string{"order-service"}, Roles: []string{"reader"}},
+		{Method: "/user.UserService/Delete", Roles: []string{"admin"}},
+		{Method: "/order.OrderService/GetById", Subjects: []string{"*"}},
+	}
+	testCases := []struct {
+		name      string
+		method    string
+		principal Principal
+
+		wantAllow bool
+	}{
+		{
+			name:      "service rule subject",
+			method:    "/user.UserService/GetById",
+			principal: Principal{Subject: "order-service"},
+			wantAllow: true,
+		},
+		{
+			name:      "service rule role",
+			method:    "/user.UserService/GetById",
+			principal: Principal{Subject: "pay-service", Roles: []string{"reader"}},
+			wantAllow: true,
+		},
+		{
+			name:      "service rule denied",
+			method:    "/user.UserService/GetById",
+			principal: Principal{Subject: "pay-service"},
+		},
+		{
+			// 方法的规则比服务的规则优先
+			name:      "method rule overrides service rule",
+			method:    "/user.UserService/Delete",
+			principal: Principal{Subject: "order-service"},
+		},
+		{
+			name:      "method rule role",
+			method:    "/user.UserService/Delete",
+			principal: Principal{Subject: "ops", Roles: []string{"admin"}},
+			wantAllow: true,
+		},
+		{
+			name:      "any subject",
+			method:    "/order.OrderService/GetById",
+			principal: Principal{Subject: "pay-service"},
+			wantAllow: true,
+		},
+		{
+			name:      "no rule",
+			method:    "/order.OrderService/Create",
+			principal: Principal{Subject: "order-service", Roles: []string{"admin"}},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.wantAllow, acl.Allow(tc.method, tc.principal))
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package auth
+
+import (
+	"context"
+	"google.golang.org/grpc/credentials"
+)
+
+// AuthorizationMetadataKey token 放在 metadata 的这个 key 里面，格式是 Bearer <token>
+const AuthorizationMetadataKey = "authorization"
+
+const bearerPrefix = "Bearer "
+
+type CredentialsOption func(c *Credentials)
+
+// Credentials 实现了 credentials.PerRPCCredentials，每个请求都带上 token
+// 通过 grpc.WithPerRPCCredentials 或者 micro.ClientWithAuth 使用
+type Credentials struct {
+	token    func() (string, error)
+	insecure bool
+}
+
+var _ credentials.PerRPCCredentials = &Credentials{}
+
+// NewTokenCredentials 每个请求都调用 token 拿到要带上的 token，例如 JWTSigner.Token
+func NewTokenCredentials(token func() (string, error), opts ...CredentialsOption) *Credentials {
+	res := &Credentials{
+		token: token,
+	}
+	for _, opt := range opts {
+		opt(res)
+	}
+	return res
+}
+
+// CredentialsAllowInsecure 允许在没有 TLS 的连接上发送 token，只应该在测试或者可信的网络里面用
+func CredentialsAllowInsecure() CredentialsOption {
+	return func(c *Credentials) {
+		c.insecure = true
+	}
+}
+
+func (c *Credentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	token, err := c.token()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{
+		AuthorizationMetadataKey: bearerPrefix + token,
+	}, nil
+}
+
+func (c *Credentials) RequireTransportSecurity() bool {
+	return !c.insecure
+}
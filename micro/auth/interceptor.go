@@ -0,0 +1,123 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"strings"
+)
+
+type InterceptorOption func(b *InterceptorBuilder)
+
+// InterceptorBuilder 服务端校验调用方的 token，再按照 ACL 检查有没有权限
+type InterceptorBuilder struct {
+	authenticator Authenticator
+	acl           ACL
+	// 不需要认证的方法，完整方法名或者服务名加 /* 前缀
+	public []string
+}
+
+// NewInterceptorBuilder 默认所有方法都要认证，认证通过就可以访问
+func NewInterceptorBuilder(authenticator Authenticator, opts ...InterceptorOption) *InterceptorBuilder {
+	res := &InterceptorBuilder{
+		authenticator: authenticator,
+	}
+	for _, opt := range opts {
+		opt(res)
+	}
+	return res
+}
+
+// InterceptorWithACL 认证之后按照 acl 检查权限，没有权限返回 PermissionDenied
+func InterceptorWithACL(acl ACL) InterceptorOption {
+	return func(b *InterceptorBuilder) {
+		b.acl = acl
+	}
+}
+
+// InterceptorWithPublicMethods 不需要认证的方法，例如健康检查，/grpc.health.v1.Health/* 表示整个服务
+func InterceptorWithPublicMethods(methods ...string) InterceptorOption {
+	return func(b *InterceptorBuilder) {
+		b.public = append(b.public, methods...)
+	}
+}
+
+func (b *InterceptorBuilder) BuildUnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		ctx, err := b.authenticate(ctx, info.FullMethod)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+func (b *InterceptorBuilder) BuildStreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := b.authenticate(ss.Context(), info.FullMethod)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &serverStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+func (b *InterceptorBuilder) authenticate(ctx context.Context, fullMethod string) (context.Context, error) {
+	if b.isPublic(fullMethod) {
+		return ctx, nil
+	}
+	token, ok := tokenFromContext(ctx)
+	if !ok {
+		return ctx, status.Error(codes.Unauthenticated, "auth: 没有 token")
+	}
+	p, err := b.authenticator.Authenticate(ctx, token)
+	if err != nil {
+		if errors.Is(err, ErrInvalidToken) || errors.Is(err, ErrTokenExpired) {
+			return ctx, status.Error(codes.Unauthenticated, err.Error())
+		}
+		// 例如认证服务不可用，不是调用方的问题
+		return ctx, status.Errorf(codes.Unavailable, "auth: 认证失败, 原因: %v", err)
+	}
+	if b.acl != nil && !b.acl.Allow(fullMethod, p) {
+		return ctx, status.Errorf(codes.PermissionDenied, "auth: %s 没有权限调用 %s", p.Subject, fullMethod)
+	}
+	return WithPrincipal(ctx, p), nil
+}
+
+func (b *InterceptorBuilder) isPublic(fullMethod string) bool {
+	for _, m := range b.public {
+		if m == fullMethod {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(m, "*"); ok && strings.HasPrefix(fullMethod, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func tokenFromContext(ctx context.Context) (string, bool) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return "", false
+	}
+	for _, val := range md.Get(AuthorizationMetadataKey) {
+		if token, ok := strings.CutPrefix(val, bearerPrefix); ok && token != "" {
+			return token, true
+		}
+	}
+	return "", false
+}
+
+// 替换掉 ctx 的 ServerStream
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
@@ -0,0 +1,117 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"testing"
+)
+
+type authenticatorFunc func(ctx context.Context, token string) (Principal, error)
+
+func (f authenticatorFunc) Authenticate(ctx context.Context, token string) (Principal, error) {
+	return f(ctx, token)
+}
+
+func TestInterceptorBuilder_BuildUnaryServerInterceptor(t *testing.T) {
+	withToken := func(val string) context.Context {
+		return metadata.NewIncomingContext(context.Background(), metadata.Pairs(AuthorizationMetadataKey, val))
+	}
+	testCases := []struct {
+		name          string
+		authenticator Authenticator
+		ctx           context.Context
+		method        string
+
+		wantCode      codes.Code
+		wantPrincipal Principal
+	}{
+		{
+			name:          "static token",
+			authenticator: StaticTokenAuthenticator{"token-1": {Subject: "order-service"}},
+			ctx:           withToken("Bearer token-1"),
+			method:        "/user.UserService/GetById",
+			wantPrincipal: Principal{Subject: "order-service"},
+		},
+		{
+			name:          "wrong token",
+			authenticator: StaticTokenAuthenticator{"token-1": {Subject: "order-service"}},
+			ctx:           withToken("Bearer token-2"),
+			method:        "/user.UserService/GetById",
+			wantCode:      codes.Unauthenticated,
+		},
+		{
+			name:          "no bearer",
+			authenticator: StaticTokenAuthenticator{"token-1": {Subject: "order-service"}},
+			ctx:           withToken("token-1"),
+			method:        "/user.UserService/GetById",
+			wantCode:      codes.Unauthenticated,
+		},
+		{
+			name:          "no metadata",
+			authenticator: StaticTokenAuthenticator{"token-1": {Subject: "order-service"}},
+			ctx:           context.Background(),
+			method:        "/user.UserService/GetById",
+			wantCode:      codes.Unauthenticated,
+		},
+		{
+			name:          "public method",
+			authenticator: StaticTokenAuthenticator{},
+			ctx:           context.Background(),
+			method:        "/grpc.health.v1.Health/Check",
+		},
+		{
+			name:          "acl denied",
+			authenticator: StaticTokenAuthenticator{"token-1": {Subject: "order-service"}},
+			ctx:           withToken("Bearer token-1"),
+			method:        "/user.UserService/Delete",
+			wantCode:      codes.PermissionDenied,
+		},
+		{
+			name: "authenticator error",
+			authenticator: authenticatorFunc(func(ctx context.Context, token string) (Principal, error) {
+				return Principal{}, errors.New("mock error")
+			}),
+			ctx:      withToken("Bearer token-1"),
+			method:   "/user.UserService/GetById",
+			wantCode: codes.Unavailable,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			interceptor := NewInterceptorBuilder(tc.authenticator,
+				InterceptorWithPublicMethods("/grpc.health.v1.Health/*"),
+				InterceptorWithACL(ACL{
+					{Method: "/user.UserService/*", Subjects: []string{"order-service"}},
+					{Method: "/user.UserService/Delete", Roles: []string{"admin"}},
+				})).BuildUnaryServerInterceptor()
+			var principal Principal
+			_, err := interceptor(tc.ctx, nil, &grpc.UnaryServerInfo{FullMethod: tc.method},
+				func(ctx context.Context, req any) (any, error) {
+					principal, _ = PrincipalFromContext(ctx)
+					return nil, nil
+				})
+			assert.Equal(t, tc.wantCode, status.Code(err))
+			assert.Equal(t, tc.wantPrincipal, principal)
+		})
+	}
+}
+
+func TestCredentials_GetRequestMetadata(t *testing.T) {
+	creds := NewStaticTokenCredentials("token-1")
+	md, err := creds.GetRequestMetadata(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{AuthorizationMetadataKey: "Bearer token-1"}, md)
+	assert.True(t, creds.RequireTransportSecurity())
+	assert.False(t, NewStaticTokenCredentials("token-1", CredentialsAllowInsecure()).RequireTransportSecurity())
+}
+
+func TestSubject(t *testing.T) {
+	assert.Equal(t, "", Subject(context.Background()))
+	ctx := WithPrincipal(context.Background(), Principal{Subject: "order-service"})
+	assert.Equal(t, "order-service", Subject(ctx))
+}
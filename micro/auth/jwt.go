@@ -0,0 +1,213 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Claims JWT 里面用到的字段
+type Claims struct {
+	Subject   string   `json:"sub"`
+	Roles     []string `json:"roles,omitempty"`
+	Issuer    string   `json:"iss,omitempty"`
+	Audience  string   `json:"aud,omitempty"`
+	IssuedAt  int64    `json:"iat,omitempty"`
+	NotBefore int64    `json:"nbf,omitempty"`
+	ExpiresAt int64    `json:"exp,omitempty"`
+}
+
+// 固定用 HS256，解析的时候不接受别的算法，避免 alg=none 之类的攻击
+const jwtHeader = `{"alg":"HS256","typ":"JWT"}`
+
+var jwtEncoding = base64.RawURLEncoding
+
+// SignJWT 用 HS256 签名
+func SignJWT(secret []byte, claims Claims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	unsigned := jwtEncoding.EncodeToString([]byte(jwtHeader)) + "." + jwtEncoding.EncodeToString(payload)
+	return unsigned + "." + jwtEncoding.EncodeToString(hmacSHA256(secret, unsigned)), nil
+}
+
+// ParseJWT 校验签名并且解析，不检查过期时间
+func ParseJWT(secret []byte, token string) (Claims, error) {
+	segs := strings.Split(token, ".")
+	if len(segs) != 3 {
+		return Claims{}, ErrInvalidToken
+	}
+	header, err := jwtEncoding.DecodeString(segs[0])
+	if err != nil {
+		return Claims{}, ErrInvalidToken
+	}
+	var h struct {
+		Alg string `json:"alg"`
+	}
+	if err = json.Unmarshal(header, &h); err != nil || h.Alg != "HS256" {
+		return Claims{}, ErrInvalidToken
+	}
+	sig, err := jwtEncoding.DecodeString(segs[2])
+	if err != nil || !hmac.Equal(sig, hmacSHA256(secret, segs[0]+"."+segs[1])) {
+		return Claims{}, ErrInvalidToken
+	}
+	payload, err := jwtEncoding.DecodeString(segs[1])
+	if err != nil {
+		return Claims{}, ErrInvalidToken
+	}
+	var claims Claims
+	if err = json.Unmarshal(payload, &claims); err != nil {
+		return Claims{}, ErrInvalidToken
+	}
+	return claims, nil
+}
+
+func hmacSHA256(secret []byte, data string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+type JWTOption func(o *jwtOptions)
+
+type jwtOptions struct {
+	issuer   string
+	audience string
+	// 服务端：允许的时钟误差
+	leeway time.Duration
+	// 客户端：token 的有效期
+	ttl   time.Duration
+	roles []string
+}
+
+// JWTWithIssuer 客户端签发的时候带上 issuer，服务端要求 issuer 一致
+func JWTWithIssuer(issuer string) JWTOption {
+	return func(o *jwtOptions) {
+		o.issuer = issuer
+	}
+}
+
+// JWTWithAudience 客户端签发的时候带上 audience，服务端要求 audience 一致，一般是被调用的服务名
+func JWTWithAudience(audience string) JWTOption {
+	return func(o *jwtOptions) {
+		o.audience = audience
+	}
+}
+
+// JWTWithLeeway 服务端校验时间的时候允许的误差，默认 30s
+func JWTWithLeeway(leeway time.Duration) JWTOption {
+	return func(o *jwtOptions) {
+		o.leeway = leeway
+	}
+}
+
+// JWTWithTTL 客户端签发的 token 的有效期，默认 5 分钟
+func JWTWithTTL(ttl time.Duration) JWTOption {
+	return func(o *jwtOptions) {
+		o.ttl = ttl
+	}
+}
+
+// JWTWithRoles 客户端签发的 token 里面带上的角色
+func JWTWithRoles(roles ...string) JWTOption {
+	return func(o *jwtOptions) {
+		o.roles = roles
+	}
+}
+
+func newJWTOptions(opts []JWTOption) jwtOptions {
+	res := jwtOptions{
+		leeway: time.Second * 30,
+		ttl:    time.Minute * 5,
+	}
+	for _, opt := range opts {
+		opt(&res)
+	}
+	return res
+}
+
+// JWTAuthenticator 校验 HS256 签名的 JWT
+type JWTAuthenticator struct {
+	secret []byte
+	opts   jwtOptions
+}
+
+func NewJWTAuthenticator(secret []byte, opts ...JWTOption) *JWTAuthenticator {
+	return &JWTAuthenticator{
+		secret: secret,
+		opts:   newJWTOptions(opts),
+	}
+}
+
+func (a *JWTAuthenticator) Authenticate(ctx context.Context, token string) (Principal, error) {
+	claims, err := ParseJWT(a.secret, token)
+	if err != nil {
+		return Principal{}, err
+	}
+	now := time.Now()
+	if claims.ExpiresAt == 0 || now.Add(-a.opts.leeway).After(time.Unix(claims.ExpiresAt, 0)) ||
+		now.Add(a.opts.leeway).Before(time.Unix(claims.NotBefore, 0)) {
+		return Principal{}, ErrTokenExpired
+	}
+	if a.opts.issuer != "" && claims.Issuer != a.opts.issuer {
+		return Principal{}, fmt.Errorf("%w, issuer: %s", ErrInvalidToken, claims.Issuer)
+	}
+	if a.opts.audience != "" && claims.Audience != a.opts.audience {
+		return Principal{}, fmt.Errorf("%w, audience: %s", ErrInvalidToken, claims.Audience)
+	}
+	if claims.Subject == "" {
+		return Principal{}, ErrInvalidToken
+	}
+	return Principal{Subject: claims.Subject, Roles: claims.Roles}, nil
+}
+
+// JWTSigner 客户端用 secret 给自己签发 JWT，快过期的时候重新签发，例如
+//
+//	NewTokenCredentials(NewJWTSigner(secret, "order-service", JWTWithRoles("admin")).Token)
+type JWTSigner struct {
+	secret  []byte
+	subject string
+	opts    jwtOptions
+
+	mutex     sync.Mutex
+	cached    string
+	refreshAt time.Time
+}
+
+func NewJWTSigner(secret []byte, subject string, opts ...JWTOption) *JWTSigner {
+	return &JWTSigner{
+		secret:  secret,
+		subject: subject,
+		opts:    newJWTOptions(opts),
+	}
+}
+
+func (s *JWTSigner) Token() (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now()
+	if s.cached != "" && now.Before(s.refreshAt) {
+		return s.cached, nil
+	}
+	token, err := SignJWT(s.secret, Claims{
+		Subject:   s.subject,
+		Roles:     s.opts.roles,
+		Issuer:    s.opts.issuer,
+		Audience:  s.opts.audience,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(s.opts.ttl).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	// 过了有效期的一半就重新签发
+	s.cached, s.refreshAt = token, now.Add(s.opts.ttl/2)
+	return token, nil
+}
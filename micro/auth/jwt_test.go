@@ -0,0 +1,129 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newSecret(t *testing.T) []byte {
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	require.NoError(t, err)
+	return secret
+}
+
+func TestJWTAuthenticator_Authenticate(t *testing.T) {
+	secret := newSecret(t)
+	now := time.Now()
+	sign := func(claims Claims) string {
+		token, err := SignJWT(secret, claims)
+		require.NoError(t, err)
+		return token
+	}
+	valid := Claims{Subject: "order-service", Roles: []string{"admin"}, Issuer: "micro",
+		Audience: "user-service", ExpiresAt: now.Add(time.Minute).Unix()}
+	testCases := []struct {
+		name  string
+		token string
+
+		wantPrincipal Principal
+		wantErr       error
+	}{
+		{
+			name:          "valid",
+			token:         sign(valid),
+			wantPrincipal: Principal{Subject: "order-service", Roles: []string{"admin"}},
+		},
+		{
+			name: "expired",
+			token: sign(Claims{Subject: "order-service", Issuer: "micro", Audience: "user-service",
+				ExpiresAt: now.Add(-time.Minute).Unix()}),
+			wantErr: ErrTokenExpired,
+		},
+		{
+			name: "within leeway",
+			token: sign(Claims{Subject: "order-service", Issuer: "micro", Audience: "user-service",
+				ExpiresAt: now.Add(-time.Second * 10).Unix()}),
+			wantPrincipal: Principal{Subject: "order-service"},
+		},
+		{
+			name: "not before",
+			token: sign(Claims{Subject: "order-service", Issuer: "micro", Audience: "user-service",
+				NotBefore: now.Add(time.Minute).Unix(), ExpiresAt: now.Add(time.Hour).Unix()}),
+			wantErr: ErrTokenExpired,
+		},
+		{
+			name:    "no expiration",
+			token:   sign(Claims{Subject: "order-service", Issuer: "micro", Audience: "user-service"}),
+			wantErr: ErrTokenExpired,
+		},
+		{
+			name: "wrong audience",
+			token: sign(Claims{Subject: "order-service", Issuer: "micro", Audience: "pay-service",
+				ExpiresAt: now.Add(time.Minute).Unix()}),
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name: "wrong secret",
+			token: func() string {
+				token, err := SignJWT(newSecret(t), valid)
+				require.NoError(t, err)
+				return token
+			}(),
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name: "alg none",
+			token: func() string {
+				segs := strings.Split(sign(valid), ".")
+				header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`))
+				return header + "." + segs[1] + "."
+			}(),
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name:    "malformed",
+			token:   "abc",
+			wantErr: ErrInvalidToken,
+		},
+	}
+	a := NewJWTAuthenticator(secret, JWTWithIssuer("micro"), JWTWithAudience("user-service"))
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := a.Authenticate(context.Background(), tc.token)
+			assert.True(t, errors.Is(err, tc.wantErr), "err: %v", err)
+			if err != nil {
+				return
+			}
+			assert.Equal(t, tc.wantPrincipal, p)
+		})
+	}
+}
+
+func TestJWTSigner_Token(t *testing.T) {
+	secret := newSecret(t)
+	s := NewJWTSigner(secret, "order-service", JWTWithRoles("admin"), JWTWithTTL(time.Second*2))
+	token, err := s.Token()
+	require.NoError(t, err)
+	claims, err := ParseJWT(secret, token)
+	require.NoError(t, err)
+	assert.Equal(t, "order-service", claims.Subject)
+	assert.Equal(t, []string{"admin"}, claims.Roles)
+	assert.Equal(t, claims.IssuedAt+2, claims.ExpiresAt)
+
+	// 有效期过半之前复用，之后重新签发
+	again, err := s.Token()
+	require.NoError(t, err)
+	assert.Equal(t, token, again)
+	time.Sleep(time.Second + time.Millisecond*100)
+	again, err = s.Token()
+	require.NoError(t, err)
+	assert.NotEqual(t, token, again)
+}
@@ -0,0 +1,34 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+)
+
+// StaticTokenAuthenticator 固定的 token，key 是 token
+// 适合内部服务之间简单的认证，token 泄露之后只能全部重新下发
+type StaticTokenAuthenticator map[string]Principal
+
+func (s StaticTokenAuthenticator) Authenticate(ctx context.Context, token string) (Principal, error) {
+	// 逐个比较，避免通过耗时猜出 token
+	var (
+		res   Principal
+		found bool
+	)
+	for t, p := range s {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			res, found = p, true
+		}
+	}
+	if !found {
+		return Principal{}, ErrInvalidToken
+	}
+	return res, nil
+}
+
+// NewStaticTokenCredentials 每个请求都带上固定的 token
+func NewStaticTokenCredentials(token string, opts ...CredentialsOption) *Credentials {
+	return NewTokenCredentials(func() (string, error) {
+		return token, nil
+	}, opts...)
+}
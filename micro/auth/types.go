@@ -0,0 +1,55 @@
+package auth
+
+import (
+	"context"
+	"errors"
+)
+
+var (
+	// ErrInvalidToken token 格式不对、签名不对，或者不认识
+	ErrInvalidToken = errors.New("auth: 非法的 token")
+	// ErrTokenExpired token 已经过期或者还没生效
+	ErrTokenExpired = errors.New("auth: token 已经过期")
+)
+
+// Principal 调用方的身份
+type Principal struct {
+	// 调用方的标识，一般是服务名
+	Subject string
+	Roles   []string
+}
+
+// HasRole 有没有 role 这个角色
+func (p Principal) HasRole(role string) bool {
+	for _, r := range p.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticator 校验调用方带过来的 token
+type Authenticator interface {
+	Authenticate(ctx context.Context, token string) (Principal, error)
+}
+
+type principalKey struct{}
+
+// WithPrincipal 一般由服务端拦截器调用
+func WithPrincipal(ctx context.Context, p Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// PrincipalFromContext 服务端拿到调用方的身份，经过认证的请求一定有
+func PrincipalFromContext(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(Principal)
+	return p, ok
+}
+
+// Subject 调用方的标识，没有经过认证的时候是空字符串
+// 例如按照调用方限流 ratelimit.KeyByMethodAndCaller("micro", auth.Subject)
+func Subject(ctx context.Context) string {
+	p, _ := PrincipalFromContext(ctx)
+	return p.Subject
+}
@@ -0,0 +1,29 @@
+package micro
+
+import (
+	"math/rand"
+	"time"
+)
+
+// 指数退避，每次失败之后等待的时间翻倍，直到 max
+type backoff struct {
+	base    time.Duration
+	max     time.Duration
+	attempt int
+}
+
+func (b *backoff) next() time.Duration {
+	d := b.max
+	if b.attempt < 32 {
+		if d2 := b.base << b.attempt; d2 > 0 && d2 < b.max {
+			d = d2
+		}
+	}
+	b.attempt++
+	// 加上最多 20% 的随机抖动，避免所有客户端同时重试
+	return d + time.Duration(rand.Int63n(int64(d)/5+1))
+}
+
+func (b *backoff) reset() {
+	b.attempt = 0
+}
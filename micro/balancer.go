@@ -0,0 +1,34 @@
+package micro
+
+import (
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/resolver"
+)
+
+// 可以通过 ClientWithBalancer 选择的负载均衡算法
+const (
+	BalancerRoundRobin         = "micro_round_robin"
+	BalancerWeightedRoundRobin = "micro_weighted_round_robin"
+	BalancerWeightedRandom     = "micro_weighted_random"
+	BalancerLeastActive        = "micro_least_active"
+)
+
+// 实例没有设置权重的时候用的权重
+const defaultWeight uint32 = 10
+
+func init() {
+	balancer.Register(base.NewBalancerBuilder(BalancerRoundRobin, &roundRobinPickerBuilder{}, base.Config{HealthCheck: true}))
+	balancer.Register(base.NewBalancerBuilder(BalancerWeightedRoundRobin, &weightedRoundRobinPickerBuilder{}, base.Config{HealthCheck: true}))
+	balancer.Register(base.NewBalancerBuilder(BalancerWeightedRandom, &weightedRandomPickerBuilder{}, base.Config{HealthCheck: true}))
+	balancer.Register(leastActiveBalancerBuilder{})
+}
+
+// 从注册中心的实例信息里面读权重
+func weightOf(addr resolver.Address) uint32 {
+	si, ok := InstanceFromAddress(addr)
+	if !ok || si.Weight == 0 {
+		return defaultWeight
+	}
+	return si.Weight
+}
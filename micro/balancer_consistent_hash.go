@@ -0,0 +1,179 @@
+package micro
+
+import (
+	"context"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/resolver"
+	"hash/crc32"
+	"math/rand"
+	"sort"
+	"strconv"
+)
+
+// BalancerConsistentHash 一致性哈希，同一个 hash key 的请求总是落到同一个实例上
+const BalancerConsistentHash = "micro_consistent_hash"
+
+// HashKeyMetadataKey 没有通过 WithHashKey 设置 hash key 的时候，从这个 metadata 里面读
+const HashKeyMetadataKey = "x-hash-key"
+
+// 每个实例在环上的虚拟节点数量，按照权重缩放
+const defaultVirtualNodes = 160
+
+func init() {
+	balancer.Register(base.NewBalancerBuilder(BalancerConsistentHash, &consistentHashPickerBuilder{}, base.Config{HealthCheck: true}))
+}
+
+type hashKey struct{}
+
+// WithHashKey 设置一致性哈希用的 key，例如用户 ID
+func WithHashKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, hashKey{}, key)
+}
+
+// 先读 WithHashKey 设置的，再读 metadata
+func hashKeyFromContext(ctx context.Context) (string, bool) {
+	if key, ok := ctx.Value(hashKey{}).(string); ok && key != "" {
+		return key, true
+	}
+	md, ok := metadata.FromOutgoingContext(ctx)
+	if !ok {
+		return "", false
+	}
+	vals := md.Get(HashKeyMetadataKey)
+	if len(vals) == 0 || vals[0] == "" {
+		return "", false
+	}
+	return vals[0], true
+}
+
+// 哈希环
+// 虚拟节点的位置只和实例的地址有关，所以实例变化的时候只有相邻的 key 会迁移
+type hashRing[T any] struct {
+	hashes []uint32
+	nodes  map[uint32]T
+}
+
+type ringNode[T any] struct {
+	name   string
+	weight uint32
+	val    T
+}
+
+func newHashRing[T any](nodes []ringNode[T]) *hashRing[T] {
+	r := &hashRing[T]{
+		nodes: make(map[uint32]T, len(nodes)*defaultVirtualNodes),
+	}
+	for _, n := range nodes {
+		cnt := int(defaultVirtualNodes * uint64(n.weight) / uint64(defaultWeight))
+		if cnt <= 0 {
+			cnt = 1
+		}
+		for i := 0; i < cnt; i++ {
+			h := crc32.ChecksumIEEE([]byte(n.name + "#" + strconv.Itoa(i)))
+			if _, ok := r.nodes[h]; ok {
+				// 哈希冲突了，保留先放进去的
+				continue
+			}
+			r.nodes[h] = n.val
+			r.hashes = append(r.hashes, h)
+		}
+	}
+	sort.Slice(r.hashes, func(i, j int) bool {
+		return r.hashes[i] < r.hashes[j]
+	})
+	return r
+}
+
+// 顺时针找第一个虚拟节点
+func (r *hashRing[T]) get(key string) T {
+	res, _ := r.getFunc(key, func(T) bool {
+		return true
+	})
+	return res
+}
+
+// 顺时针找第一个 accept 返回 true 的虚拟节点，路由之后只能在部分节点里面选
+func (r *hashRing[T]) getFunc(key string, accept func(T) bool) (T, bool) {
+	h := crc32.ChecksumIEEE([]byte(key))
+	idx := sort.Search(len(r.hashes), func(i int) bool {
+		return r.hashes[i] >= h
+	})
+	for i := 0; i < len(r.hashes); i++ {
+		val := r.nodes[r.hashes[(idx+i)%len(r.hashes)]]
+		if accept(val) {
+			return val, true
+		}
+	}
+	var t T
+	return t, false
+}
+
+type consistentHashPickerBuilder struct {
+}
+
+func (b *consistentHashPickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+	if len(info.ReadySCs) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+	// 环上放的是 conns 的下标
+	nodes := make([]ringNode[int], 0, len(info.ReadySCs))
+	conns := make([]balancer.SubConn, 0, len(info.ReadySCs))
+	addrs := make([]resolver.Address, 0, len(info.ReadySCs))
+	for sc, sci := range info.ReadySCs {
+		nodes = append(nodes, ringNode[int]{
+			name:   sci.Address.Addr,
+			weight: weightOf(sci.Address),
+			val:    len(conns),
+		})
+		conns = append(conns, sc)
+		addrs = append(addrs, sci.Address)
+	}
+	return &consistentHashPicker{
+		routable: newRoutable(addrs),
+		ring:     newHashRing(nodes),
+		conns:    conns,
+	}
+}
+
+type consistentHashPicker struct {
+	routable
+	ring  *hashRing[int]
+	conns []balancer.SubConn
+}
+
+func (p *consistentHashPicker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	candidates, err := p.route(info.Ctx)
+	if err != nil {
+		return balancer.PickResult{}, err
+	}
+	key, ok := hashKeyFromContext(info.Ctx)
+	if !ok {
+		// 没有 hash key 的请求不需要粘性，随便选一个
+		idx := rand.Intn(len(p.conns))
+		if candidates != nil {
+			idx = candidates[rand.Intn(len(candidates))]
+		}
+		return p.picked(info.Ctx, idx, balancer.PickResult{
+			SubConn: p.conns[idx],
+		})
+	}
+	if candidates == nil {
+		idx := p.ring.get(key)
+		return p.picked(info.Ctx, idx, balancer.PickResult{
+			SubConn: p.conns[idx],
+		})
+	}
+	accepted := make(map[int]struct{}, len(candidates))
+	for _, idx := range candidates {
+		accepted[idx] = struct{}{}
+	}
+	idx, _ := p.ring.getFunc(key, func(i int) bool {
+		_, ok := accepted[i]
+		return ok
+	})
+	return p.picked(info.Ctx, idx, balancer.PickResult{
+		SubConn: p.conns[idx],
+	})
+}
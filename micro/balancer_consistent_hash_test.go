@@ -0,0 +1,162 @@
+package micro
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/metadata"
+	"testing"
+)
+
+func TestHashKeyFromContext(t *testing.T) {
+	testCases := []struct {
+		name    string
+		ctx     context.Context
+		wantKey string
+		wantOk  bool
+	}{
+		{
+			name: "no key",
+			ctx:  context.Background(),
+		},
+		{
+			name:    "context value",
+			ctx:     WithHashKey(context.Background(), "user-1"),
+			wantKey: "user-1",
+			wantOk:  true,
+		},
+		{
+			name:    "metadata",
+			ctx:     metadata.AppendToOutgoingContext(context.Background(), HashKeyMetadataKey, "user-2"),
+			wantKey: "user-2",
+			wantOk:  true,
+		},
+		{
+			name: "context value first",
+			ctx: WithHashKey(metadata.AppendToOutgoingContext(context.Background(),
+				HashKeyMetadataKey, "user-2"), "user-1"),
+			wantKey: "user-1",
+			wantOk:  true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			key, ok := hashKeyFromContext(tc.ctx)
+			assert.Equal(t, tc.wantOk, ok)
+			assert.Equal(t, tc.wantKey, key)
+		})
+	}
+}
+
+func TestConsistentHashPicker_Pick(t *testing.T) {
+	weights := map[string]uint32{}
+	for i := 0; i < 5; i++ {
+		weights[fmt.Sprintf("127.0.0.1:%d", 8080+i)] = 0
+	}
+	p := (&consistentHashPickerBuilder{}).Build(newPickerBuildInfo(weights))
+	for i := 0; i < 100; i++ {
+		ctx := WithHashKey(context.Background(), fmt.Sprintf("user-%d", i))
+		first, err := p.Pick(balancer.PickInfo{Ctx: ctx})
+		require.NoError(t, err)
+		// 同一个 key 每次都选中同一个实例
+		for j := 0; j < 3; j++ {
+			pr, err := p.Pick(balancer.PickInfo{Ctx: ctx})
+			require.NoError(t, err)
+			assert.Equal(t, first.SubConn, pr.SubConn)
+		}
+	}
+
+	// 重新构建 picker 之后 key 也不会迁移
+	p2 := (&consistentHashPickerBuilder{}).Build(newPickerBuildInfo(weights))
+	for i := 0; i < 100; i++ {
+		ctx := WithHashKey(context.Background(), fmt.Sprintf("user-%d", i))
+		pr1, err := p.Pick(balancer.PickInfo{Ctx: ctx})
+		require.NoError(t, err)
+		pr2, err := p2.Pick(balancer.PickInfo{Ctx: ctx})
+		require.NoError(t, err)
+		assert.Equal(t, pr1.SubConn.(*fakeSubConn).addr, pr2.SubConn.(*fakeSubConn).addr)
+	}
+
+	// 没有 hash key 也能选出来
+	_, err := p.Pick(balancer.PickInfo{Ctx: context.Background()})
+	require.NoError(t, err)
+
+	_, err = (&consistentHashPickerBuilder{}).Build(base.PickerBuildInfo{}).Pick(balancer.PickInfo{})
+	assert.Equal(t, balancer.ErrNoSubConnAvailable, err)
+}
+
+func TestHashRing_KeyMovement(t *testing.T) {
+	newRing := func(n int) *hashRing[string] {
+		nodes := make([]ringNode[string], 0, n)
+		for i := 0; i < n; i++ {
+			addr := fmt.Sprintf("10.0.0.%d:8080", i+1)
+			nodes = append(nodes, ringNode[string]{name: addr, weight: defaultWeight, val: addr})
+		}
+		return newHashRing(nodes)
+	}
+	// 统计 from 变成 to 之后迁移的 key 的比例
+	moved := func(from, to *hashRing[string]) float64 {
+		const total = 100000
+		cnt := 0
+		for i := 0; i < total; i++ {
+			key := fmt.Sprintf("user-%d", i)
+			if from.get(key) != to.get(key) {
+				cnt++
+			}
+		}
+		return float64(cnt) / total
+	}
+
+	testCases := []struct {
+		name string
+		from int
+		to   int
+		// 理想情况下迁移的比例
+		want float64
+	}{
+		{name: "add node", from: 10, to: 11, want: 1.0 / 11},
+		{name: "remove node", from: 10, to: 9, want: 1.0 / 10},
+		{name: "add many nodes", from: 5, to: 10, want: 5.0 / 10},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res := moved(newRing(tc.from), newRing(tc.to))
+			t.Logf("moved %.4f, ideal %.4f", res, tc.want)
+			assert.InDelta(t, tc.want, res, tc.want*0.3)
+		})
+	}
+}
+
+func TestHashRing_Weight(t *testing.T) {
+	r := newHashRing([]ringNode[string]{
+		{name: "127.0.0.1:8081", weight: 10, val: "a"},
+		{name: "127.0.0.1:8082", weight: 30, val: "b"},
+	})
+	const total = 100000
+	cnt := map[string]int{}
+	for i := 0; i < total; i++ {
+		cnt[r.get(fmt.Sprintf("user-%d", i))]++
+	}
+	assert.InDelta(t, 0.25, float64(cnt["a"])/total, 0.05)
+	assert.InDelta(t, 0.75, float64(cnt["b"])/total, 0.05)
+}
+
+func TestHashRing_OnlyMoveToNewNode(t *testing.T) {
+	nodes := make([]ringNode[string], 0, 11)
+	for i := 0; i < 11; i++ {
+		addr := fmt.Sprintf("10.0.0.%d:8080", i+1)
+		nodes = append(nodes, ringNode[string]{name: addr, weight: defaultWeight, val: addr})
+	}
+	before, after := newHashRing(nodes[:10]), newHashRing(nodes)
+	newAddr := nodes[10].val
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("user-%d", i)
+		if b, a := before.get(key), after.get(key); b != a {
+			// 加节点的时候，迁移的 key 只会迁移到新节点上
+			assert.Equal(t, newAddr, a)
+		}
+	}
+}
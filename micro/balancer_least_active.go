@@ -0,0 +1,135 @@
+package micro
+
+import (
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/resolver"
+	"math"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+)
+
+// 每个 ClientConn 用自己的 leastActivePickerBuilder，活跃请求数保存在 builder 里面
+type leastActiveBalancerBuilder struct{}
+
+func (leastActiveBalancerBuilder) Name() string {
+	return BalancerLeastActive
+}
+
+func (leastActiveBalancerBuilder) Build(cc balancer.ClientConn, opts balancer.BuildOptions) balancer.Balancer {
+	return base.NewBalancerBuilder(BalancerLeastActive, &leastActivePickerBuilder{},
+		base.Config{HealthCheck: true}).Build(cc, opts)
+}
+
+// 最少活跃请求，选正在处理的请求最少的节点
+// 活跃请求数一样的时候按照权重随机，处理得快的节点会分到更多的请求
+// SubConn 状态变化或者地址更新的时候 picker 都会重建，还没结束的请求不能丢，所以计数按照 SubConn 保存在这里
+type leastActivePickerBuilder struct {
+	mutex   sync.Mutex
+	actives map[balancer.SubConn]*atomic.Int64
+}
+
+func (b *leastActivePickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.actives == nil {
+		b.actives = make(map[balancer.SubConn]*atomic.Int64)
+	}
+	// 不可用的 SubConn 上面的请求都结束了才删掉，不然重新可用的时候计数就不对了
+	for sc, active := range b.actives {
+		if _, ok := info.ReadySCs[sc]; !ok && active.Load() == 0 {
+			delete(b.actives, sc)
+		}
+	}
+	if len(info.ReadySCs) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+	conns := make([]*activeConn, 0, len(info.ReadySCs))
+	addrs := make([]resolver.Address, 0, len(info.ReadySCs))
+	for sc, sci := range info.ReadySCs {
+		active, ok := b.actives[sc]
+		if !ok {
+			active = &atomic.Int64{}
+			b.actives[sc] = active
+		}
+		conns = append(conns, &activeConn{
+			c:      sc,
+			weight: int64(weightOf(sci.Address)),
+			active: active,
+		})
+		addrs = append(addrs, sci.Address)
+	}
+	return &leastActivePicker{
+		routable: newRoutable(addrs),
+		conns:    conns,
+	}
+}
+
+type leastActivePicker struct {
+	routable
+	conns []*activeConn
+}
+
+type activeConn struct {
+	c      balancer.SubConn
+	weight int64
+	active *atomic.Int64
+}
+
+func (p *leastActivePicker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	routed, err := p.route(info.Ctx)
+	if err != nil {
+		return balancer.PickResult{}, err
+	}
+	var (
+		least      int64 = math.MaxInt64
+		candidates []int
+		total      int64
+	)
+	visit := func(idx int) {
+		c := p.conns[idx]
+		active := c.active.Load()
+		if active < least {
+			least = active
+			candidates = candidates[:0]
+			total = 0
+		}
+		if active == least {
+			candidates = append(candidates, idx)
+			total += c.weight
+		}
+	}
+	if routed == nil {
+		for idx := range p.conns {
+			visit(idx)
+		}
+	} else {
+		for _, idx := range routed {
+			visit(idx)
+		}
+	}
+	res := candidates[0]
+	if len(candidates) > 1 {
+		target := rand.Int63n(total)
+		for _, idx := range candidates {
+			target -= p.conns[idx].weight
+			if target < 0 {
+				res = idx
+				break
+			}
+		}
+	}
+	c := p.conns[res]
+	pr, err := p.picked(info.Ctx, res, balancer.PickResult{
+		SubConn: c.c,
+		Done: func(info balancer.DoneInfo) {
+			c.active.Add(-1)
+		},
+	})
+	if err != nil {
+		return pr, err
+	}
+	c.active.Add(1)
+	return pr, nil
+}
@@ -0,0 +1,52 @@
+package micro
+
+import (
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/resolver"
+	"sync/atomic"
+)
+
+// 轮询，不考虑权重
+type roundRobinPickerBuilder struct {
+}
+
+func (b *roundRobinPickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+	if len(info.ReadySCs) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+	conns := make([]balancer.SubConn, 0, len(info.ReadySCs))
+	addrs := make([]resolver.Address, 0, len(info.ReadySCs))
+	for sc, sci := range info.ReadySCs {
+		conns = append(conns, sc)
+		addrs = append(addrs, sci.Address)
+	}
+	return &roundRobinPicker{
+		routable: newRoutable(addrs),
+		conns:    conns,
+	}
+}
+
+type roundRobinPicker struct {
+	routable
+	conns []balancer.SubConn
+	index uint64
+}
+
+func (p *roundRobinPicker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	candidates, err := p.route(info.Ctx)
+	if err != nil {
+		return balancer.PickResult{}, err
+	}
+	idx := atomic.AddUint64(&p.index, 1)
+	if candidates == nil {
+		i := int(idx % uint64(len(p.conns)))
+		return p.picked(info.Ctx, i, balancer.PickResult{
+			SubConn: p.conns[i],
+		})
+	}
+	i := candidates[idx%uint64(len(candidates))]
+	return p.picked(info.Ctx, i, balancer.PickResult{
+		SubConn: p.conns[i],
+	})
+}
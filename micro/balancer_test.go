@@ -0,0 +1,196 @@
+package micro
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zhuguangfeng/study/micro/registry"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"testing"
+)
+
+type fakeSubConn struct {
+	balancer.SubConn
+	addr string
+}
+
+// 按照 weights 构造 PickerBuildInfo，weight 为 0 表示用默认权重
+func newPickerBuildInfo(weights map[string]uint32) base.PickerBuildInfo {
+	info := base.PickerBuildInfo{
+		ReadySCs: make(map[balancer.SubConn]base.SubConnInfo, len(weights)),
+	}
+	for addr, weight := range weights {
+		info.ReadySCs[&fakeSubConn{addr: addr}] = base.SubConnInfo{
+			Address: newAddress(registry.ServiceInstance{
+				Name:    "user-service",
+				Address: addr,
+				Weight:  weight,
+			}),
+		}
+	}
+	return info
+}
+
+// 挑选 n 次，统计每个地址被选中的次数
+func pickN(t *testing.T, p balancer.Picker, n int) map[string]int {
+	res := make(map[string]int)
+	for i := 0; i < n; i++ {
+		pr, err := p.Pick(balancer.PickInfo{})
+		require.NoError(t, err)
+		res[pr.SubConn.(*fakeSubConn).addr]++
+		if pr.Done != nil {
+			pr.Done(balancer.DoneInfo{})
+		}
+	}
+	return res
+}
+
+func TestPickerBuilder_NoSubConn(t *testing.T) {
+	builders := []base.PickerBuilder{
+		&roundRobinPickerBuilder{},
+		&weightedRoundRobinPickerBuilder{},
+		&weightedRandomPickerBuilder{},
+		&leastActivePickerBuilder{},
+	}
+	for _, b := range builders {
+		p := b.Build(base.PickerBuildInfo{})
+		_, err := p.Pick(balancer.PickInfo{})
+		assert.Equal(t, balancer.ErrNoSubConnAvailable, err)
+	}
+}
+
+func TestRoundRobinPicker_Pick(t *testing.T) {
+	p := (&roundRobinPickerBuilder{}).Build(newPickerBuildInfo(map[string]uint32{
+		"127.0.0.1:8081": 1,
+		"127.0.0.1:8082": 100,
+		"127.0.0.1:8083": 0,
+	}))
+	assert.Equal(t, map[string]int{
+		"127.0.0.1:8081": 100,
+		"127.0.0.1:8082": 100,
+		"127.0.0.1:8083": 100,
+	}, pickN(t, p, 300))
+}
+
+func TestWeightedRoundRobinPicker_Pick(t *testing.T) {
+	p := (&weightedRoundRobinPickerBuilder{}).Build(newPickerBuildInfo(map[string]uint32{
+		"127.0.0.1:8081": 1,
+		"127.0.0.1:8082": 2,
+		"127.0.0.1:8083": 0,
+	}))
+	// 总权重 13，一轮刚好按照权重分配
+	assert.Equal(t, map[string]int{
+		"127.0.0.1:8081": 10,
+		"127.0.0.1:8082": 20,
+		"127.0.0.1:8083": 100,
+	}, pickN(t, p, 130))
+}
+
+func TestWeightedRoundRobinPicker_Smooth(t *testing.T) {
+	p := (&weightedRoundRobinPickerBuilder{}).Build(newPickerBuildInfo(map[string]uint32{
+		"127.0.0.1:8081": 5,
+		"127.0.0.1:8082": 1,
+		"127.0.0.1:8083": 1,
+	}))
+	// 权重 5:1:1 的时候，一轮里面权重最大的节点最多连续被选中 2 次，而不是一口气选 5 次
+	var last string
+	cnt := 0
+	for i := 0; i < 7; i++ {
+		pr, err := p.Pick(balancer.PickInfo{})
+		require.NoError(t, err)
+		addr := pr.SubConn.(*fakeSubConn).addr
+		if addr == last {
+			cnt++
+		} else {
+			last, cnt = addr, 1
+		}
+		assert.LessOrEqual(t, cnt, 2)
+	}
+}
+
+func TestWeightedRandomPicker_Pick(t *testing.T) {
+	p := (&weightedRandomPickerBuilder{}).Build(newPickerBuildInfo(map[string]uint32{
+		"127.0.0.1:8081": 10,
+		"127.0.0.1:8082": 30,
+		"127.0.0.1:8083": 60,
+	}))
+	n := 100000
+	res := pickN(t, p, n)
+	assert.InDelta(t, 0.1, float64(res["127.0.0.1:8081"])/float64(n), 0.02)
+	assert.InDelta(t, 0.3, float64(res["127.0.0.1:8082"])/float64(n), 0.02)
+	assert.InDelta(t, 0.6, float64(res["127.0.0.1:8083"])/float64(n), 0.02)
+}
+
+func TestLeastActivePicker_Pick(t *testing.T) {
+	p := (&leastActivePickerBuilder{}).Build(newPickerBuildInfo(map[string]uint32{
+		"127.0.0.1:8081": 1,
+		"127.0.0.1:8082": 1,
+		"127.0.0.1:8083": 1,
+	}))
+	// 请求都没有结束，所以每个节点轮流被选中
+	var dones []func(balancer.DoneInfo)
+	picked := make(map[string]int)
+	for i := 0; i < 3; i++ {
+		pr, err := p.Pick(balancer.PickInfo{})
+		require.NoError(t, err)
+		picked[pr.SubConn.(*fakeSubConn).addr]++
+		dones = append(dones, pr.Done)
+	}
+	assert.Len(t, picked, 3)
+
+	// 第一个请求结束了，下一个请求一定会落到它上面
+	dones[0](balancer.DoneInfo{})
+	lp := p.(*leastActivePicker)
+	var freed string
+	for _, c := range lp.conns {
+		if c.active.Load() == 0 {
+			freed = c.c.(*fakeSubConn).addr
+		}
+	}
+	pr, err := p.Pick(balancer.PickInfo{})
+	require.NoError(t, err)
+	assert.Equal(t, freed, pr.SubConn.(*fakeSubConn).addr)
+	for _, c := range lp.conns {
+		assert.Equal(t, int64(1), c.active.Load())
+	}
+}
+
+func TestLeastActivePickerBuilder_Rebuild(t *testing.T) {
+	b := &leastActivePickerBuilder{}
+	info := newPickerBuildInfo(map[string]uint32{
+		"127.0.0.1:8081": 1,
+		"127.0.0.1:8082": 1,
+	})
+	var busy balancer.SubConn
+	for sc, sci := range info.ReadySCs {
+		if sci.Address.Addr == "127.0.0.1:8081" {
+			busy = sc
+		}
+	}
+	p := b.Build(info)
+	var dones []func(balancer.DoneInfo)
+	for i := 0; i < 10; i++ {
+		pr, err := p.Pick(balancer.PickInfo{})
+		require.NoError(t, err)
+		if pr.SubConn == busy {
+			dones = append(dones, pr.Done)
+		} else {
+			pr.Done(balancer.DoneInfo{})
+		}
+	}
+	require.NotEmpty(t, dones)
+
+	// picker 重建之后，还没结束的请求依旧算在 8081 上面
+	p = b.Build(info)
+	assert.Equal(t, map[string]int{"127.0.0.1:8082": 10}, pickN(t, p, 10))
+
+	// 8081 不可用了，上面的请求结束之后才删掉计数
+	delete(info.ReadySCs, busy)
+	b.Build(info)
+	assert.Len(t, b.actives, 2)
+	for _, done := range dones {
+		done(balancer.DoneInfo{})
+	}
+	b.Build(info)
+	assert.Len(t, b.actives, 1)
+}
@@ -0,0 +1,150 @@
+package micro
+
+import (
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/resolver"
+	"math/rand"
+	"sort"
+	"sync"
+)
+
+// 平滑的加权轮询，和 nginx 的算法一样
+// 每次挑选的时候所有节点的 currentWeight 加上自己的权重，选 currentWeight 最大的
+// 然后被选中的节点减去总权重，这样权重大的节点不会被连续选中
+type weightedRoundRobinPickerBuilder struct {
+}
+
+func (b *weightedRoundRobinPickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+	if len(info.ReadySCs) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+	conns := make([]*weightedConn, 0, len(info.ReadySCs))
+	addrs := make([]resolver.Address, 0, len(info.ReadySCs))
+	for sc, sci := range info.ReadySCs {
+		conns = append(conns, &weightedConn{
+			c:      sc,
+			weight: int64(weightOf(sci.Address)),
+		})
+		addrs = append(addrs, sci.Address)
+	}
+	return &weightedRoundRobinPicker{
+		routable: newRoutable(addrs),
+		conns:    conns,
+	}
+}
+
+type weightedRoundRobinPicker struct {
+	routable
+	conns []*weightedConn
+	mutex sync.Mutex
+}
+
+type weightedConn struct {
+	c             balancer.SubConn
+	weight        int64
+	currentWeight int64
+}
+
+func (p *weightedRoundRobinPicker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	candidates, err := p.route(info.Ctx)
+	if err != nil {
+		return balancer.PickResult{}, err
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	var (
+		total int64
+		res   = -1
+	)
+	// 路由之后只在候选的节点里面轮询
+	visit := func(idx int) {
+		c := p.conns[idx]
+		total += c.weight
+		c.currentWeight += c.weight
+		if res < 0 || c.currentWeight > p.conns[res].currentWeight {
+			res = idx
+		}
+	}
+	if candidates == nil {
+		for idx := range p.conns {
+			visit(idx)
+		}
+	} else {
+		for _, idx := range candidates {
+			visit(idx)
+		}
+	}
+	p.conns[res].currentWeight -= total
+	return p.picked(info.Ctx, res, balancer.PickResult{
+		SubConn: p.conns[res].c,
+	})
+}
+
+// 加权随机，权重越大被选中的概率越大
+type weightedRandomPickerBuilder struct {
+}
+
+func (b *weightedRandomPickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+	if len(info.ReadySCs) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+	p := &weightedRandomPicker{
+		conns:   make([]balancer.SubConn, 0, len(info.ReadySCs)),
+		weights: make([]int64, 0, len(info.ReadySCs)),
+		offsets: make([]int64, 0, len(info.ReadySCs)),
+	}
+	addrs := make([]resolver.Address, 0, len(info.ReadySCs))
+	for sc, sci := range info.ReadySCs {
+		weight := int64(weightOf(sci.Address))
+		p.total += weight
+		p.conns = append(p.conns, sc)
+		p.weights = append(p.weights, weight)
+		p.offsets = append(p.offsets, p.total)
+		addrs = append(addrs, sci.Address)
+	}
+	p.routable = newRoutable(addrs)
+	return p
+}
+
+type weightedRandomPicker struct {
+	routable
+	conns   []balancer.SubConn
+	weights []int64
+	// 权重的前缀和
+	offsets []int64
+	total   int64
+}
+
+func (p *weightedRandomPicker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	candidates, err := p.route(info.Ctx)
+	if err != nil {
+		return balancer.PickResult{}, err
+	}
+	if candidates == nil {
+		target := rand.Int63n(p.total)
+		idx := sort.Search(len(p.offsets), func(i int) bool {
+			return p.offsets[i] > target
+		})
+		return p.picked(info.Ctx, idx, balancer.PickResult{
+			SubConn: p.conns[idx],
+		})
+	}
+	// 路由之后候选的节点每次都不一样，直接遍历
+	var total int64
+	for _, idx := range candidates {
+		total += p.weights[idx]
+	}
+	target := rand.Int63n(total)
+	res := candidates[len(candidates)-1]
+	for _, idx := range candidates {
+		target -= p.weights[idx]
+		if target < 0 {
+			res = idx
+			break
+		}
+	}
+	return p.picked(info.Ctx, res, balancer.PickResult{
+		SubConn: p.conns[res],
+	})
+}
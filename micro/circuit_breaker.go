@@ -0,0 +1,270 @@
+package micro
+
+import (
+	"context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen 候选的实例全部都熔断了
+var ErrCircuitOpen = status.Error(codes.Unavailable, "micro: 实例全部熔断")
+
+// CircuitState 单个实例的熔断状态
+type CircuitState uint8
+
+const (
+	// CircuitClosed 正常放行，统计错误率
+	CircuitClosed CircuitState = iota
+	// CircuitOpen 错误率太高，不再往这个实例发请求
+	CircuitOpen
+	// CircuitHalfOpen 熔断一段时间之后，放少量请求过去探测
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+type CircuitBreakerOption func(cb *CircuitBreaker)
+
+// CircuitBreaker 按照实例熔断
+// 一个统计窗口里面请求数超过 minRequests 并且错误率超过 errorRate 就熔断，
+// 熔断 openTimeout 之后进入半开，放 halfOpenRequests 个请求探测，全部成功就恢复，有一个失败就继续熔断
+type CircuitBreaker struct {
+	window           time.Duration
+	minRequests      int64
+	errorRate        float64
+	openTimeout      time.Duration
+	halfOpenRequests int64
+	failureCodes     map[codes.Code]struct{}
+
+	mutex    sync.Mutex
+	circuits map[string]*circuit
+	// 上一次清理空闲实例的时间
+	sweptAt time.Time
+}
+
+type circuit struct {
+	state CircuitState
+	// 统计窗口的开始时间，熔断的时候是熔断的时间，半开的时候是进入半开的时间
+	start    time.Time
+	total    int64
+	failures int64
+	// 半开的时候已经放过去的探测请求
+	probes int64
+}
+
+func NewCircuitBreaker(opts ...CircuitBreakerOption) *CircuitBreaker {
+	res := &CircuitBreaker{
+		window:           time.Second * 10,
+		minRequests:      20,
+		errorRate:        0.5,
+		openTimeout:      time.Second * 5,
+		halfOpenRequests: 3,
+		circuits:         make(map[string]*circuit),
+	}
+	CircuitBreakerWithFailureCodes(codes.Unavailable, codes.DeadlineExceeded,
+		codes.Internal, codes.Unknown)(res)
+	for _, opt := range opts {
+		opt(res)
+	}
+	return res
+}
+
+// CircuitBreakerWithErrorRate 统计窗口里面至少有 minRequests 个请求，并且错误率达到 errorRate 就熔断
+// 默认是 10s 里面至少 20 个请求，错误率 50%
+func CircuitBreakerWithErrorRate(window time.Duration, minRequests int64, errorRate float64) CircuitBreakerOption {
+	return func(cb *CircuitBreaker) {
+		cb.window = window
+		cb.minRequests = minRequests
+		cb.errorRate = errorRate
+	}
+}
+
+// CircuitBreakerWithHalfOpen 熔断多久之后进入半开，以及半开的时候放多少个探测请求，默认 5s 和 3 个
+func CircuitBreakerWithHalfOpen(openTimeout time.Duration, requests int64) CircuitBreakerOption {
+	return func(cb *CircuitBreaker) {
+		cb.openTimeout = openTimeout
+		cb.halfOpenRequests = max(requests, 1)
+	}
+}
+
+// CircuitBreakerWithFailureCodes 哪些错误码算失败
+// 默认是 Unavailable、DeadlineExceeded、Internal 和 Unknown，业务错误不应该导致熔断
+func CircuitBreakerWithFailureCodes(cs ...codes.Code) CircuitBreakerOption {
+	return func(cb *CircuitBreaker) {
+		cb.failureCodes = make(map[codes.Code]struct{}, len(cs))
+		for _, c := range cs {
+			cb.failureCodes[c] = struct{}{}
+		}
+	}
+}
+
+// State 实例 addr 当前的熔断状态
+func (cb *CircuitBreaker) State(addr string) CircuitState {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	c, ok := cb.circuits[addr]
+	if !ok {
+		return CircuitClosed
+	}
+	return c.state
+}
+
+// 能不能往 addr 发请求，不会改变状态
+func (cb *CircuitBreaker) available(addr string) bool {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	c, ok := cb.circuits[addr]
+	if !ok {
+		return true
+	}
+	switch c.state {
+	case CircuitOpen:
+		return time.Since(c.start) >= cb.openTimeout
+	case CircuitHalfOpen:
+		return c.probes < cb.halfOpenRequests
+	default:
+		return true
+	}
+}
+
+// 选中了 addr，熔断到期了就进入半开，返回请求结束之后的回调
+// 检查能不能发请求和占用半开的探测名额在同一个临界区里面，返回 false 表示不能发
+func (cb *CircuitBreaker) picked(addr string) (func(err error), bool) {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	now := time.Now()
+	cb.sweep(now)
+	c := cb.circuitOf(addr)
+	if c.state == CircuitOpen {
+		if now.Sub(c.start) < cb.openTimeout {
+			return nil, false
+		}
+		c.state = CircuitHalfOpen
+		c.start = now
+		c.probes = 0
+		c.total = 0
+	}
+	if c.state == CircuitHalfOpen {
+		if c.probes >= cb.halfOpenRequests {
+			return nil, false
+		}
+		c.probes++
+	}
+	return func(err error) {
+		cb.report(addr, err)
+	}, true
+}
+
+// 每个统计窗口清理一次很久没有请求的实例，下线的实例不会再被选中，最终都会被清理掉
+// 同一个熔断器可能被多个服务共用，所以按照空闲的时间清理，而不是按照某个服务当前的实例列表
+// 调用方要持有锁
+func (cb *CircuitBreaker) sweep(now time.Time) {
+	if now.Sub(cb.sweptAt) < cb.window {
+		return
+	}
+	cb.sweptAt = now
+	for addr, c := range cb.circuits {
+		idle := now.Sub(c.start)
+		var evict bool
+		switch c.state {
+		case CircuitOpen:
+			evict = idle >= cb.openTimeout+cb.window
+		case CircuitHalfOpen:
+			// 还有探测请求没有返回的不能删
+			evict = c.total >= c.probes && idle >= cb.window
+		default:
+			// 统计窗口过期了，和没有记录是一样的
+			evict = idle >= cb.window
+		}
+		if evict {
+			delete(cb.circuits, addr)
+		}
+	}
+}
+
+func (cb *CircuitBreaker) circuitOf(addr string) *circuit {
+	c, ok := cb.circuits[addr]
+	if !ok {
+		c = &circuit{start: time.Now()}
+		cb.circuits[addr] = c
+	}
+	return c
+}
+
+func (cb *CircuitBreaker) report(addr string, err error) {
+	_, failed := cb.failureCodes[status.Code(err)]
+	failed = failed && err != nil
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	c := cb.circuitOf(addr)
+	now := time.Now()
+	switch c.state {
+	case CircuitOpen:
+		// 熔断之前发出去的请求，不用管
+	case CircuitHalfOpen:
+		if failed {
+			c.state = CircuitOpen
+			c.start = now
+			return
+		}
+		c.total++
+		if c.total >= cb.halfOpenRequests {
+			*c = circuit{state: CircuitClosed, start: now}
+		}
+	default:
+		if now.Sub(c.start) >= cb.window {
+			c.start = now
+			c.total = 0
+			c.failures = 0
+		}
+		c.total++
+		if failed {
+			c.failures++
+		}
+		if c.total >= cb.minRequests && float64(c.failures) >= float64(c.total)*cb.errorRate {
+			c.state = CircuitOpen
+			c.start = now
+		}
+	}
+}
+
+type circuitBreakerKey struct{}
+
+func withCircuitBreaker(ctx context.Context, cb *CircuitBreaker) context.Context {
+	return context.WithValue(ctx, circuitBreakerKey{}, cb)
+}
+
+func circuitBreakerFromContext(ctx context.Context) (*CircuitBreaker, bool) {
+	if ctx == nil {
+		return nil, false
+	}
+	cb, ok := ctx.Value(circuitBreakerKey{}).(*CircuitBreaker)
+	return cb, ok
+}
+
+// 跟路由一样，picker 从 ctx 里面拿到熔断器
+func circuitBreakerUnaryClientInterceptor(cb *CircuitBreaker) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		return invoker(withCircuitBreaker(ctx, cb), method, req, reply, cc, opts...)
+	}
+}
+
+func circuitBreakerStreamClientInterceptor(cb *CircuitBreaker) grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		return streamer(withCircuitBreaker(ctx, cb), desc, cc, method, opts...)
+	}
+}
@@ -0,0 +1,151 @@
+package micro
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"maps"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker_State(t *testing.T) {
+	const addr = "127.0.0.1:8081"
+	cb := NewCircuitBreaker(CircuitBreakerWithErrorRate(time.Minute, 4, 0.5),
+		CircuitBreakerWithHalfOpen(time.Millisecond*100, 2))
+	pick := func() func(err error) {
+		report, ok := cb.picked(addr)
+		require.True(t, ok)
+		return report
+	}
+	call := func(err error) {
+		pick()(err)
+	}
+	unavailable := status.Error(codes.Unavailable, "unavailable")
+
+	// 业务错误不算失败
+	call(status.Error(codes.NotFound, "not found"))
+	call(unavailable)
+	call(nil)
+	assert.Equal(t, CircuitClosed, cb.State(addr))
+	// 4 个请求 2 个失败，达到 50%
+	call(unavailable)
+	assert.Equal(t, CircuitOpen, cb.State(addr))
+	assert.False(t, cb.available(addr))
+
+	// 半开的时候只放 2 个请求，有一个失败就继续熔断
+	time.Sleep(time.Millisecond * 100)
+	assert.True(t, cb.available(addr))
+	report := pick()
+	assert.Equal(t, CircuitHalfOpen, cb.State(addr))
+	report(unavailable)
+	assert.Equal(t, CircuitOpen, cb.State(addr))
+	assert.False(t, cb.available(addr))
+
+	// 探测请求全部成功就恢复
+	time.Sleep(time.Millisecond * 100)
+	first := pick()
+	second := pick()
+	assert.False(t, cb.available(addr))
+	// 探测名额用完了
+	_, ok := cb.picked(addr)
+	assert.False(t, ok)
+	first(nil)
+	assert.Equal(t, CircuitHalfOpen, cb.State(addr))
+	second(nil)
+	assert.Equal(t, CircuitClosed, cb.State(addr))
+	assert.True(t, cb.available(addr))
+
+	// 恢复之后重新统计
+	call(unavailable)
+	assert.Equal(t, CircuitClosed, cb.State(addr))
+}
+
+func TestCircuitBreaker_Window(t *testing.T) {
+	const addr = "127.0.0.1:8081"
+	cb := NewCircuitBreaker(CircuitBreakerWithErrorRate(time.Millisecond*100, 2, 0.5))
+	call := func(err error) {
+		report, ok := cb.picked(addr)
+		require.True(t, ok)
+		report(err)
+	}
+	unavailable := status.Error(codes.Unavailable, "unavailable")
+	call(unavailable)
+	// 上一个窗口的错误不算
+	time.Sleep(time.Millisecond * 100)
+	call(unavailable)
+	assert.Equal(t, CircuitClosed, cb.State(addr))
+	call(nil)
+	assert.Equal(t, CircuitOpen, cb.State(addr))
+}
+
+func TestCircuitBreaker_sweep(t *testing.T) {
+	cb := NewCircuitBreaker(CircuitBreakerWithErrorRate(time.Minute, 1, 0.5),
+		CircuitBreakerWithHalfOpen(time.Minute, 1))
+	now := time.Now()
+	cb.circuits = map[string]*circuit{
+		// 统计窗口过期了
+		"closed-idle": {state: CircuitClosed, start: now.Add(-time.Minute)},
+		"closed":      {state: CircuitClosed, start: now.Add(-time.Second)},
+		// 熔断之后过了 openTimeout 和一个统计窗口都没有请求
+		"open-idle": {state: CircuitOpen, start: now.Add(-time.Minute * 2)},
+		"open":      {state: CircuitOpen, start: now.Add(-time.Minute)},
+		// 探测请求还没有返回
+		"half-open-probing": {state: CircuitHalfOpen, start: now.Add(-time.Minute), probes: 1},
+		"half-open-idle":    {state: CircuitHalfOpen, start: now.Add(-time.Minute), probes: 1, total: 1},
+	}
+	cb.sweep(now)
+	assert.Equal(t, []string{"closed", "half-open-probing", "open"}, slices.Sorted(maps.Keys(cb.circuits)))
+
+	// 一个统计窗口只清理一次
+	cb.circuits["closed-idle"] = &circuit{state: CircuitClosed, start: now.Add(-time.Minute)}
+	cb.sweep(now.Add(time.Second))
+	assert.Len(t, cb.circuits, 4)
+	cb.sweep(now.Add(time.Minute))
+	assert.Equal(t, []string{"half-open-probing"}, slices.Sorted(maps.Keys(cb.circuits)))
+}
+
+func TestPicker_CircuitBreaker(t *testing.T) {
+	info := base.PickerBuildInfo{
+		ReadySCs: make(map[balancer.SubConn]base.SubConnInfo, len(routeInstances)),
+	}
+	for _, si := range routeInstances {
+		info.ReadySCs[&fakeSubConn{addr: si.Address}] = base.SubConnInfo{
+			Address: newAddress(si),
+		}
+	}
+	builders := map[string]base.PickerBuilder{
+		BalancerRoundRobin:         &roundRobinPickerBuilder{},
+		BalancerWeightedRoundRobin: &weightedRoundRobinPickerBuilder{},
+		BalancerWeightedRandom:     &weightedRandomPickerBuilder{},
+		BalancerLeastActive:        &leastActivePickerBuilder{},
+		BalancerConsistentHash:     &consistentHashPickerBuilder{},
+	}
+	for name, b := range builders {
+		t.Run(name, func(t *testing.T) {
+			p := b.Build(info)
+			cb := NewCircuitBreaker(CircuitBreakerWithErrorRate(time.Minute, 1, 0.5))
+			ctx := withCircuitBreaker(WithHashKey(context.Background(), "user-1"), cb)
+
+			// 选中的实例失败一次就熔断，之后换别的实例，直到全部熔断
+			broken := make(map[string]struct{}, len(routeInstances))
+			for i := 0; i < len(routeInstances); i++ {
+				pr, err := p.Pick(balancer.PickInfo{Ctx: ctx})
+				require.NoError(t, err)
+				addr := pr.SubConn.(*fakeSubConn).addr
+				assert.NotContains(t, broken, addr)
+				broken[addr] = struct{}{}
+				require.NotNil(t, pr.Done)
+				pr.Done(balancer.DoneInfo{Err: status.Error(codes.Unavailable, "unavailable")})
+				assert.Equal(t, CircuitOpen, cb.State(addr))
+			}
+			_, err := p.Pick(balancer.PickInfo{Ctx: ctx})
+			assert.Equal(t, ErrCircuitOpen, err)
+		})
+	}
+}
@@ -2,18 +2,28 @@ package micro
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"github.com/zhuguangfeng/study/micro/registry"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"time"
 )
 
 type ClientOption func(c *Client)
 
 type Client struct {
-	insecure bool
-	r        registry.Registry
-	timeout  time.Duration
+	insecure     bool
+	r            registry.Registry
+	timeout      time.Duration
+	resolverOpts []ResolverOption
+	balancer     string
+	router       Router
+	dialOpts     []grpc.DialOption
+	timeouts     timeouts
+	retry        *RetryPolicy
+	breaker      *CircuitBreaker
+	tlsConfig    *tls.Config
 }
 
 func NewClient(opts ...ClientOption) (*Client, error) {
@@ -38,18 +48,135 @@ func ClientWithRegistry(r registry.Registry, timeout time.Duration) ClientOption
 	}
 }
 
+// ClientWithResolverOptions 服务发现的参数，例如全量同步的间隔
+func ClientWithResolverOptions(opts ...ResolverOption) ClientOption {
+	return func(c *Client) {
+		c.resolverOpts = append(c.resolverOpts, opts...)
+	}
+}
+
+// ClientWithBalancer 负载均衡算法，例如 BalancerWeightedRoundRobin
+// 不设置就是 gRPC 默认的 pick_first
+func ClientWithBalancer(name string) ClientOption {
+	return func(c *Client) {
+		c.balancer = name
+	}
+}
+
+// ClientWithRouter 路由规则，按照顺序过滤实例，例如
+//
+//	ClientWithRouter(
+//		RouteRule{Filter: GroupFilter(), Fallback: FallbackFail},
+//		RouteRule{Filter: ZoneFilter("hz"), Fallback: FallbackIgnore},
+//	)
+//
+// 表示灰度流量只发给灰度实例，并且优先发给同一个可用区的实例
+// 只有 micro 自己的负载均衡算法支持路由，没有设置负载均衡算法的时候默认用 BalancerRoundRobin
+func ClientWithRouter(rules ...RouteRule) ClientOption {
+	return func(c *Client) {
+		c.router = append(c.router, rules...)
+	}
+}
+
+// ClientWithTLS 用 TLS 连接服务端，cfg 一般用 NewClientTLSConfig 创建
+// 没有设置 ServerName 的时候用服务名校验服务端证书
+func ClientWithTLS(cfg *tls.Config) ClientOption {
+	return func(c *Client) {
+		c.tlsConfig = cfg
+	}
+}
+
+// ClientWithAuth 每个请求都带上 creds 提供的身份，例如 auth.NewStaticTokenCredentials
+// creds 默认要求 TLS，没有 TLS 的时候要用 auth.CredentialsAllowInsecure
+func ClientWithAuth(creds credentials.PerRPCCredentials) ClientOption {
+	return func(c *Client) {
+		c.dialOpts = append(c.dialOpts, grpc.WithPerRPCCredentials(creds))
+	}
+}
+
+// ClientWithCallTimeout 一元调用默认的超时时间，可以用 ClientWithMethodTimeout 单独设置
+func ClientWithCallTimeout(timeout time.Duration) ClientOption {
+	return func(c *Client) {
+		c.timeouts.defaultTimeout = timeout
+	}
+}
+
+// ClientWithMethodTimeout 单独设置某个方法的超时时间，method 是完整的方法名，例如 /user.UserService/GetById
+// 流只有通过这个方法设置了才会有超时
+func ClientWithMethodTimeout(method string, timeout time.Duration) ClientOption {
+	return func(c *Client) {
+		if c.timeouts.methods == nil {
+			c.timeouts.methods = make(map[string]time.Duration)
+		}
+		c.timeouts.methods[method] = timeout
+	}
+}
+
+// ClientWithRetry 幂等的方法失败之后重试，超时时间包括了重试
+func ClientWithRetry(policy RetryPolicy) ClientOption {
+	return func(c *Client) {
+		c.retry = &policy
+	}
+}
+
+// ClientWithCircuitBreaker 按照实例熔断，熔断的实例不会被选中
+// 和路由一样，只有 micro 自己的负载均衡算法支持，没有设置负载均衡算法的时候默认用 BalancerRoundRobin
+func ClientWithCircuitBreaker(cb *CircuitBreaker) ClientOption {
+	return func(c *Client) {
+		c.breaker = cb
+	}
+}
+
+// ClientWithDialOptions 透传给 grpc.DialContext 的参数
+func ClientWithDialOptions(opts ...grpc.DialOption) ClientOption {
+	return func(c *Client) {
+		c.dialOpts = append(c.dialOpts, opts...)
+	}
+}
+
 func (c *Client) Dial(ctx context.Context, service string) (*grpc.ClientConn, error) {
 	var opts []grpc.DialOption
 	if c.r != nil {
-		rb, err := NewRegistryBuilder(c.r, c.timeout)
+		rb, err := NewRegistryBuilder(c.r, c.timeout, c.resolverOpts...)
 		if err != nil {
 			return nil, err
 		}
 		opts = append(opts, grpc.WithResolvers(rb))
 	}
-	if c.insecure {
+	switch {
+	case c.tlsConfig != nil:
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(c.tlsConfig)))
+	case c.insecure:
 		opts = append(opts, grpc.WithInsecure())
 	}
-	cc, err := grpc.DialContext(ctx, fmt.Sprintf("registry:///%s", service), opts...)
+	bl := c.balancer
+	// 超时在最外层，包括了重试的时间；重试每次都会经过路由和熔断重新挑选实例
+	if c.timeouts.defaultTimeout > 0 || len(c.timeouts.methods) > 0 {
+		opts = append(opts,
+			grpc.WithChainUnaryInterceptor(timeoutUnaryClientInterceptor(c.timeouts)),
+			grpc.WithChainStreamInterceptor(timeoutStreamClientInterceptor(c.timeouts)))
+	}
+	if c.retry != nil {
+		opts = append(opts, grpc.WithChainUnaryInterceptor(retryUnaryClientInterceptor(*c.retry)))
+	}
+	if len(c.router) > 0 {
+		opts = append(opts,
+			grpc.WithChainUnaryInterceptor(routerUnaryClientInterceptor(c.router)),
+			grpc.WithChainStreamInterceptor(routerStreamClientInterceptor(c.router)))
+	}
+	if c.breaker != nil {
+		opts = append(opts,
+			grpc.WithChainUnaryInterceptor(circuitBreakerUnaryClientInterceptor(c.breaker)),
+			grpc.WithChainStreamInterceptor(circuitBreakerStreamClientInterceptor(c.breaker)))
+	}
+	if (len(c.router) > 0 || c.breaker != nil) && bl == "" {
+		bl = BalancerRoundRobin
+	}
+	if bl != "" {
+		opts = append(opts, grpc.WithDefaultServiceConfig(
+			fmt.Sprintf(`{"loadBalancingConfig": [{"%s": {}}]}`, bl)))
+	}
+	opts = append(opts, c.dialOpts...)
+	cc, err := grpc.DialContext(ctx, fmt.Sprintf("%s:///%s", registryScheme, service), opts...)
 	return cc, err
 }
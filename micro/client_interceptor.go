@@ -0,0 +1,127 @@
+package micro
+
+import (
+	"context"
+	"github.com/zhuguangfeng/study/cache"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"time"
+)
+
+// 按照方法设置超时，没有单独设置的方法用 defaultTimeout，0 表示不设置
+type timeouts struct {
+	defaultTimeout time.Duration
+	methods        map[string]time.Duration
+}
+
+func (t timeouts) timeout(method string) time.Duration {
+	if timeout, ok := t.methods[method]; ok {
+		return timeout
+	}
+	return t.defaultTimeout
+}
+
+// 调用方已经设置了更短的超时时间的话，以调用方的为准
+func timeoutUnaryClientInterceptor(t timeouts) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		timeout := t.timeout(method)
+		if timeout <= 0 {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
+
+// 流一般是长连接，只有单独给这个方法设置了超时才生效，超时时间是整个流的
+func timeoutStreamClientInterceptor(t timeouts) grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		timeout, ok := t.methods[method]
+		if !ok || timeout <= 0 {
+			return streamer(ctx, desc, cc, method, opts...)
+		}
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		stream, err := streamer(ctx, desc, cc, method, opts...)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		return &timeoutClientStream{ClientStream: stream, cancel: cancel}, nil
+	}
+}
+
+// 流结束的时候释放 ctx
+type timeoutClientStream struct {
+	grpc.ClientStream
+	cancel context.CancelFunc
+}
+
+func (s *timeoutClientStream) RecvMsg(m any) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err != nil {
+		s.cancel()
+	}
+	return err
+}
+
+// RetryPolicy 重试策略，只有幂等的方法才能重试
+type RetryPolicy struct {
+	// 可以重试的方法，完整的方法名，例如 /user.UserService/GetById
+	Methods []string
+	// 哪些错误码要重试，默认重试 Unavailable 和 ResourceExhausted
+	// 服务端限流返回的是 ResourceExhausted，这个时候请求还没有处理，换一个实例重试就可以
+	Codes []codes.Code
+	// 每次调用都会创建一个新的重试策略，例如
+	//
+	//	func() cache.RetryStrategy {
+	//		return cache.NewExponentialBackoffRetryStrategy(time.Millisecond*100, time.Second, 3)
+	//	}
+	Strategy func() cache.RetryStrategy
+}
+
+func (p RetryPolicy) retryable(err error) bool {
+	code := status.Code(err)
+	if len(p.Codes) == 0 {
+		return code == codes.Unavailable || code == codes.ResourceExhausted
+	}
+	for _, c := range p.Codes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// 只重试一元调用，流发出去之后不知道对端处理到哪里了
+// 每次重试都会重新挑选实例，配合熔断器可以避开出问题的实例
+func retryUnaryClientInterceptor(p RetryPolicy) grpc.UnaryClientInterceptor {
+	methods := make(map[string]struct{}, len(p.Methods))
+	for _, m := range p.Methods {
+		methods[m] = struct{}{}
+	}
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if _, ok := methods[method]; !ok || p.Strategy == nil {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+		strategy := p.Strategy()
+		for {
+			err := invoker(ctx, method, req, reply, cc, opts...)
+			if err == nil || !p.retryable(err) {
+				return err
+			}
+			interval, ok := strategy.Next()
+			if !ok {
+				return err
+			}
+			timer := time.NewTimer(interval)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return err
+			}
+		}
+	}
+}
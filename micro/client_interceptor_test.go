@@ -0,0 +1,172 @@
+package micro
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/zhuguangfeng/study/cache"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+	"time"
+)
+
+func TestTimeoutUnaryClientInterceptor(t *testing.T) {
+	interceptor := timeoutUnaryClientInterceptor(timeouts{
+		defaultTimeout: time.Second,
+		methods: map[string]time.Duration{
+			"/user.UserService/Export": time.Minute,
+			"/user.UserService/Watch":  0,
+		},
+	})
+	shortCtx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	testCases := []struct {
+		name   string
+		ctx    context.Context
+		method string
+
+		wantTimeout time.Duration
+		wantNoLimit bool
+	}{
+		{
+			name:        "default",
+			ctx:         context.Background(),
+			method:      "/user.UserService/GetById",
+			wantTimeout: time.Second,
+		},
+		{
+			name:        "method",
+			ctx:         context.Background(),
+			method:      "/user.UserService/Export",
+			wantTimeout: time.Minute,
+		},
+		{
+			name:        "disabled",
+			ctx:         context.Background(),
+			method:      "/user.UserService/Watch",
+			wantNoLimit: true,
+		},
+		{
+			name:        "caller shorter",
+			ctx:         shortCtx,
+			method:      "/user.UserService/Export",
+			wantTimeout: time.Millisecond * 100,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := interceptor(tc.ctx, tc.method, nil, nil, nil,
+				func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+					deadline, ok := ctx.Deadline()
+					if tc.wantNoLimit {
+						assert.False(t, ok)
+						return nil
+					}
+					assert.True(t, ok)
+					assert.InDelta(t, tc.wantTimeout, time.Until(deadline), float64(time.Millisecond*50))
+					return nil
+				})
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestRetryUnaryClientInterceptor(t *testing.T) {
+	const (
+		getById = "/user.UserService/GetById"
+		create  = "/user.UserService/Create"
+	)
+	unavailable := status.Error(codes.Unavailable, "unavailable")
+	testCases := []struct {
+		name   string
+		policy RetryPolicy
+		method string
+		// 每次调用的结果，用完了就返回 nil
+		results []error
+
+		wantErr   error
+		wantCalls int
+	}{
+		{
+			name:      "success after retry",
+			method:    getById,
+			results:   []error{unavailable, unavailable},
+			wantCalls: 3,
+		},
+		{
+			name:      "retry exhausted",
+			method:    getById,
+			results:   []error{unavailable, unavailable, unavailable, unavailable},
+			wantErr:   unavailable,
+			wantCalls: 4,
+		},
+		{
+			name:      "not idempotent",
+			method:    create,
+			results:   []error{unavailable},
+			wantErr:   unavailable,
+			wantCalls: 1,
+		},
+		{
+			name:      "not retryable code",
+			method:    getById,
+			results:   []error{status.Error(codes.NotFound, "not found")},
+			wantErr:   status.Error(codes.NotFound, "not found"),
+			wantCalls: 1,
+		},
+		{
+			name:      "resource exhausted",
+			method:    getById,
+			results:   []error{status.Error(codes.ResourceExhausted, "limited")},
+			wantCalls: 2,
+		},
+		{
+			name:      "custom codes",
+			policy:    RetryPolicy{Codes: []codes.Code{codes.ResourceExhausted}},
+			method:    getById,
+			results:   []error{status.Error(codes.ResourceExhausted, "limited"), unavailable},
+			wantErr:   unavailable,
+			wantCalls: 2,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.policy.Methods = []string{getById}
+			tc.policy.Strategy = func() cache.RetryStrategy {
+				return cache.NewFixedIntervalRetryStrategy(time.Millisecond, 3)
+			}
+			calls := 0
+			err := retryUnaryClientInterceptor(tc.policy)(context.Background(), tc.method, nil, nil, nil,
+				func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+					calls++
+					if calls > len(tc.results) {
+						return nil
+					}
+					return tc.results[calls-1]
+				})
+			assert.Equal(t, tc.wantErr, err)
+			assert.Equal(t, tc.wantCalls, calls)
+		})
+	}
+}
+
+func TestRetryUnaryClientInterceptor_ContextDone(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	unavailable := status.Error(codes.Unavailable, "unavailable")
+	calls := 0
+	err := retryUnaryClientInterceptor(RetryPolicy{
+		Methods: []string{"/user.UserService/GetById"},
+		Strategy: func() cache.RetryStrategy {
+			return cache.NewFixedIntervalRetryStrategy(time.Second, 3)
+		},
+	})(ctx, "/user.UserService/GetById", nil, nil, nil,
+		func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+			calls++
+			return unavailable
+		})
+	// 超时之后不再等下一次重试
+	assert.Equal(t, unavailable, err)
+	assert.Equal(t, 1, calls)
+}
@@ -0,0 +1,94 @@
+package registry
+
+import (
+	"context"
+	"crypto/rand"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zhuguangfeng/study/micro"
+	"github.com/zhuguangfeng/study/micro/auth"
+	"github.com/zhuguangfeng/study/micro/registry/memory"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"testing"
+	"time"
+)
+
+// 手写的业务服务，借用健康检查的消息，返回调用方的身份
+var userServiceDesc = grpc.ServiceDesc{
+	ServiceName: "user.UserService",
+	HandlerType: (*any)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Check",
+			Handler: func(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+				req := &healthpb.HealthCheckRequest{}
+				if err := dec(req); err != nil {
+					return nil, err
+				}
+				handler := func(ctx context.Context, req any) (any, error) {
+					if _, ok := auth.PrincipalFromContext(ctx); !ok {
+						return nil, status.Error(codes.Internal, "no principal")
+					}
+					return &healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_SERVING}, nil
+				}
+				if interceptor == nil {
+					return handler(ctx, req)
+				}
+				return interceptor(ctx, req, &grpc.UnaryServerInfo{FullMethod: "/user.UserService/Check"}, handler)
+			},
+		},
+	},
+}
+
+func TestServer_Auth(t *testing.T) {
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	require.NoError(t, err)
+	ca := newTestCA(t, t.TempDir())
+	certFile, keyFile := ca.issue(t, "server", "server-1", "user-service")
+	serverTLS, err := micro.NewServerTLSConfig(certFile, keyFile)
+	require.NoError(t, err)
+	clientTLS, err := micro.NewClientTLSConfig(micro.TLSWithCA(ca.file))
+	require.NoError(t, err)
+
+	r := memory.NewRegistry()
+	defer r.Close()
+	n := newBufNet()
+	s, err := micro.NewServer("user-service",
+		micro.ServiceWithRegistry(r),
+		micro.ServerWithAddress("server-1"),
+		micro.ServerWithTLS(serverTLS),
+		micro.ServerWithAuth(auth.NewJWTAuthenticator(secret, auth.JWTWithAudience("user-service")),
+			auth.InterceptorWithACL(auth.ACL{
+				{Method: "/user.UserService/*", Subjects: []string{"order-service"}},
+			})))
+	require.NoError(t, err)
+	s.RegisterService(&userServiceDesc, nil)
+	l := n.listen("server-1")
+	go func() {
+		_ = s.StartWithListener(context.Background(), l)
+	}()
+	t.Cleanup(s.Stop)
+
+	call := func(opts ...micro.ClientOption) error {
+		opts = append(opts, micro.ClientWithTLS(clientTLS))
+		cc := n.dialService(t, r, opts...)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+		defer cancel()
+		// 健康检查不需要认证
+		_, err := healthpb.NewHealthClient(cc).Check(ctx, &healthpb.HealthCheckRequest{}, grpc.WaitForReady(true))
+		require.NoError(t, err)
+		return cc.Invoke(ctx, "/user.UserService/Check", &healthpb.HealthCheckRequest{}, &healthpb.HealthCheckResponse{})
+	}
+	jwt := func(subject string, opts ...auth.JWTOption) micro.ClientOption {
+		return micro.ClientWithAuth(auth.NewTokenCredentials(auth.NewJWTSigner(secret, subject, opts...).Token))
+	}
+
+	assert.NoError(t, call(jwt("order-service", auth.JWTWithAudience("user-service"))))
+	assert.Equal(t, codes.PermissionDenied, status.Code(call(jwt("pay-service", auth.JWTWithAudience("user-service")))))
+	assert.Equal(t, codes.Unauthenticated, status.Code(call(jwt("order-service", auth.JWTWithAudience("pay-service")))))
+	assert.Equal(t, codes.Unauthenticated, status.Code(call()))
+}
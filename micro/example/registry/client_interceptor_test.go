@@ -0,0 +1,77 @@
+package registry
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zhuguangfeng/study/cache"
+	"github.com/zhuguangfeng/study/micro"
+	"github.com/zhuguangfeng/study/micro/registry/memory"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"testing"
+	"time"
+)
+
+const healthCheckMethod = "/grpc.health.v1.Health/Check"
+
+// 所有请求都返回 Unavailable，相当于实例出问题了
+func unavailableServer() micro.ServerOption {
+	return micro.ServerWithUnaryInterceptors(func(ctx context.Context, req any,
+		info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		return nil, status.Error(codes.Unavailable, "broken")
+	})
+}
+
+func TestClient_CircuitBreakerAndRetry(t *testing.T) {
+	r := memory.NewRegistry()
+	defer r.Close()
+	n := newBufNet()
+	n.startServer(t, r, "server-1")
+	n.startServer(t, r, "server-2", unavailableServer())
+	cb := micro.NewCircuitBreaker(micro.CircuitBreakerWithErrorRate(time.Minute, 2, 0.5),
+		micro.CircuitBreakerWithHalfOpen(time.Minute, 1))
+	cc := n.dialService(t, r,
+		micro.ClientWithCircuitBreaker(cb),
+		micro.ClientWithRetry(micro.RetryPolicy{
+			Methods: []string{healthCheckMethod},
+			Strategy: func() cache.RetryStrategy {
+				return cache.NewFixedIntervalRetryStrategy(time.Millisecond, 2)
+			},
+		}))
+	ctx := context.Background()
+	hc := healthpb.NewHealthClient(cc)
+	assert.Eventually(t, func() bool {
+		_, err := hc.Check(ctx, &healthpb.HealthCheckRequest{})
+		return err == nil && cb.State("server-2") == micro.CircuitOpen
+	}, time.Second*5, time.Millisecond*10)
+
+	// server-2 熔断之后请求都发给 server-1，重试也不会失败
+	res, err := callServers(ctx, cc, 10)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"server-1": 10}, res)
+}
+
+func TestClient_MethodTimeout(t *testing.T) {
+	r := memory.NewRegistry()
+	defer r.Close()
+	n := newBufNet()
+	n.startServer(t, r, "server-1")
+	cc := n.dialService(t, r,
+		micro.ClientWithCallTimeout(time.Second),
+		micro.ClientWithMethodTimeout("/grpc.health.v1.Health/Watch", time.Millisecond*200))
+	waitServers(t, context.Background(), cc, "server-1")
+
+	// 流只要设置了超时，时间到了就会断开
+	stream, err := healthpb.NewHealthClient(cc).Watch(context.Background(),
+		&healthpb.HealthCheckRequest{Service: "user-service"})
+	require.NoError(t, err)
+	start := time.Now()
+	for err == nil {
+		_, err = stream.Recv()
+	}
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+	assert.Less(t, time.Since(start), time.Second)
+}
@@ -1,3 +1,5 @@
+//go:build e2e
+
 package registry
 
 import (
@@ -25,6 +27,7 @@ func TestClient(t *testing.T) {
 
 	cc, err := client.Dial(ctx, "user-service")
 	require.NoError(t, err)
+	defer cc.Close()
 
 	//uc:=gen.NewUserServiceClient(cc)
 	//resp,err:=uc.GetById(ctx ,&gen.GetById(Id:13))
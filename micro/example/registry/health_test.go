@@ -0,0 +1,71 @@
+package registry
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zhuguangfeng/study/micro"
+	"github.com/zhuguangfeng/study/micro/registry"
+	"github.com/zhuguangfeng/study/micro/registry/memory"
+	"github.com/zhuguangfeng/study/micro/registry/static"
+	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"testing"
+	"time"
+)
+
+func TestHealthChecker(t *testing.T) {
+	r := memory.NewRegistry()
+	defer r.Close()
+	n := newBufNet()
+	n.startServer(t, r, "server-1")
+	s2 := n.startServer(t, r, "server-2")
+	ctx := context.Background()
+	// 注册了但是进程已经卡死，连不上
+	require.NoError(t, r.Registry(ctx, registry.ServiceInstance{Name: "user-service", Address: "server-3"}))
+
+	cc := n.dialService(t, r)
+	waitServers(t, ctx, cc, "server-1", "server-2")
+
+	checker, err := micro.NewHealthChecker(r, []string{"user-service"},
+		micro.HealthCheckerWithThreshold(2, 1),
+		micro.HealthCheckerWithTimeout(time.Millisecond*200),
+		micro.HealthCheckerWithDialOptions(grpc.WithContextDialer(n.dial)))
+	require.NoError(t, err)
+
+	// server-2 自己报告不健康
+	s2.Health().SetServingStatus("user-service", healthpb.HealthCheckResponse_NOT_SERVING)
+	unhealthy := func() map[string]bool {
+		instances, err := r.ListServices(ctx, "user-service")
+		require.NoError(t, err)
+		res := make(map[string]bool, len(instances))
+		for _, si := range instances {
+			res[si.Address] = si.Unhealthy
+		}
+		return res
+	}
+
+	// 失败一次还不会标记
+	require.NoError(t, checker.Check(ctx))
+	assert.Equal(t, map[string]bool{"server-1": false, "server-2": false, "server-3": false}, unhealthy())
+	require.NoError(t, checker.Check(ctx))
+	assert.Equal(t, map[string]bool{"server-1": false, "server-2": true, "server-3": true}, unhealthy())
+	// 客户端不会再把请求发给不健康的实例
+	waitServers(t, ctx, cc, "server-1")
+
+	// 恢复之后重新加入
+	s2.Health().SetServingStatus("user-service", healthpb.HealthCheckResponse_SERVING)
+	require.NoError(t, checker.Check(ctx))
+	assert.Equal(t, map[string]bool{"server-1": false, "server-2": false, "server-3": true}, unhealthy())
+	waitServers(t, ctx, cc, "server-1", "server-2")
+
+	// Run 在 ctx 取消之后退出
+	runCtx, cancel := context.WithTimeout(ctx, time.Millisecond*100)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, checker.Run(runCtx))
+}
+
+func TestNewHealthChecker_ReadOnly(t *testing.T) {
+	_, err := micro.NewHealthChecker(static.NewRegistry(), []string{"user-service"})
+	assert.Equal(t, micro.ErrRegistryNotUpdatable, err)
+}
@@ -0,0 +1,215 @@
+package registry
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zhuguangfeng/study/micro"
+	"github.com/zhuguangfeng/study/micro/registry"
+	"github.com/zhuguangfeng/study/micro/registry/memory"
+	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/test/bufconn"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 响应头里面放上处理请求的服务端地址
+const serverAddrHeader = "x-server-addr"
+
+// 进程内的网络，地址 -> bufconn
+type bufNet struct {
+	mutex     sync.Mutex
+	listeners map[string]*bufconn.Listener
+}
+
+func newBufNet() *bufNet {
+	return &bufNet{
+		listeners: make(map[string]*bufconn.Listener),
+	}
+}
+
+func (n *bufNet) listen(addr string) *bufconn.Listener {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	l := bufconn.Listen(1024 * 1024)
+	n.listeners[addr] = l
+	return l
+}
+
+func (n *bufNet) dial(ctx context.Context, addr string) (net.Conn, error) {
+	n.mutex.Lock()
+	l, ok := n.listeners[addr]
+	n.mutex.Unlock()
+	if !ok {
+		return nil, &net.OpError{Op: "dial", Net: "bufconn", Err: net.UnknownNetworkError(addr)}
+	}
+	return l.DialContext(ctx)
+}
+
+// 启动一个 user-service 的实例，注册到 r
+func (n *bufNet) startServer(t *testing.T, r registry.Registry, addr string, opts ...micro.ServerOption) *micro.Server {
+	s, _ := n.runServer(context.Background(), t, r, addr, nil, opts...)
+	return s
+}
+
+// 在 bufNet 上启动，ctx 取消或者收到 signals 之后退出，返回 Start 的结果
+func (n *bufNet) runServer(ctx context.Context, t *testing.T, r registry.Registry, addr string,
+	signals []os.Signal, opts ...micro.ServerOption) (*micro.Server, <-chan error) {
+	opts = append([]micro.ServerOption{
+		micro.ServiceWithRegistry(r),
+		micro.ServerWithAddress(addr),
+		micro.ServerWithGRPCOptions(grpc.UnaryInterceptor(func(ctx context.Context, req any,
+			info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			_ = grpc.SetHeader(ctx, metadata.Pairs(serverAddrHeader, addr))
+			return handler(ctx, req)
+		})),
+	}, opts...)
+	s, err := micro.NewServer("user-service", opts...)
+	require.NoError(t, err)
+	l := n.listen(addr)
+	res := make(chan error, 1)
+	go func() {
+		res <- s.StartWithListener(ctx, l, signals...)
+	}()
+	// Close 会等 drainTimeout，测试里面直接停掉
+	t.Cleanup(s.Stop)
+	return s, res
+}
+
+func (n *bufNet) dialService(t *testing.T, r registry.Registry, opts ...micro.ClientOption) *grpc.ClientConn {
+	opts = append([]micro.ClientOption{
+		micro.ClientInsecure(),
+		micro.ClientWithRegistry(r, time.Second),
+		micro.ClientWithBalancer(micro.BalancerRoundRobin),
+		micro.ClientWithDialOptions(grpc.WithContextDialer(n.dial)),
+	}, opts...)
+	client, err := micro.NewClient(opts...)
+	require.NoError(t, err)
+	cc, err := client.Dial(context.Background(), "user-service")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = cc.Close()
+	})
+	return cc
+}
+
+// 调用 cnt 次，统计每个服务端处理的请求数
+func callServers(ctx context.Context, cc *grpc.ClientConn, cnt int) (map[string]int, error) {
+	hc := healthpb.NewHealthClient(cc)
+	res := make(map[string]int)
+	for i := 0; i < cnt; i++ {
+		var header metadata.MD
+		_, err := hc.Check(ctx, &healthpb.HealthCheckRequest{}, grpc.Header(&header))
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range header.Get(serverAddrHeader) {
+			res[addr]++
+		}
+	}
+	return res, nil
+}
+
+// 等到请求只会落到 want 这些服务端上
+func waitServers(t *testing.T, ctx context.Context, cc *grpc.ClientConn, want ...string) {
+	assert.Eventually(t, func() bool {
+		res, err := callServers(ctx, cc, len(want)*3)
+		if err != nil || len(res) != len(want) {
+			return false
+		}
+		for _, addr := range want {
+			if res[addr] == 0 {
+				return false
+			}
+		}
+		return true
+	}, time.Second*5, time.Millisecond*50)
+}
+
+func TestMemoryRegistry_RoundRobin(t *testing.T) {
+	r := memory.NewRegistry()
+	defer r.Close()
+	n := newBufNet()
+	for _, addr := range []string{"server-1", "server-2", "server-3"} {
+		n.startServer(t, r, addr)
+	}
+	cc := n.dialService(t, r)
+	ctx := context.Background()
+	waitServers(t, ctx, cc, "server-1", "server-2", "server-3")
+
+	res, err := callServers(ctx, cc, 30)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{
+		"server-1": 10,
+		"server-2": 10,
+		"server-3": 10,
+	}, res)
+
+	// 下线之后不会再收到请求
+	require.NoError(t, r.UnRegistry(ctx, registry.ServiceInstance{Name: "user-service", Address: "server-2"}))
+	waitServers(t, ctx, cc, "server-1", "server-3")
+
+	// 新上线的实例能收到请求
+	n.startServer(t, r, "server-4")
+	waitServers(t, ctx, cc, "server-1", "server-3", "server-4")
+}
+
+func TestMemoryRegistry_TTL(t *testing.T) {
+	r := memory.NewRegistry(memory.WithTTL(time.Millisecond * 300))
+	defer r.Close()
+	n := newBufNet()
+	n.startServer(t, r, "server-1")
+	n.startServer(t, r, "server-2")
+
+	// 只有 server-1 续约，server-2 相当于崩溃了
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		ticker := time.NewTicker(time.Millisecond * 50)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				_ = r.KeepAlive(ctx, registry.ServiceInstance{Name: "user-service", Address: "server-1"})
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	cc := n.dialService(t, r)
+	waitServers(t, ctx, cc, "server-1")
+	time.Sleep(time.Millisecond * 500)
+	res, err := callServers(ctx, cc, 10)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"server-1": 10}, res)
+}
+
+func TestMemoryRegistry_Router(t *testing.T) {
+	r := memory.NewRegistry()
+	defer r.Close()
+	n := newBufNet()
+	n.startServer(t, r, "server-1", micro.ServerWithZone("hz"))
+	n.startServer(t, r, "server-2", micro.ServerWithZone("sh"))
+	n.startServer(t, r, "canary-1", micro.ServerWithZone("sh"), micro.ServerWithGroup("canary"))
+	cc := n.dialService(t, r, micro.ClientWithRouter(
+		micro.RouteRule{Filter: micro.GroupFilter(), Fallback: micro.FallbackFail},
+		micro.RouteRule{Filter: micro.ZoneFilter("hz"), Fallback: micro.FallbackIgnore},
+	))
+
+	// 灰度流量只发给灰度实例，虽然可用区不一样
+	ctx := micro.WithGroup(context.Background(), "canary")
+	waitServers(t, ctx, cc, "canary-1")
+
+	// 普通流量优先发给同一个可用区的实例
+	ctx = context.Background()
+	waitServers(t, ctx, cc, "server-1")
+	res, err := callServers(ctx, cc, 10)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"server-1": 10}, res)
+}
@@ -0,0 +1,145 @@
+package registry
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zhuguangfeng/study/cache"
+	"github.com/zhuguangfeng/study/micro"
+	"github.com/zhuguangfeng/study/micro/registry/memory"
+	"github.com/zhuguangfeng/study/ratelimit"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"testing"
+	"time"
+)
+
+const slowCheckMethod = "/user.UserService/Check"
+
+// Service 是 block 的请求会一直等到 release 被关闭
+type slowUserService struct {
+	entered chan struct{}
+	release chan struct{}
+}
+
+func newSlowUserService() *slowUserService {
+	return &slowUserService{
+		entered: make(chan struct{}, 16),
+		release: make(chan struct{}),
+	}
+}
+
+var slowServiceDesc = grpc.ServiceDesc{
+	ServiceName: "user.UserService",
+	HandlerType: (*any)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Check",
+			Handler: func(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+				req := &healthpb.HealthCheckRequest{}
+				if err := dec(req); err != nil {
+					return nil, err
+				}
+				svc := srv.(*slowUserService)
+				handler := func(ctx context.Context, req any) (any, error) {
+					if req.(*healthpb.HealthCheckRequest).Service == "block" {
+						svc.entered <- struct{}{}
+						<-svc.release
+					}
+					return &healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_SERVING}, nil
+				}
+				if interceptor == nil {
+					return handler(ctx, req)
+				}
+				return interceptor(ctx, req, &grpc.UnaryServerInfo{FullMethod: slowCheckMethod}, handler)
+			},
+		},
+	},
+}
+
+func invokeCheck(ctx context.Context, cc *grpc.ClientConn, service string, opts ...grpc.CallOption) error {
+	return cc.Invoke(ctx, slowCheckMethod, &healthpb.HealthCheckRequest{Service: service},
+		&healthpb.HealthCheckResponse{}, opts...)
+}
+
+// 直接连某个实例，不经过负载均衡
+func (n *bufNet) dialAddr(t *testing.T, addr string) *grpc.ClientConn {
+	cc, err := grpc.Dial(addr, grpc.WithContextDialer(n.dial),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = cc.Close()
+	})
+	return cc
+}
+
+func TestServer_ConcurrencyLimit(t *testing.T) {
+	r := memory.NewRegistry()
+	defer r.Close()
+	n := newBufNet()
+	svc1, svc2 := newSlowUserService(), newSlowUserService()
+	defer close(svc1.release)
+	s1 := n.startServer(t, r, "server-1",
+		micro.ServerWithConcurrencyLimit(ratelimit.NewMaxInFlightLimiter(1)))
+	s1.RegisterService(&slowServiceDesc, svc1)
+	s2 := n.startServer(t, r, "server-2")
+	s2.RegisterService(&slowServiceDesc, svc2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	cc1 := n.dialAddr(t, "server-1")
+	go func() {
+		_ = invokeCheck(ctx, cc1, "block")
+	}()
+	<-svc1.entered
+
+	// server-1 的并发满了，健康检查不受影响
+	err := invokeCheck(ctx, cc1, "")
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	_, err = healthpb.NewHealthClient(cc1).Check(ctx, &healthpb.HealthCheckRequest{})
+	assert.NoError(t, err)
+
+	// 客户端重试的时候换到 server-2
+	cc := n.dialService(t, r, micro.ClientWithRetry(micro.RetryPolicy{
+		Methods: []string{slowCheckMethod},
+		Strategy: func() cache.RetryStrategy {
+			return cache.NewFixedIntervalRetryStrategy(time.Millisecond, 2)
+		},
+	}))
+	waitServers(t, ctx, cc, "server-1", "server-2")
+	res := make(map[string]int)
+	for i := 0; i < 10; i++ {
+		var header metadata.MD
+		require.NoError(t, invokeCheck(ctx, cc, "", grpc.Header(&header)))
+		for _, addr := range header.Get(serverAddrHeader) {
+			res[addr]++
+		}
+	}
+	assert.Equal(t, map[string]int{"server-2": 10}, res)
+}
+
+func TestServer_RateLimit(t *testing.T) {
+	r := memory.NewRegistry()
+	defer r.Close()
+	n := newBufNet()
+	s := n.startServer(t, r, "server-1",
+		micro.ServerWithRateLimit(ratelimit.NewLocalTokenBucketLimiter(0.001, 2)))
+	s.RegisterService(&slowServiceDesc, newSlowUserService())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	cc := n.dialAddr(t, "server-1")
+	require.NoError(t, invokeCheck(ctx, cc, ""))
+	require.NoError(t, invokeCheck(ctx, cc, ""))
+	err := invokeCheck(ctx, cc, "")
+	assert.Equal(t, status.Error(codes.ResourceExhausted, "ratelimit: 触发限流, method: /user.UserService/Check"), err)
+	// 健康检查不限流
+	for i := 0; i < 5; i++ {
+		_, err = healthpb.NewHealthClient(cc).Check(ctx, &healthpb.HealthCheckRequest{})
+		require.NoError(t, err)
+	}
+}
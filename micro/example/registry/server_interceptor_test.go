@@ -0,0 +1,93 @@
+package registry
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zhuguangfeng/study/micro"
+	"github.com/zhuguangfeng/study/micro/interceptor"
+	"github.com/zhuguangfeng/study/micro/registry/memory"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"sync"
+	"testing"
+)
+
+func TestServer_Interceptors(t *testing.T) {
+	r := memory.NewRegistry()
+	defer r.Close()
+	n := newBufNet()
+	var (
+		mutex sync.Mutex
+		logs  []interceptor.AccessLog
+		order []string
+	)
+	trace := func(name string) grpc.UnaryServerInterceptor {
+		return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			mutex.Lock()
+			order = append(order, name)
+			mutex.Unlock()
+			return handler(ctx, req)
+		}
+	}
+	recorder := interceptor.NewLatencyRecorder()
+	n.startServer(t, r, "server-1", micro.ServerWithUnaryInterceptors(
+		trace("first"),
+		// 访问日志要拿到请求 ID，并且记录 panic 转换之后的错误码
+		interceptor.NewRequestIDBuilder().BuildUnaryServerInterceptor(),
+		interceptor.NewAccessLogBuilder(interceptor.AccessLogWithLogFunc(func(ctx context.Context, l interceptor.AccessLog) {
+			mutex.Lock()
+			logs = append(logs, l)
+			mutex.Unlock()
+		})).BuildUnaryServerInterceptor(),
+		interceptor.NewRecoveryBuilder().BuildUnaryServerInterceptor(),
+		interceptor.NewMetricsBuilder(recorder).BuildUnaryServerInterceptor(),
+	), micro.ServerWithUnaryInterceptors(
+		trace("second"),
+		// 没有注册过的服务会 panic
+		func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			if r, ok := req.(*healthpb.HealthCheckRequest); ok && r.Service == "panic" {
+				panic("boom")
+			}
+			return handler(ctx, req)
+		},
+	))
+	cc := n.dialService(t, r, micro.ClientWithDialOptions(
+		grpc.WithChainUnaryInterceptor(interceptor.NewRequestIDBuilder().BuildUnaryClientInterceptor())))
+	waitServers(t, context.Background(), cc, "server-1")
+	mutex.Lock()
+	logs, order = nil, nil
+	mutex.Unlock()
+	const method = "/grpc.health.v1.Health/Check"
+	before := recorder.Snapshot()[method].Count
+
+	// 请求 ID 一路传到服务端，并且通过响应头返回
+	hc := healthpb.NewHealthClient(cc)
+	var header metadata.MD
+	ctx := interceptor.WithRequestID(context.Background(), "req-1")
+	_, err := hc.Check(ctx, &healthpb.HealthCheckRequest{}, grpc.Header(&header))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"req-1"}, header.Get(interceptor.RequestIDMetadataKey))
+
+	// panic 变成 Internal 错误，后面的请求不受影响
+	_, err = hc.Check(ctx, &healthpb.HealthCheckRequest{Service: "panic"})
+	assert.Equal(t, codes.Internal, status.Code(err))
+	_, err = hc.Check(ctx, &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.Equal(t, []string{"first", "second", "first", "second", "first", "second"}, order)
+	require.Len(t, logs, 3)
+	for i, code := range []codes.Code{codes.OK, codes.Internal, codes.OK} {
+		assert.Equal(t, "req-1", logs[i].RequestID)
+		assert.Equal(t, code, logs[i].Code)
+	}
+	// metrics 在 recovery 里面，panic 的请求没有记录
+	stats := recorder.Snapshot()[method]
+	assert.Equal(t, before+2, stats.Count)
+	assert.Equal(t, map[codes.Code]int64{codes.OK: stats.Count}, stats.Codes)
+}
@@ -0,0 +1,216 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zhuguangfeng/study/micro"
+	"github.com/zhuguangfeng/study/micro/registry"
+	"github.com/zhuguangfeng/study/micro/registry/memory"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/test/bufconn"
+	"net"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func addressesOf(t *testing.T, r registry.Registry) []string {
+	instances, err := r.ListServices(context.Background(), "user-service")
+	require.NoError(t, err)
+	res := make([]string, 0, len(instances))
+	for _, si := range instances {
+		res = append(res, si.Address)
+	}
+	return res
+}
+
+func TestServer_ShutdownOnContext(t *testing.T) {
+	r := memory.NewRegistry()
+	defer r.Close()
+	n := newBufNet()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, done := n.runServer(ctx, t, r, "server-1", nil, micro.ServerWithDrainTimeout(time.Millisecond*500))
+	n.startServer(t, r, "server-2")
+	cc := n.dialService(t, r)
+	waitServers(t, context.Background(), cc, "server-1", "server-2")
+
+	cancel()
+	// 先注销，这个时候还在正常处理请求
+	assert.Eventually(t, func() bool {
+		addrs := addressesOf(t, r)
+		return len(addrs) == 1 && addrs[0] == "server-2"
+	}, time.Second, time.Millisecond*10)
+	conn, err := grpc.Dial("server-1", grpc.WithContextDialer(n.dial),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = healthpb.NewHealthClient(conn).Check(context.Background(), &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+	select {
+	case <-done:
+		t.Fatal("还在 drain 的时候就退出了")
+	default:
+	}
+
+	// 客户端感知到下线之后才停止
+	waitServers(t, context.Background(), cc, "server-2")
+	select {
+	case err = <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second * 2):
+		t.Fatal("没有退出")
+	}
+}
+
+func TestServer_ShutdownStopTimeout(t *testing.T) {
+	r := memory.NewRegistry()
+	defer r.Close()
+	n := newBufNet()
+	s, done := n.runServer(context.Background(), t, r, "server-1", nil,
+		micro.ServerWithDrainTimeout(0), micro.ServerWithStopTimeout(time.Millisecond*200))
+
+	cc := n.dialService(t, r)
+	waitServers(t, context.Background(), cc, "server-1")
+	// 一直不结束的流，GracefulStop 会一直等
+	stream, err := healthpb.NewHealthClient(cc).Watch(context.Background(),
+		&healthpb.HealthCheckRequest{Service: "user-service"})
+	require.NoError(t, err)
+	resp, err := stream.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, resp.Status)
+
+	start := time.Now()
+	require.NoError(t, s.Close())
+	assert.GreaterOrEqual(t, time.Since(start), time.Millisecond*200)
+	assert.Less(t, time.Since(start), time.Second*2)
+	// 强制停止之后流会被断开
+	for err == nil {
+		_, err = stream.Recv()
+	}
+	assert.Error(t, err)
+	assert.Empty(t, addressesOf(t, r))
+	assert.NoError(t, <-done)
+	// 重复调用没有问题
+	assert.NoError(t, s.Close())
+}
+
+func TestServer_ShutdownOnSignal(t *testing.T) {
+	// 测试自己也监听这个信号，避免 Start 监听之前收到信号导致进程退出
+	sigChan := make(chan os.Signal, 16)
+	signal.Notify(sigChan, syscall.SIGUSR1)
+	defer signal.Stop(sigChan)
+
+	r := memory.NewRegistry()
+	defer r.Close()
+	n := newBufNet()
+	_, done := n.runServer(context.Background(), t, r, "server-1", []os.Signal{syscall.SIGUSR1},
+		micro.ServerWithDrainTimeout(0))
+	assert.Eventually(t, func() bool {
+		return len(addressesOf(t, r)) == 1
+	}, time.Second, time.Millisecond*10)
+
+	p, err := os.FindProcess(os.Getpid())
+	require.NoError(t, err)
+	ticker := time.NewTicker(time.Millisecond * 50)
+	defer ticker.Stop()
+	timeout := time.After(time.Second * 5)
+	for {
+		require.NoError(t, p.Signal(syscall.SIGUSR1))
+		select {
+		case err = <-done:
+			assert.NoError(t, err)
+			assert.Empty(t, addressesOf(t, r))
+			return
+		case <-ticker.C:
+		case <-timeout:
+			t.Fatal("没有退出")
+		}
+	}
+}
+
+var (
+	errAcceptFailed   = errors.New("accept failed")
+	errRegistryFailed = errors.New("registry failed")
+)
+
+// faultyListener 在 fail 关闭之后 Accept 返回错误，模拟 Serve 自己出错
+type faultyListener struct {
+	net.Listener
+	fail   chan struct{}
+	closed atomic.Bool
+}
+
+func newFaultyListener() *faultyListener {
+	return &faultyListener{Listener: bufconn.Listen(1024), fail: make(chan struct{})}
+}
+
+func (l *faultyListener) Accept() (net.Conn, error) {
+	<-l.fail
+	return nil, errAcceptFailed
+}
+
+func (l *faultyListener) Close() error {
+	l.closed.Store(true)
+	return l.Listener.Close()
+}
+
+type memoryRegistry = memory.Registry
+
+// failingRegistry 注册总是失败
+type failingRegistry struct {
+	*memoryRegistry
+}
+
+func (failingRegistry) Registry(ctx context.Context, si registry.ServiceInstance) error {
+	return errRegistryFailed
+}
+
+func TestServer_ServeError(t *testing.T) {
+	r := memory.NewRegistry()
+	defer r.Close()
+	s, err := micro.NewServer("user-service", micro.ServiceWithRegistry(r),
+		micro.ServerWithAddress("server-1"), micro.ServerWithDrainTimeout(0))
+	require.NoError(t, err)
+	l := newFaultyListener()
+	done := make(chan error, 1)
+	go func() {
+		done <- s.StartWithListener(context.Background(), l)
+	}()
+	assert.Eventually(t, func() bool {
+		return len(addressesOf(t, r)) == 1
+	}, time.Second, time.Millisecond*10)
+
+	// Serve 自己出错了也要注销，健康检查返回 NOT_SERVING
+	close(l.fail)
+	select {
+	case err = <-done:
+		assert.ErrorIs(t, err, errAcceptFailed)
+	case <-time.After(time.Second * 2):
+		t.Fatal("没有退出")
+	}
+	assert.Empty(t, addressesOf(t, r))
+	resp, err := s.Health().Check(context.Background(), &healthpb.HealthCheckRequest{Service: "user-service"})
+	require.NoError(t, err)
+	assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, resp.Status)
+}
+
+func TestServer_RegisterError(t *testing.T) {
+	r := memory.NewRegistry()
+	defer r.Close()
+	s, err := micro.NewServer("user-service", micro.ServiceWithRegistry(failingRegistry{r}),
+		micro.ServerWithAddress("server-1"))
+	require.NoError(t, err)
+	l := newFaultyListener()
+	err = s.StartWithListener(context.Background(), l)
+	assert.ErrorIs(t, err, errRegistryFailed)
+	// 注册失败的时候 listener 也要关掉
+	assert.True(t, l.closed.Load())
+}
@@ -0,0 +1,228 @@
+package registry
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zhuguangfeng/study/micro"
+	"github.com/zhuguangfeng/study/micro/registry/memory"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 测试的时候生成的自签名 CA
+type testCA struct {
+	dir    string
+	file   string
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	serial int64
+}
+
+func newTestCA(t *testing.T, dir string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "micro-test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	ca := &testCA{dir: dir, file: filepath.Join(dir, "ca.pem"), cert: cert, key: key, serial: 1}
+	writePEM(t, ca.file, "CERTIFICATE", der)
+	return ca
+}
+
+// 签发证书，写到 name.pem 和 name-key.pem 里面
+func (ca *testCA) issue(t *testing.T, name string, cn string, dnsNames ...string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	ca.serial++
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.serial),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	certFile := filepath.Join(ca.dir, name+".pem")
+	keyFile := filepath.Join(ca.dir, name+"-key.pem")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+	return certFile, keyFile
+}
+
+func writePEM(t *testing.T, file string, typ string, der []byte) {
+	require.NoError(t, os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600))
+}
+
+func TestServer_TLS(t *testing.T) {
+	ca := newTestCA(t, t.TempDir())
+	certFile, keyFile := ca.issue(t, "server", "server-1", "user-service")
+	serverTLS, err := micro.NewServerTLSConfig(certFile, keyFile)
+	require.NoError(t, err)
+	r := memory.NewRegistry()
+	defer r.Close()
+	n := newBufNet()
+	n.startServer(t, r, "server-1", micro.ServerWithTLS(serverTLS))
+
+	// 服务名就是证书里面的域名
+	clientTLS, err := micro.NewClientTLSConfig(micro.TLSWithCA(ca.file))
+	require.NoError(t, err)
+	cc := n.dialService(t, r, micro.ClientWithTLS(clientTLS))
+	waitServers(t, context.Background(), cc, "server-1")
+
+	// 不信任这个 CA 的客户端连不上
+	other := newTestCA(t, t.TempDir())
+	clientTLS, err = micro.NewClientTLSConfig(micro.TLSWithCA(other.file))
+	require.NoError(t, err)
+	cc = n.dialService(t, r, micro.ClientWithTLS(clientTLS))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*500)
+	defer cancel()
+	_, err = healthpb.NewHealthClient(cc).Check(ctx, &healthpb.HealthCheckRequest{})
+	assert.Error(t, err)
+}
+
+func TestServer_MTLS(t *testing.T) {
+	ca := newTestCA(t, t.TempDir())
+	certFile, keyFile := ca.issue(t, "server", "server-1", "user-service")
+	serverTLS, err := micro.NewServerTLSConfig(certFile, keyFile, micro.TLSWithCA(ca.file))
+	require.NoError(t, err)
+	r := memory.NewRegistry()
+	defer r.Close()
+	n := newBufNet()
+	var identity atomic.Value
+	n.startServer(t, r, "server-1", micro.ServerWithTLS(serverTLS),
+		micro.ServerWithUnaryInterceptors(func(ctx context.Context, req any,
+			info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			id, ok := micro.PeerIdentity(ctx)
+			if !ok {
+				return nil, status.Error(codes.Unauthenticated, "no identity")
+			}
+			identity.Store(id.CommonName)
+			return handler(ctx, req)
+		}))
+
+	// 没有客户端证书连不上
+	clientTLS, err := micro.NewClientTLSConfig(micro.TLSWithCA(ca.file))
+	require.NoError(t, err)
+	cc := n.dialService(t, r, micro.ClientWithTLS(clientTLS))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*500)
+	defer cancel()
+	_, err = healthpb.NewHealthClient(cc).Check(ctx, &healthpb.HealthCheckRequest{})
+	assert.Error(t, err)
+
+	// 服务端能拿到客户端证书里面的身份
+	clientCert, clientKey := ca.issue(t, "client", "order-service")
+	clientTLS, err = micro.NewClientTLSConfig(micro.TLSWithCA(ca.file),
+		micro.TLSWithCertificate(clientCert, clientKey))
+	require.NoError(t, err)
+	cc = n.dialService(t, r, micro.ClientWithTLS(clientTLS))
+	waitServers(t, context.Background(), cc, "server-1")
+	assert.Equal(t, "order-service", identity.Load())
+}
+
+func TestServer_TLSReload(t *testing.T) {
+	ca := newTestCA(t, t.TempDir())
+	certFile, keyFile := ca.issue(t, "server", "server-v1", "user-service")
+	serverTLS, err := micro.NewServerTLSConfig(certFile, keyFile,
+		micro.TLSWithReloadInterval(time.Millisecond*50))
+	require.NoError(t, err)
+	r := memory.NewRegistry()
+	defer r.Close()
+	n := newBufNet()
+	n.startServer(t, r, "server-1", micro.ServerWithTLS(serverTLS))
+
+	clientTLS, err := micro.NewClientTLSConfig(micro.TLSWithCA(ca.file))
+	require.NoError(t, err)
+	clientTLS.ServerName = "user-service"
+	// 直接握手，看服务端用的是哪个证书
+	serverCN := func() string {
+		conn, err := n.dial(context.Background(), "server-1")
+		require.NoError(t, err)
+		defer conn.Close()
+		tc := tls.Client(conn, clientTLS)
+		require.NoError(t, tc.Handshake())
+		return tc.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+	assert.Equal(t, "server-v1", serverCN())
+
+	// 证书轮换之后，新的连接用新的证书
+	ca.issue(t, "server", "server-v2", "user-service")
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(certFile, future, future))
+	assert.Eventually(t, func() bool {
+		return serverCN() == "server-v2"
+	}, time.Second*2, time.Millisecond*20)
+}
+
+func TestServer_TLSReloadBadCA(t *testing.T) {
+	ca := newTestCA(t, t.TempDir())
+	certFile, keyFile := ca.issue(t, "server", "server-v1", "user-service")
+	serverTLS, err := micro.NewServerTLSConfig(certFile, keyFile, micro.TLSWithCA(ca.file),
+		micro.TLSWithReloadInterval(time.Millisecond*50))
+	require.NoError(t, err)
+	r := memory.NewRegistry()
+	defer r.Close()
+	n := newBufNet()
+	n.startServer(t, r, "server-1", micro.ServerWithTLS(serverTLS))
+
+	clientCert, clientKey := ca.issue(t, "client", "order-service")
+	clientTLS, err := micro.NewClientTLSConfig(micro.TLSWithCA(ca.file),
+		micro.TLSWithCertificate(clientCert, clientKey))
+	require.NoError(t, err)
+	clientTLS.ServerName = "user-service"
+	serverCN := func() string {
+		conn, err := n.dial(context.Background(), "server-1")
+		require.NoError(t, err)
+		defer conn.Close()
+		tc := tls.Client(conn, clientTLS)
+		require.NoError(t, tc.Handshake())
+		return tc.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+	assert.Equal(t, "server-v1", serverCN())
+
+	// CA 文件坏了，新的证书也不会用上，证书和 CA 要一起换
+	ca.issue(t, "server", "server-v2", "user-service")
+	require.NoError(t, os.WriteFile(ca.file, []byte("broken"), 0600))
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(ca.file, future, future))
+	time.Sleep(time.Millisecond * 200)
+	assert.Equal(t, "server-v1", serverCN())
+
+	// CA 修好之后一起加载
+	writePEM(t, ca.file, "CERTIFICATE", ca.cert.Raw)
+	future = future.Add(time.Minute)
+	require.NoError(t, os.Chtimes(ca.file, future, future))
+	assert.Eventually(t, func() bool {
+		return serverCN() == "server-v2"
+	}, time.Second*2, time.Millisecond*20)
+}
@@ -2,36 +2,109 @@ package micro
 
 import (
 	"context"
+	"errors"
 	"github.com/zhuguangfeng/study/micro/registry"
+	"google.golang.org/grpc/attributes"
 	"google.golang.org/grpc/resolver"
+	"reflect"
+	"sort"
+	"sync"
 	"time"
 )
 
+// Client.Dial 用的 scheme，target 是 registry:///服务名
+const registryScheme = "registry"
+
+// ErrNoHealthyInstance 服务有实例，但是全部被标记成了不健康
+var ErrNoHealthyInstance = errors.New("micro: 没有健康的实例")
+
+type ResolverOption func(b *grpcResolverBuilder)
+
 type grpcResolverBuilder struct {
 	r       registry.Registry
 	timeout time.Duration
+	// 全量同步的间隔，用来修复漏掉的事件
+	resyncInterval time.Duration
+	// 两次 ResolveNow 触发的全量同步之间最少间隔多久
+	minResolveInterval time.Duration
+	// 订阅和全量同步失败之后的重试间隔
+	backoffBase time.Duration
+	backoffMax  time.Duration
+	// 实例全部不健康的时候是不是还用全部的实例
+	unhealthyFallback bool
 }
 
 func (b *grpcResolverBuilder) Scheme() string {
-	//TODO implement me
-	panic("implement me")
+	return registryScheme
+}
+
+func NewRegistryBuilder(r registry.Registry, timeout time.Duration, opts ...ResolverOption) (*grpcResolverBuilder, error) {
+	res := &grpcResolverBuilder{
+		r:                  r,
+		timeout:            timeout,
+		resyncInterval:     time.Minute,
+		minResolveInterval: time.Second,
+		backoffBase:        time.Millisecond * 100,
+		backoffMax:         time.Second * 10,
+	}
+	for _, opt := range opts {
+		opt(res)
+	}
+	return res, nil
+}
+
+// ResolverWithResyncInterval 全量同步的间隔
+func ResolverWithResyncInterval(interval time.Duration) ResolverOption {
+	return func(b *grpcResolverBuilder) {
+		b.resyncInterval = interval
+	}
+}
+
+// ResolverWithMinResolveInterval gRPC 连接出问题的时候会频繁调用 ResolveNow
+// 两次全量同步之间至少间隔 interval，中间的 ResolveNow 会被合并
+func ResolverWithMinResolveInterval(interval time.Duration) ResolverOption {
+	return func(b *grpcResolverBuilder) {
+		b.minResolveInterval = interval
+	}
 }
 
-func NewRegistryBuilder(r registry.Registry, timeout time.Duration) (*grpcResolverBuilder, error) {
-	return &grpcResolverBuilder{
-		r:       r,
-		timeout: timeout,
-	}, nil
+// ResolverWithBackoff 订阅或者全量同步失败之后，从 base 开始指数退避重试，最多间隔 max
+func ResolverWithBackoff(base, max time.Duration) ResolverOption {
+	return func(b *grpcResolverBuilder) {
+		b.backoffBase = base
+		b.backoffMax = max
+	}
+}
+
+// ResolverWithUnhealthyFallback 实例全部被标记成不健康的时候还是用全部的实例
+// 全部不健康的时候有可能是健康检查自己出了问题，默认不开启，这时候请求会直接失败
+func ResolverWithUnhealthyFallback() ResolverOption {
+	return func(b *grpcResolverBuilder) {
+		b.unhealthyFallback = true
+	}
 }
 
 func (b *grpcResolverBuilder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
+	ctx, cancel := context.WithCancel(context.Background())
 	r := &grpcResolver{
-		cc:      cc,
-		r:       b.r,
-		target:  target,
-		timeout: b.timeout,
+		cc:                 cc,
+		r:                  b.r,
+		target:             target,
+		timeout:            b.timeout,
+		resyncInterval:     b.resyncInterval,
+		minResolveInterval: b.minResolveInterval,
+		backoff: backoff{
+			base: b.backoffBase,
+			max:  b.backoffMax,
+		},
+		unhealthyFallback: b.unhealthyFallback,
+		ctx:               ctx,
+		cancel:            cancel,
+		done:              make(chan struct{}),
+		resolveNowCh:      make(chan struct{}, 1),
+		instances:         make(map[string]registry.ServiceInstance),
+		revisions:         make(map[string]int64),
 	}
-	r.resolve()
 
 	go r.watch()
 
@@ -39,66 +112,246 @@ func (b *grpcResolverBuilder) Build(target resolver.Target, cc resolver.ClientCo
 }
 
 type grpcResolver struct {
-	target  resolver.Target
-	r       registry.Registry
-	cc      resolver.ClientConn
-	timeout time.Duration
-	close   chan struct{}
+	target             resolver.Target
+	r                  registry.Registry
+	cc                 resolver.ClientConn
+	timeout            time.Duration
+	resyncInterval     time.Duration
+	minResolveInterval time.Duration
+	backoff            backoff
+	unhealthyFallback  bool
+
+	// Close 的时候取消，同时取消订阅和正在进行的全量同步
+	ctx    context.Context
+	cancel context.CancelFunc
+	// watch 退出的时候关闭
+	done         chan struct{}
+	resolveNowCh chan struct{}
+
+	mutex sync.Mutex
+	// 当前的实例，key 是实例的地址
+	instances map[string]registry.ServiceInstance
+	// 每个实例最后一次事件的版本号，用来丢弃过期的事件
+	revisions map[string]int64
 }
 
+// ResolveNow 只是发个信号，真正的全量同步在 watch 里面做
 func (g *grpcResolver) ResolveNow(options resolver.ResolveNowOptions) {
-	g.resolve()
+	select {
+	case g.resolveNowCh <- struct{}{}:
+	default:
+		// 已经有一个信号还没处理，合并掉
+	}
 }
 
+// 订阅、全量同步、重试都在这个 goroutine 里面，直到 Close
 func (g *grpcResolver) watch() {
-	events, err := g.r.Subscribe(g.target.Endpoint())
-	if err != nil {
-		g.cc.ReportError(err)
-		return
+	defer close(g.done)
+	var (
+		events <-chan registry.Event
+		// 下一次重试或者延迟的全量同步
+		timer  *time.Timer
+		timerC <-chan time.Time
+		// 上一次全量同步的时间
+		lastResolve time.Time
+	)
+	schedule := func(d time.Duration) {
+		if timer != nil {
+			timer.Stop()
+		}
+		timer = time.NewTimer(d)
+		timerC = timer.C
 	}
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+	// 先订阅再全量同步，这样全量同步之后的变更都不会漏掉
+	resync := func() {
+		timerC = nil
+		if events == nil {
+			ch, err := g.r.Subscribe(g.ctx, g.target.Endpoint())
+			if err != nil {
+				g.cc.ReportError(err)
+				schedule(g.backoff.next())
+				return
+			}
+			events = ch
+		}
+		// 订阅里面积压的事件都发生在全量同步之前，全量的结果里面已经有了，
+		// 不丢掉的话会在新的结果上面再应用一遍，实例会短暂地闪一下
+		for drained := false; !drained; {
+			select {
+			case _, ok := <-events:
+				if !ok {
+					events = nil
+					drained = true
+				}
+			default:
+				drained = true
+			}
+		}
+		lastResolve = time.Now()
+		if err := g.resolve(); err != nil || events == nil {
+			// 订阅中断了也要重试，重新订阅
+			schedule(g.backoff.next())
+			return
+		}
+		g.backoff.reset()
+	}
+
+	resync()
+	ticker := time.NewTicker(g.resyncInterval)
+	defer ticker.Stop()
 
 	for {
 		select {
-		case <-events:
-			g.resolve()
-
-			//case event := <-events:
-			//switch event.Type {
-			//case "ADD":
-			//case "DELETE":
-			//	//删除已有借点
-			//
-			//}
-		case <-g.close:
+		case event, ok := <-events:
+			if !ok {
+				// 订阅中断了，重新订阅之后全量同步一次
+				events = nil
+				if g.ctx.Err() == nil {
+					schedule(g.backoff.next())
+				}
+				continue
+			}
+			// 增量更新
+			g.apply(event)
+		case <-ticker.C:
+			// 定期全量同步，修复漏掉的事件
+			if timerC == nil {
+				resync()
+			}
+		case <-g.resolveNowCh:
+			if timerC != nil {
+				// 马上就会重试了
+				continue
+			}
+			if wait := g.minResolveInterval - time.Since(lastResolve); wait > 0 {
+				schedule(wait)
+				continue
+			}
+			resync()
+		case <-timerC:
+			resync()
+		case <-g.ctx.Done():
 			return
 		}
 	}
+}
 
+func (g *grpcResolver) apply(event registry.Event) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	addr := event.Instance.Address
+	if event.Revision != 0 && event.Revision < g.revisions[addr] {
+		// 过期的事件
+		return
+	}
+	switch event.Type {
+	case registry.EventTypeAdd, registry.EventTypeUpdate:
+		g.instances[addr] = event.Instance
+		g.revisions[addr] = event.Revision
+	case registry.EventTypeDelete:
+		// 同一个订阅里面的事件是有序的，删掉之后不会再收到更早的事件，版本号不用留着
+		delete(g.instances, addr)
+		delete(g.revisions, addr)
+	default:
+		return
+	}
+	_ = g.updateState()
 }
 
-func (g *grpcResolver) resolve() {
-	ctx, cancel := context.WithTimeout(context.Background(), g.timeout)
+func (g *grpcResolver) resolve() error {
+	ctx, cancel := context.WithTimeout(g.ctx, g.timeout)
 	defer cancel()
 	instances, err := g.r.ListServices(ctx, g.target.Endpoint())
 	if err != nil {
 		g.cc.ReportError(err)
-		return
+		return err
 	}
-	address := make([]resolver.Address, 0, len(instances))
 
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.instances = make(map[string]registry.ServiceInstance, len(instances))
 	for _, si := range instances {
-		address = append(address, resolver.Address{Addr: si.Address})
+		g.instances[si.Address] = si
+	}
+	// 已经不在的实例的版本号没用了，不删的话实例上下线多了会一直涨
+	for addr := range g.revisions {
+		if _, ok := g.instances[addr]; !ok {
+			delete(g.revisions, addr)
+		}
+	}
+	return g.updateState()
+}
+
+// 把当前的实例推给 gRPC，调用方要持有锁
+func (g *grpcResolver) updateState() error {
+	address := make([]resolver.Address, 0, len(g.instances))
+
+	for _, si := range g.instances {
+		if si.Unhealthy {
+			continue
+		}
+		address = append(address, newAddress(si))
 	}
+	allUnhealthy := len(address) == 0 && len(g.instances) > 0
+	if allUnhealthy && g.unhealthyFallback {
+		for _, si := range g.instances {
+			address = append(address, newAddress(si))
+		}
+		allUnhealthy = false
+	}
+	// 保证顺序稳定，不然每次推送都像是地址变了
+	sort.Slice(address, func(i, j int) bool {
+		return address[i].Addr < address[j].Addr
+	})
 
-	err = g.cc.UpdateState(resolver.State{
+	err := g.cc.UpdateState(resolver.State{
 		Addresses: address,
 	})
+	if allUnhealthy {
+		// 没有地址的时候 balancer 会返回 ErrBadResolverState，报告真正的原因，让请求快速失败
+		g.cc.ReportError(ErrNoHealthyInstance)
+		return nil
+	}
 	if err != nil {
 		g.cc.ReportError(err)
-		return
 	}
+	return err
 }
 
+// Close 停止订阅，等 watch 退出之后才返回
 func (g *grpcResolver) Close() {
-	close(g.close)
+	g.cancel()
+	<-g.done
+}
+
+// 实例信息在 resolver.Address.Attributes 里面的 key
+type instanceAttrKey struct{}
+
+// ServiceInstance 里面有 map，不能直接比较，所以包一层实现 Equal
+type instanceAttr struct {
+	si registry.ServiceInstance
+}
+
+func (i instanceAttr) Equal(o any) bool {
+	oi, ok := o.(instanceAttr)
+	return ok && reflect.DeepEqual(i.si, oi.si)
+}
+
+func newAddress(si registry.ServiceInstance) resolver.Address {
+	return resolver.Address{
+		Addr:       si.Address,
+		Attributes: attributes.New(instanceAttrKey{}, instanceAttr{si: si}),
+	}
+}
+
+// InstanceFromAddress 取出 grpcResolver 放在 resolver.Address 里面的实例信息
+// 负载均衡和路由可以根据里面的权重、分组、可用区等信息做决策
+func InstanceFromAddress(addr resolver.Address) (registry.ServiceInstance, bool) {
+	val, ok := addr.Attributes.Value(instanceAttrKey{}).(instanceAttr)
+	return val.si, ok
 }
@@ -0,0 +1,525 @@
+package micro
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zhuguangfeng/study/micro/registry"
+	"google.golang.org/grpc/resolver"
+	"net/url"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGrpcResolver_resolve(t *testing.T) {
+	instances := []registry.ServiceInstance{
+		{
+			Name:    "user-service",
+			Address: "localhost:8081",
+			Version: "v1.0.0",
+			Weight:  10,
+			Zone:    "zone-a",
+			Group:   "canary",
+			Tags:    map[string]string{"env": "test"},
+		},
+		{
+			Name:    "user-service",
+			Address: "localhost:8082",
+		},
+	}
+	cc := &fakeClientConn{}
+	r := &grpcResolver{
+		target:  resolver.Target{},
+		r:       newFakeRegistry(instances...),
+		cc:      cc,
+		timeout: time.Second,
+		ctx:     context.Background(),
+	}
+	require.NoError(t, r.resolve())
+
+	require.Len(t, cc.state.Addresses, 2)
+	for i, addr := range cc.state.Addresses {
+		assert.Equal(t, instances[i].Address, addr.Addr)
+		si, ok := InstanceFromAddress(addr)
+		require.True(t, ok)
+		assert.Equal(t, instances[i], si)
+	}
+	// 实例信息一样的地址要认为是相等的
+	assert.True(t, cc.state.Addresses[0].Equal(newAddress(instances[0])))
+	assert.False(t, cc.state.Addresses[0].Equal(newAddress(instances[1])))
+}
+
+func TestGrpcResolver_apply(t *testing.T) {
+	cc := &fakeClientConn{}
+	r := &grpcResolver{
+		r: newFakeRegistry(registry.ServiceInstance{
+			Name: "user-service", Address: "localhost:8081",
+		}),
+		cc:        cc,
+		timeout:   time.Second,
+		ctx:       context.Background(),
+		revisions: make(map[string]int64),
+	}
+	require.NoError(t, r.resolve())
+
+	testCases := []struct {
+		name      string
+		event     registry.Event
+		wantAddrs []string
+	}{
+		{
+			name: "add",
+			event: registry.Event{
+				Type:     registry.EventTypeAdd,
+				Instance: registry.ServiceInstance{Name: "user-service", Address: "localhost:8082"},
+				Revision: 10,
+			},
+			wantAddrs: []string{"localhost:8081", "localhost:8082"},
+		},
+		{
+			name: "update",
+			event: registry.Event{
+				Type:     registry.EventTypeUpdate,
+				Instance: registry.ServiceInstance{Name: "user-service", Address: "localhost:8082", Weight: 100},
+				Revision: 12,
+			},
+			wantAddrs: []string{"localhost:8081", "localhost:8082"},
+		},
+		{
+			name: "stale delete",
+			event: registry.Event{
+				Type:     registry.EventTypeDelete,
+				Instance: registry.ServiceInstance{Name: "user-service", Address: "localhost:8082"},
+				Revision: 11,
+			},
+			wantAddrs: []string{"localhost:8081", "localhost:8082"},
+		},
+		{
+			name: "delete",
+			event: registry.Event{
+				Type:     registry.EventTypeDelete,
+				Instance: registry.ServiceInstance{Name: "user-service", Address: "localhost:8081"},
+				Revision: 13,
+			},
+			wantAddrs: []string{"localhost:8082"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r.apply(tc.event)
+			addrs := make([]string, 0, len(cc.state.Addresses))
+			for _, addr := range cc.state.Addresses {
+				addrs = append(addrs, addr.Addr)
+			}
+			assert.Equal(t, tc.wantAddrs, addrs)
+		})
+	}
+	// 更新之后的权重要推给 gRPC
+	si, ok := InstanceFromAddress(cc.state.Addresses[0])
+	require.True(t, ok)
+	assert.Equal(t, uint32(100), si.Weight)
+	// 删掉的实例不再记录版本号
+	assert.Equal(t, map[string]int64{"localhost:8082": 12}, r.revisions)
+
+	// 全量同步之后不在的实例的版本号也会被清理掉
+	r.revisions["localhost:8083"] = 14
+	require.NoError(t, r.resolve())
+	assert.Equal(t, map[string]int64{}, r.revisions)
+}
+
+func TestGrpcResolver_Unhealthy(t *testing.T) {
+	testCases := []struct {
+		name      string
+		instances []registry.ServiceInstance
+		fallback  bool
+		wantAddrs []string
+		wantErr   error
+	}{
+		{
+			name: "exclude unhealthy",
+			instances: []registry.ServiceInstance{
+				{Name: "user-service", Address: "localhost:8081"},
+				{Name: "user-service", Address: "localhost:8082", Unhealthy: true},
+				{Name: "user-service", Address: "localhost:8083"},
+			},
+			wantAddrs: []string{"localhost:8081", "localhost:8083"},
+		},
+		{
+			// 全部不健康的时候不发请求，并且报告错误
+			name: "all unhealthy",
+			instances: []registry.ServiceInstance{
+				{Name: "user-service", Address: "localhost:8081", Unhealthy: true},
+				{Name: "user-service", Address: "localhost:8082", Unhealthy: true},
+			},
+			wantAddrs: []string{},
+			wantErr:   ErrNoHealthyInstance,
+		},
+		{
+			name: "all unhealthy with fallback",
+			instances: []registry.ServiceInstance{
+				{Name: "user-service", Address: "localhost:8081", Unhealthy: true},
+				{Name: "user-service", Address: "localhost:8082", Unhealthy: true},
+			},
+			fallback:  true,
+			wantAddrs: []string{"localhost:8081", "localhost:8082"},
+		},
+		{
+			name:      "no instance",
+			wantAddrs: []string{},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cc := &fakeClientConn{}
+			r := &grpcResolver{
+				r:                 newFakeRegistry(tc.instances...),
+				cc:                cc,
+				timeout:           time.Second,
+				unhealthyFallback: tc.fallback,
+				ctx:               context.Background(),
+			}
+			require.NoError(t, r.resolve())
+			addrs := make([]string, 0, len(cc.state.Addresses))
+			for _, addr := range cc.state.Addresses {
+				addrs = append(addrs, addr.Addr)
+			}
+			assert.Equal(t, tc.wantAddrs, addrs)
+			assert.Equal(t, tc.wantErr, cc.getErr())
+		})
+	}
+}
+
+func TestGrpcResolverBuilder_Scheme(t *testing.T) {
+	b, err := NewRegistryBuilder(newFakeRegistry(), time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "registry", b.Scheme())
+}
+
+// 构造一个 resolver，等第一次全量同步完成
+func newTestResolver(t *testing.T, r registry.Registry, opts ...ResolverOption) (*grpcResolver, *fakeClientConn) {
+	opts = append([]ResolverOption{ResolverWithBackoff(time.Millisecond*10, time.Millisecond*50)}, opts...)
+	b, err := NewRegistryBuilder(r, time.Second, opts...)
+	require.NoError(t, err)
+	cc := &fakeClientConn{}
+	res, err := b.Build(resolver.Target{URL: url.URL{Scheme: "registry", Path: "/user-service"}}, cc, resolver.BuildOptions{})
+	require.NoError(t, err)
+	t.Cleanup(res.Close)
+	return res.(*grpcResolver), cc
+}
+
+func TestGrpcResolver_Watch(t *testing.T) {
+	fr := newFakeRegistry(registry.ServiceInstance{Name: "user-service", Address: "localhost:8081"})
+	_, cc := newTestResolver(t, fr)
+	cc.waitAddrs(t, "localhost:8081")
+
+	ctx := context.Background()
+	require.NoError(t, fr.Registry(ctx, registry.ServiceInstance{Name: "user-service", Address: "localhost:8082"}))
+	cc.waitAddrs(t, "localhost:8081", "localhost:8082")
+
+	// 别的服务的变更不会影响
+	require.NoError(t, fr.Registry(ctx, registry.ServiceInstance{Name: "order-service", Address: "localhost:9091"}))
+	require.NoError(t, fr.UnRegistry(ctx, registry.ServiceInstance{Name: "user-service", Address: "localhost:8081"}))
+	cc.waitAddrs(t, "localhost:8082")
+}
+
+func TestGrpcResolver_Close(t *testing.T) {
+	fr := newFakeRegistry(registry.ServiceInstance{Name: "user-service", Address: "localhost:8081"})
+	r, cc := newTestResolver(t, fr)
+	cc.waitAddrs(t, "localhost:8081")
+	assert.Equal(t, 1, fr.subscribers())
+
+	r.Close()
+	select {
+	case <-r.done:
+	default:
+		t.Fatal("Close 返回之后 watch 应该已经退出")
+	}
+	// 订阅也取消了
+	assert.Eventually(t, func() bool {
+		return fr.subscribers() == 0
+	}, time.Second, time.Millisecond*10)
+	// 重复 Close 没有问题
+	r.Close()
+}
+
+func TestGrpcResolver_ResolveNow(t *testing.T) {
+	fr := newFakeRegistry(registry.ServiceInstance{Name: "user-service", Address: "localhost:8081"})
+	r, cc := newTestResolver(t, fr, ResolverWithMinResolveInterval(time.Millisecond*200))
+	cc.waitAddrs(t, "localhost:8081")
+	assert.Equal(t, int64(1), fr.listCnt.Load())
+
+	// 一瞬间调用很多次，只会触发一次全量同步
+	for i := 0; i < 100; i++ {
+		r.ResolveNow(resolver.ResolveNowOptions{})
+	}
+	assert.Eventually(t, func() bool {
+		return fr.listCnt.Load() == 2
+	}, time.Second, time.Millisecond*10)
+	time.Sleep(time.Millisecond * 300)
+	assert.Equal(t, int64(2), fr.listCnt.Load())
+}
+
+func TestGrpcResolver_ReportError(t *testing.T) {
+	fr := newFakeRegistry(registry.ServiceInstance{Name: "user-service", Address: "localhost:8081"})
+	listErr := errors.New("list error")
+	fr.setListErr(listErr)
+	_, cc := newTestResolver(t, fr)
+
+	assert.Eventually(t, func() bool {
+		return errors.Is(cc.getErr(), listErr) && fr.listCnt.Load() >= 3
+	}, time.Second, time.Millisecond*10, "失败之后要退避重试")
+
+	// 恢复之后能拿到实例
+	fr.setListErr(nil)
+	cc.waitAddrs(t, "localhost:8081")
+}
+
+func TestGrpcResolver_Resubscribe(t *testing.T) {
+	fr := newFakeRegistry(registry.ServiceInstance{Name: "user-service", Address: "localhost:8081"})
+	subErr := errors.New("subscribe error")
+	fr.setSubscribeErr(subErr)
+	_, cc := newTestResolver(t, fr)
+	assert.Eventually(t, func() bool {
+		return errors.Is(cc.getErr(), subErr)
+	}, time.Second, time.Millisecond*10)
+
+	fr.setSubscribeErr(nil)
+	cc.waitAddrs(t, "localhost:8081")
+	assert.Eventually(t, func() bool {
+		return fr.subscribers() == 1
+	}, time.Second, time.Millisecond*10)
+
+	// 订阅中断了要重新订阅，并且全量同步一次修复中断期间漏掉的变更
+	fr.dropSubscribers()
+	fr.mutex.Lock()
+	fr.instances["localhost:8082"] = registry.ServiceInstance{Name: "user-service", Address: "localhost:8082"}
+	fr.mutex.Unlock()
+	cc.waitAddrs(t, "localhost:8081", "localhost:8082")
+}
+
+// 订阅的时候已经积压了全量同步之前的事件
+type backlogRegistry struct {
+	*fakeRegistry
+	backlog []registry.Event
+}
+
+func (b *backlogRegistry) Subscribe(ctx context.Context, serviceName string) (<-chan registry.Event, error) {
+	ch := make(chan registry.Event, len(b.backlog))
+	for _, event := range b.backlog {
+		ch <- event
+	}
+	return ch, nil
+}
+
+func TestGrpcResolver_DropBacklog(t *testing.T) {
+	br := &backlogRegistry{
+		fakeRegistry: newFakeRegistry(registry.ServiceInstance{Name: "user-service", Address: "localhost:8081"}),
+		backlog: []registry.Event{
+			{Type: registry.EventTypeAdd, Instance: registry.ServiceInstance{Name: "user-service", Address: "localhost:8082"}, Revision: 1},
+			{Type: registry.EventTypeDelete, Instance: registry.ServiceInstance{Name: "user-service", Address: "localhost:8082"}, Revision: 2},
+		},
+	}
+	r, cc := newTestResolver(t, br)
+	cc.waitAddrs(t, "localhost:8081")
+	time.Sleep(time.Millisecond * 50)
+	// 积压的事件已经包含在全量同步的结果里面了，不会再应用一遍
+	cc.mutex.Lock()
+	assert.Equal(t, [][]string{{"localhost:8081"}}, cc.history)
+	cc.mutex.Unlock()
+	r.mutex.Lock()
+	assert.Empty(t, r.revisions)
+	r.mutex.Unlock()
+}
+
+// fakeRegistry 内存实现，可以注入错误
+type fakeRegistry struct {
+	mutex        sync.Mutex
+	instances    map[string]registry.ServiceInstance
+	subs         map[*fakeSubscriber]struct{}
+	listErr      error
+	subscribeErr error
+	listCnt      atomic.Int64
+}
+
+type fakeSubscriber struct {
+	name   string
+	ch     chan registry.Event
+	ctx    context.Context
+	cancel context.CancelFunc
+	// 正在发送的事件，关闭 ch 之前要等它们结束
+	wg sync.WaitGroup
+}
+
+func newFakeRegistry(instances ...registry.ServiceInstance) *fakeRegistry {
+	res := &fakeRegistry{
+		instances: make(map[string]registry.ServiceInstance, len(instances)),
+		subs:      make(map[*fakeSubscriber]struct{}),
+	}
+	for _, si := range instances {
+		res.instances[si.Address] = si
+	}
+	return res
+}
+
+func (f *fakeRegistry) Registry(ctx context.Context, si registry.ServiceInstance) error {
+	f.mutex.Lock()
+	_, ok := f.instances[si.Address]
+	f.instances[si.Address] = si
+	f.mutex.Unlock()
+	typ := registry.EventTypeAdd
+	if ok {
+		typ = registry.EventTypeUpdate
+	}
+	f.publish(registry.Event{Type: typ, Instance: si})
+	return nil
+}
+
+func (f *fakeRegistry) UnRegistry(ctx context.Context, si registry.ServiceInstance) error {
+	f.mutex.Lock()
+	delete(f.instances, si.Address)
+	f.mutex.Unlock()
+	f.publish(registry.Event{Type: registry.EventTypeDelete, Instance: si})
+	return nil
+}
+
+func (f *fakeRegistry) publish(event registry.Event) {
+	f.mutex.Lock()
+	subs := make([]*fakeSubscriber, 0, len(f.subs))
+	for sub := range f.subs {
+		if sub.name == event.Instance.Name {
+			sub.wg.Add(1)
+			subs = append(subs, sub)
+		}
+	}
+	f.mutex.Unlock()
+	for _, sub := range subs {
+		select {
+		case sub.ch <- event:
+		case <-sub.ctx.Done():
+		}
+		sub.wg.Done()
+	}
+}
+
+func (f *fakeRegistry) ListServices(ctx context.Context, serviceName string) ([]registry.ServiceInstance, error) {
+	f.listCnt.Add(1)
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.listErr != nil {
+		return nil, f.listErr
+	}
+	res := make([]registry.ServiceInstance, 0, len(f.instances))
+	for _, si := range f.instances {
+		if si.Name == serviceName || serviceName == "" {
+			res = append(res, si)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Address < res[j].Address
+	})
+	return res, nil
+}
+
+func (f *fakeRegistry) Subscribe(ctx context.Context, serviceName string) (<-chan registry.Event, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.subscribeErr != nil {
+		return nil, f.subscribeErr
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	sub := &fakeSubscriber{name: serviceName, ch: make(chan registry.Event), ctx: ctx, cancel: cancel}
+	f.subs[sub] = struct{}{}
+	go func() {
+		<-ctx.Done()
+		f.mutex.Lock()
+		delete(f.subs, sub)
+		f.mutex.Unlock()
+		sub.wg.Wait()
+		close(sub.ch)
+	}()
+	return sub.ch, nil
+}
+
+func (f *fakeRegistry) subscribers() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return len(f.subs)
+}
+
+// 模拟订阅中断
+func (f *fakeRegistry) dropSubscribers() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for sub := range f.subs {
+		sub.cancel()
+	}
+}
+
+func (f *fakeRegistry) setListErr(err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.listErr = err
+}
+
+func (f *fakeRegistry) setSubscribeErr(err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.subscribeErr = err
+}
+
+func (f *fakeRegistry) Close() error {
+	f.dropSubscribers()
+	return nil
+}
+
+type fakeClientConn struct {
+	resolver.ClientConn
+	mutex sync.Mutex
+	state resolver.State
+	err   error
+	// 每次推送的地址
+	history [][]string
+}
+
+func (f *fakeClientConn) UpdateState(state resolver.State) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.state = state
+	addrs := make([]string, 0, len(state.Addresses))
+	for _, addr := range state.Addresses {
+		addrs = append(addrs, addr.Addr)
+	}
+	f.history = append(f.history, addrs)
+	return nil
+}
+
+func (f *fakeClientConn) ReportError(err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.err = err
+}
+
+func (f *fakeClientConn) getErr() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.err
+}
+
+// 等到推给 gRPC 的地址变成 want
+func (f *fakeClientConn) waitAddrs(t *testing.T, want ...string) {
+	assert.Eventually(t, func() bool {
+		f.mutex.Lock()
+		defer f.mutex.Unlock()
+		addrs := make([]string, 0, len(f.state.Addresses))
+		for _, addr := range f.state.Addresses {
+			addrs = append(addrs, addr.Addr)
+		}
+		return reflect.DeepEqual(want, addrs)
+	}, time.Second, time.Millisecond*10)
+}
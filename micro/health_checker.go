@@ -0,0 +1,225 @@
+package micro
+
+import (
+	"context"
+	"errors"
+	"github.com/zhuguangfeng/study/micro/registry"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"sync"
+	"time"
+)
+
+var ErrRegistryNotUpdatable = errors.New("micro: 注册中心不支持更新实例信息")
+
+type HealthCheckerOption func(c *HealthChecker)
+
+// HealthChecker 定期通过 gRPC 健康检查探测注册中心里面的实例
+// 连续失败的实例会被标记成不健康，grpcResolver 不会把它们推给 gRPC
+// 可以跑在任意一个进程里面，例如单独部署的巡检服务
+type HealthChecker struct {
+	r        registry.Registry
+	updater  registry.Updater
+	services []string
+	interval time.Duration
+	timeout  time.Duration
+	// 连续失败多少次标记成不健康
+	failureThreshold int
+	// 连续成功多少次恢复成健康
+	successThreshold int
+	dialOpts         []grpc.DialOption
+
+	mutex sync.Mutex
+	// 探测用的连接，key 是地址
+	conns map[string]*grpc.ClientConn
+	// 正数表示连续成功的次数，负数表示连续失败的次数
+	counters map[instanceKey]int
+}
+
+type instanceKey struct {
+	name    string
+	address string
+}
+
+// NewHealthChecker r 要实现 registry.Updater，不然没办法标记实例
+func NewHealthChecker(r registry.Registry, services []string, opts ...HealthCheckerOption) (*HealthChecker, error) {
+	updater, ok := r.(registry.Updater)
+	if !ok {
+		return nil, ErrRegistryNotUpdatable
+	}
+	res := &HealthChecker{
+		r:                r,
+		updater:          updater,
+		services:         services,
+		interval:         time.Second * 10,
+		timeout:          time.Second,
+		failureThreshold: 3,
+		successThreshold: 2,
+		dialOpts:         []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())},
+		conns:            make(map[string]*grpc.ClientConn),
+		counters:         make(map[instanceKey]int),
+	}
+	for _, opt := range opts {
+		opt(res)
+	}
+	return res, nil
+}
+
+// HealthCheckerWithInterval 探测的间隔
+func HealthCheckerWithInterval(interval time.Duration) HealthCheckerOption {
+	return func(c *HealthChecker) {
+		c.interval = interval
+	}
+}
+
+// HealthCheckerWithTimeout 单次探测的超时时间
+func HealthCheckerWithTimeout(timeout time.Duration) HealthCheckerOption {
+	return func(c *HealthChecker) {
+		c.timeout = timeout
+	}
+}
+
+// HealthCheckerWithThreshold 连续失败 failure 次标记成不健康，连续成功 success 次恢复
+func HealthCheckerWithThreshold(failure, success int) HealthCheckerOption {
+	return func(c *HealthChecker) {
+		c.failureThreshold = failure
+		c.successThreshold = success
+	}
+}
+
+// HealthCheckerWithDialOptions 连接实例用的参数，默认不加密
+func HealthCheckerWithDialOptions(opts ...grpc.DialOption) HealthCheckerOption {
+	return func(c *HealthChecker) {
+		c.dialOpts = append(c.dialOpts, opts...)
+	}
+}
+
+// Run 定期探测，直到 ctx 被取消
+func (c *HealthChecker) Run(ctx context.Context) error {
+	defer c.closeConns(nil)
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		// 单次失败不影响下一次
+		_ = c.Check(ctx)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Check 探测一轮，返回的 error 是查询和更新注册中心的 error
+func (c *HealthChecker) Check(ctx context.Context) error {
+	var (
+		errs []error
+		// 这一轮还存在的实例
+		alive = make(map[string]struct{})
+	)
+	for _, name := range c.services {
+		instances, err := c.r.ListServices(ctx, name)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		healthy := make([]bool, len(instances))
+		var wg sync.WaitGroup
+		for i, si := range instances {
+			alive[si.Address] = struct{}{}
+			wg.Add(1)
+			go func(i int, si registry.ServiceInstance) {
+				defer wg.Done()
+				healthy[i] = c.probe(ctx, si)
+			}(i, si)
+		}
+		wg.Wait()
+		for i, si := range instances {
+			if err = c.report(ctx, si, healthy[i]); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	c.closeConns(alive)
+	return errors.Join(errs...)
+}
+
+func (c *HealthChecker) probe(ctx context.Context, si registry.ServiceInstance) bool {
+	cc, err := c.conn(si.Address)
+	if err != nil {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	resp, err := healthpb.NewHealthClient(cc).Check(ctx, &healthpb.HealthCheckRequest{
+		Service: si.Name,
+	})
+	if status.Code(err) == codes.Unimplemented {
+		// 没有实现健康检查的服务，只能认为它是健康的
+		return true
+	}
+	return err == nil && resp.GetStatus() == healthpb.HealthCheckResponse_SERVING
+}
+
+// 记录探测结果，达到阈值就更新注册中心
+func (c *HealthChecker) report(ctx context.Context, si registry.ServiceInstance, healthy bool) error {
+	key := instanceKey{name: si.Name, address: si.Address}
+	c.mutex.Lock()
+	cnt := c.counters[key]
+	if healthy {
+		cnt = max(cnt, 0) + 1
+	} else {
+		cnt = min(cnt, 0) - 1
+	}
+	c.counters[key] = cnt
+	c.mutex.Unlock()
+
+	switch {
+	case si.Unhealthy && cnt >= c.successThreshold:
+		si.Unhealthy = false
+	case !si.Unhealthy && -cnt >= c.failureThreshold:
+		si.Unhealthy = true
+	default:
+		return nil
+	}
+	err := c.updater.Update(ctx, si)
+	if errors.Is(err, registry.ErrInstanceNotFound) {
+		// 探测的时候实例下线了
+		return nil
+	}
+	return err
+}
+
+func (c *HealthChecker) conn(addr string) (*grpc.ClientConn, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if cc, ok := c.conns[addr]; ok {
+		return cc, nil
+	}
+	cc, err := grpc.Dial(addr, c.dialOpts...)
+	if err != nil {
+		return nil, err
+	}
+	c.conns[addr] = cc
+	return cc, nil
+}
+
+// 关闭不在 alive 里面的连接，alive 是 nil 的时候全部关闭
+func (c *HealthChecker) closeConns(alive map[string]struct{}) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for addr, cc := range c.conns {
+		if _, ok := alive[addr]; !ok {
+			_ = cc.Close()
+			delete(c.conns, addr)
+		}
+	}
+	for key := range c.counters {
+		if _, ok := alive[key.address]; !ok {
+			delete(c.counters, key)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package interceptor
+
+import (
+	"context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"log"
+	"time"
+)
+
+// AccessLog 一次请求的访问日志
+type AccessLog struct {
+	Method string
+	// 放在 RequestIDBuilder 的拦截器后面才有
+	RequestID string
+	Peer      string
+	Code      codes.Code
+	Err       error
+	Duration  time.Duration
+}
+
+type AccessLogOption func(b *AccessLogBuilder)
+
+// AccessLogBuilder 每个请求结束的时候记录一条访问日志
+type AccessLogBuilder struct {
+	logFunc func(ctx context.Context, l AccessLog)
+}
+
+// NewAccessLogBuilder 默认用标准库的 log 输出
+func NewAccessLogBuilder(opts ...AccessLogOption) *AccessLogBuilder {
+	res := &AccessLogBuilder{
+		logFunc: func(ctx context.Context, l AccessLog) {
+			log.Printf("micro: access method=%s request_id=%s peer=%s code=%s duration=%s err=%v",
+				l.Method, l.RequestID, l.Peer, l.Code, l.Duration, l.Err)
+		},
+	}
+	for _, opt := range opts {
+		opt(res)
+	}
+	return res
+}
+
+// AccessLogWithLogFunc 自定义输出，例如接入自己的日志库
+func AccessLogWithLogFunc(fn func(ctx context.Context, l AccessLog)) AccessLogOption {
+	return func(b *AccessLogBuilder) {
+		b.logFunc = fn
+	}
+}
+
+func (b *AccessLogBuilder) BuildUnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		b.log(ctx, info.FullMethod, start, err)
+		return resp, err
+	}
+}
+
+func (b *AccessLogBuilder) BuildStreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		start := time.Now()
+		err := handler(srv, ss)
+		b.log(ss.Context(), info.FullMethod, start, err)
+		return err
+	}
+}
+
+func (b *AccessLogBuilder) log(ctx context.Context, method string, start time.Time, err error) {
+	l := AccessLog{
+		Method:   method,
+		Code:     status.Code(err),
+		Err:      err,
+		Duration: time.Since(start),
+	}
+	l.RequestID, _ = RequestIDFromContext(ctx)
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		l.Peer = p.Addr.String()
+	}
+	b.logFunc(ctx, l)
+}
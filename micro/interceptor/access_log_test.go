@@ -0,0 +1,39 @@
+package interceptor
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAccessLogBuilder_BuildUnaryServerInterceptor(t *testing.T) {
+	var logs []AccessLog
+	interceptor := NewAccessLogBuilder(AccessLogWithLogFunc(func(ctx context.Context, l AccessLog) {
+		logs = append(logs, l)
+	})).BuildUnaryServerInterceptor()
+	ctx := WithRequestID(context.Background(), "req-1")
+	ctx = peer.NewContext(ctx, &peer.Peer{Addr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 12345}})
+	notFound := status.Error(codes.NotFound, "not found")
+	_, err := interceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: "/user.UserService/GetById"},
+		func(ctx context.Context, req any) (any, error) {
+			time.Sleep(time.Millisecond * 10)
+			return nil, notFound
+		})
+	assert.Equal(t, notFound, err)
+	assert.Len(t, logs, 1)
+	assert.GreaterOrEqual(t, logs[0].Duration, time.Millisecond*10)
+	logs[0].Duration = 0
+	assert.Equal(t, AccessLog{
+		Method:    "/user.UserService/GetById",
+		RequestID: "req-1",
+		Peer:      "127.0.0.1:12345",
+		Code:      codes.NotFound,
+		Err:       notFound,
+	}, logs[0])
+}
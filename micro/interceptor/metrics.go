@@ -0,0 +1,128 @@
+package interceptor
+
+import (
+	"context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MetricsRecorder 记录每个请求的耗时，可以对接 Prometheus 之类的监控系统
+type MetricsRecorder interface {
+	Observe(method string, code codes.Code, duration time.Duration)
+}
+
+// MetricsBuilder 按照方法统计请求的耗时和错误码
+type MetricsBuilder struct {
+	recorder MetricsRecorder
+}
+
+func NewMetricsBuilder(recorder MetricsRecorder) *MetricsBuilder {
+	return &MetricsBuilder{
+		recorder: recorder,
+	}
+}
+
+func (b *MetricsBuilder) BuildUnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		b.recorder.Observe(info.FullMethod, status.Code(err), time.Since(start))
+		return resp, err
+	}
+}
+
+func (b *MetricsBuilder) BuildStreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		start := time.Now()
+		err := handler(srv, ss)
+		b.recorder.Observe(info.FullMethod, status.Code(err), time.Since(start))
+		return err
+	}
+}
+
+// DefaultLatencyBuckets 默认的耗时分桶
+var DefaultLatencyBuckets = []time.Duration{
+	time.Millisecond * 5, time.Millisecond * 10, time.Millisecond * 25, time.Millisecond * 50,
+	time.Millisecond * 100, time.Millisecond * 250, time.Millisecond * 500,
+	time.Second, time.Second * 2, time.Second * 5,
+}
+
+// MethodStats 一个方法的统计数据
+type MethodStats struct {
+	Count int64
+	// 按照错误码统计的请求数，成功的是 codes.OK
+	Codes map[codes.Code]int64
+	Total time.Duration
+	Max   time.Duration
+	// Buckets[i] 是耗时不超过 LatencyRecorder 第 i 个分桶的请求数，最后一个是超过所有分桶的
+	Buckets []int64
+}
+
+// LatencyRecorder 内存里的 MetricsRecorder，按照方法统计耗时分布
+type LatencyRecorder struct {
+	buckets []time.Duration
+	mutex   sync.Mutex
+	methods map[string]*MethodStats
+}
+
+// NewLatencyRecorder buckets 是耗时分桶的上界，不传就用 DefaultLatencyBuckets
+func NewLatencyRecorder(buckets ...time.Duration) *LatencyRecorder {
+	if len(buckets) == 0 {
+		buckets = DefaultLatencyBuckets
+	}
+	buckets = append([]time.Duration(nil), buckets...)
+	sort.Slice(buckets, func(i, j int) bool {
+		return buckets[i] < buckets[j]
+	})
+	return &LatencyRecorder{
+		buckets: buckets,
+		methods: make(map[string]*MethodStats),
+	}
+}
+
+func (r *LatencyRecorder) Observe(method string, code codes.Code, duration time.Duration) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	stats, ok := r.methods[method]
+	if !ok {
+		stats = &MethodStats{
+			Codes:   make(map[codes.Code]int64),
+			Buckets: make([]int64, len(r.buckets)+1),
+		}
+		r.methods[method] = stats
+	}
+	stats.Count++
+	stats.Codes[code]++
+	stats.Total += duration
+	stats.Max = max(stats.Max, duration)
+	idx := sort.Search(len(r.buckets), func(i int) bool {
+		return duration <= r.buckets[i]
+	})
+	stats.Buckets[idx]++
+}
+
+// Buckets 耗时分桶的上界
+func (r *LatencyRecorder) Buckets() []time.Duration {
+	return append([]time.Duration(nil), r.buckets...)
+}
+
+// Snapshot 当前所有方法的统计数据，返回的是拷贝
+func (r *LatencyRecorder) Snapshot() map[string]MethodStats {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	res := make(map[string]MethodStats, len(r.methods))
+	for method, stats := range r.methods {
+		cp := *stats
+		cp.Codes = make(map[codes.Code]int64, len(stats.Codes))
+		for c, cnt := range stats.Codes {
+			cp.Codes[c] = cnt
+		}
+		cp.Buckets = append([]int64(nil), stats.Buckets...)
+		res[method] = cp
+	}
+	return res
+}
@@ -0,0 +1,56 @@
+package interceptor
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+	"time"
+)
+
+func TestLatencyRecorder_Observe(t *testing.T) {
+	r := NewLatencyRecorder(time.Millisecond*100, time.Millisecond*10)
+	r.Observe("/user.UserService/GetById", codes.OK, time.Millisecond*5)
+	r.Observe("/user.UserService/GetById", codes.OK, time.Millisecond*10)
+	r.Observe("/user.UserService/GetById", codes.NotFound, time.Millisecond*50)
+	r.Observe("/user.UserService/GetById", codes.Unavailable, time.Second)
+	r.Observe("/user.UserService/Create", codes.OK, time.Millisecond)
+
+	assert.Equal(t, []time.Duration{time.Millisecond * 10, time.Millisecond * 100}, r.Buckets())
+	assert.Equal(t, map[string]MethodStats{
+		"/user.UserService/GetById": {
+			Count: 4,
+			Codes: map[codes.Code]int64{codes.OK: 2, codes.NotFound: 1, codes.Unavailable: 1},
+			Total: time.Millisecond*65 + time.Second,
+			Max:   time.Second,
+			// 边界算在小的分桶里面
+			Buckets: []int64{2, 1, 1},
+		},
+		"/user.UserService/Create": {
+			Count:   1,
+			Codes:   map[codes.Code]int64{codes.OK: 1},
+			Total:   time.Millisecond,
+			Max:     time.Millisecond,
+			Buckets: []int64{1, 0, 0},
+		},
+	}, r.Snapshot())
+}
+
+func TestMetricsBuilder_BuildUnaryServerInterceptor(t *testing.T) {
+	r := NewLatencyRecorder()
+	interceptor := NewMetricsBuilder(r).BuildUnaryServerInterceptor()
+	info := &grpc.UnaryServerInfo{FullMethod: "/user.UserService/GetById"}
+	_, _ = interceptor(context.Background(), nil, info, func(ctx context.Context, req any) (any, error) {
+		time.Sleep(time.Millisecond * 20)
+		return nil, nil
+	})
+	_, _ = interceptor(context.Background(), nil, info, func(ctx context.Context, req any) (any, error) {
+		return nil, status.Error(codes.NotFound, "not found")
+	})
+	stats := r.Snapshot()[info.FullMethod]
+	assert.Equal(t, int64(2), stats.Count)
+	assert.Equal(t, map[codes.Code]int64{codes.OK: 1, codes.NotFound: 1}, stats.Codes)
+	assert.GreaterOrEqual(t, stats.Max, time.Millisecond*20)
+}
@@ -0,0 +1,62 @@
+package interceptor
+
+import (
+	"context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"log"
+	"runtime/debug"
+)
+
+// RecoveryHandler 把 panic 转换成返回给调用方的错误
+type RecoveryHandler func(ctx context.Context, fullMethod string, p any) error
+
+type RecoveryOption func(b *RecoveryBuilder)
+
+// RecoveryBuilder 业务代码 panic 的时候返回错误，而不是让整个进程崩溃
+type RecoveryBuilder struct {
+	handler RecoveryHandler
+}
+
+// NewRecoveryBuilder 默认打印堆栈，返回 codes.Internal
+func NewRecoveryBuilder(opts ...RecoveryOption) *RecoveryBuilder {
+	res := &RecoveryBuilder{
+		handler: func(ctx context.Context, fullMethod string, p any) error {
+			log.Printf("micro: 处理请求 panic, method: %s, 原因: %v\n%s", fullMethod, p, debug.Stack())
+			return status.Error(codes.Internal, "micro: 服务端内部错误")
+		},
+	}
+	for _, opt := range opts {
+		opt(res)
+	}
+	return res
+}
+
+func RecoveryWithHandler(handler RecoveryHandler) RecoveryOption {
+	return func(b *RecoveryBuilder) {
+		b.handler = handler
+	}
+}
+
+func (b *RecoveryBuilder) BuildUnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp any, err error) {
+		defer func() {
+			if p := recover(); p != nil {
+				resp, err = nil, b.handler(ctx, info.FullMethod, p)
+			}
+		}()
+		return handler(ctx, req)
+	}
+}
+
+func (b *RecoveryBuilder) BuildStreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+		defer func() {
+			if p := recover(); p != nil {
+				err = b.handler(ss.Context(), info.FullMethod, p)
+			}
+		}()
+		return handler(srv, ss)
+	}
+}
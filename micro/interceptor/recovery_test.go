@@ -0,0 +1,75 @@
+package interceptor
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+)
+
+func TestRecoveryBuilder_BuildUnaryServerInterceptor(t *testing.T) {
+	testCases := []struct {
+		name    string
+		opts    []RecoveryOption
+		handler grpc.UnaryHandler
+
+		wantResp any
+		wantErr  error
+	}{
+		{
+			name: "no panic",
+			handler: func(ctx context.Context, req any) (any, error) {
+				return "ok", nil
+			},
+			wantResp: "ok",
+		},
+		{
+			name: "panic",
+			handler: func(ctx context.Context, req any) (any, error) {
+				panic("boom")
+			},
+			wantErr: status.Error(codes.Internal, "micro: 服务端内部错误"),
+		},
+		{
+			name: "custom handler",
+			opts: []RecoveryOption{RecoveryWithHandler(func(ctx context.Context, fullMethod string, p any) error {
+				return status.Errorf(codes.Unknown, "%s %v", fullMethod, p)
+			})},
+			handler: func(ctx context.Context, req any) (any, error) {
+				panic(errors.New("boom"))
+			},
+			wantErr: status.Error(codes.Unknown, "/user.UserService/GetById boom"),
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			interceptor := NewRecoveryBuilder(tc.opts...).BuildUnaryServerInterceptor()
+			resp, err := interceptor(context.Background(), nil,
+				&grpc.UnaryServerInfo{FullMethod: "/user.UserService/GetById"}, tc.handler)
+			assert.Equal(t, tc.wantErr, err)
+			assert.Equal(t, tc.wantResp, resp)
+		})
+	}
+}
+
+func TestRecoveryBuilder_BuildStreamServerInterceptor(t *testing.T) {
+	interceptor := NewRecoveryBuilder().BuildStreamServerInterceptor()
+	err := interceptor(nil, &fakeServerStream{ctx: context.Background()},
+		&grpc.StreamServerInfo{FullMethod: "/user.UserService/Watch"},
+		func(srv any, stream grpc.ServerStream) error {
+			panic("boom")
+		})
+	assert.Equal(t, codes.Internal, status.Code(err))
+}
+
+type fakeServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *fakeServerStream) Context() context.Context {
+	return s.ctx
+}
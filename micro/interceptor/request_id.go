@@ -0,0 +1,110 @@
+package interceptor
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// RequestIDMetadataKey 请求 ID 放在 metadata 的这个 key 里面
+const RequestIDMetadataKey = "x-request-id"
+
+type requestIDKey struct{}
+
+// WithRequestID 指定请求 ID，一般在链路的入口设置
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestIDFromContext 当前请求的 ID，服务端经过 RequestIDBuilder 的拦截器之后一定有
+func RequestIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(requestIDKey{}).(string)
+	return id, ok && id != ""
+}
+
+type RequestIDOption func(b *RequestIDBuilder)
+
+// RequestIDBuilder 在整条调用链上传递请求 ID
+// 服务端从 metadata 里面取出来放进 ctx，没有的话生成一个，并且通过响应头返回给调用方
+// 客户端把 ctx 里面的请求 ID 放进 metadata，传给下游
+type RequestIDBuilder struct {
+	generator func() string
+}
+
+// NewRequestIDBuilder 默认用 UUID 作为请求 ID
+func NewRequestIDBuilder(opts ...RequestIDOption) *RequestIDBuilder {
+	res := &RequestIDBuilder{
+		generator: uuid.NewString,
+	}
+	for _, opt := range opts {
+		opt(res)
+	}
+	return res
+}
+
+func RequestIDWithGenerator(generator func() string) RequestIDOption {
+	return func(b *RequestIDBuilder) {
+		b.generator = generator
+	}
+}
+
+func (b *RequestIDBuilder) BuildUnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		return handler(b.serverContext(ctx), req)
+	}
+}
+
+func (b *RequestIDBuilder) BuildStreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		return handler(srv, &serverStream{ServerStream: ss, ctx: b.serverContext(ss.Context())})
+	}
+}
+
+func (b *RequestIDBuilder) serverContext(ctx context.Context) context.Context {
+	var id string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if vals := md.Get(RequestIDMetadataKey); len(vals) > 0 {
+			id = vals[0]
+		}
+	}
+	if id == "" {
+		id = b.generator()
+	}
+	_ = grpc.SetHeader(ctx, metadata.Pairs(RequestIDMetadataKey, id))
+	return WithRequestID(ctx, id)
+}
+
+func (b *RequestIDBuilder) BuildUnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		return invoker(b.clientContext(ctx), method, req, reply, cc, opts...)
+	}
+}
+
+func (b *RequestIDBuilder) BuildStreamClientInterceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		return streamer(b.clientContext(ctx), desc, cc, method, opts...)
+	}
+}
+
+// 已经在 metadata 里面的不覆盖，ctx 里面没有的时候生成一个新的
+func (b *RequestIDBuilder) clientContext(ctx context.Context) context.Context {
+	if md, ok := metadata.FromOutgoingContext(ctx); ok && len(md.Get(RequestIDMetadataKey)) > 0 {
+		return ctx
+	}
+	id, ok := RequestIDFromContext(ctx)
+	if !ok {
+		id = b.generator()
+	}
+	return metadata.AppendToOutgoingContext(ctx, RequestIDMetadataKey, id)
+}
+
+// 替换掉 ctx 的 ServerStream
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
@@ -0,0 +1,85 @@
+package interceptor
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"testing"
+)
+
+func TestRequestIDBuilder_BuildUnaryServerInterceptor(t *testing.T) {
+	testCases := []struct {
+		name string
+		ctx  context.Context
+
+		wantID string
+	}{
+		{
+			name:   "from metadata",
+			ctx:    metadata.NewIncomingContext(context.Background(), metadata.Pairs(RequestIDMetadataKey, "req-1")),
+			wantID: "req-1",
+		},
+		{
+			name:   "generate",
+			ctx:    context.Background(),
+			wantID: "generated",
+		},
+	}
+	b := NewRequestIDBuilder(RequestIDWithGenerator(func() string {
+		return "generated"
+	}))
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := b.BuildUnaryServerInterceptor()(tc.ctx, nil, &grpc.UnaryServerInfo{},
+				func(ctx context.Context, req any) (any, error) {
+					id, ok := RequestIDFromContext(ctx)
+					assert.True(t, ok)
+					assert.Equal(t, tc.wantID, id)
+					return nil, nil
+				})
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestRequestIDBuilder_BuildUnaryClientInterceptor(t *testing.T) {
+	testCases := []struct {
+		name string
+		ctx  context.Context
+
+		wantIDs []string
+	}{
+		{
+			name:    "from context",
+			ctx:     WithRequestID(context.Background(), "req-1"),
+			wantIDs: []string{"req-1"},
+		},
+		{
+			name: "already in metadata",
+			ctx: metadata.AppendToOutgoingContext(WithRequestID(context.Background(), "req-1"),
+				RequestIDMetadataKey, "req-2"),
+			wantIDs: []string{"req-2"},
+		},
+		{
+			name:    "generate",
+			ctx:     context.Background(),
+			wantIDs: []string{"generated"},
+		},
+	}
+	b := NewRequestIDBuilder(RequestIDWithGenerator(func() string {
+		return "generated"
+	}))
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := b.BuildUnaryClientInterceptor()(tc.ctx, "/user.UserService/GetById", nil, nil, nil,
+				func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+					md, _ := metadata.FromOutgoingContext(ctx)
+					assert.Equal(t, tc.wantIDs, md.Get(RequestIDMetadataKey))
+					return nil
+				})
+			require.NoError(t, err)
+		})
+	}
+}
@@ -3,42 +3,227 @@ package etcd
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/zhuguangfeng/study/micro/registry"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
 	clientv3 "go.etcd.io/etcd/client/v3"
 	"go.etcd.io/etcd/client/v3/concurrency"
+	"slices"
+	"strings"
 	"sync"
+	"time"
 )
 
+// State 注册中心和 etcd 之间的连接状态
+type State int
+
+const (
+	// StateConnected 租约正常续约
+	StateConnected State = iota
+	// StateDisconnected 租约丢失，注册的实例已经被 etcd 删掉了，正在重建
+	StateDisconnected
+)
+
+func (s State) String() string {
+	switch s {
+	case StateConnected:
+		return "connected"
+	case StateDisconnected:
+		return "disconnected"
+	default:
+		return fmt.Sprintf("State(%d)", int(s))
+	}
+}
+
+type Option func(r *Registry)
+
+// KeyFormat 实例 key 的格式，实例 key 是 prefix/服务名/Key(si)
+type KeyFormat interface {
+	Key(si registry.ServiceInstance) string
+	// Parse Key 的逆运算，拿不到实例信息的时候用，例如删除事件里面没有删除之前的 value
+	Parse(key string) (registry.ServiceInstance, bool)
+}
+
+// AddressKeyFormat 默认的格式，直接用实例地址
+type AddressKeyFormat struct{}
+
+func (AddressKeyFormat) Key(si registry.ServiceInstance) string {
+	return si.Address
+}
+
+func (AddressKeyFormat) Parse(key string) (registry.ServiceInstance, bool) {
+	return registry.ServiceInstance{Address: key}, key != ""
+}
+
 type Registry struct {
-	c       *clientv3.Client
-	sess    *concurrency.Session
-	cancels []func()
+	c    *clientv3.Client
+	sess *concurrency.Session
+	// 自己注册的实例，租约丢失之后要重新注册，key 是 instanceKey
+	instances map[string]registry.ServiceInstance
+	// 注册要拿读锁，重建 session 的时候拿写锁，避免注册到过期的租约上
+	sessMutex sync.RWMutex
+	// 订阅的 cancel，订阅结束之后删掉，key 是订阅的 id
+	cancels map[uint64]func()
+	subID   uint64
 	mutex   sync.Mutex
+
+	state     State
+	listeners []func(State)
+	// 重建 session、重新 watch 的间隔
+	retryInterval time.Duration
+
+	prefix    string
+	ttl       time.Duration
+	keyFormat KeyFormat
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
 }
 
-func NewRegistry(c *clientv3.Client) (*Registry, error) {
-	sess, err := concurrency.NewSession(c)
+func NewRegistry(c *clientv3.Client, opts ...Option) (*Registry, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	res := &Registry{
+		c:             c,
+		instances:     make(map[string]registry.ServiceInstance),
+		retryInterval: time.Second,
+		prefix:        "/micro",
+		keyFormat:     AddressKeyFormat{},
+		ctx:           ctx,
+		cancel:        cancel,
+		done:          make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(res)
+	}
+	sess, err := res.newSession()
 	if err != nil {
+		cancel()
 		return nil, err
 	}
-	return &Registry{
-		c:    c,
-		sess: sess,
-	}, nil
+	res.sess = sess
+	go res.keepSession()
+	return res, nil
+}
+
+// WithPrefix key 的前缀，默认是 /micro
+// 多个环境共用一个 etcd 的时候用不同的前缀隔离，例如 /micro-prod 和 /micro-test
+// 不要用 /micro/prod 这种嵌套在别的前缀下面的，不然用 /micro 的注册中心 ListServiceNames 会把 prod 当成服务名
+func WithPrefix(prefix string) Option {
+	return func(r *Registry) {
+		r.prefix = strings.TrimSuffix(prefix, "/")
+	}
+}
+
+// WithTTL 租约的过期时间，精确到秒，默认是 etcd session 的 60s
+// 进程崩溃之后要等这么久实例才会被删除
+func WithTTL(ttl time.Duration) Option {
+	return func(r *Registry) {
+		r.ttl = ttl
+	}
+}
+
+// WithKeyFormat 实例 key 的格式，默认是 AddressKeyFormat
+func WithKeyFormat(format KeyFormat) Option {
+	return func(r *Registry) {
+		r.keyFormat = format
+	}
+}
+
+// WithStateListener 连接状态变化的时候回调，回调是同步的，不要阻塞
+func WithStateListener(fn func(state State)) Option {
+	return func(r *Registry) {
+		r.listeners = append(r.listeners, fn)
+	}
+}
+
+// WithRetryInterval 租约丢失之后重建 session、watch 出错之后重新 watch 的间隔，默认 1s
+func WithRetryInterval(interval time.Duration) Option {
+	return func(r *Registry) {
+		r.retryInterval = interval
+	}
 }
 
 func (r *Registry) Registry(ctx context.Context, si registry.ServiceInstance) error {
+	r.sessMutex.RLock()
+	defer r.sessMutex.RUnlock()
+	err := r.put(ctx, r.sess, si)
+	if err != nil {
+		return err
+	}
+	r.mutex.Lock()
+	r.instances[r.instanceKey(si)] = si
+	r.mutex.Unlock()
+	return nil
+}
+
+// 健康检查的结果由 HealthChecker 通过 Update 维护，重新注册的时候不能覆盖掉
+// 先读出来再用事务写，中间被 Update 改过的话重新来一次
+func (r *Registry) put(ctx context.Context, sess *concurrency.Session, si registry.ServiceInstance) error {
+	key := r.instanceKey(si)
+	for {
+		getResp, err := r.c.Get(ctx, key)
+		if err != nil {
+			return err
+		}
+		var rev int64
+		if len(getResp.Kvs) > 0 {
+			rev = getResp.Kvs[0].ModRevision
+			var old registry.ServiceInstance
+			if json.Unmarshal(getResp.Kvs[0].Value, &old) == nil && old.Unhealthy {
+				si.Unhealthy = true
+			}
+		}
+		val, err := json.Marshal(si)
+		if err != nil {
+			return err
+		}
+		txnResp, err := r.c.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(key), "=", rev)).
+			Then(clientv3.OpPut(key, string(val), clientv3.WithLease(sess.Lease()))).
+			Commit()
+		if err != nil {
+			return err
+		}
+		if txnResp.Succeeded {
+			return nil
+		}
+	}
+}
+
+// Update 更新实例信息，保留原来的租约，实例不存在的时候返回 registry.ErrInstanceNotFound
+func (r *Registry) Update(ctx context.Context, si registry.ServiceInstance) error {
 	val, err := json.Marshal(si)
 	if err != nil {
 		return err
 	}
-	_, err = r.c.Put(ctx, r.instanceKey(si), string(val), clientv3.WithLease(r.sess.Lease()))
-	return err
+	_, err = r.c.Put(ctx, r.instanceKey(si), string(val), clientv3.WithIgnoreLease())
+	if errors.Is(err, rpctypes.ErrKeyNotFound) {
+		return registry.ErrInstanceNotFound
+	}
+	if err != nil {
+		return err
+	}
+	// 自己注册的实例，重新注册的时候要用更新之后的信息
+	key := r.instanceKey(si)
+	r.mutex.Lock()
+	if _, ok := r.instances[key]; ok {
+		r.instances[key] = si
+	}
+	r.mutex.Unlock()
+	return nil
 }
 
 func (r *Registry) UnRegistry(ctx context.Context, si registry.ServiceInstance) error {
-	_, err := r.c.Delete(ctx, r.instanceKey(si))
+	// 和重建 session 互斥，不然重建的时候可能把刚注销的实例又注册回去
+	r.sessMutex.RLock()
+	defer r.sessMutex.RUnlock()
+	key := r.instanceKey(si)
+	r.mutex.Lock()
+	delete(r.instances, key)
+	r.mutex.Unlock()
+	_, err := r.c.Delete(ctx, key)
 	return err
 }
 
@@ -61,27 +246,87 @@ func (r *Registry) ListServices(ctx context.Context, serviceName string) ([]regi
 	return res, nil
 }
 
-func (r *Registry) Subscribe(serviceName string) (<-chan registry.Event, error) {
-	ctx, cancel := context.WithCancel(context.Background())
-	r.mutex.Lock()
-	r.cancels = append(r.cancels, cancel)
-	r.mutex.Unlock()
+// ListServiceNames 前缀下面所有有实例的服务名，按字典序排列
+func (r *Registry) ListServiceNames(ctx context.Context) ([]string, error) {
+	getResp, err := r.c.Get(ctx, r.prefix+"/", clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return nil, err
+	}
+	res := make([]string, 0, len(getResp.Kvs))
+	for _, kv := range getResp.Kvs {
+		name, _, ok := r.splitKey(string(kv.Key))
+		if !ok {
+			continue
+		}
+		// key 是有序的，同一个服务的实例挨在一起
+		if len(res) == 0 || res[len(res)-1] != name {
+			res = append(res, name)
+		}
+	}
+	// user-service/ 排在 user/ 前面，要重新排序
+	slices.Sort(res)
+	return res, nil
+}
+
+// Subscribe 订阅服务的变化
+// watch 出错之后会从上一次收到的 revision 开始重新 watch，不会漏掉事件
+// 如果这些 revision 已经被压缩了，就关闭 channel，让订阅方重新全量拉取
+func (r *Registry) Subscribe(ctx context.Context, serviceName string) (<-chan registry.Event, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	id := r.addCancel(cancel)
 	ctx = clientv3.WithRequireLeader(ctx)
-	watchResp := r.c.Watch(ctx, r.serviceKey(serviceName), clientv3.WithPrefix())
+	key := r.serviceKey(serviceName)
+	// 要知道从哪个 revision 开始 watch 的，断开之后才能接上
+	watchResp := r.c.Watch(ctx, key, clientv3.WithPrefix(), clientv3.WithPrevKV(), clientv3.WithCreatedNotify())
 	res := make(chan registry.Event)
 	go func() {
+		defer close(res)
+		defer r.removeCancel(id)
+		defer cancel()
+		// 已经处理过的 revision，重新 watch 的时候从下一个开始
+		var rev int64
 		for {
 			select {
-			case resp := <-watchResp:
-				if resp.Err() != nil {
-					//return
+			case resp, ok := <-watchResp:
+				if resp.CompactRevision != 0 {
+					// 要的 revision 已经被压缩了，中间的事件拿不到
+					return
+				}
+				if !ok || resp.Err() != nil {
+					if r.c.Ctx().Err() != nil {
+						// client 已经关闭了
+						return
+					}
+					// 例如失去了 leader，等一会从断开的地方重新 watch
+					select {
+					case <-time.After(r.retryInterval):
+					case <-ctx.Done():
+						return
+					}
+					opts := []clientv3.OpOption{clientv3.WithPrefix(), clientv3.WithPrevKV(), clientv3.WithRev(rev + 1)}
+					if rev == 0 {
+						// 还没有 watch 成功过
+						opts = []clientv3.OpOption{clientv3.WithPrefix(), clientv3.WithPrevKV(), clientv3.WithCreatedNotify()}
+					}
+					watchResp = r.c.Watch(ctx, key, opts...)
 					continue
 				}
-				if resp.Canceled {
-					return
+				if resp.Created {
+					rev = resp.Header.Revision
+					continue
 				}
-				for range resp.Events {
-					res <- registry.Event{}
+				for _, ev := range resp.Events {
+					rev = max(rev, ev.Kv.ModRevision)
+					event, err := r.toEvent(ev)
+					if err != nil {
+						// 不是合法的实例，跳过
+						continue
+					}
+					select {
+					case res <- event:
+					case <-ctx.Done():
+						return
+					}
 				}
 			case <-ctx.Done():
 				return
@@ -92,6 +337,116 @@ func (r *Registry) Subscribe(serviceName string) (<-chan registry.Event, error)
 	return res, nil
 }
 
+// 记录订阅的 cancel，Close 的时候全部取消，订阅结束的时候用返回的 id 删掉
+func (r *Registry) addCancel(cancel func()) uint64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.cancels == nil {
+		r.cancels = make(map[uint64]func())
+	}
+	r.subID++
+	r.cancels[r.subID] = cancel
+	return r.subID
+}
+
+func (r *Registry) removeCancel(id uint64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.cancels, id)
+}
+
+// Session 注册用的 session，其它需要跟实例同生共死的功能可以复用，例如选主
+// 租约丢失之后会换成新的 session，所以每次要用的时候都重新获取
+func (r *Registry) Session() *concurrency.Session {
+	r.sessMutex.RLock()
+	defer r.sessMutex.RUnlock()
+	return r.sess
+}
+
+// State 当前的连接状态
+func (r *Registry) State() State {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.state
+}
+
+func (r *Registry) setState(state State) {
+	r.mutex.Lock()
+	changed := r.state != state
+	r.state = state
+	r.mutex.Unlock()
+	if !changed {
+		return
+	}
+	for _, fn := range r.listeners {
+		fn(state)
+	}
+}
+
+func (r *Registry) newSession(opts ...concurrency.SessionOption) (*concurrency.Session, error) {
+	if r.ttl > 0 {
+		opts = append(opts, concurrency.WithTTL(max(int(r.ttl/time.Second), 1)))
+	}
+	return concurrency.NewSession(r.c, opts...)
+}
+
+// 租约丢失之后重建 session，并且重新注册自己的实例
+func (r *Registry) keepSession() {
+	defer close(r.done)
+	for {
+		select {
+		case <-r.Session().Done():
+		case <-r.ctx.Done():
+			return
+		}
+		// 关闭 client 之后 session 也会结束，这个时候不需要重建
+		if r.ctx.Err() != nil || r.c.Ctx().Err() != nil {
+			return
+		}
+		r.setState(StateDisconnected)
+		for !r.recover() {
+			select {
+			case <-time.After(r.retryInterval):
+			case <-r.ctx.Done():
+				return
+			}
+		}
+		r.setState(StateConnected)
+	}
+}
+
+func (r *Registry) recover() bool {
+	sess, err := r.newSession(concurrency.WithContext(r.ctx))
+	if err != nil {
+		return false
+	}
+	r.sessMutex.Lock()
+	defer r.sessMutex.Unlock()
+	r.mutex.Lock()
+	instances := make([]registry.ServiceInstance, 0, len(r.instances))
+	for _, si := range r.instances {
+		instances = append(instances, si)
+	}
+	r.mutex.Unlock()
+	for _, si := range instances {
+		ctx, cancel := context.WithTimeout(r.ctx, r.retryInterval+time.Second*3)
+		err = r.put(ctx, sess, si)
+		cancel()
+		if err != nil {
+			// 新的租约撤销掉，下一轮重新来
+			_ = sess.Close()
+			return false
+		}
+	}
+	old := r.sess
+	r.sess = sess
+	// 旧的租约已经失效了，撤销一下以防万一，实例已经挂到新的租约上了
+	go func() {
+		_ = old.Close()
+	}()
+	return true
+}
+
 func (r *Registry) Close() error {
 	r.mutex.Lock()
 	cancels := r.cancels
@@ -101,13 +456,79 @@ func (r *Registry) Close() error {
 	for _, cancel := range cancels {
 		cancel()
 	}
-	return r.sess.Close()
+	r.cancel()
+	<-r.done
+	// 重建的 session 绑定了 r.ctx，不能用 sess.Close 撤销租约
+	sess := r.Session()
+	sess.Orphan()
+	ctx, cancel := context.WithTimeout(r.c.Ctx(), time.Second*3)
+	defer cancel()
+	_, err := r.c.Revoke(ctx, sess.Lease())
+	if errors.Is(err, rpctypes.ErrLeaseNotFound) {
+		// 租约已经过期了
+		return nil
+	}
+	return err
+}
+
+// 把 etcd 的事件转换成注册中心的事件
+func (r *Registry) toEvent(ev *clientv3.Event) (registry.Event, error) {
+	var (
+		event registry.Event
+		kv    = ev.Kv
+	)
+	switch {
+	case ev.Type == clientv3.EventTypeDelete:
+		event.Type = registry.EventTypeDelete
+		// 删除事件里面没有 value，要用删除之前的
+		if ev.PrevKv != nil {
+			kv = ev.PrevKv
+		}
+	case ev.IsCreate():
+		event.Type = registry.EventTypeAdd
+	default:
+		event.Type = registry.EventTypeUpdate
+	}
+	event.Revision = ev.Kv.ModRevision
+	if len(kv.Value) == 0 {
+		// 拿不到删除之前的 value，例如已经被压缩了，只能从 key 里面解析
+		si, ok := r.parseInstanceKey(string(ev.Kv.Key))
+		if !ok {
+			return event, fmt.Errorf("micro: 非法的实例 key %s", ev.Kv.Key)
+		}
+		event.Instance = si
+		return event, nil
+	}
+	err := json.Unmarshal(kv.Value, &event.Instance)
+	return event, err
 }
 
 func (r *Registry) instanceKey(si registry.ServiceInstance) string {
-	return fmt.Sprintf("/micro/%s/%s", si.Name, si.Address)
+	return r.serviceKey(si.Name) + r.keyFormat.Key(si)
 }
 
+// 带上结尾的 /，避免 user 匹配到 user-service 的实例
 func (r *Registry) serviceKey(sn string) string {
-	return fmt.Sprintf("/micro/%s", sn)
+	return fmt.Sprintf("%s/%s/", r.prefix, sn)
+}
+
+// instanceKey 的逆运算
+func (r *Registry) parseInstanceKey(key string) (registry.ServiceInstance, bool) {
+	name, rest, ok := r.splitKey(key)
+	if !ok {
+		return registry.ServiceInstance{}, false
+	}
+	si, ok := r.keyFormat.Parse(rest)
+	si.Name = name
+	return si, ok
+}
+
+// 把 key 拆成服务名和实例部分
+func (r *Registry) splitKey(key string) (string, string, bool) {
+	rest, ok := strings.CutPrefix(key, r.prefix+"/")
+	if !ok {
+		return "", "", false
+	}
+	name, rest, ok := strings.Cut(rest, "/")
+	return name, rest, ok && name != ""
 }
@@ -0,0 +1,189 @@
+//go:build e2e
+
+package etcd
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zhuguangfeng/study/micro/registry"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRegistry_e2e_Update(t *testing.T) {
+	etcdClient, err := clientv3.New(clientv3.Config{
+		Endpoints: []string{"localhost:2379"},
+	})
+	require.NoError(t, err)
+	server, err := NewRegistry(etcdClient)
+	require.NoError(t, err)
+	checker, err := NewRegistry(etcdClient)
+	require.NoError(t, err)
+	defer checker.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	si := registry.ServiceInstance{Name: "user-service-e2e", Address: "localhost:8081"}
+	assert.Equal(t, registry.ErrInstanceNotFound, checker.Update(ctx, si))
+	require.NoError(t, server.Registry(ctx, si))
+
+	si.Unhealthy = true
+	require.NoError(t, checker.Update(ctx, si))
+	res, err := checker.ListServices(ctx, si.Name)
+	require.NoError(t, err)
+	assert.Equal(t, []registry.ServiceInstance{si}, res)
+
+	// 重新注册不会覆盖健康检查的结果
+	reg := si
+	reg.Unhealthy = false
+	require.NoError(t, server.Registry(ctx, reg))
+	res, err = checker.ListServices(ctx, si.Name)
+	require.NoError(t, err)
+	assert.Equal(t, []registry.ServiceInstance{si}, res)
+
+	// 更新不会改变租约，实例还是跟着注册它的进程一起下线
+	require.NoError(t, server.Close())
+	res, err = checker.ListServices(ctx, si.Name)
+	require.NoError(t, err)
+	assert.Empty(t, res)
+}
+
+func TestRegistry_e2e_SessionRecovery(t *testing.T) {
+	etcdClient, err := clientv3.New(clientv3.Config{
+		Endpoints: []string{"localhost:2379"},
+	})
+	require.NoError(t, err)
+	states := make(chan State, 4)
+	server, err := NewRegistry(etcdClient, WithRetryInterval(time.Millisecond*100),
+		WithStateListener(func(state State) {
+			states <- state
+		}))
+	require.NoError(t, err)
+	defer server.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	si := registry.ServiceInstance{Name: "user-service-recovery", Address: "localhost:8081"}
+	require.NoError(t, server.Registry(ctx, si))
+	si.Weight = 20
+	require.NoError(t, server.Update(ctx, si))
+	events, err := server.Subscribe(ctx, si.Name)
+	require.NoError(t, err)
+
+	// 模拟网络分区太久，租约过期
+	oldLease := server.Session().Lease()
+	_, err = etcdClient.Revoke(ctx, oldLease)
+	require.NoError(t, err)
+	assert.Equal(t, StateDisconnected, <-states)
+	assert.Equal(t, StateConnected, <-states)
+	assert.NotEqual(t, oldLease, server.Session().Lease())
+
+	// 用更新之后的信息重新注册，订阅方能看到删除和重新添加
+	res, err := server.ListServices(ctx, si.Name)
+	require.NoError(t, err)
+	assert.Equal(t, []registry.ServiceInstance{si}, res)
+	event := <-events
+	assert.Equal(t, registry.EventTypeDelete, event.Type)
+	event = <-events
+	assert.Equal(t, registry.EventTypeAdd, event.Type)
+	assert.Equal(t, si, event.Instance)
+}
+
+func TestRegistry_e2e_UnRegistryDuringRecover(t *testing.T) {
+	etcdClient, err := clientv3.New(clientv3.Config{
+		Endpoints: []string{"localhost:2379"},
+	})
+	require.NoError(t, err)
+	r, err := NewRegistry(etcdClient, WithPrefix("/micro-e2e-recover"))
+	require.NoError(t, err)
+	defer r.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	// 重建 session 和注销同时进行，注销的实例不能被重新注册回去
+	for i := 0; i < 20; i++ {
+		si := registry.ServiceInstance{Name: "user-service", Address: fmt.Sprintf("localhost:%d", 8081+i)}
+		require.NoError(t, r.Registry(ctx, si))
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.True(t, r.recover())
+		}()
+		require.NoError(t, r.UnRegistry(ctx, si))
+		wg.Wait()
+		res, err := r.ListServices(ctx, si.Name)
+		require.NoError(t, err)
+		assert.Empty(t, res)
+	}
+}
+
+func TestRegistry_e2e_SubscribeCancel(t *testing.T) {
+	etcdClient, err := clientv3.New(clientv3.Config{
+		Endpoints: []string{"localhost:2379"},
+	})
+	require.NoError(t, err)
+	r, err := NewRegistry(etcdClient)
+	require.NoError(t, err)
+	defer r.Close()
+
+	// 订阅结束之后不会再留着 cancel
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		events, err := r.Subscribe(ctx, "user-service-e2e")
+		require.NoError(t, err)
+		cancel()
+		for range events {
+		}
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	assert.Empty(t, r.cancels)
+}
+
+func TestRegistry_e2e_Prefix(t *testing.T) {
+	etcdClient, err := clientv3.New(clientv3.Config{
+		Endpoints: []string{"localhost:2379"},
+	})
+	require.NoError(t, err)
+	prod, err := NewRegistry(etcdClient, WithPrefix("/micro-e2e-prod"), WithTTL(time.Second*5))
+	require.NoError(t, err)
+	defer prod.Close()
+	test, err := NewRegistry(etcdClient, WithPrefix("/micro-e2e-test"))
+	require.NoError(t, err)
+	defer test.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	for _, si := range []registry.ServiceInstance{
+		{Name: "user", Address: "localhost:8081"},
+		{Name: "user-service", Address: "localhost:8082"},
+		{Name: "user-service", Address: "localhost:8083"},
+	} {
+		require.NoError(t, prod.Registry(ctx, si))
+	}
+	require.NoError(t, test.Registry(ctx, registry.ServiceInstance{Name: "order-service", Address: "localhost:8084"}))
+
+	names, err := prod.ListServiceNames(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"user", "user-service"}, names)
+	names, err = test.ListServiceNames(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"order-service"}, names)
+
+	// user 不会把 user-service 的实例也查出来
+	res, err := prod.ListServices(ctx, "user")
+	require.NoError(t, err)
+	assert.Equal(t, []registry.ServiceInstance{{Name: "user", Address: "localhost:8081"}}, res)
+	res, err = test.ListServices(ctx, "user")
+	require.NoError(t, err)
+	assert.Empty(t, res)
+
+	ttlResp, err := etcdClient.TimeToLive(ctx, prod.Session().Lease())
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), ttlResp.GrantedTTL)
+}
@@ -0,0 +1,175 @@
+package etcd
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/zhuguangfeng/study/micro/registry"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"strings"
+	"testing"
+)
+
+func TestRegistry_toEvent(t *testing.T) {
+	val := `{"Name":"user-service","Address":"localhost:8081","Weight":10}`
+	testCases := []struct {
+		name string
+		ev   *clientv3.Event
+
+		wantEvent registry.Event
+		wantErr   bool
+	}{
+		{
+			name: "add",
+			ev: &clientv3.Event{
+				Type: clientv3.EventTypePut,
+				Kv: &mvccpb.KeyValue{
+					Key:            []byte("/micro/user-service/localhost:8081"),
+					Value:          []byte(val),
+					CreateRevision: 5,
+					ModRevision:    5,
+				},
+			},
+			wantEvent: registry.Event{
+				Type:     registry.EventTypeAdd,
+				Instance: registry.ServiceInstance{Name: "user-service", Address: "localhost:8081", Weight: 10},
+				Revision: 5,
+			},
+		},
+		{
+			name: "update",
+			ev: &clientv3.Event{
+				Type: clientv3.EventTypePut,
+				Kv: &mvccpb.KeyValue{
+					Key:            []byte("/micro/user-service/localhost:8081"),
+					Value:          []byte(val),
+					CreateRevision: 5,
+					ModRevision:    8,
+				},
+			},
+			wantEvent: registry.Event{
+				Type:     registry.EventTypeUpdate,
+				Instance: registry.ServiceInstance{Name: "user-service", Address: "localhost:8081", Weight: 10},
+				Revision: 8,
+			},
+		},
+		{
+			name: "delete with prev kv",
+			ev: &clientv3.Event{
+				Type: clientv3.EventTypeDelete,
+				Kv: &mvccpb.KeyValue{
+					Key:         []byte("/micro/user-service/localhost:8081"),
+					ModRevision: 9,
+				},
+				PrevKv: &mvccpb.KeyValue{
+					Key:   []byte("/micro/user-service/localhost:8081"),
+					Value: []byte(val),
+				},
+			},
+			wantEvent: registry.Event{
+				Type:     registry.EventTypeDelete,
+				Instance: registry.ServiceInstance{Name: "user-service", Address: "localhost:8081", Weight: 10},
+				Revision: 9,
+			},
+		},
+		{
+			name: "delete without prev kv",
+			ev: &clientv3.Event{
+				Type: clientv3.EventTypeDelete,
+				Kv: &mvccpb.KeyValue{
+					Key:         []byte("/micro/user-service/localhost:8081"),
+					ModRevision: 9,
+				},
+			},
+			wantEvent: registry.Event{
+				Type:     registry.EventTypeDelete,
+				Instance: registry.ServiceInstance{Name: "user-service", Address: "localhost:8081"},
+				Revision: 9,
+			},
+		},
+		{
+			name: "invalid key",
+			ev: &clientv3.Event{
+				Type: clientv3.EventTypeDelete,
+				Kv: &mvccpb.KeyValue{
+					Key: []byte("/other/key"),
+				},
+			},
+			wantErr: true,
+		},
+	}
+
+	r := &Registry{prefix: "/micro", keyFormat: AddressKeyFormat{}}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			event, err := r.toEvent(tc.ev)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.wantEvent, event)
+		})
+	}
+}
+
+// 测试用的格式，key 里面带上版本
+type versionKeyFormat struct{}
+
+func (versionKeyFormat) Key(si registry.ServiceInstance) string {
+	return fmt.Sprintf("%s@%s", si.Version, si.Address)
+}
+
+func (versionKeyFormat) Parse(key string) (registry.ServiceInstance, bool) {
+	version, addr, ok := strings.Cut(key, "@")
+	return registry.ServiceInstance{Version: version, Address: addr}, ok
+}
+
+func TestRegistry_keys(t *testing.T) {
+	si := registry.ServiceInstance{Name: "user-service", Address: "localhost:8081", Version: "v1"}
+	testCases := []struct {
+		name string
+		opts []Option
+
+		wantServiceKey  string
+		wantInstanceKey string
+		wantInstance    registry.ServiceInstance
+	}{
+		{
+			name:            "default",
+			wantServiceKey:  "/micro/user-service/",
+			wantInstanceKey: "/micro/user-service/localhost:8081",
+			wantInstance:    registry.ServiceInstance{Name: "user-service", Address: "localhost:8081"},
+		},
+		{
+			name:            "prefix",
+			opts:            []Option{WithPrefix("/micro/prod/")},
+			wantServiceKey:  "/micro/prod/user-service/",
+			wantInstanceKey: "/micro/prod/user-service/localhost:8081",
+			wantInstance:    registry.ServiceInstance{Name: "user-service", Address: "localhost:8081"},
+		},
+		{
+			name:            "key format",
+			opts:            []Option{WithKeyFormat(versionKeyFormat{})},
+			wantServiceKey:  "/micro/user-service/",
+			wantInstanceKey: "/micro/user-service/v1@localhost:8081",
+			wantInstance:    si,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := &Registry{prefix: "/micro", keyFormat: AddressKeyFormat{}}
+			for _, opt := range tc.opts {
+				opt(r)
+			}
+			assert.Equal(t, tc.wantServiceKey, r.serviceKey(si.Name))
+			key := r.instanceKey(si)
+			assert.Equal(t, tc.wantInstanceKey, key)
+			res, ok := r.parseInstanceKey(key)
+			assert.True(t, ok)
+			assert.Equal(t, tc.wantInstance, res)
+			// 服务名是另一个服务名前缀的时候不会串
+			assert.False(t, strings.HasPrefix(key, r.serviceKey("user")))
+		})
+	}
+}
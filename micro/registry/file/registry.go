@@ -0,0 +1,185 @@
+package file
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/zhuguangfeng/study/micro/registry"
+	"github.com/zhuguangfeng/study/micro/registry/memory"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"time"
+)
+
+type Option func(r *Registry)
+
+// Registry 从 JSON 或者 YAML 文件里面读实例列表，定期检查文件有没有变化
+// 文件内容是实例的数组，字段名和 registry.ServiceInstance 一样，用小写，例如
+//
+//	[{"name": "user-service", "address": "127.0.0.1:8081", "weight": 10}]
+//
+// 扩展名是 .yaml 或者 .yml 的按照 YAML 解析，其它的按照 JSON 解析
+type Registry struct {
+	path         string
+	pollInterval time.Duration
+	onError      func(err error)
+	store        *memory.Registry
+
+	mutex sync.Mutex
+	// 上一次加载的文件内容
+	content []byte
+	// 上一次加载的实例
+	current map[instanceKey]registry.ServiceInstance
+
+	close chan struct{}
+	done  chan struct{}
+	once  sync.Once
+}
+
+type instanceKey struct {
+	name    string
+	address string
+}
+
+// NewRegistry 第一次加载失败会返回 error，之后加载失败会保留上一次的实例
+func NewRegistry(path string, opts ...Option) (*Registry, error) {
+	res := &Registry{
+		path:         path,
+		pollInterval: time.Second * 2,
+		onError:      func(err error) {},
+		store:        memory.NewRegistry(),
+		current:      make(map[instanceKey]registry.ServiceInstance),
+		close:        make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(res)
+	}
+	if err := res.Reload(); err != nil {
+		_ = res.store.Close()
+		return nil, err
+	}
+	go res.poll()
+	return res, nil
+}
+
+// WithPollInterval 检查文件变化的间隔
+func WithPollInterval(interval time.Duration) Option {
+	return func(r *Registry) {
+		r.pollInterval = interval
+	}
+}
+
+// WithErrorHandler 定期加载失败的时候回调，例如打个日志
+func WithErrorHandler(fn func(err error)) Option {
+	return func(r *Registry) {
+		r.onError = fn
+	}
+}
+
+// Reload 立刻重新加载文件，内容变了就通知订阅者
+func (r *Registry) Reload() error {
+	content, err := os.ReadFile(r.path)
+	if err != nil {
+		return err
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.content != nil && bytes.Equal(content, r.content) {
+		return nil
+	}
+	instances, err := r.parse(content)
+	if err != nil {
+		return err
+	}
+	latest := make(map[instanceKey]registry.ServiceInstance, len(instances))
+	for _, si := range instances {
+		latest[instanceKey{name: si.Name, address: si.Address}] = si
+	}
+
+	ctx := context.Background()
+	for key, si := range r.current {
+		if _, ok := latest[key]; !ok {
+			if err = r.store.UnRegistry(ctx, si); err != nil {
+				return err
+			}
+		}
+	}
+	for key, si := range latest {
+		if old, ok := r.current[key]; ok && reflect.DeepEqual(old, si) {
+			continue
+		}
+		if err = r.store.Registry(ctx, si); err != nil {
+			return err
+		}
+	}
+	r.content = content
+	r.current = latest
+	return nil
+}
+
+func (r *Registry) parse(content []byte) ([]registry.ServiceInstance, error) {
+	var (
+		instances []registry.ServiceInstance
+		err       error
+	)
+	switch filepath.Ext(r.path) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(content, &instances)
+	default:
+		err = json.Unmarshal(content, &instances)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("micro: 解析注册中心文件 %s 失败, %w", r.path, err)
+	}
+	for i, si := range instances {
+		if si.Name == "" || si.Address == "" {
+			return nil, fmt.Errorf("micro: 注册中心文件 %s 第 %d 个实例缺少服务名或者地址", r.path, i)
+		}
+	}
+	return instances, nil
+}
+
+func (r *Registry) poll() {
+	defer close(r.done)
+	ticker := time.NewTicker(r.pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := r.Reload(); err != nil {
+				r.onError(err)
+			}
+		case <-r.close:
+			return
+		}
+	}
+}
+
+func (r *Registry) Registry(ctx context.Context, si registry.ServiceInstance) error {
+	return registry.ErrReadOnly
+}
+
+func (r *Registry) UnRegistry(ctx context.Context, si registry.ServiceInstance) error {
+	return registry.ErrReadOnly
+}
+
+func (r *Registry) ListServices(ctx context.Context, serviceName string) ([]registry.ServiceInstance, error) {
+	return r.store.ListServices(ctx, serviceName)
+}
+
+func (r *Registry) Subscribe(ctx context.Context, serviceName string) (<-chan registry.Event, error) {
+	return r.store.Subscribe(ctx, serviceName)
+}
+
+func (r *Registry) Close() error {
+	r.once.Do(func() {
+		close(r.close)
+	})
+	<-r.done
+	return r.store.Close()
+}
@@ -0,0 +1,191 @@
+package file
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zhuguangfeng/study/micro/registry"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNewRegistry(t *testing.T) {
+	testCases := []struct {
+		name    string
+		file    string
+		content string
+
+		wantInstances []registry.ServiceInstance
+		wantErr       bool
+	}{
+		{
+			name: "json",
+			file: "registry.json",
+			content: `[
+	{"name": "user-service", "address": "localhost:8082"},
+	{"name": "user-service", "address": "localhost:8081", "weight": 10, "zone": "hz"},
+	{"name": "order-service", "address": "localhost:9091"}
+]`,
+			wantInstances: []registry.ServiceInstance{
+				{Name: "user-service", Address: "localhost:8081", Weight: 10, Zone: "hz"},
+				{Name: "user-service", Address: "localhost:8082"},
+			},
+		},
+		{
+			name: "yaml",
+			file: "registry.yaml",
+			content: `
+- name: user-service
+  address: localhost:8081
+  group: canary
+  tags:
+    env: test
+- name: order-service
+  address: localhost:9091
+`,
+			wantInstances: []registry.ServiceInstance{
+				{Name: "user-service", Address: "localhost:8081", Group: "canary",
+					Tags: map[string]string{"env": "test"}},
+			},
+		},
+		{
+			name:    "invalid json",
+			file:    "registry.json",
+			content: `[{"name": "user-service"`,
+			wantErr: true,
+		},
+		{
+			name:    "missing address",
+			file:    "registry.yml",
+			content: `- name: user-service`,
+			wantErr: true,
+		},
+		{
+			name:    "file not found",
+			file:    "registry.json",
+			wantErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tc.file)
+			if tc.content != "" {
+				require.NoError(t, os.WriteFile(path, []byte(tc.content), 0o644))
+			}
+			r, err := NewRegistry(path)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			defer r.Close()
+			res, err := r.ListServices(context.Background(), "user-service")
+			require.NoError(t, err)
+			assert.Equal(t, tc.wantInstances, res)
+
+			si := registry.ServiceInstance{Name: "user-service", Address: "localhost:8083"}
+			assert.Equal(t, registry.ErrReadOnly, r.Registry(context.Background(), si))
+			assert.Equal(t, registry.ErrReadOnly, r.UnRegistry(context.Background(), si))
+		})
+	}
+}
+
+func TestRegistry_Reload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registry.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+- name: user-service
+  address: localhost:8081
+- name: user-service
+  address: localhost:8082
+`), 0o644))
+	r, err := NewRegistry(path, WithPollInterval(time.Hour))
+	require.NoError(t, err)
+	defer r.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, err := r.Subscribe(ctx, "user-service")
+	require.NoError(t, err)
+
+	// 8081 改了权重，8082 删掉了，新增了 8083
+	require.NoError(t, os.WriteFile(path, []byte(`
+- name: user-service
+  address: localhost:8081
+  weight: 20
+- name: user-service
+  address: localhost:8083
+`), 0o644))
+	require.NoError(t, r.Reload())
+
+	got := make(map[string]registry.EventType, 3)
+	for i := 0; i < 3; i++ {
+		select {
+		case event := <-ch:
+			got[event.Instance.Address] = event.Type
+		case <-time.After(time.Second):
+			t.Fatal("没有收到事件")
+		}
+	}
+	assert.Equal(t, map[string]registry.EventType{
+		"localhost:8081": registry.EventTypeUpdate,
+		"localhost:8082": registry.EventTypeDelete,
+		"localhost:8083": registry.EventTypeAdd,
+	}, got)
+
+	// 内容没变不会有事件
+	require.NoError(t, r.Reload())
+	select {
+	case event := <-ch:
+		t.Fatalf("不应该有事件 %v", event)
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	// 文件写坏了，保留上一次的实例
+	require.NoError(t, os.WriteFile(path, []byte(`- name: [`), 0o644))
+	assert.Error(t, r.Reload())
+	res, err := r.ListServices(ctx, "user-service")
+	require.NoError(t, err)
+	assert.Equal(t, []registry.ServiceInstance{
+		{Name: "user-service", Address: "localhost:8081", Weight: 20},
+		{Name: "user-service", Address: "localhost:8083"},
+	}, res)
+}
+
+func TestRegistry_Poll(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registry.json")
+	require.NoError(t, os.WriteFile(path, []byte(`[{"name": "user-service", "address": "localhost:8081"}]`), 0o644))
+	errChan := make(chan error, 10)
+	r, err := NewRegistry(path, WithPollInterval(time.Millisecond*10), WithErrorHandler(func(err error) {
+		select {
+		case errChan <- err:
+		default:
+		}
+	}))
+	require.NoError(t, err)
+	defer r.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, err := r.Subscribe(ctx, "user-service")
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(path, []byte(`[]`), 0o644))
+	select {
+	case event := <-ch:
+		assert.Equal(t, registry.EventTypeDelete, event.Type)
+		assert.Equal(t, "localhost:8081", event.Instance.Address)
+	case <-time.After(time.Second):
+		t.Fatal("没有发现文件的变化")
+	}
+
+	// 定期加载失败的时候回调
+	require.NoError(t, os.Remove(path))
+	select {
+	case err = <-errChan:
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	case <-time.After(time.Second):
+		t.Fatal("没有回调错误")
+	}
+}
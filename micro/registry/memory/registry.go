@@ -0,0 +1,300 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"github.com/zhuguangfeng/study/micro/registry"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrRegistryClosed = errors.New("micro: 注册中心已经关闭")
+
+type Option func(r *Registry)
+
+// Registry 内存实现的注册中心，用于测试和本地开发
+// 设置了 TTL 的时候，实例要在 TTL 内调用 KeepAlive 或者重新注册，不然就会过期，用来模拟进程崩溃
+type Registry struct {
+	mutex sync.RWMutex
+	// 服务名 -> 地址 -> 实例
+	services map[string]map[string]*entry
+	subs     map[string]map[*subscriber]struct{}
+	// 每次变更加一，对应 etcd 的 revision
+	revision int64
+	ttl      time.Duration
+	closed   bool
+	close    chan struct{}
+	// 过期检查 goroutine 退出的时候关闭
+	done chan struct{}
+}
+
+type entry struct {
+	si       registry.ServiceInstance
+	expireAt time.Time
+}
+
+func NewRegistry(opts ...Option) *Registry {
+	res := &Registry{
+		services: make(map[string]map[string]*entry),
+		subs:     make(map[string]map[*subscriber]struct{}),
+		close:    make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(res)
+	}
+	if res.ttl > 0 {
+		go res.expireLoop()
+	} else {
+		close(res.done)
+	}
+	return res
+}
+
+// WithTTL 实例的过期时间，不设置就永远不过期
+func WithTTL(ttl time.Duration) Option {
+	return func(r *Registry) {
+		r.ttl = ttl
+	}
+}
+
+func (r *Registry) Registry(ctx context.Context, si registry.ServiceInstance) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.closed {
+		return ErrRegistryClosed
+	}
+	instances, ok := r.services[si.Name]
+	if !ok {
+		instances = make(map[string]*entry)
+		r.services[si.Name] = instances
+	}
+	typ := registry.EventTypeAdd
+	if _, ok = instances[si.Address]; ok {
+		typ = registry.EventTypeUpdate
+	}
+	instances[si.Address] = &entry{
+		si:       si,
+		expireAt: r.expireAt(),
+	}
+	r.publish(typ, si)
+	return nil
+}
+
+func (r *Registry) UnRegistry(ctx context.Context, si registry.ServiceInstance) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.closed {
+		return ErrRegistryClosed
+	}
+	e, ok := r.services[si.Name][si.Address]
+	if !ok {
+		return nil
+	}
+	delete(r.services[si.Name], si.Address)
+	r.publish(registry.EventTypeDelete, e.si)
+	return nil
+}
+
+// Update 更新实例信息，不会续约
+func (r *Registry) Update(ctx context.Context, si registry.ServiceInstance) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.closed {
+		return ErrRegistryClosed
+	}
+	e, ok := r.services[si.Name][si.Address]
+	if !ok || e.expired(time.Now()) {
+		return registry.ErrInstanceNotFound
+	}
+	e.si = si
+	r.publish(registry.EventTypeUpdate, si)
+	return nil
+}
+
+// KeepAlive 续约，相当于 etcd 的 lease keepalive
+func (r *Registry) KeepAlive(ctx context.Context, si registry.ServiceInstance) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.closed {
+		return ErrRegistryClosed
+	}
+	e, ok := r.services[si.Name][si.Address]
+	if !ok {
+		return registry.ErrInstanceNotFound
+	}
+	e.expireAt = r.expireAt()
+	return nil
+}
+
+func (r *Registry) ListServices(ctx context.Context, serviceName string) ([]registry.ServiceInstance, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if r.closed {
+		return nil, ErrRegistryClosed
+	}
+	now := time.Now()
+	res := make([]registry.ServiceInstance, 0, len(r.services[serviceName]))
+	for _, e := range r.services[serviceName] {
+		if e.expired(now) {
+			// 还没来得及清理
+			continue
+		}
+		res = append(res, e.si)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Address < res[j].Address
+	})
+	return res, nil
+}
+
+func (r *Registry) Subscribe(ctx context.Context, serviceName string) (<-chan registry.Event, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.closed {
+		return nil, ErrRegistryClosed
+	}
+	sub := newSubscriber()
+	subs, ok := r.subs[serviceName]
+	if !ok {
+		subs = make(map[*subscriber]struct{})
+		r.subs[serviceName] = subs
+	}
+	subs[sub] = struct{}{}
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-r.close:
+		}
+		r.mutex.Lock()
+		delete(r.subs[serviceName], sub)
+		r.mutex.Unlock()
+		sub.stop()
+	}()
+	go sub.run()
+	return sub.out, nil
+}
+
+// 通知所有订阅者，调用方要持有写锁，这样所有订阅者收到的事件顺序都一样
+func (r *Registry) publish(typ registry.EventType, si registry.ServiceInstance) {
+	r.revision++
+	event := registry.Event{
+		Type:     typ,
+		Instance: si,
+		Revision: r.revision,
+	}
+	for sub := range r.subs[si.Name] {
+		sub.push(event)
+	}
+}
+
+func (r *Registry) expireAt() time.Time {
+	if r.ttl <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(r.ttl)
+}
+
+func (e *entry) expired(now time.Time) bool {
+	return !e.expireAt.IsZero() && now.After(e.expireAt)
+}
+
+// 定期清理过期的实例
+func (r *Registry) expireLoop() {
+	defer close(r.done)
+	interval := r.ttl / 10
+	if interval < time.Millisecond {
+		interval = time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			r.mutex.Lock()
+			for _, instances := range r.services {
+				for addr, e := range instances {
+					if e.expired(now) {
+						delete(instances, addr)
+						r.publish(registry.EventTypeDelete, e.si)
+					}
+				}
+			}
+			r.mutex.Unlock()
+		case <-r.close:
+			return
+		}
+	}
+}
+
+func (r *Registry) Close() error {
+	r.mutex.Lock()
+	if r.closed {
+		r.mutex.Unlock()
+		return nil
+	}
+	r.closed = true
+	close(r.close)
+	r.mutex.Unlock()
+	<-r.done
+	return nil
+}
+
+// 每个订阅者一个队列，注册和注销不会因为订阅者消费得慢被阻塞
+type subscriber struct {
+	mutex  sync.Mutex
+	queue  []registry.Event
+	notify chan struct{}
+	out    chan registry.Event
+	// stop 之后关闭
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newSubscriber() *subscriber {
+	return &subscriber{
+		notify: make(chan struct{}, 1),
+		out:    make(chan registry.Event),
+		closed: make(chan struct{}),
+	}
+}
+
+func (s *subscriber) push(event registry.Event) {
+	s.mutex.Lock()
+	s.queue = append(s.queue, event)
+	s.mutex.Unlock()
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// 把队列里面的事件发出去，stop 之后关闭 out
+func (s *subscriber) run() {
+	defer close(s.out)
+	for {
+		select {
+		case <-s.notify:
+		case <-s.closed:
+			return
+		}
+		s.mutex.Lock()
+		events := s.queue
+		s.queue = nil
+		s.mutex.Unlock()
+		for _, event := range events {
+			select {
+			case s.out <- event:
+			case <-s.closed:
+				return
+			}
+		}
+	}
+}
+
+func (s *subscriber) stop() {
+	s.once.Do(func() {
+		close(s.closed)
+	})
+}
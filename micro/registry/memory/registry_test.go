@@ -0,0 +1,169 @@
+package memory
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zhuguangfeng/study/micro/registry"
+	"testing"
+	"time"
+)
+
+func TestRegistry_Subscribe(t *testing.T) {
+	r := NewRegistry()
+	defer r.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// 多个订阅者都能收到同样的事件
+	ch1, err := r.Subscribe(ctx, "user-service")
+	require.NoError(t, err)
+	ch2, err := r.Subscribe(ctx, "user-service")
+	require.NoError(t, err)
+
+	si := registry.ServiceInstance{Name: "user-service", Address: "localhost:8081"}
+	require.NoError(t, r.Registry(ctx, si))
+	require.NoError(t, r.Registry(ctx, registry.ServiceInstance{Name: "order-service", Address: "localhost:9091"}))
+	si.Weight = 100
+	require.NoError(t, r.Registry(ctx, si))
+	require.NoError(t, r.UnRegistry(ctx, si))
+	// 不存在的实例不会产生事件
+	require.NoError(t, r.UnRegistry(ctx, si))
+
+	wantEvents := []registry.Event{
+		{
+			Type:     registry.EventTypeAdd,
+			Instance: registry.ServiceInstance{Name: "user-service", Address: "localhost:8081"},
+			Revision: 1,
+		},
+		{Type: registry.EventTypeUpdate, Instance: si, Revision: 3},
+		{Type: registry.EventTypeDelete, Instance: si, Revision: 4},
+	}
+	for _, ch := range []<-chan registry.Event{ch1, ch2} {
+		for _, want := range wantEvents {
+			select {
+			case event := <-ch:
+				assert.Equal(t, want, event)
+			case <-time.After(time.Second):
+				t.Fatal("没有收到事件")
+			}
+		}
+	}
+
+	// 取消订阅之后关闭 channel
+	cancel()
+	_, ok := <-ch1
+	assert.False(t, ok)
+}
+
+func TestRegistry_ListServices(t *testing.T) {
+	r := NewRegistry()
+	defer r.Close()
+	ctx := context.Background()
+
+	require.NoError(t, r.Registry(ctx, registry.ServiceInstance{Name: "user-service", Address: "localhost:8082"}))
+	require.NoError(t, r.Registry(ctx, registry.ServiceInstance{Name: "user-service", Address: "localhost:8081"}))
+	require.NoError(t, r.Registry(ctx, registry.ServiceInstance{Name: "order-service", Address: "localhost:9091"}))
+
+	res, err := r.ListServices(ctx, "user-service")
+	require.NoError(t, err)
+	assert.Equal(t, []registry.ServiceInstance{
+		{Name: "user-service", Address: "localhost:8081"},
+		{Name: "user-service", Address: "localhost:8082"},
+	}, res)
+
+	res, err = r.ListServices(ctx, "unknown-service")
+	require.NoError(t, err)
+	assert.Empty(t, res)
+}
+
+func TestRegistry_TTL(t *testing.T) {
+	r := NewRegistry(WithTTL(time.Millisecond * 100))
+	defer r.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch, err := r.Subscribe(ctx, "user-service")
+	require.NoError(t, err)
+	alive := registry.ServiceInstance{Name: "user-service", Address: "localhost:8081"}
+	dead := registry.ServiceInstance{Name: "user-service", Address: "localhost:8082"}
+	require.NoError(t, r.Registry(ctx, alive))
+	require.NoError(t, r.Registry(ctx, dead))
+	<-ch
+	<-ch
+
+	// 一直续约的实例不会过期
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(time.Millisecond * 20)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				_ = r.KeepAlive(ctx, alive)
+			case <-stop:
+				return
+			}
+		}
+	}()
+	defer close(stop)
+
+	select {
+	case event := <-ch:
+		assert.Equal(t, registry.EventTypeDelete, event.Type)
+		assert.Equal(t, dead, event.Instance)
+	case <-time.After(time.Second):
+		t.Fatal("实例没有过期")
+	}
+	res, err := r.ListServices(ctx, "user-service")
+	require.NoError(t, err)
+	assert.Equal(t, []registry.ServiceInstance{alive}, res)
+
+	assert.Equal(t, registry.ErrInstanceNotFound, r.KeepAlive(ctx, dead))
+}
+
+func TestRegistry_Close(t *testing.T) {
+	r := NewRegistry(WithTTL(time.Second))
+	ctx := context.Background()
+	ch, err := r.Subscribe(ctx, "user-service")
+	require.NoError(t, err)
+
+	require.NoError(t, r.Close())
+	_, ok := <-ch
+	assert.False(t, ok)
+
+	si := registry.ServiceInstance{Name: "user-service", Address: "localhost:8081"}
+	assert.Equal(t, ErrRegistryClosed, r.Registry(ctx, si))
+	assert.Equal(t, ErrRegistryClosed, r.UnRegistry(ctx, si))
+	_, err = r.ListServices(ctx, "user-service")
+	assert.Equal(t, ErrRegistryClosed, err)
+	_, err = r.Subscribe(ctx, "user-service")
+	assert.Equal(t, ErrRegistryClosed, err)
+	// 重复关闭没有问题
+	assert.NoError(t, r.Close())
+}
+
+func TestRegistry_Update(t *testing.T) {
+	r := NewRegistry()
+	defer r.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	si := registry.ServiceInstance{Name: "user-service", Address: "localhost:8081"}
+	assert.Equal(t, registry.ErrInstanceNotFound, r.Update(ctx, si))
+
+	require.NoError(t, r.Registry(ctx, si))
+	ch, err := r.Subscribe(ctx, "user-service")
+	require.NoError(t, err)
+	si.Unhealthy = true
+	require.NoError(t, r.Update(ctx, si))
+	select {
+	case event := <-ch:
+		assert.Equal(t, registry.Event{Type: registry.EventTypeUpdate, Instance: si, Revision: 2}, event)
+	case <-time.After(time.Second):
+		t.Fatal("没有收到事件")
+	}
+	res, err := r.ListServices(ctx, "user-service")
+	require.NoError(t, err)
+	assert.Equal(t, []registry.ServiceInstance{si}, res)
+}
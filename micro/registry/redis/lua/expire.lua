@@ -0,0 +1,16 @@
+-- KEYS[1] 过期时间的 zset，KEYS[2] 实例信息的 hash，KEYS[3] 版本号
+-- ARGV[1] 通知的 channel
+-- 清理过期的实例，返回清理的数量
+local t = redis.call("TIME")
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local expired = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", now)
+for _, addr in ipairs(expired) do
+    local val = redis.call("HGET", KEYS[2], addr)
+    redis.call("ZREM", KEYS[1], addr)
+    if val then
+        redis.call("HDEL", KEYS[2], addr)
+        local rev = redis.call("INCR", KEYS[3])
+        redis.call("PUBLISH", ARGV[1], '{"Type":"DELETE","Revision":' .. rev .. ',"Instance":' .. val .. '}')
+    end
+end
+return #expired
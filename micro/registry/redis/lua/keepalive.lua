@@ -0,0 +1,10 @@
+-- KEYS[1] 过期时间的 zset
+-- ARGV[1] 地址，ARGV[2] 过期时间（毫秒）
+-- 实例已经过期被清理掉了就返回 0，调用方要重新注册
+local t = redis.call("TIME")
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+if not redis.call("ZSCORE", KEYS[1], ARGV[1]) then
+    return 0
+end
+redis.call("ZADD", KEYS[1], now + tonumber(ARGV[2]), ARGV[1])
+return 1
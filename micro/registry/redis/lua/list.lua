@@ -0,0 +1,9 @@
+-- KEYS[1] 过期时间的 zset，KEYS[2] 实例信息的 hash
+-- 返回没有过期的实例信息
+local t = redis.call("TIME")
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local addrs = redis.call("ZRANGEBYSCORE", KEYS[1], "(" .. now, "+inf")
+if #addrs == 0 then
+    return {}
+end
+return redis.call("HMGET", KEYS[2], unpack(addrs))
@@ -0,0 +1,21 @@
+-- KEYS[1] 过期时间的 zset，KEYS[2] 实例信息的 hash，KEYS[3] 版本号
+-- ARGV[1] 地址，ARGV[2] 实例信息，ARGV[3] 过期时间（毫秒），ARGV[4] 通知的 channel
+local t = redis.call("TIME")
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local typ = "ADD"
+if redis.call("ZSCORE", KEYS[1], ARGV[1]) then
+    typ = "UPDATE"
+end
+local val = ARGV[2]
+-- 健康检查的结果由 HealthChecker 维护，重新注册的时候保留
+local old = redis.call("HGET", KEYS[2], ARGV[1])
+if old and cjson.decode(old).Unhealthy == true then
+    local si = cjson.decode(val)
+    si.Unhealthy = true
+    val = cjson.encode(si)
+end
+redis.call("HSET", KEYS[2], ARGV[1], val)
+redis.call("ZADD", KEYS[1], now + tonumber(ARGV[3]), ARGV[1])
+local rev = redis.call("INCR", KEYS[3])
+redis.call("PUBLISH", ARGV[4], '{"Type":"' .. typ .. '","Revision":' .. rev .. ',"Instance":' .. val .. '}')
+return rev
@@ -0,0 +1,11 @@
+-- KEYS[1] 过期时间的 zset，KEYS[2] 实例信息的 hash，KEYS[3] 版本号
+-- ARGV[1] 地址，ARGV[2] 通知的 channel
+local val = redis.call("HGET", KEYS[2], ARGV[1])
+redis.call("ZREM", KEYS[1], ARGV[1])
+if not val then
+    return 0
+end
+redis.call("HDEL", KEYS[2], ARGV[1])
+local rev = redis.call("INCR", KEYS[3])
+redis.call("PUBLISH", ARGV[2], '{"Type":"DELETE","Revision":' .. rev .. ',"Instance":' .. val .. '}')
+return rev
@@ -0,0 +1,13 @@
+-- KEYS[1] 过期时间的 zset，KEYS[2] 实例信息的 hash，KEYS[3] 版本号
+-- ARGV[1] 地址，ARGV[2] 实例信息，ARGV[3] 通知的 channel
+-- 只更新实例信息，不续约，实例不存在或者已经过期返回 0
+local t = redis.call("TIME")
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local score = redis.call("ZSCORE", KEYS[1], ARGV[1])
+if not score or tonumber(score) <= now then
+    return 0
+end
+redis.call("HSET", KEYS[2], ARGV[1], ARGV[2])
+local rev = redis.call("INCR", KEYS[3])
+redis.call("PUBLISH", ARGV[3], '{"Type":"UPDATE","Revision":' .. rev .. ',"Instance":' .. ARGV[2] .. '}')
+return rev
@@ -0,0 +1,333 @@
+package redis
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"github.com/zhuguangfeng/study/micro/registry"
+	"sync"
+	"time"
+)
+
+var (
+	//go:embed lua/register.lua
+	luaRegister string
+	//go:embed lua/unregister.lua
+	luaUnregister string
+	//go:embed lua/keepalive.lua
+	luaKeepAlive string
+	//go:embed lua/expire.lua
+	luaExpire string
+	//go:embed lua/list.lua
+	luaList string
+	//go:embed lua/update.lua
+	luaUpdate string
+)
+
+type Option func(r *Registry)
+
+// Registry 基于 Redis 的注册中心
+// 每个服务一个 zset 记录实例的过期时间，一个 hash 记录实例信息，心跳就是更新 zset 里面的过期时间
+// 注册、注销和过期清理都会通过 pub/sub 通知订阅者，事件的版本号由每个服务的计数器生成
+type Registry struct {
+	client redis.Cmdable
+	// 订阅要用 pub/sub，redis.Cmdable 里面没有
+	subscriber interface {
+		Subscribe(ctx context.Context, channels ...string) *redis.PubSub
+	}
+	prefix  string
+	ttl     time.Duration
+	timeout time.Duration
+
+	mutex sync.Mutex
+	// 通过这个 Registry 注册的实例，心跳的时候续约，Close 的时候注销
+	instances map[instanceKey]registry.ServiceInstance
+	// 订阅的 cancel，订阅结束之后删掉，key 是订阅的 id
+	cancels map[uint64]func()
+	subID   uint64
+
+	close chan struct{}
+	// 心跳 goroutine 退出的时候关闭
+	done chan struct{}
+	once sync.Once
+}
+
+type instanceKey struct {
+	name    string
+	address string
+}
+
+func NewRegistry(client redis.UniversalClient, opts ...Option) *Registry {
+	res := newRegistry(client, opts...)
+	res.subscriber = client
+	res.done = make(chan struct{})
+	go res.heartbeat()
+	return res
+}
+
+func newRegistry(client redis.Cmdable, opts ...Option) *Registry {
+	res := &Registry{
+		client:    client,
+		prefix:    "micro",
+		ttl:       time.Second * 30,
+		timeout:   time.Second * 3,
+		instances: make(map[instanceKey]registry.ServiceInstance),
+		close:     make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(res)
+	}
+	return res
+}
+
+// WithPrefix key 和 channel 的前缀，默认是 micro
+func WithPrefix(prefix string) Option {
+	return func(r *Registry) {
+		r.prefix = prefix
+	}
+}
+
+// WithTTL 实例的过期时间，心跳间隔是 TTL 的三分之一
+func WithTTL(ttl time.Duration) Option {
+	return func(r *Registry) {
+		r.ttl = ttl
+	}
+}
+
+// WithTimeout 心跳、过期清理和 Close 的时候注销实例的超时时间
+func WithTimeout(timeout time.Duration) Option {
+	return func(r *Registry) {
+		r.timeout = timeout
+	}
+}
+
+func (r *Registry) Registry(ctx context.Context, si registry.ServiceInstance) error {
+	if err := r.register(ctx, si); err != nil {
+		return err
+	}
+	r.mutex.Lock()
+	r.instances[instanceKey{name: si.Name, address: si.Address}] = si
+	r.mutex.Unlock()
+	return nil
+}
+
+func (r *Registry) register(ctx context.Context, si registry.ServiceInstance) error {
+	val, err := json.Marshal(si)
+	if err != nil {
+		return err
+	}
+	return r.client.Eval(ctx, luaRegister, r.keys(si.Name),
+		si.Address, string(val), r.ttl.Milliseconds(), r.channel(si.Name)).Err()
+}
+
+// Update 更新实例信息，不会续约，实例不存在的时候返回 registry.ErrInstanceNotFound
+func (r *Registry) Update(ctx context.Context, si registry.ServiceInstance) error {
+	val, err := json.Marshal(si)
+	if err != nil {
+		return err
+	}
+	rev, err := r.client.Eval(ctx, luaUpdate, r.keys(si.Name),
+		si.Address, string(val), r.channel(si.Name)).Int64()
+	if err != nil {
+		return err
+	}
+	if rev == 0 {
+		return registry.ErrInstanceNotFound
+	}
+	// 自己注册的实例，续约失败重新注册的时候要用新的信息
+	r.mutex.Lock()
+	key := instanceKey{name: si.Name, address: si.Address}
+	if _, ok := r.instances[key]; ok {
+		r.instances[key] = si
+	}
+	r.mutex.Unlock()
+	return nil
+}
+
+func (r *Registry) UnRegistry(ctx context.Context, si registry.ServiceInstance) error {
+	r.mutex.Lock()
+	delete(r.instances, instanceKey{name: si.Name, address: si.Address})
+	r.mutex.Unlock()
+	return r.client.Eval(ctx, luaUnregister, r.keys(si.Name), si.Address, r.channel(si.Name)).Err()
+}
+
+func (r *Registry) ListServices(ctx context.Context, serviceName string) ([]registry.ServiceInstance, error) {
+	vals, err := r.client.Eval(ctx, luaList, r.keys(serviceName)[:2]).Slice()
+	if err != nil {
+		return nil, err
+	}
+	res := make([]registry.ServiceInstance, 0, len(vals))
+	for _, v := range vals {
+		val, ok := v.(string)
+		if !ok {
+			// hash 里面没有，数据被别人改坏了
+			continue
+		}
+		var si registry.ServiceInstance
+		if err = json.Unmarshal([]byte(val), &si); err != nil {
+			return nil, err
+		}
+		res = append(res, si)
+	}
+	return res, nil
+}
+
+// Subscribe 和 etcd 的实现一样，ctx 取消或者 Close 的时候关闭 channel
+// pub/sub 断线重连期间的事件会丢失，grpcResolver 会定期全量同步修复
+func (r *Registry) Subscribe(ctx context.Context, serviceName string) (<-chan registry.Event, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	ps := r.subscriber.Subscribe(ctx, r.channel(serviceName))
+	// 等订阅成功再返回，不然订阅成功之前的变更会漏掉
+	if _, err := ps.Receive(ctx); err != nil {
+		_ = ps.Close()
+		cancel()
+		return nil, err
+	}
+	id := r.addCancel(cancel)
+
+	res := make(chan registry.Event)
+	go func() {
+		defer close(res)
+		defer r.removeCancel(id)
+		defer func() {
+			_ = ps.Close()
+		}()
+		defer cancel()
+		msgs := ps.Channel()
+		// 订阅方也负责清理过期的实例，不然一个服务的实例全部崩溃之后就没人清理了
+		ticker := time.NewTicker(r.ttl / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case msg, ok := <-msgs:
+				if !ok {
+					return
+				}
+				var event registry.Event
+				if err := json.Unmarshal([]byte(msg.Payload), &event); err != nil {
+					// 不是合法的事件，跳过
+					continue
+				}
+				select {
+				case res <- event:
+				case <-ctx.Done():
+					return
+				}
+			case <-ticker.C:
+				_ = r.expire(serviceName)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return res, nil
+}
+
+// 记录订阅的 cancel，Close 的时候全部取消，订阅结束的时候用返回的 id 删掉
+func (r *Registry) addCancel(cancel func()) uint64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.cancels == nil {
+		r.cancels = make(map[uint64]func())
+	}
+	r.subID++
+	r.cancels[r.subID] = cancel
+	return r.subID
+}
+
+func (r *Registry) removeCancel(id uint64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.cancels, id)
+}
+
+// 定期续约，同时清理自己注册过的服务里面过期的实例
+func (r *Registry) heartbeat() {
+	defer close(r.done)
+	ticker := time.NewTicker(r.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.keepAlive()
+		case <-r.close:
+			return
+		}
+	}
+}
+
+func (r *Registry) keepAlive() {
+	r.mutex.Lock()
+	instances := make([]registry.ServiceInstance, 0, len(r.instances))
+	for _, si := range r.instances {
+		instances = append(instances, si)
+	}
+	r.mutex.Unlock()
+
+	names := make(map[string]struct{}, len(instances))
+	for _, si := range instances {
+		names[si.Name] = struct{}{}
+		ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+		ok, err := r.client.Eval(ctx, luaKeepAlive, r.keys(si.Name)[:1],
+			si.Address, r.ttl.Milliseconds()).Bool()
+		if err == nil && !ok {
+			// 网络抖动之类的原因导致过期被清理了，重新注册
+			_ = r.register(ctx, si)
+		}
+		cancel()
+	}
+	for name := range names {
+		_ = r.expire(name)
+	}
+}
+
+func (r *Registry) expire(serviceName string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+	return r.client.Eval(ctx, luaExpire, r.keys(serviceName), r.channel(serviceName)).Err()
+}
+
+// Close 停止心跳，取消订阅，并且注销通过这个 Registry 注册的实例
+func (r *Registry) Close() error {
+	r.once.Do(func() {
+		close(r.close)
+	})
+	if r.done != nil {
+		<-r.done
+	}
+
+	r.mutex.Lock()
+	cancels := r.cancels
+	r.cancels = nil
+	instances := r.instances
+	r.instances = make(map[instanceKey]registry.ServiceInstance)
+	r.mutex.Unlock()
+
+	for _, cancel := range cancels {
+		cancel()
+	}
+	var err error
+	for _, si := range instances {
+		ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+		if er := r.client.Eval(ctx, luaUnregister, r.keys(si.Name), si.Address, r.channel(si.Name)).Err(); er != nil {
+			err = er
+		}
+		cancel()
+	}
+	return err
+}
+
+// 同一个服务的 key 用 hash tag 放到同一个 slot，集群模式下 lua 脚本才能执行
+func (r *Registry) keys(serviceName string) []string {
+	return []string{
+		fmt.Sprintf("%s:{%s}:expire", r.prefix, serviceName),
+		fmt.Sprintf("%s:{%s}:instances", r.prefix, serviceName),
+		fmt.Sprintf("%s:{%s}:revision", r.prefix, serviceName),
+	}
+}
+
+func (r *Registry) channel(serviceName string) string {
+	return fmt.Sprintf("%s:{%s}:events", r.prefix, serviceName)
+}
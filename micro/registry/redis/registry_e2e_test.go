@@ -0,0 +1,94 @@
+//go:build e2e
+
+package redis
+
+import (
+	"context"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zhuguangfeng/study/micro/registry"
+	"testing"
+	"time"
+)
+
+func TestRegistry_e2e(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	prefix := "micro_e2e_" + time.Now().Format("150405.000")
+	server := NewRegistry(rdb, WithPrefix(prefix), WithTTL(time.Millisecond*600))
+	client := NewRegistry(rdb, WithPrefix(prefix), WithTTL(time.Millisecond*600))
+	defer client.Close()
+
+	events, err := client.Subscribe(ctx, "user-service")
+	require.NoError(t, err)
+	nextEvent := func() registry.Event {
+		select {
+		case event := <-events:
+			return event
+		case <-ctx.Done():
+			t.Fatal("没有收到事件")
+			return registry.Event{}
+		}
+	}
+
+	si := registry.ServiceInstance{Name: "user-service", Address: "localhost:8081", Weight: 10}
+	require.NoError(t, server.Registry(ctx, si))
+	assert.Equal(t, registry.Event{Type: registry.EventTypeAdd, Instance: si, Revision: 1}, nextEvent())
+	si.Weight = 20
+	require.NoError(t, server.Registry(ctx, si))
+	assert.Equal(t, registry.Event{Type: registry.EventTypeUpdate, Instance: si, Revision: 2}, nextEvent())
+
+	// 更新实例信息
+	si.Unhealthy = true
+	require.NoError(t, client.Update(ctx, si))
+	assert.Equal(t, registry.Event{Type: registry.EventTypeUpdate, Instance: si, Revision: 3}, nextEvent())
+	// 重新注册不会覆盖健康检查的结果
+	reg := si
+	reg.Unhealthy = false
+	require.NoError(t, server.Registry(ctx, reg))
+	assert.Equal(t, registry.Event{Type: registry.EventTypeUpdate, Instance: si, Revision: 4}, nextEvent())
+	assert.Equal(t, registry.ErrInstanceNotFound, client.Update(ctx, registry.ServiceInstance{
+		Name: "user-service", Address: "localhost:8083",
+	}))
+
+	// 心跳会续约，超过 TTL 也不会过期
+	time.Sleep(time.Second * 2)
+	res, err := client.ListServices(ctx, "user-service")
+	require.NoError(t, err)
+	assert.Equal(t, []registry.ServiceInstance{si}, res)
+
+	// 没有心跳的实例过期之后会被清理
+	keys := server.keys("user-service")
+	require.NoError(t, rdb.ZAdd(ctx, keys[0], redis.Z{Score: 1, Member: "localhost:8082"}).Err())
+	require.NoError(t, rdb.HSet(ctx, keys[1], "localhost:8082",
+		`{"Name":"user-service","Address":"localhost:8082"}`).Err())
+	event := nextEvent()
+	assert.Equal(t, registry.EventTypeDelete, event.Type)
+	assert.Equal(t, "localhost:8082", event.Instance.Address)
+
+	// 关闭的时候注销自己注册的实例
+	require.NoError(t, server.Close())
+	event = nextEvent()
+	assert.Equal(t, registry.EventTypeDelete, event.Type)
+	assert.Equal(t, si, event.Instance)
+	res, err = client.ListServices(ctx, "user-service")
+	require.NoError(t, err)
+	assert.Empty(t, res)
+
+	// 订阅结束之后不会再留着 cancel
+	subCtx, subCancel := context.WithCancel(ctx)
+	_, err = client.Subscribe(subCtx, "user-service")
+	require.NoError(t, err)
+	subCancel()
+	assert.Eventually(t, func() bool {
+		client.mutex.Lock()
+		defer client.mutex.Unlock()
+		return len(client.cancels) == 0
+	}, time.Second, time.Millisecond*10)
+
+	require.NoError(t, rdb.Del(ctx, keys...).Err())
+}
@@ -0,0 +1,259 @@
+package redis
+
+import (
+	"context"
+	"github.com/golang/mock/gomock"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zhuguangfeng/study/cache/mocks"
+	"github.com/zhuguangfeng/study/micro/registry"
+	"testing"
+	"time"
+)
+
+var (
+	userKeys = []string{
+		"micro:{user-service}:expire",
+		"micro:{user-service}:instances",
+		"micro:{user-service}:revision",
+	}
+	userChannel = "micro:{user-service}:events"
+)
+
+func TestRegistry_Registry(t *testing.T) {
+	si := registry.ServiceInstance{Name: "user-service", Address: "localhost:8081", Weight: 10}
+	testCases := []struct {
+		name string
+		mock func(ctrl *gomock.Controller) redis.Cmdable
+
+		wantErr       error
+		wantInstances int
+	}{
+		{
+			name: "eval error",
+			mock: func(ctrl *gomock.Controller) redis.Cmdable {
+				cmd := mocks.NewMockCmdable(ctrl)
+				res := redis.NewCmd(context.Background())
+				res.SetErr(context.DeadlineExceeded)
+				cmd.EXPECT().Eval(gomock.Any(), luaRegister, userKeys, gomock.Any()).Return(res)
+				return cmd
+			},
+			wantErr: context.DeadlineExceeded,
+		},
+		{
+			name: "registered",
+			mock: func(ctrl *gomock.Controller) redis.Cmdable {
+				cmd := mocks.NewMockCmdable(ctrl)
+				res := redis.NewCmd(context.Background())
+				res.SetVal(int64(1))
+				cmd.EXPECT().Eval(gomock.Any(), luaRegister, userKeys, "localhost:8081",
+					`{"Name":"user-service","Address":"localhost:8081","Version":"","Weight":10,"Zone":"","Group":"","Tags":null,"Unhealthy":false}`,
+					int64(30000), userChannel).Return(res)
+				return cmd
+			},
+			wantInstances: 1,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			r := newRegistry(tc.mock(ctrl))
+			err := r.Registry(context.Background(), si)
+			assert.Equal(t, tc.wantErr, err)
+			// 注册成功的实例要续约
+			assert.Len(t, r.instances, tc.wantInstances)
+		})
+	}
+}
+
+func TestRegistry_ListServices(t *testing.T) {
+	testCases := []struct {
+		name string
+		mock func(ctrl *gomock.Controller) redis.Cmdable
+
+		wantRes []registry.ServiceInstance
+		wantErr error
+	}{
+		{
+			name: "eval error",
+			mock: func(ctrl *gomock.Controller) redis.Cmdable {
+				cmd := mocks.NewMockCmdable(ctrl)
+				res := redis.NewCmd(context.Background())
+				res.SetErr(context.DeadlineExceeded)
+				cmd.EXPECT().Eval(gomock.Any(), luaList, userKeys[:2]).Return(res)
+				return cmd
+			},
+			wantErr: context.DeadlineExceeded,
+		},
+		{
+			name: "empty",
+			mock: func(ctrl *gomock.Controller) redis.Cmdable {
+				cmd := mocks.NewMockCmdable(ctrl)
+				res := redis.NewCmd(context.Background())
+				res.SetVal([]any{})
+				cmd.EXPECT().Eval(gomock.Any(), luaList, userKeys[:2]).Return(res)
+				return cmd
+			},
+			wantRes: []registry.ServiceInstance{},
+		},
+		{
+			name: "instances",
+			mock: func(ctrl *gomock.Controller) redis.Cmdable {
+				cmd := mocks.NewMockCmdable(ctrl)
+				res := redis.NewCmd(context.Background())
+				res.SetVal([]any{
+					`{"Name":"user-service","Address":"localhost:8081","Weight":10}`,
+					// hash 里面已经没有了
+					nil,
+					`{"Name":"user-service","Address":"localhost:8082","Tags":{"env":"test"}}`,
+				})
+				cmd.EXPECT().Eval(gomock.Any(), luaList, userKeys[:2]).Return(res)
+				return cmd
+			},
+			wantRes: []registry.ServiceInstance{
+				{Name: "user-service", Address: "localhost:8081", Weight: 10},
+				{Name: "user-service", Address: "localhost:8082", Tags: map[string]string{"env": "test"}},
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			r := newRegistry(tc.mock(ctrl))
+			res, err := r.ListServices(context.Background(), "user-service")
+			assert.Equal(t, tc.wantErr, err)
+			if err != nil {
+				return
+			}
+			assert.Equal(t, tc.wantRes, res)
+		})
+	}
+}
+
+func TestRegistry_Update(t *testing.T) {
+	si := registry.ServiceInstance{Name: "user-service", Address: "localhost:8081", Unhealthy: true}
+	testCases := []struct {
+		name string
+		mock func(ctrl *gomock.Controller) redis.Cmdable
+
+		wantErr error
+	}{
+		{
+			name: "eval error",
+			mock: func(ctrl *gomock.Controller) redis.Cmdable {
+				cmd := mocks.NewMockCmdable(ctrl)
+				res := redis.NewCmd(context.Background())
+				res.SetErr(context.DeadlineExceeded)
+				cmd.EXPECT().Eval(gomock.Any(), luaUpdate, userKeys, gomock.Any()).Return(res)
+				return cmd
+			},
+			wantErr: context.DeadlineExceeded,
+		},
+		{
+			name: "not found",
+			mock: func(ctrl *gomock.Controller) redis.Cmdable {
+				cmd := mocks.NewMockCmdable(ctrl)
+				res := redis.NewCmd(context.Background())
+				res.SetVal(int64(0))
+				cmd.EXPECT().Eval(gomock.Any(), luaUpdate, userKeys, gomock.Any()).Return(res)
+				return cmd
+			},
+			wantErr: registry.ErrInstanceNotFound,
+		},
+		{
+			name: "updated",
+			mock: func(ctrl *gomock.Controller) redis.Cmdable {
+				cmd := mocks.NewMockCmdable(ctrl)
+				res := redis.NewCmd(context.Background())
+				res.SetVal(int64(12))
+				cmd.EXPECT().Eval(gomock.Any(), luaUpdate, userKeys, "localhost:8081",
+					`{"Name":"user-service","Address":"localhost:8081","Version":"","Weight":0,"Zone":"","Group":"","Tags":null,"Unhealthy":true}`,
+					userChannel).Return(res)
+				return cmd
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			r := newRegistry(tc.mock(ctrl))
+			err := r.Update(context.Background(), si)
+			assert.Equal(t, tc.wantErr, err)
+		})
+	}
+}
+
+func TestRegistry_keepAlive(t *testing.T) {
+	si := registry.ServiceInstance{Name: "user-service", Address: "localhost:8081"}
+	testCases := []struct {
+		name string
+		mock func(ctrl *gomock.Controller) redis.Cmdable
+	}{
+		{
+			name: "refreshed",
+			mock: func(ctrl *gomock.Controller) redis.Cmdable {
+				cmd := mocks.NewMockCmdable(ctrl)
+				res := redis.NewCmd(context.Background())
+				res.SetVal(int64(1))
+				cmd.EXPECT().Eval(gomock.Any(), luaKeepAlive, userKeys[:1], "localhost:8081", int64(30000)).Return(res)
+				cmd.EXPECT().Eval(gomock.Any(), luaExpire, userKeys, userChannel).Return(redis.NewCmd(context.Background()))
+				return cmd
+			},
+		},
+		{
+			// 已经过期被清理了，要重新注册
+			name: "expired",
+			mock: func(ctrl *gomock.Controller) redis.Cmdable {
+				cmd := mocks.NewMockCmdable(ctrl)
+				res := redis.NewCmd(context.Background())
+				res.SetVal(int64(0))
+				cmd.EXPECT().Eval(gomock.Any(), luaKeepAlive, userKeys[:1], "localhost:8081", int64(30000)).Return(res)
+				cmd.EXPECT().Eval(gomock.Any(), luaRegister, userKeys, "localhost:8081", gomock.Any(),
+					int64(30000), userChannel).Return(redis.NewCmd(context.Background()))
+				cmd.EXPECT().Eval(gomock.Any(), luaExpire, userKeys, userChannel).Return(redis.NewCmd(context.Background()))
+				return cmd
+			},
+		},
+		{
+			// 网络问题，下次再试
+			name: "eval error",
+			mock: func(ctrl *gomock.Controller) redis.Cmdable {
+				cmd := mocks.NewMockCmdable(ctrl)
+				res := redis.NewCmd(context.Background())
+				res.SetErr(context.DeadlineExceeded)
+				cmd.EXPECT().Eval(gomock.Any(), luaKeepAlive, userKeys[:1], "localhost:8081", int64(30000)).Return(res)
+				cmd.EXPECT().Eval(gomock.Any(), luaExpire, userKeys, userChannel).Return(redis.NewCmd(context.Background()))
+				return cmd
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			r := newRegistry(tc.mock(ctrl))
+			r.instances[instanceKey{name: si.Name, address: si.Address}] = si
+			r.keepAlive()
+		})
+	}
+}
+
+func TestRegistry_Close(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	cmd := mocks.NewMockCmdable(ctrl)
+	cmd.EXPECT().Eval(gomock.Any(), luaUnregister, userKeys, "localhost:8081", userChannel).
+		Return(redis.NewCmd(context.Background()))
+	r := newRegistry(cmd, WithTTL(time.Second))
+	r.instances[instanceKey{name: "user-service", address: "localhost:8081"}] = registry.ServiceInstance{
+		Name: "user-service", Address: "localhost:8081",
+	}
+	require.NoError(t, r.Close())
+	assert.Empty(t, r.instances)
+	// 重复关闭不会再注销
+	require.NoError(t, r.Close())
+}
@@ -0,0 +1,44 @@
+package static
+
+import (
+	"context"
+	"github.com/zhuguangfeng/study/micro/registry"
+	"github.com/zhuguangfeng/study/micro/registry/memory"
+)
+
+// Registry 固定的实例列表，一般来自配置，只能给客户端用
+type Registry struct {
+	store *memory.Registry
+}
+
+func NewRegistry(instances ...registry.ServiceInstance) *Registry {
+	store := memory.NewRegistry()
+	for _, si := range instances {
+		// 内存实现在关闭之前不会返回 error
+		_ = store.Registry(context.Background(), si)
+	}
+	return &Registry{
+		store: store,
+	}
+}
+
+func (r *Registry) Registry(ctx context.Context, si registry.ServiceInstance) error {
+	return registry.ErrReadOnly
+}
+
+func (r *Registry) UnRegistry(ctx context.Context, si registry.ServiceInstance) error {
+	return registry.ErrReadOnly
+}
+
+func (r *Registry) ListServices(ctx context.Context, serviceName string) ([]registry.ServiceInstance, error) {
+	return r.store.ListServices(ctx, serviceName)
+}
+
+// Subscribe 实例不会变，所以不会有事件，ctx 取消的时候关闭 channel
+func (r *Registry) Subscribe(ctx context.Context, serviceName string) (<-chan registry.Event, error) {
+	return r.store.Subscribe(ctx, serviceName)
+}
+
+func (r *Registry) Close() error {
+	return r.store.Close()
+}
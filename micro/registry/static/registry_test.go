@@ -0,0 +1,37 @@
+package static
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zhuguangfeng/study/micro/registry"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry(
+		registry.ServiceInstance{Name: "user-service", Address: "localhost:8082", Weight: 20},
+		registry.ServiceInstance{Name: "user-service", Address: "localhost:8081", Weight: 10},
+		registry.ServiceInstance{Name: "order-service", Address: "localhost:9091"},
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	res, err := r.ListServices(ctx, "user-service")
+	require.NoError(t, err)
+	assert.Equal(t, []registry.ServiceInstance{
+		{Name: "user-service", Address: "localhost:8081", Weight: 10},
+		{Name: "user-service", Address: "localhost:8082", Weight: 20},
+	}, res)
+
+	si := registry.ServiceInstance{Name: "user-service", Address: "localhost:8083"}
+	assert.Equal(t, registry.ErrReadOnly, r.Registry(ctx, si))
+	assert.Equal(t, registry.ErrReadOnly, r.UnRegistry(ctx, si))
+
+	ch, err := r.Subscribe(ctx, "user-service")
+	require.NoError(t, err)
+	cancel()
+	_, ok := <-ch
+	assert.False(t, ok)
+
+	require.NoError(t, r.Close())
+}
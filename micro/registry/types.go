@@ -2,14 +2,21 @@ package registry
 
 import (
 	"context"
+	"errors"
 	"io"
 )
 
+var (
+	ErrInstanceNotFound = errors.New("micro: 实例不存在")
+	ErrReadOnly         = errors.New("micro: 只读的注册中心不支持注册和注销")
+)
+
 type Registry interface {
 	Registry(ctx context.Context, si ServiceInstance) error
 	UnRegistry(ctx context.Context, si ServiceInstance) error
 	ListServices(ctx context.Context, serviceName string) ([]ServiceInstance, error)
-	Subscribe(ServiceName string) (<-chan Event, error)
+	// Subscribe 订阅服务的变更，ctx 被取消或者订阅中断的时候关闭返回的 channel
+	Subscribe(ctx context.Context, serviceName string) (<-chan Event, error)
 	io.Closer
 }
 
@@ -17,9 +24,39 @@ type ServiceInstance struct {
 	Name string
 	//最关键的 就是定位信息
 	Address string
+	// 版本，例如 v1.0.0
+	Version string
+	// 权重，负载均衡用，0 表示使用默认权重
+	Weight uint32
+	// 所在的可用区，路由的时候优先选择同一个可用区的实例
+	Zone string
+	// 分组，例如 canary
+	Group string
+	// 其它自定义的标签
+	Tags map[string]string
+	// 健康检查没通过，客户端不会把请求发给这个实例
+	Unhealthy bool
+}
+
+// Updater 可选的接口，更新已经注册的实例信息，例如健康检查的结果
+// 和 Registry 不同，Update 不会改变实例的生命周期，实例不存在的时候返回 ErrInstanceNotFound
+type Updater interface {
+	Update(ctx context.Context, si ServiceInstance) error
 }
 
+type EventType string
+
+const (
+	EventTypeAdd    EventType = "ADD"
+	EventTypeUpdate EventType = "UPDATE"
+	EventTypeDelete EventType = "DELETE"
+)
+
 type Event struct {
-	//ADD DELETE
-	Type string
+	Type EventType
+	// 发生变化的实例，DELETE 的时候是删除之前的实例
+	Instance ServiceInstance
+	// 注册中心里面的版本号，例如 etcd 的 revision，同一个实例的事件版本号是递增的
+	// 没有版本号的注册中心是 0
+	Revision int64
 }
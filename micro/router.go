@@ -0,0 +1,205 @@
+package micro
+
+import (
+	"context"
+	"github.com/zhuguangfeng/study/micro/registry"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/status"
+)
+
+// ErrNoInstanceMatched 路由规则过滤之后没有可以用的实例
+var ErrNoInstanceMatched = status.Error(codes.Unavailable, "micro: 没有符合路由规则的实例")
+
+// Filter 路由过滤条件，返回 false 表示这次请求不能发到这个实例
+type Filter func(ctx context.Context, si registry.ServiceInstance) bool
+
+// Fallback 过滤之后一个实例都没有的时候怎么办
+type Fallback uint8
+
+const (
+	// FallbackIgnore 忽略这条规则，用过滤之前的实例
+	FallbackIgnore Fallback = iota
+	// FallbackFail 直接返回 ErrNoInstanceMatched
+	FallbackFail
+)
+
+// RouteRule 一条路由规则
+type RouteRule struct {
+	Filter   Filter
+	Fallback Fallback
+}
+
+// Router 路由规则链，按照顺序一条条过滤
+type Router []RouteRule
+
+// Route 返回可以用的实例的下标
+func (r Router) Route(ctx context.Context, instances []registry.ServiceInstance) ([]int, error) {
+	candidates := make([]int, 0, len(instances))
+	for i := range instances {
+		candidates = append(candidates, i)
+	}
+	for _, rule := range r {
+		filtered := make([]int, 0, len(candidates))
+		for _, idx := range candidates {
+			if rule.Filter(ctx, instances[idx]) {
+				filtered = append(filtered, idx)
+			}
+		}
+		if len(filtered) > 0 {
+			candidates = filtered
+			continue
+		}
+		if rule.Fallback == FallbackFail {
+			return nil, ErrNoInstanceMatched
+		}
+	}
+	return candidates, nil
+}
+
+type routerKey struct{}
+
+func withRouter(ctx context.Context, r Router) context.Context {
+	return context.WithValue(ctx, routerKey{}, r)
+}
+
+func routerFromContext(ctx context.Context) (Router, bool) {
+	if ctx == nil {
+		return nil, false
+	}
+	r, ok := ctx.Value(routerKey{}).(Router)
+	return r, ok && len(r) > 0
+}
+
+// 把路由规则放进 ctx，picker 从 balancer.PickInfo 的 Ctx 里面取出来
+func routerUnaryClientInterceptor(r Router) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		return invoker(withRouter(ctx, r), method, req, reply, cc, opts...)
+	}
+}
+
+func routerStreamClientInterceptor(r Router) grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		return streamer(withRouter(ctx, r), desc, cc, method, opts...)
+	}
+}
+
+// picker 共用的路由逻辑
+type routable struct {
+	instances []registry.ServiceInstance
+}
+
+func newRoutable(addrs []resolver.Address) routable {
+	res := routable{
+		instances: make([]registry.ServiceInstance, 0, len(addrs)),
+	}
+	for _, addr := range addrs {
+		si, ok := InstanceFromAddress(addr)
+		if !ok {
+			si = registry.ServiceInstance{Address: addr.Addr}
+		}
+		res.instances = append(res.instances, si)
+	}
+	return res
+}
+
+// 返回这次请求可以用的实例的下标，没有路由规则和熔断器的时候返回 nil，表示全部都可以用
+func (r routable) route(ctx context.Context) ([]int, error) {
+	var candidates []int
+	if router, ok := routerFromContext(ctx); ok {
+		var err error
+		candidates, err = router.Route(ctx, r.instances)
+		if err != nil {
+			return nil, err
+		}
+	}
+	cb, ok := circuitBreakerFromContext(ctx)
+	if !ok {
+		return candidates, nil
+	}
+	// 路由之后再去掉熔断的实例
+	filtered := make([]int, 0, len(r.instances))
+	if candidates == nil {
+		for i, si := range r.instances {
+			if cb.available(si.Address) {
+				filtered = append(filtered, i)
+			}
+		}
+	} else {
+		for _, idx := range candidates {
+			if cb.available(r.instances[idx].Address) {
+				filtered = append(filtered, idx)
+			}
+		}
+	}
+	if len(filtered) == 0 {
+		return nil, ErrCircuitOpen
+	}
+	return filtered, nil
+}
+
+// 选中了第 idx 个实例，有熔断器的时候请求结束要上报结果
+// route 之后半开的探测名额可能被别的请求抢先用完了，这个时候返回 ErrCircuitOpen
+func (r routable) picked(ctx context.Context, idx int, res balancer.PickResult) (balancer.PickResult, error) {
+	cb, ok := circuitBreakerFromContext(ctx)
+	if !ok {
+		return res, nil
+	}
+	report, ok := cb.picked(r.instances[idx].Address)
+	if !ok {
+		return balancer.PickResult{}, ErrCircuitOpen
+	}
+	done := res.Done
+	res.Done = func(info balancer.DoneInfo) {
+		report(info.Err)
+		if done != nil {
+			done(info)
+		}
+	}
+	return res, nil
+}
+
+type groupKey struct{}
+
+// WithGroup 指定这次请求发到哪个分组，例如灰度流量设置成 canary
+func WithGroup(ctx context.Context, group string) context.Context {
+	return context.WithValue(ctx, groupKey{}, group)
+}
+
+// GroupFilter 按照分组过滤
+// 请求通过 WithGroup 指定了分组就只发给这个分组的实例，没有指定就只发给没有分组的实例
+func GroupFilter() Filter {
+	return func(ctx context.Context, si registry.ServiceInstance) bool {
+		group, _ := ctx.Value(groupKey{}).(string)
+		return si.Group == group
+	}
+}
+
+// ZoneFilter 只发给 zone 这个可用区的实例，一般配合 FallbackIgnore 实现同可用区优先
+func ZoneFilter(zone string) Filter {
+	return func(ctx context.Context, si registry.ServiceInstance) bool {
+		return si.Zone == zone
+	}
+}
+
+type tagsKey struct{}
+
+// WithTags 指定这次请求要求实例带上的标签
+func WithTags(ctx context.Context, tags map[string]string) context.Context {
+	return context.WithValue(ctx, tagsKey{}, tags)
+}
+
+// TagFilter 实例要带上 WithTags 指定的全部标签，没有指定就不过滤
+func TagFilter() Filter {
+	return func(ctx context.Context, si registry.ServiceInstance) bool {
+		tags, _ := ctx.Value(tagsKey{}).(map[string]string)
+		for k, v := range tags {
+			if si.Tags[k] != v {
+				return false
+			}
+		}
+		return true
+	}
+}
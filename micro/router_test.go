@@ -0,0 +1,157 @@
+package micro
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zhuguangfeng/study/micro/registry"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"testing"
+)
+
+var routeInstances = []registry.ServiceInstance{
+	{Address: "127.0.0.1:8081", Zone: "hz"},
+	{Address: "127.0.0.1:8082", Zone: "sh"},
+	{Address: "127.0.0.1:8083", Zone: "hz", Group: "canary"},
+	{Address: "127.0.0.1:8084", Zone: "sh", Group: "canary", Tags: map[string]string{"env": "test"}},
+}
+
+func TestRouter_Route(t *testing.T) {
+	testCases := []struct {
+		name   string
+		router Router
+		ctx    context.Context
+
+		wantRes []int
+		wantErr error
+	}{
+		{
+			name:    "no rule",
+			ctx:     context.Background(),
+			wantRes: []int{0, 1, 2, 3},
+		},
+		{
+			name:    "default group",
+			router:  Router{{Filter: GroupFilter()}},
+			ctx:     context.Background(),
+			wantRes: []int{0, 1},
+		},
+		{
+			name:    "canary",
+			router:  Router{{Filter: GroupFilter()}},
+			ctx:     WithGroup(context.Background(), "canary"),
+			wantRes: []int{2, 3},
+		},
+		{
+			name: "canary prefer zone",
+			router: Router{
+				{Filter: GroupFilter(), Fallback: FallbackFail},
+				{Filter: ZoneFilter("sh"), Fallback: FallbackIgnore},
+			},
+			ctx:     WithGroup(context.Background(), "canary"),
+			wantRes: []int{3},
+		},
+		{
+			name: "zone fallback",
+			router: Router{
+				{Filter: GroupFilter(), Fallback: FallbackFail},
+				{Filter: ZoneFilter("bj"), Fallback: FallbackIgnore},
+			},
+			ctx:     context.Background(),
+			wantRes: []int{0, 1},
+		},
+		{
+			name: "group not found ignore",
+			router: Router{
+				{Filter: GroupFilter(), Fallback: FallbackIgnore},
+			},
+			ctx:     WithGroup(context.Background(), "blue"),
+			wantRes: []int{0, 1, 2, 3},
+		},
+		{
+			name: "group not found fail",
+			router: Router{
+				{Filter: GroupFilter(), Fallback: FallbackFail},
+				{Filter: ZoneFilter("sh"), Fallback: FallbackIgnore},
+			},
+			ctx:     WithGroup(context.Background(), "blue"),
+			wantErr: ErrNoInstanceMatched,
+		},
+		{
+			name:    "tags",
+			router:  Router{{Filter: TagFilter(), Fallback: FallbackFail}},
+			ctx:     WithTags(context.Background(), map[string]string{"env": "test"}),
+			wantRes: []int{3},
+		},
+		{
+			name:    "no tags",
+			router:  Router{{Filter: TagFilter(), Fallback: FallbackFail}},
+			ctx:     context.Background(),
+			wantRes: []int{0, 1, 2, 3},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := tc.router.Route(tc.ctx, routeInstances)
+			assert.Equal(t, tc.wantErr, err)
+			if err != nil {
+				return
+			}
+			assert.Equal(t, tc.wantRes, res)
+		})
+	}
+}
+
+func TestPicker_Route(t *testing.T) {
+	info := base.PickerBuildInfo{
+		ReadySCs: make(map[balancer.SubConn]base.SubConnInfo, len(routeInstances)),
+	}
+	for _, si := range routeInstances {
+		info.ReadySCs[&fakeSubConn{addr: si.Address}] = base.SubConnInfo{
+			Address: newAddress(si),
+		}
+	}
+	builders := map[string]base.PickerBuilder{
+		BalancerRoundRobin:         &roundRobinPickerBuilder{},
+		BalancerWeightedRoundRobin: &weightedRoundRobinPickerBuilder{},
+		BalancerWeightedRandom:     &weightedRandomPickerBuilder{},
+		BalancerLeastActive:        &leastActivePickerBuilder{},
+		BalancerConsistentHash:     &consistentHashPickerBuilder{},
+	}
+	router := Router{
+		{Filter: GroupFilter(), Fallback: FallbackFail},
+		{Filter: ZoneFilter("hz"), Fallback: FallbackIgnore},
+	}
+	for name, b := range builders {
+		t.Run(name, func(t *testing.T) {
+			p := b.Build(info)
+
+			// 灰度流量只会发到灰度实例，并且优先同可用区
+			ctx := withRouter(WithHashKey(WithGroup(context.Background(), "canary"), "user-1"), router)
+			for i := 0; i < 20; i++ {
+				pr, err := p.Pick(balancer.PickInfo{Ctx: ctx})
+				require.NoError(t, err)
+				assert.Equal(t, "127.0.0.1:8083", pr.SubConn.(*fakeSubConn).addr)
+				if pr.Done != nil {
+					pr.Done(balancer.DoneInfo{})
+				}
+			}
+
+			// 普通流量不会发到灰度实例
+			ctx = withRouter(context.Background(), router)
+			for i := 0; i < 20; i++ {
+				pr, err := p.Pick(balancer.PickInfo{Ctx: ctx})
+				require.NoError(t, err)
+				assert.Equal(t, "127.0.0.1:8081", pr.SubConn.(*fakeSubConn).addr)
+				if pr.Done != nil {
+					pr.Done(balancer.DoneInfo{})
+				}
+			}
+
+			ctx = withRouter(WithGroup(context.Background(), "blue"), router)
+			_, err := p.Pick(balancer.PickInfo{Ctx: ctx})
+			assert.Equal(t, ErrNoInstanceMatched, err)
+		})
+	}
+}
@@ -2,81 +2,379 @@ package micro
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
+	"github.com/zhuguangfeng/study/micro/auth"
 	"github.com/zhuguangfeng/study/micro/registry"
+	"github.com/zhuguangfeng/study/ratelimit"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
 	"time"
 )
 
 type ServerOption func(server *Server)
 
 type Server struct {
-	name            string
+	name string
+	// 注册到注册中心的实例信息，Name 和 Address 在 Start 的时候填充
+	instance        registry.ServiceInstance
 	registry        registry.Registry
 	registryTimeout time.Duration
 	*grpc.Server
 	listener net.Listener
+	grpcOpts []grpc.ServerOption
+	// 按照顺序执行，第一个在最外层
+	unaryInterceptors  []grpc.UnaryServerInterceptor
+	streamInterceptors []grpc.StreamServerInterceptor
+	health             *health.Server
+	// 注销之后等多久再停止，让客户端有时间感知到实例下线
+	drainTimeout time.Duration
+	// GracefulStop 最多等多久，超时之后强制 Stop
+	stopTimeout time.Duration
+
+	mutex      sync.Mutex
+	registered bool
+	closed     bool
+	closeOnce  sync.Once
+	closeErr   error
 }
 
 func NewServer(name string, opts ...ServerOption) (*Server, error) {
 	res := &Server{
 		name:            name,
-		Server:          grpc.NewServer(),
 		registryTimeout: time.Second * 10,
+		drainTimeout:    time.Second * 5,
+		stopTimeout:     time.Second * 30,
 	}
 
 	for _, opt := range opts {
 		opt(res)
 	}
+	// grpc.Server 创建之后就不能再改了，所以要等所有的 option 都处理完
+	grpcOpts := append([]grpc.ServerOption{}, res.grpcOpts...)
+	if len(res.unaryInterceptors) > 0 {
+		grpcOpts = append(grpcOpts, grpc.ChainUnaryInterceptor(res.unaryInterceptors...))
+	}
+	if len(res.streamInterceptors) > 0 {
+		grpcOpts = append(grpcOpts, grpc.ChainStreamInterceptor(res.streamInterceptors...))
+	}
+	res.Server = grpc.NewServer(grpcOpts...)
+	// 标准的 gRPC 健康检查，整个 server 和服务名两个维度
+	res.health = health.NewServer()
+	res.health.SetServingStatus(name, healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(res.Server, res.health)
 
 	return res, nil
 }
 
-func (s *Server) Start(ctx context.Context, addr string) error {
+// Start 启动并且阻塞，直到 Close 被调用、ctx 被取消或者收到 signals 里面的信号
+// 后两种情况会调用 Close 优雅退出，例如
+//
+//	server.Start(ctx, ":8081", syscall.SIGINT, syscall.SIGTERM)
+func (s *Server) Start(ctx context.Context, addr string, signals ...os.Signal) error {
 
 	listener, err := net.Listen("tcp", addr)
 	if err != nil {
 		return err
 	}
+	return s.StartWithListener(ctx, listener, signals...)
+}
+
+// StartWithListener 在已经创建好的 listener 上启动，例如测试用的 bufconn
+func (s *Server) StartWithListener(ctx context.Context, listener net.Listener, signals ...os.Signal) error {
 	s.listener = listener
+	if err := s.register(listener); err != nil {
+		// 还没有开始 Serve，listener 要自己关掉
+		return errors.Join(err, listener.Close())
+	}
 
-	//开始注册
-	if s.registry != nil {
-		//在这里注册
-		ctx, cancel := context.WithTimeout(context.Background(), s.registryTimeout)
-		defer cancel()
-		err = s.registry.Registry(ctx, registry.ServiceInstance{
-			Name:    s.name,
-			Address: listener.Addr().String(),
-		})
-		if err != nil {
-			return err
-		}
-		//这里已经注册成功了
-		defer func() {
-			//忽略或者log一下错误
-			//_ = s.registry.Close()
-			//_ = s.registry.UnRegistry(context.Background(), registry.ServiceInstance{})
-		}()
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- s.Serve(listener)
+	}()
+	var sigChan chan os.Signal
+	if len(signals) > 0 {
+		sigChan = make(chan os.Signal, 1)
+		signal.Notify(sigChan, signals...)
+		defer signal.Stop(sigChan)
+	}
+	select {
+	case err := <-serveErr:
+		// 别人调用了 Close，或者 Serve 自己出错了
+		// 后一种情况也要注销，不然注册中心里面会一直留着这个已经不能用的地址
+		return errors.Join(err, s.Close())
+	case <-ctx.Done():
+	case <-sigChan:
+	}
+	err := s.Close()
+	// Serve 在 GracefulStop 或者 Stop 之后返回 nil
+	return errors.Join(err, <-serveErr)
+}
+
+func (s *Server) register(listener net.Listener) error {
+	if s.registry == nil {
+		return nil
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return grpc.ErrServerStopped
 	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.registryTimeout)
+	defer cancel()
+	s.instance.Name = s.name
+	if s.instance.Address == "" {
+		s.instance.Address = listener.Addr().String()
+	}
+	if err := s.registry.Registry(ctx, s.instance); err != nil {
+		return err
+	}
+	s.registered = true
+	return nil
+}
 
-	return s.Serve(listener)
+// Health 健康检查的状态，业务发现自己出问题的时候可以设置成 NOT_SERVING
+func (s *Server) Health() *health.Server {
+	return s.health
 }
 
+// Close 按顺序优雅退出
+//  1. 健康检查返回 NOT_SERVING
+//  2. 从注册中心注销自己
+//  3. 等待 drainTimeout，让客户端感知到实例下线，这期间还能正常处理请求
+//  4. GracefulStop，等正在处理的请求结束，超过 stopTimeout 强制 Stop
+//
+// 注册中心可能是多个 Server 共享的，所以 Close 不会关闭注册中心
 func (s *Server) Close() error {
-	if s.registry != nil {
-		err := s.registry.Close()
-		if err != nil {
-			return err
-		}
+	s.closeOnce.Do(func() {
+		s.closeErr = s.shutdown()
+	})
+	return s.closeErr
+}
+
+func (s *Server) shutdown() error {
+	s.health.Shutdown()
+
+	s.mutex.Lock()
+	s.closed = true
+	registered := s.registered
+	s.registered = false
+	s.mutex.Unlock()
+
+	var err error
+	if registered {
+		ctx, cancel := context.WithTimeout(context.Background(), s.registryTimeout)
+		err = s.registry.UnRegistry(ctx, s.instance)
+		cancel()
+		time.Sleep(s.drainTimeout)
 	}
-	s.GracefulStop()
-	//s.listener.Close()
-	return nil
+
+	stopped := make(chan struct{})
+	go func() {
+		s.GracefulStop()
+		close(stopped)
+	}()
+	timer := time.NewTimer(s.stopTimeout)
+	defer timer.Stop()
+	select {
+	case <-stopped:
+	case <-timer.C:
+		// 有请求一直不结束，例如长连接的流
+		s.Stop()
+		<-stopped
+	}
+	return err
 }
 
+// ServerWithDrainTimeout 注销之后等多久再停止，默认 5s
+func ServerWithDrainTimeout(timeout time.Duration) ServerOption {
+	return func(server *Server) {
+		server.drainTimeout = timeout
+	}
+}
+
+// ServerWithStopTimeout 等正在处理的请求结束的最长时间，默认 30s
+func ServerWithStopTimeout(timeout time.Duration) ServerOption {
+	return func(server *Server) {
+		server.stopTimeout = timeout
+	}
+}
+
+// ServiceWithRegistry 注册中心由调用方创建，也由调用方关闭
 func ServiceWithRegistry(r registry.Registry) ServerOption {
 	return func(server *Server) {
 		server.registry = r
 	}
 }
+
+// ServerWithGRPCOptions 透传给 grpc.NewServer 的参数，例如拦截器
+func ServerWithGRPCOptions(opts ...grpc.ServerOption) ServerOption {
+	return func(server *Server) {
+		server.grpcOpts = append(server.grpcOpts, opts...)
+	}
+}
+
+// ServerWithUnaryInterceptors 一元调用的拦截器，按照传入的顺序执行，可以多次调用，例如
+//
+//	ServerWithUnaryInterceptors(
+//		interceptor.NewRecoveryBuilder().BuildUnaryServerInterceptor(),
+//		interceptor.NewRequestIDBuilder().BuildUnaryServerInterceptor(),
+//		interceptor.NewAccessLogBuilder().BuildUnaryServerInterceptor(),
+//	)
+func ServerWithUnaryInterceptors(interceptors ...grpc.UnaryServerInterceptor) ServerOption {
+	return func(server *Server) {
+		server.unaryInterceptors = append(server.unaryInterceptors, interceptors...)
+	}
+}
+
+// ServerWithStreamInterceptors 流的拦截器，按照传入的顺序执行，可以多次调用
+func ServerWithStreamInterceptors(interceptors ...grpc.StreamServerInterceptor) ServerOption {
+	return func(server *Server) {
+		server.streamInterceptors = append(server.streamInterceptors, interceptors...)
+	}
+}
+
+// ServerWithAuth 校验调用方的 token，和其它拦截器一起按照顺序执行，例如
+//
+//	ServerWithAuth(auth.NewJWTAuthenticator(secret), auth.InterceptorWithACL(auth.ACL{
+//		{Method: "/user.UserService/*", Subjects: []string{"order-service"}},
+//		{Method: "/user.UserService/Delete", Roles: []string{"admin"}},
+//	}))
+//
+// 健康检查不需要认证，不然 HealthChecker 和负载均衡都没办法探活
+func ServerWithAuth(authenticator auth.Authenticator, opts ...auth.InterceptorOption) ServerOption {
+	return func(server *Server) {
+		opts = append([]auth.InterceptorOption{
+			auth.InterceptorWithPublicMethods(healthServicePrefix + "*"),
+		}, opts...)
+		b := auth.NewInterceptorBuilder(authenticator, opts...)
+		server.unaryInterceptors = append(server.unaryInterceptors, b.BuildUnaryServerInterceptor())
+		server.streamInterceptors = append(server.streamInterceptors, b.BuildStreamServerInterceptor())
+	}
+}
+
+// ServerWithConcurrencyLimit 限制同时在处理的一元调用数，超过上限返回 ResourceExhausted，
+// 客户端的 RetryPolicy 会换一个实例重试，例如
+//
+//	ServerWithConcurrencyLimit(ratelimit.NewMaxInFlightLimiter(1000))
+//	// 根据延迟自适应调整上限
+//	ServerWithConcurrencyLimit(ratelimit.NewGradientLimiter())
+//
+// 健康检查不限流，不然过载的时候实例会被当成挂了
+// 流不受这个限制，需要的话用 ServerWithStreamConcurrencyLimit
+func ServerWithConcurrencyLimit(limiter ratelimit.ConcurrencyLimiter) ServerOption {
+	return func(server *Server) {
+		b := ratelimit.NewConcurrencyInterceptorBuilder(limiter)
+		server.unaryInterceptors = append(server.unaryInterceptors, skipHealthUnary(b.BuildUnaryServerInterceptor()))
+	}
+}
+
+// ServerWithStreamConcurrencyLimit 限制同时打开的流，流结束之前一直占着许可
+// 流的处理时间和一元调用差别很大，所以和 ServerWithConcurrencyLimit 分开，一般用 MaxInFlightLimiter
+//
+//	ServerWithStreamConcurrencyLimit(ratelimit.NewMaxInFlightLimiter(100))
+func ServerWithStreamConcurrencyLimit(limiter ratelimit.ConcurrencyLimiter) ServerOption {
+	return func(server *Server) {
+		b := ratelimit.NewConcurrencyInterceptorBuilder(limiter)
+		server.streamInterceptors = append(server.streamInterceptors, skipHealthStream(b.BuildStreamServerInterceptor()))
+	}
+}
+
+// ServerWithRateLimit 限流，触发限流返回 ResourceExhausted，默认每个方法一个 key，所有调用方共享，例如
+//
+//	// 每个方法一个令牌桶，每秒 1000 个请求，最多突发 100 个
+//	ServerWithRateLimit(ratelimit.NewLocalTokenBucketLimiter(1000, 100))
+//
+// 和 ServerWithConcurrencyLimit 一样，健康检查不限流
+func ServerWithRateLimit(limiter ratelimit.Limiter, opts ...ratelimit.InterceptorOption) ServerOption {
+	return func(server *Server) {
+		opts = append([]ratelimit.InterceptorOption{
+			ratelimit.InterceptorWithKeyFunc(ratelimit.KeyByMethod("micro")),
+		}, opts...)
+		b := ratelimit.NewInterceptorBuilder(limiter, opts...)
+		server.unaryInterceptors = append(server.unaryInterceptors, skipHealthUnary(b.BuildUnaryServerInterceptor()))
+		server.streamInterceptors = append(server.streamInterceptors, skipHealthStream(b.BuildStreamServerInterceptor()))
+	}
+}
+
+const healthServicePrefix = "/grpc.health.v1.Health/"
+
+func skipHealthUnary(interceptor grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if strings.HasPrefix(info.FullMethod, healthServicePrefix) {
+			return handler(ctx, req)
+		}
+		return interceptor(ctx, req, info, handler)
+	}
+}
+
+func skipHealthStream(interceptor grpc.StreamServerInterceptor) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if strings.HasPrefix(info.FullMethod, healthServicePrefix) {
+			return handler(srv, ss)
+		}
+		return interceptor(srv, ss, info, handler)
+	}
+}
+
+// ServerWithTLS 开启 TLS，cfg 一般用 NewServerTLSConfig 创建，这样证书更新之后不需要重启
+func ServerWithTLS(cfg *tls.Config) ServerOption {
+	return func(server *Server) {
+		server.grpcOpts = append(server.grpcOpts, grpc.Creds(credentials.NewTLS(cfg)))
+	}
+}
+
+// ServerWithAddress 注册到注册中心的地址，不设置就用监听的地址
+// 监听 0.0.0.0 或者在容器里面的时候，要设置成客户端能访问到的地址
+func ServerWithAddress(addr string) ServerOption {
+	return func(server *Server) {
+		server.instance.Address = addr
+	}
+}
+
+// ServerWithVersion 注册到注册中心的版本
+func ServerWithVersion(version string) ServerOption {
+	return func(server *Server) {
+		server.instance.Version = version
+	}
+}
+
+// ServerWithWeight 注册到注册中心的权重
+func ServerWithWeight(weight uint32) ServerOption {
+	return func(server *Server) {
+		server.instance.Weight = weight
+	}
+}
+
+// ServerWithZone 注册到注册中心的可用区
+func ServerWithZone(zone string) ServerOption {
+	return func(server *Server) {
+		server.instance.Zone = zone
+	}
+}
+
+// ServerWithGroup 注册到注册中心的分组
+func ServerWithGroup(group string) ServerOption {
+	return func(server *Server) {
+		server.instance.Group = group
+	}
+}
+
+// ServerWithTags 注册到注册中心的自定义标签，多次调用会合并
+func ServerWithTags(tags map[string]string) ServerOption {
+	return func(server *Server) {
+		if server.instance.Tags == nil {
+			server.instance.Tags = make(map[string]string, len(tags))
+		}
+		for k, v := range tags {
+			server.instance.Tags[k] = v
+		}
+	}
+}
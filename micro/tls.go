@@ -0,0 +1,231 @@
+package micro
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"log"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+type TLSOption func(o *tlsOptions)
+
+type tlsOptions struct {
+	certFile string
+	keyFile  string
+	caFile   string
+	// 客户端用的，校验服务端证书里面的域名，默认是服务名
+	serverName string
+	interval   time.Duration
+}
+
+// TLSWithCA 服务端用这个 CA 校验客户端证书，也就是开启 mTLS
+// 客户端用这个 CA 校验服务端证书，不设置就用系统的 CA
+func TLSWithCA(caFile string) TLSOption {
+	return func(o *tlsOptions) {
+		o.caFile = caFile
+	}
+}
+
+// TLSWithCertificate 客户端的证书，服务端开启了 mTLS 的时候要设置
+func TLSWithCertificate(certFile, keyFile string) TLSOption {
+	return func(o *tlsOptions) {
+		o.certFile = certFile
+		o.keyFile = keyFile
+	}
+}
+
+// TLSWithServerName 客户端校验服务端证书用的域名，默认是 Dial 的服务名
+func TLSWithServerName(name string) TLSOption {
+	return func(o *tlsOptions) {
+		o.serverName = name
+	}
+}
+
+// TLSWithReloadInterval 多久检查一次证书文件有没有更新，默认 10s，0 表示不重新加载
+func TLSWithReloadInterval(interval time.Duration) TLSOption {
+	return func(o *tlsOptions) {
+		o.interval = interval
+	}
+}
+
+// NewServerTLSConfig 从文件加载服务端证书，设置了 TLSWithCA 就要求客户端也提供证书
+// 证书文件更新之后，新的连接会用新的证书，已经建立的连接不受影响
+func NewServerTLSConfig(certFile, keyFile string, opts ...TLSOption) (*tls.Config, error) {
+	o := tlsOptions{interval: time.Second * 10}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	o.certFile, o.keyFile = certFile, keyFile
+	r, err := newCertReloader(o)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, pool := r.current()
+			cfg := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*cert},
+				// gRPC 要求协商 h2
+				NextProtos: []string{"h2"},
+			}
+			if pool != nil {
+				cfg.ClientCAs = pool
+				cfg.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			return cfg, nil
+		},
+	}, nil
+}
+
+// NewClientTLSConfig 从文件加载客户端的 TLS 配置
+// 客户端证书会重新加载，CA 只在创建的时候加载一次
+func NewClientTLSConfig(opts ...TLSOption) (*tls.Config, error) {
+	o := tlsOptions{interval: time.Second * 10}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	r, err := newCertReloader(o)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: o.serverName,
+	}
+	_, cfg.RootCAs = r.current()
+	if o.certFile != "" {
+		cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, _ := r.current()
+			return cert, nil
+		}
+	}
+	return cfg, nil
+}
+
+// 证书文件有更新的时候重新加载
+type certReloader struct {
+	opts tlsOptions
+
+	mutex     sync.Mutex
+	checkedAt time.Time
+	modTime   time.Time
+	cert      *tls.Certificate
+	pool      *x509.CertPool
+}
+
+func newCertReloader(o tlsOptions) (*certReloader, error) {
+	r := &certReloader{opts: o}
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return nil, err
+	}
+	if err = r.load(); err != nil {
+		return nil, err
+	}
+	r.modTime = modTime
+	r.checkedAt = time.Now()
+	return r, nil
+}
+
+// 当前的证书和 CA，距离上一次检查超过了间隔就看一下文件有没有更新
+func (r *certReloader) current() (*tls.Certificate, *x509.CertPool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.opts.interval > 0 && time.Since(r.checkedAt) >= r.opts.interval {
+		r.checkedAt = time.Now()
+		modTime, err := r.latestModTime()
+		if err == nil && !modTime.Equal(r.modTime) {
+			err = r.load()
+			if err == nil {
+				r.modTime = modTime
+			}
+		}
+		if err != nil {
+			// 证书可能正在写，继续用旧的，下次检查的时候再试
+			log.Printf("micro: 重新加载证书失败, 原因: %v", err)
+		}
+	}
+	return r.cert, r.pool
+}
+
+// 所有文件里面最新的修改时间
+func (r *certReloader) latestModTime() (time.Time, error) {
+	var res time.Time
+	for _, file := range []string{r.opts.certFile, r.opts.keyFile, r.opts.caFile} {
+		if file == "" {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(res) {
+			res = info.ModTime()
+		}
+	}
+	return res, nil
+}
+
+// 证书和 CA 都加载成功了才替换，不然继续用旧的，避免新证书配旧 CA
+func (r *certReloader) load() error {
+	var (
+		cert *tls.Certificate
+		pool *x509.CertPool
+	)
+	if r.opts.certFile != "" {
+		c, err := tls.LoadX509KeyPair(r.opts.certFile, r.opts.keyFile)
+		if err != nil {
+			return err
+		}
+		cert = &c
+	}
+	if r.opts.caFile != "" {
+		data, err := os.ReadFile(r.opts.caFile)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("micro: %s 里面没有合法的证书", r.opts.caFile)
+		}
+	}
+	r.cert, r.pool = cert, pool
+	return nil
+}
+
+// Identity 对端通过 TLS 证书证明的身份
+type Identity struct {
+	CommonName string
+	DNSNames   []string
+	// 例如 SPIFFE ID
+	URIs        []*url.URL
+	Certificate *x509.Certificate
+}
+
+// PeerIdentity 服务端拿到客户端的身份，只有开启了 mTLS 并且证书校验通过才有
+func PeerIdentity(ctx context.Context) (Identity, bool) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return Identity{}, false
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.VerifiedChains) == 0 || len(info.State.VerifiedChains[0]) == 0 {
+		return Identity{}, false
+	}
+	cert := info.State.VerifiedChains[0][0]
+	return Identity{
+		CommonName:  cert.Subject.CommonName,
+		DNSNames:    cert.DNSNames,
+		URIs:        cert.URIs,
+		Certificate: cert,
+	}, true
+}
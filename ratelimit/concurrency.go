@@ -0,0 +1,191 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConcurrencyLimiter 限制同时在处理的请求数，和 Limiter 不一样，请求处理完之后要归还许可
+type ConcurrencyLimiter interface {
+	// Acquire 拿到许可返回 true，请求处理完之后必须调用 release，重复调用没有影响
+	// 返回 false 表示触发了限流，这个请求不应该继续处理
+	Acquire(ctx context.Context) (release func(), ok bool)
+}
+
+// MaxInFlightLimiter 固定的最大并发数
+type MaxInFlightLimiter struct {
+	max      int64
+	inflight atomic.Int64
+}
+
+func NewMaxInFlightLimiter(maxInFlight int64) *MaxInFlightLimiter {
+	return &MaxInFlightLimiter{max: maxInFlight}
+}
+
+func (l *MaxInFlightLimiter) Acquire(ctx context.Context) (func(), bool) {
+	if l.inflight.Add(1) > l.max {
+		l.inflight.Add(-1)
+		return nil, false
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.inflight.Add(-1)
+		})
+	}, true
+}
+
+// InFlight 当前正在处理的请求数
+func (l *MaxInFlightLimiter) InFlight() int64 {
+	return l.inflight.Load()
+}
+
+type GradientOption func(l *GradientLimiter)
+
+// GradientLimiter 参考 Netflix 的 Gradient2，根据延迟的变化自适应地调整并发上限
+// 每 window 个请求算一次平均延迟 shortRTT，长期的延迟 longRTT 是 shortRTT 的滑动平均
+//
+//	gradient = clamp(tolerance * longRTT / shortRTT, 0.5, 1)
+//	limit = limit * (1 - smoothing) + (limit * gradient + queueSize) * smoothing
+//
+// 延迟稳定的时候 gradient 是 1，上限慢慢增加 queueSize；延迟上涨说明开始排队了，上限跟着下降
+type GradientLimiter struct {
+	minLimit  float64
+	maxLimit  float64
+	queueSize float64
+	smoothing float64
+	tolerance float64
+	// 多少个请求更新一次上限
+	window int
+	// longRTT 的滑动窗口，单位是更新的次数
+	longWindow float64
+
+	mutex    sync.Mutex
+	limit    float64
+	inflight int64
+	// 当前窗口的延迟总和、请求数和最大的并发数
+	rttSum      time.Duration
+	count       int
+	maxInflight int64
+	longRTT     float64
+}
+
+// NewGradientLimiter 默认初始并发上限 20，最小 10，最大 1000
+func NewGradientLimiter(opts ...GradientOption) *GradientLimiter {
+	res := &GradientLimiter{
+		limit:      20,
+		minLimit:   10,
+		maxLimit:   1000,
+		queueSize:  4,
+		smoothing:  0.2,
+		tolerance:  1.5,
+		window:     10,
+		longWindow: 600,
+	}
+	for _, opt := range opts {
+		opt(res)
+	}
+	return res
+}
+
+// GradientWithLimit 初始、最小和最大的并发上限
+func GradientWithLimit(initial, minLimit, maxLimit int64) GradientOption {
+	return func(l *GradientLimiter) {
+		l.minLimit = float64(minLimit)
+		l.maxLimit = float64(maxLimit)
+		l.limit = math.Max(l.minLimit, math.Min(l.maxLimit, float64(initial)))
+	}
+}
+
+// GradientWithTolerance 延迟上涨到 longRTT 的多少倍以内还不降低上限，默认 1.5，不能小于 1
+func GradientWithTolerance(tolerance float64) GradientOption {
+	return func(l *GradientLimiter) {
+		l.tolerance = math.Max(tolerance, 1)
+	}
+}
+
+// GradientWithSmoothing 每次更新上限的平滑系数，越大调整得越快，默认 0.2
+func GradientWithSmoothing(smoothing float64) GradientOption {
+	return func(l *GradientLimiter) {
+		l.smoothing = smoothing
+	}
+}
+
+// GradientWithWindow 每 samples 个请求更新一次上限，longRTT 按照 longWindow 次更新做滑动平均
+// 默认是 10 和 600
+func GradientWithWindow(samples int, longWindow int) GradientOption {
+	return func(l *GradientLimiter) {
+		l.window = max(samples, 1)
+		l.longWindow = float64(max(longWindow, 1))
+	}
+}
+
+func (l *GradientLimiter) Acquire(ctx context.Context) (func(), bool) {
+	l.mutex.Lock()
+	if float64(l.inflight) >= math.Floor(l.limit) {
+		l.mutex.Unlock()
+		return nil, false
+	}
+	l.inflight++
+	inflight := l.inflight
+	l.mutex.Unlock()
+
+	start := time.Now()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.release(time.Since(start), inflight)
+		})
+	}, true
+}
+
+// Limit 当前的并发上限
+func (l *GradientLimiter) Limit() int64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return int64(l.limit)
+}
+
+func (l *GradientLimiter) release(rtt time.Duration, inflight int64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.inflight--
+	l.sample(rtt, inflight)
+}
+
+// 记录一个请求的延迟，inflight 是这个请求开始的时候的并发数，调用方要持有锁
+func (l *GradientLimiter) sample(rtt time.Duration, inflight int64) {
+	l.rttSum += rtt
+	l.count++
+	l.maxInflight = max(l.maxInflight, inflight)
+	if l.count < l.window {
+		return
+	}
+	shortRTT := float64(l.rttSum) / float64(l.count)
+	maxInflight := l.maxInflight
+	l.rttSum, l.count, l.maxInflight = 0, 0, 0
+	if shortRTT <= 0 {
+		return
+	}
+
+	if l.longRTT == 0 {
+		l.longRTT = shortRTT
+	} else {
+		l.longRTT += (shortRTT - l.longRTT) / l.longWindow
+	}
+	// 延迟从高位降下来了，longRTT 要跟着快点降，不然之后延迟再涨上去也发现不了
+	if l.longRTT/shortRTT > 2 {
+		l.longRTT *= 0.95
+	}
+	// 并发远远没到上限，说明压力不大，延迟说明不了问题
+	if float64(maxInflight) < l.limit/2 {
+		return
+	}
+	gradient := math.Max(0.5, math.Min(1, l.tolerance*l.longRTT/shortRTT))
+	limit := l.limit*gradient + l.queueSize
+	limit = l.limit*(1-l.smoothing) + limit*l.smoothing
+	l.limit = math.Max(l.minLimit, math.Min(l.maxLimit, limit))
+}
@@ -0,0 +1,122 @@
+package ratelimit
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestMaxInFlightLimiter_Acquire(t *testing.T) {
+	l := NewMaxInFlightLimiter(2)
+	ctx := context.Background()
+	release1, ok := l.Acquire(ctx)
+	require.True(t, ok)
+	release2, ok := l.Acquire(ctx)
+	require.True(t, ok)
+	_, ok = l.Acquire(ctx)
+	assert.False(t, ok)
+	assert.Equal(t, int64(2), l.InFlight())
+
+	release1()
+	// 重复归还不会多出许可
+	release1()
+	assert.Equal(t, int64(1), l.InFlight())
+	release3, ok := l.Acquire(ctx)
+	require.True(t, ok)
+	_, ok = l.Acquire(ctx)
+	assert.False(t, ok)
+	release2()
+	release3()
+	assert.Equal(t, int64(0), l.InFlight())
+}
+
+func TestGradientLimiter_Acquire(t *testing.T) {
+	l := NewGradientLimiter(GradientWithLimit(2, 1, 10))
+	ctx := context.Background()
+	release1, ok := l.Acquire(ctx)
+	require.True(t, ok)
+	release2, ok := l.Acquire(ctx)
+	require.True(t, ok)
+	_, ok = l.Acquire(ctx)
+	assert.False(t, ok)
+	release1()
+	release1()
+	_, ok = l.Acquire(ctx)
+	assert.True(t, ok)
+	release2()
+}
+
+func TestGradientLimiter_sample(t *testing.T) {
+	testCases := []struct {
+		name string
+		// 每个窗口的延迟
+		rtts     []time.Duration
+		inflight int64
+
+		wantLimit int64
+	}{
+		{
+			name:     "stable latency grows",
+			rtts:     []time.Duration{time.Millisecond * 10, time.Millisecond * 10, time.Millisecond * 10},
+			inflight: 20,
+			// 每次增加 queueSize * smoothing
+			wantLimit: 22,
+		},
+		{
+			name:     "latency within tolerance",
+			rtts:     []time.Duration{time.Millisecond * 10, time.Millisecond * 14},
+			inflight: 20,
+			// 和延迟稳定的时候一样
+			wantLimit: 21,
+		},
+		{
+			name: "latency increases",
+			rtts: []time.Duration{time.Millisecond * 10, time.Millisecond * 100, time.Millisecond * 100,
+				time.Millisecond * 100, time.Millisecond * 100, time.Millisecond * 100},
+			inflight: 20,
+			// 每次最多降到 0.9 倍再加上 0.8
+			wantLimit: 15,
+		},
+		{
+			name:      "bounded by min limit",
+			rtts:      append([]time.Duration{time.Millisecond * 10}, slices.Repeat([]time.Duration{time.Second}, 20)...),
+			inflight:  20,
+			wantLimit: 10,
+		},
+		{
+			name:     "app limited",
+			rtts:     []time.Duration{time.Millisecond * 10, time.Millisecond * 100, time.Millisecond * 100},
+			inflight: 5,
+			// 并发不到上限的一半，延迟上涨不是因为排队
+			wantLimit: 20,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			l := NewGradientLimiter(GradientWithWindow(5, 600))
+			for _, rtt := range tc.rtts {
+				for i := 0; i < 5; i++ {
+					l.sample(rtt, tc.inflight)
+				}
+			}
+			assert.Equal(t, tc.wantLimit, l.Limit())
+		})
+	}
+}
+
+func TestGradientLimiter_recover(t *testing.T) {
+	l := NewGradientLimiter(GradientWithWindow(1, 600))
+	l.sample(time.Millisecond*10, 20)
+	for i := 0; i < 20; i++ {
+		l.sample(time.Millisecond*100, 20)
+	}
+	assert.Equal(t, int64(10), l.Limit())
+	// 延迟恢复之后上限慢慢涨回去
+	for i := 0; i < 30; i++ {
+		l.sample(time.Millisecond*10, 20)
+	}
+	assert.Greater(t, l.Limit(), int64(10))
+}
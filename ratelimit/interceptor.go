@@ -0,0 +1,139 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"log"
+	"net"
+)
+
+// KeyFunc 根据请求生成限流的 key
+type KeyFunc func(ctx context.Context, fullMethod string) string
+
+type InterceptorOption func(b *InterceptorBuilder)
+
+// InterceptorBuilder 把 Limiter 包装成 gRPC 的服务端拦截器
+type InterceptorBuilder struct {
+	limiter Limiter
+	keyFunc KeyFunc
+}
+
+// NewInterceptorBuilder 默认按照方法和调用方的 IP 限流
+func NewInterceptorBuilder(limiter Limiter, opts ...InterceptorOption) *InterceptorBuilder {
+	res := &InterceptorBuilder{
+		limiter: limiter,
+		keyFunc: KeyByMethodAndCaller("ratelimit", PeerCaller),
+	}
+	for _, opt := range opts {
+		opt(res)
+	}
+	return res
+}
+
+func InterceptorWithKeyFunc(fn KeyFunc) InterceptorOption {
+	return func(b *InterceptorBuilder) {
+		b.keyFunc = fn
+	}
+}
+
+// KeyByMethod 每个方法一个限流的 key，所有调用方共享
+func KeyByMethod(prefix string) KeyFunc {
+	return func(ctx context.Context, fullMethod string) string {
+		return fmt.Sprintf("%s:%s", prefix, fullMethod)
+	}
+}
+
+// KeyByMethodAndCaller 每个方法的每个调用方一个限流的 key，caller 返回空字符串的时候用对端的 IP
+// 不能用调用方自己在 metadata 里面填的标识，不然换一个值就绕过限流了
+// 按照认证之后的身份限流可以传 auth.Subject，拦截器要放在认证的拦截器后面
+func KeyByMethodAndCaller(prefix string, caller func(ctx context.Context) string) KeyFunc {
+	return func(ctx context.Context, fullMethod string) string {
+		c := caller(ctx)
+		if c == "" {
+			c = PeerCaller(ctx)
+		}
+		return fmt.Sprintf("%s:%s:%s", prefix, fullMethod, c)
+	}
+}
+
+// PeerCaller 对端的 IP，拿不到的时候是 unknown
+func PeerCaller(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		host, _, err := net.SplitHostPort(p.Addr.String())
+		if err != nil {
+			return p.Addr.String()
+		}
+		return host
+	}
+	return "unknown"
+}
+
+func (b *InterceptorBuilder) BuildUnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if err := b.limit(ctx, info.FullMethod); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+func (b *InterceptorBuilder) BuildStreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := b.limit(ss.Context(), info.FullMethod); err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+}
+
+func (b *InterceptorBuilder) limit(ctx context.Context, fullMethod string) error {
+	key := b.keyFunc(ctx, fullMethod)
+	limited, err := b.limiter.Limit(ctx, key)
+	if err != nil {
+		// 限流器出错的时候放行，不能因为限流器不可用就拒绝所有请求
+		// 需要兜底的话用 FallbackLimiter
+		log.Printf("ratelimit: 限流器出错, key: %s, 原因: %v", key, err)
+		return nil
+	}
+	if limited {
+		return status.Errorf(codes.ResourceExhausted, "ratelimit: 触发限流, method: %s", fullMethod)
+	}
+	return nil
+}
+
+// ConcurrencyInterceptorBuilder 把 ConcurrencyLimiter 包装成 gRPC 的服务端拦截器
+// 流在 handler 返回之前一直占着许可，长连接的流处理时间说明不了服务端的压力，
+// 所以流最好用单独的 MaxInFlightLimiter，不要和一元调用共用 GradientLimiter
+type ConcurrencyInterceptorBuilder struct {
+	limiter ConcurrencyLimiter
+}
+
+func NewConcurrencyInterceptorBuilder(limiter ConcurrencyLimiter) *ConcurrencyInterceptorBuilder {
+	return &ConcurrencyInterceptorBuilder{limiter: limiter}
+}
+
+func (b *ConcurrencyInterceptorBuilder) BuildUnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		release, ok := b.limiter.Acquire(ctx)
+		if !ok {
+			return nil, status.Errorf(codes.ResourceExhausted, "ratelimit: 并发超过上限, method: %s", info.FullMethod)
+		}
+		defer release()
+		return handler(ctx, req)
+	}
+}
+
+func (b *ConcurrencyInterceptorBuilder) BuildStreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		release, ok := b.limiter.Acquire(ss.Context())
+		if !ok {
+			return status.Errorf(codes.ResourceExhausted, "ratelimit: 并发超过上限, method: %s", info.FullMethod)
+		}
+		defer release()
+		return handler(srv, ss)
+	}
+}
@@ -0,0 +1,185 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestInterceptorBuilder_BuildUnaryServerInterceptor(t *testing.T) {
+	testCases := []struct {
+		name    string
+		limiter Limiter
+		keyFunc KeyFunc
+		ctx     context.Context
+
+		wantKey string
+		wantErr error
+	}{
+		{
+			name: "custom caller",
+			limiter: limiterFunc(func(ctx context.Context, key string) (bool, error) {
+				return false, nil
+			}),
+			keyFunc: KeyByMethodAndCaller("ratelimit", func(ctx context.Context) string {
+				return "order-service"
+			}),
+			ctx: peer.NewContext(context.Background(), &peer.Peer{
+				Addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 8081},
+			}),
+			wantKey: "ratelimit:/user.UserService/GetById:order-service",
+		},
+		{
+			// 拿不到调用方的时候用对端的 IP
+			name: "custom caller fallback to peer",
+			limiter: limiterFunc(func(ctx context.Context, key string) (bool, error) {
+				return false, nil
+			}),
+			keyFunc: KeyByMethodAndCaller("ratelimit", func(ctx context.Context) string {
+				return ""
+			}),
+			ctx: peer.NewContext(context.Background(), &peer.Peer{
+				Addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 8081},
+			}),
+			wantKey: "ratelimit:/user.UserService/GetById:10.0.0.1",
+		},
+		{
+			// 调用方自己填的 metadata 不可信
+			name: "metadata ignored",
+			limiter: limiterFunc(func(ctx context.Context, key string) (bool, error) {
+				return false, nil
+			}),
+			ctx: metadata.NewIncomingContext(peer.NewContext(context.Background(), &peer.Peer{
+				Addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 8081},
+			}), metadata.Pairs("x-caller", "order-service")),
+			wantKey: "ratelimit:/user.UserService/GetById:10.0.0.1",
+		},
+		{
+			name: "caller from peer",
+			limiter: limiterFunc(func(ctx context.Context, key string) (bool, error) {
+				return true, nil
+			}),
+			ctx: peer.NewContext(context.Background(), &peer.Peer{
+				Addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 8081},
+			}),
+			wantKey: "ratelimit:/user.UserService/GetById:10.0.0.1",
+			wantErr: status.Error(codes.ResourceExhausted, "ratelimit: 触发限流, method: /user.UserService/GetById"),
+		},
+		{
+			name: "limiter error",
+			limiter: limiterFunc(func(ctx context.Context, key string) (bool, error) {
+				return true, errors.New("redis 不可用")
+			}),
+			ctx:     context.Background(),
+			wantKey: "ratelimit:/user.UserService/GetById:unknown",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var gotKey string
+			limiter := limiterFunc(func(ctx context.Context, key string) (bool, error) {
+				gotKey = key
+				return tc.limiter.Limit(ctx, key)
+			})
+			var opts []InterceptorOption
+			if tc.keyFunc != nil {
+				opts = append(opts, InterceptorWithKeyFunc(tc.keyFunc))
+			}
+			interceptor := NewInterceptorBuilder(limiter, opts...).BuildUnaryServerInterceptor()
+			resp, err := interceptor(tc.ctx, "req", &grpc.UnaryServerInfo{FullMethod: "/user.UserService/GetById"},
+				func(ctx context.Context, req any) (any, error) {
+					return "resp", nil
+				})
+			assert.Equal(t, tc.wantKey, gotKey)
+			assert.Equal(t, tc.wantErr, err)
+			if err != nil {
+				return
+			}
+			assert.Equal(t, "resp", resp)
+		})
+	}
+}
+
+func TestConcurrencyInterceptorBuilder_BuildUnaryServerInterceptor(t *testing.T) {
+	limiter := NewMaxInFlightLimiter(1)
+	interceptor := NewConcurrencyInterceptorBuilder(limiter).BuildUnaryServerInterceptor()
+	info := &grpc.UnaryServerInfo{FullMethod: "/user.UserService/GetById"}
+	entered := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		_, _ = interceptor(context.Background(), "req", info, func(ctx context.Context, req any) (any, error) {
+			close(entered)
+			<-done
+			return "resp", nil
+		})
+	}()
+	<-entered
+
+	_, err := interceptor(context.Background(), "req", info, func(ctx context.Context, req any) (any, error) {
+		return "resp", nil
+	})
+	assert.Equal(t, status.Error(codes.ResourceExhausted, "ratelimit: 并发超过上限, method: /user.UserService/GetById"), err)
+
+	// 前一个请求处理完之后归还许可
+	close(done)
+	assert.Eventually(t, func() bool {
+		return limiter.InFlight() == 0
+	}, time.Second, time.Millisecond*10)
+	resp, err := interceptor(context.Background(), "req", info, func(ctx context.Context, req any) (any, error) {
+		return "resp", nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "resp", resp)
+	assert.Equal(t, int64(0), limiter.InFlight())
+}
+
+func TestConcurrencyInterceptorBuilder_BuildStreamServerInterceptor(t *testing.T) {
+	limiter := NewMaxInFlightLimiter(1)
+	interceptor := NewConcurrencyInterceptorBuilder(limiter).BuildStreamServerInterceptor()
+	info := &grpc.StreamServerInfo{FullMethod: "/user.UserService/Watch"}
+	ss := &fakeServerStream{ctx: context.Background()}
+	entered := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		_ = interceptor(nil, ss, info, func(srv any, stream grpc.ServerStream) error {
+			close(entered)
+			<-done
+			return nil
+		})
+	}()
+	<-entered
+
+	// 流没有结束之前一直占着许可
+	err := interceptor(nil, ss, info, func(srv any, stream grpc.ServerStream) error {
+		return nil
+	})
+	assert.Equal(t, status.Error(codes.ResourceExhausted, "ratelimit: 并发超过上限, method: /user.UserService/Watch"), err)
+
+	close(done)
+	assert.Eventually(t, func() bool {
+		return limiter.InFlight() == 0
+	}, time.Second, time.Millisecond*10)
+	err = interceptor(nil, ss, info, func(srv any, stream grpc.ServerStream) error {
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), limiter.InFlight())
+}
+
+type fakeServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *fakeServerStream) Context() context.Context {
+	return s.ctx
+}
@@ -0,0 +1,206 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// 本地限流器的状态都按照 key 保存在内存里，只对当前实例生效
+// 一般用来在 redis 不可用的时候兜底，见 FallbackLimiter
+// 每隔 sweepInterval 清理一次已经空闲的 key，空闲的 key 和不存在的 key 限流效果一样，
+// 所以清理掉不会影响限流，只是避免 key 越来越多，内存一直涨
+
+const defaultSweepInterval = time.Minute
+
+// LocalTokenBucketLimiter 本地令牌桶
+type LocalTokenBucketLimiter struct {
+	rate          float64
+	capacity      float64
+	sweepInterval time.Duration
+	mutex         sync.Mutex
+	buckets       map[string]*tokenBucket
+	sweptAt       time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	ts     time.Time
+}
+
+func NewLocalTokenBucketLimiter(rate float64, capacity int64) *LocalTokenBucketLimiter {
+	return &LocalTokenBucketLimiter{
+		rate:          rate,
+		capacity:      float64(capacity),
+		sweepInterval: defaultSweepInterval,
+		buckets:       make(map[string]*tokenBucket),
+		sweptAt:       time.Now(),
+	}
+}
+
+func (l *LocalTokenBucketLimiter) Limit(ctx context.Context, key string) (bool, error) {
+	now := time.Now()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.sweep(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		//第一次来，桶是满的
+		b = &tokenBucket{tokens: l.capacity, ts: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.capacity, b.tokens+now.Sub(b.ts).Seconds()*l.rate)
+	b.ts = now
+	if b.tokens < 1 {
+		return true, nil
+	}
+	b.tokens--
+	return false, nil
+}
+
+// 桶已经补满了的 key 可以删掉，下次来的时候还是一个满的桶
+func (l *LocalTokenBucketLimiter) sweep(now time.Time) {
+	if l.rate <= 0 || now.Sub(l.sweptAt) < l.sweepInterval {
+		return
+	}
+	l.sweptAt = now
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.ts).Seconds()*l.rate >= l.capacity {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// LocalFixedWindowLimiter 本地固定窗口
+type LocalFixedWindowLimiter struct {
+	window        time.Duration
+	threshold     int64
+	sweepInterval time.Duration
+	mutex         sync.Mutex
+	windows       map[string]*fixedWindow
+	sweptAt       time.Time
+}
+
+type fixedWindow struct {
+	start time.Time
+	cnt   int64
+}
+
+func NewLocalFixedWindowLimiter(window time.Duration, threshold int64) *LocalFixedWindowLimiter {
+	return &LocalFixedWindowLimiter{
+		window:        window,
+		threshold:     threshold,
+		sweepInterval: defaultSweepInterval,
+		windows:       make(map[string]*fixedWindow),
+		sweptAt:       time.Now(),
+	}
+}
+
+func (l *LocalFixedWindowLimiter) Limit(ctx context.Context, key string) (bool, error) {
+	now := time.Now()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.sweep(now)
+	w, ok := l.windows[key]
+	if !ok || now.Sub(w.start) >= l.window {
+		//新的窗口
+		w = &fixedWindow{start: now}
+		l.windows[key] = w
+	}
+	if w.cnt >= l.threshold {
+		return true, nil
+	}
+	w.cnt++
+	return false, nil
+}
+
+// 窗口已经结束的 key 可以删掉
+func (l *LocalFixedWindowLimiter) sweep(now time.Time) {
+	if now.Sub(l.sweptAt) < l.sweepInterval {
+		return
+	}
+	l.sweptAt = now
+	for key, w := range l.windows {
+		if now.Sub(w.start) >= l.window {
+			delete(l.windows, key)
+		}
+	}
+}
+
+// LocalSlidingWindowLimiter 本地滑动窗口日志
+type LocalSlidingWindowLimiter struct {
+	window        time.Duration
+	threshold     int64
+	sweepInterval time.Duration
+	mutex         sync.Mutex
+	logs          map[string][]time.Time
+	sweptAt       time.Time
+}
+
+func NewLocalSlidingWindowLimiter(window time.Duration, threshold int64) *LocalSlidingWindowLimiter {
+	return &LocalSlidingWindowLimiter{
+		window:        window,
+		threshold:     threshold,
+		sweepInterval: defaultSweepInterval,
+		logs:          make(map[string][]time.Time),
+		sweptAt:       time.Now(),
+	}
+}
+
+func (l *LocalSlidingWindowLimiter) Limit(ctx context.Context, key string) (bool, error) {
+	now := time.Now()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.sweep(now)
+	// 删掉窗口之外的请求，请求是按时间顺序追加的，找到第一个还在窗口内的就可以了
+	reqs := l.logs[key]
+	boundary := now.Add(-l.window)
+	i := 0
+	for i < len(reqs) && !reqs[i].After(boundary) {
+		i++
+	}
+	reqs = reqs[i:]
+	if int64(len(reqs)) >= l.threshold {
+		l.logs[key] = reqs
+		return true, nil
+	}
+	l.logs[key] = append(reqs, now)
+	return false, nil
+}
+
+// 最后一个请求都已经在窗口之外的 key 可以删掉
+func (l *LocalSlidingWindowLimiter) sweep(now time.Time) {
+	if now.Sub(l.sweptAt) < l.sweepInterval {
+		return
+	}
+	l.sweptAt = now
+	boundary := now.Add(-l.window)
+	for key, reqs := range l.logs {
+		if len(reqs) == 0 || !reqs[len(reqs)-1].After(boundary) {
+			delete(l.logs, key)
+		}
+	}
+}
+
+// FallbackLimiter 优先使用 primary，primary 出错的时候用 fallback
+// 典型用法是 primary 用 redis 做集群限流，fallback 用本地限流器兜底
+type FallbackLimiter struct {
+	primary  Limiter
+	fallback Limiter
+}
+
+func NewFallbackLimiter(primary Limiter, fallback Limiter) *FallbackLimiter {
+	return &FallbackLimiter{
+		primary:  primary,
+		fallback: fallback,
+	}
+}
+
+func (l *FallbackLimiter) Limit(ctx context.Context, key string) (bool, error) {
+	limited, err := l.primary.Limit(ctx, key)
+	if err == nil {
+		return limited, nil
+	}
+	return l.fallback.Limit(ctx, key)
+}
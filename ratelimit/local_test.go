@@ -0,0 +1,126 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestLocalLimiter_Limit(t *testing.T) {
+	testCases := []struct {
+		name    string
+		limiter Limiter
+		// 窗口或者令牌补充需要等待的时间
+		wait time.Duration
+	}{
+		{
+			name:    "token bucket",
+			limiter: NewLocalTokenBucketLimiter(20, 3),
+			wait:    time.Millisecond * 60,
+		},
+		{
+			name:    "fixed window",
+			limiter: NewLocalFixedWindowLimiter(time.Millisecond*50, 3),
+			wait:    time.Millisecond * 60,
+		},
+		{
+			name:    "sliding window",
+			limiter: NewLocalSlidingWindowLimiter(time.Millisecond*50, 3),
+			wait:    time.Millisecond * 60,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			for i := 0; i < 3; i++ {
+				limited, err := tc.limiter.Limit(ctx, "key1")
+				require.NoError(t, err)
+				assert.False(t, limited)
+			}
+			limited, err := tc.limiter.Limit(ctx, "key1")
+			require.NoError(t, err)
+			assert.True(t, limited)
+
+			// 不同的 key 互不影响
+			limited, err = tc.limiter.Limit(ctx, "key2")
+			require.NoError(t, err)
+			assert.False(t, limited)
+
+			time.Sleep(tc.wait)
+			limited, err = tc.limiter.Limit(ctx, "key1")
+			require.NoError(t, err)
+			assert.False(t, limited)
+		})
+	}
+}
+
+func TestLocalLimiter_sweep(t *testing.T) {
+	ctx := context.Background()
+	tokenBucket := NewLocalTokenBucketLimiter(100, 1)
+	tokenBucket.sweepInterval = time.Hour
+	fixedWindow := NewLocalFixedWindowLimiter(time.Millisecond*10, 1)
+	fixedWindow.sweepInterval = time.Hour
+	slidingWindow := NewLocalSlidingWindowLimiter(time.Millisecond*10, 1)
+	slidingWindow.sweepInterval = time.Hour
+	limiters := []Limiter{tokenBucket, fixedWindow, slidingWindow}
+	sizes := func() []int {
+		tokenBucket.mutex.Lock()
+		fixedWindow.mutex.Lock()
+		slidingWindow.mutex.Lock()
+		defer tokenBucket.mutex.Unlock()
+		defer fixedWindow.mutex.Unlock()
+		defer slidingWindow.mutex.Unlock()
+		return []int{len(tokenBucket.buckets), len(fixedWindow.windows), len(slidingWindow.logs)}
+	}
+
+	// 每次换一个 key，空闲的 key 会被清理掉
+	for i := 0; i < 100; i++ {
+		for _, l := range limiters {
+			_, err := l.Limit(ctx, fmt.Sprintf("key%d", i))
+			require.NoError(t, err)
+		}
+	}
+	assert.Equal(t, []int{100, 100, 100}, sizes())
+	// 等所有的 key 都空闲下来，然后马上触发清理
+	time.Sleep(time.Millisecond * 30)
+	tokenBucket.sweepInterval, fixedWindow.sweepInterval, slidingWindow.sweepInterval = 0, 0, 0
+	for _, l := range limiters {
+		_, err := l.Limit(ctx, "key-new")
+		require.NoError(t, err)
+	}
+	assert.Equal(t, []int{1, 1, 1}, sizes())
+}
+
+type limiterFunc func(ctx context.Context, key string) (bool, error)
+
+func (f limiterFunc) Limit(ctx context.Context, key string) (bool, error) {
+	return f(ctx, key)
+}
+
+func TestFallbackLimiter_Limit(t *testing.T) {
+	primary := limiterFunc(func(ctx context.Context, key string) (bool, error) {
+		if key == "broken" {
+			return false, errors.New("redis 不可用")
+		}
+		return true, nil
+	})
+	fallback := NewLocalFixedWindowLimiter(time.Minute, 1)
+	l := NewFallbackLimiter(primary, fallback)
+
+	limited, err := l.Limit(context.Background(), "key1")
+	require.NoError(t, err)
+	assert.True(t, limited)
+
+	// primary 出错之后走本地限流
+	limited, err = l.Limit(context.Background(), "broken")
+	require.NoError(t, err)
+	assert.False(t, limited)
+	limited, err = l.Limit(context.Background(), "broken")
+	require.NoError(t, err)
+	assert.True(t, limited)
+}
@@ -0,0 +1,16 @@
+-- 固定窗口
+-- KEYS[1] 窗口的 key
+-- ARGV[1] 窗口大小，毫秒
+-- ARGV[2] 窗口内允许的请求数
+local cnt = redis.call('get', KEYS[1])
+if cnt == false then
+    --    新的窗口
+    redis.call('set', KEYS[1], 1, 'PX', ARGV[1])
+    return 0
+elseif tonumber(cnt) < tonumber(ARGV[2]) then
+    redis.call('incr', KEYS[1])
+    return 0
+else
+    --    触发限流
+    return 1
+end
@@ -0,0 +1,19 @@
+-- 滑动窗口日志
+-- KEYS[1] 窗口的 key，zset，score 是请求的时间
+-- ARGV[1] 窗口大小，毫秒
+-- ARGV[2] 窗口内允许的请求数
+-- ARGV[3] 这次请求的唯一标识
+local window = tonumber(ARGV[1])
+local t = redis.call('time')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+
+-- 删掉窗口之外的请求
+redis.call('zremrangebyscore', KEYS[1], '-inf', now - window)
+local cnt = redis.call('zcard', KEYS[1])
+if cnt >= tonumber(ARGV[2]) then
+    --    触发限流
+    return 1
+end
+redis.call('zadd', KEYS[1], now, ARGV[3])
+redis.call('pexpire', KEYS[1], window)
+return 0
@@ -0,0 +1,29 @@
+-- 令牌桶
+-- KEYS[1] 桶的 key，hash，tokens 是剩余令牌，ts 是上一次计算的时间
+-- ARGV[1] 每秒生成的令牌数
+-- ARGV[2] 桶的容量
+local rate = tonumber(ARGV[1])
+local capacity = tonumber(ARGV[2])
+local t = redis.call('time')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+
+local bucket = redis.call('hmget', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(bucket[1])
+local ts = tonumber(bucket[2])
+if tokens == nil or ts == nil then
+    --    第一次来，桶是满的
+    tokens = capacity
+    ts = now
+end
+-- 补充这段时间生成的令牌
+tokens = math.min(capacity, tokens + (now - ts) * rate / 1000)
+
+local limited = 1
+if tokens >= 1 then
+    tokens = tokens - 1
+    limited = 0
+end
+redis.call('hset', KEYS[1], 'tokens', tostring(tokens), 'ts', now)
+-- 桶装满需要的时间之后，这个 key 就没有意义了
+redis.call('pexpire', KEYS[1], math.ceil(capacity / rate * 1000))
+return limited
@@ -0,0 +1,78 @@
+package ratelimit
+
+import (
+	"context"
+	_ "embed"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"time"
+)
+
+var (
+	//go:embed lua/token_bucket.lua
+	luaTokenBucket string
+	//go:embed lua/fixed_window.lua
+	luaFixedWindow string
+	//go:embed lua/sliding_window.lua
+	luaSlidingWindow string
+)
+
+// RedisTokenBucketLimiter 基于 redis 的令牌桶，允许一定程度的突发流量
+type RedisTokenBucketLimiter struct {
+	client redis.Cmdable
+	// 每秒生成的令牌数
+	rate float64
+	// 桶的容量，也就是允许的最大突发请求数
+	capacity int64
+}
+
+func NewRedisTokenBucketLimiter(client redis.Cmdable, rate float64, capacity int64) *RedisTokenBucketLimiter {
+	return &RedisTokenBucketLimiter{
+		client:   client,
+		rate:     rate,
+		capacity: capacity,
+	}
+}
+
+func (l *RedisTokenBucketLimiter) Limit(ctx context.Context, key string) (bool, error) {
+	return l.client.Eval(ctx, luaTokenBucket, []string{key}, l.rate, l.capacity).Bool()
+}
+
+// RedisFixedWindowLimiter 基于 redis 的固定窗口，窗口交界的地方可能放过两倍的请求
+type RedisFixedWindowLimiter struct {
+	client    redis.Cmdable
+	window    time.Duration
+	threshold int64
+}
+
+func NewRedisFixedWindowLimiter(client redis.Cmdable, window time.Duration, threshold int64) *RedisFixedWindowLimiter {
+	return &RedisFixedWindowLimiter{
+		client:    client,
+		window:    window,
+		threshold: threshold,
+	}
+}
+
+func (l *RedisFixedWindowLimiter) Limit(ctx context.Context, key string) (bool, error) {
+	return l.client.Eval(ctx, luaFixedWindow, []string{key}, l.window.Milliseconds(), l.threshold).Bool()
+}
+
+// RedisSlidingWindowLimiter 基于 redis 的滑动窗口日志，精确但是每个请求都要占用一个 zset 成员
+type RedisSlidingWindowLimiter struct {
+	client    redis.Cmdable
+	window    time.Duration
+	threshold int64
+}
+
+func NewRedisSlidingWindowLimiter(client redis.Cmdable, window time.Duration, threshold int64) *RedisSlidingWindowLimiter {
+	return &RedisSlidingWindowLimiter{
+		client:    client,
+		window:    window,
+		threshold: threshold,
+	}
+}
+
+func (l *RedisSlidingWindowLimiter) Limit(ctx context.Context, key string) (bool, error) {
+	return l.client.Eval(ctx, luaSlidingWindow, []string{key},
+		l.window.Milliseconds(), l.threshold, uuid.New().String()).Bool()
+}
@@ -0,0 +1,91 @@
+package ratelimit
+
+import (
+	"context"
+	"github.com/golang/mock/gomock"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/zhuguangfeng/study/cache/mocks"
+	"testing"
+	"time"
+)
+
+func TestRedisLimiter_Limit(t *testing.T) {
+	testCases := []struct {
+		name    string
+		mock    func(ctrl *gomock.Controller) redis.Cmdable
+		limiter func(client redis.Cmdable) Limiter
+
+		wantLimited bool
+		wantErr     error
+	}{
+		{
+			name: "token bucket eval error",
+			mock: func(ctrl *gomock.Controller) redis.Cmdable {
+				cmd := mocks.NewMockCmdable(ctrl)
+				res := redis.NewCmd(context.Background())
+				res.SetErr(context.DeadlineExceeded)
+				cmd.EXPECT().Eval(gomock.Any(), luaTokenBucket, []string{"key1"}, 10.0, int64(20)).Return(res)
+				return cmd
+			},
+			limiter: func(client redis.Cmdable) Limiter {
+				return NewRedisTokenBucketLimiter(client, 10, 20)
+			},
+			wantErr: context.DeadlineExceeded,
+		},
+		{
+			name: "token bucket limited",
+			mock: func(ctrl *gomock.Controller) redis.Cmdable {
+				cmd := mocks.NewMockCmdable(ctrl)
+				res := redis.NewCmd(context.Background())
+				res.SetVal(int64(1))
+				cmd.EXPECT().Eval(gomock.Any(), luaTokenBucket, []string{"key1"}, 10.0, int64(20)).Return(res)
+				return cmd
+			},
+			limiter: func(client redis.Cmdable) Limiter {
+				return NewRedisTokenBucketLimiter(client, 10, 20)
+			},
+			wantLimited: true,
+		},
+		{
+			name: "fixed window passed",
+			mock: func(ctrl *gomock.Controller) redis.Cmdable {
+				cmd := mocks.NewMockCmdable(ctrl)
+				res := redis.NewCmd(context.Background())
+				res.SetVal(int64(0))
+				cmd.EXPECT().Eval(gomock.Any(), luaFixedWindow, []string{"key1"}, int64(1000), int64(100)).Return(res)
+				return cmd
+			},
+			limiter: func(client redis.Cmdable) Limiter {
+				return NewRedisFixedWindowLimiter(client, time.Second, 100)
+			},
+		},
+		{
+			name: "sliding window limited",
+			mock: func(ctrl *gomock.Controller) redis.Cmdable {
+				cmd := mocks.NewMockCmdable(ctrl)
+				res := redis.NewCmd(context.Background())
+				res.SetVal(int64(1))
+				cmd.EXPECT().Eval(gomock.Any(), luaSlidingWindow, []string{"key1"},
+					int64(1000), int64(100), gomock.Any()).Return(res)
+				return cmd
+			},
+			limiter: func(client redis.Cmdable) Limiter {
+				return NewRedisSlidingWindowLimiter(client, time.Second, 100)
+			},
+			wantLimited: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			l := tc.limiter(tc.mock(ctrl))
+
+			limited, err := l.Limit(context.Background(), "key1")
+			assert.Equal(t, tc.wantErr, err)
+			assert.Equal(t, tc.wantLimited, limited)
+		})
+	}
+}
@@ -0,0 +1,10 @@
+package ratelimit
+
+import "context"
+
+// Limiter 限流器
+type Limiter interface {
+	// Limit 有没有触发限流，key 是限流的对象，例如某个接口或者某个调用方
+	// 返回 true 表示触发了限流，这个请求不应该继续处理
+	Limit(ctx context.Context, key string) (bool, error)
+}